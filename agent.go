@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/tmc/langchaingo/agents"
+	"github.com/tmc/langchaingo/chains"
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/tools"
+	"github.com/tmc/langchaingo/tools/sqldatabase"
+	_ "github.com/tmc/langchaingo/tools/sqldatabase/sqlite3" // sqlite3 engine
+	"github.com/tmc/langchaingo/vectorstores"
+)
+
+const (
+	ModeRAG      = "rag"
+	ModeAgent    = "agent"
+	ModeChitchat = "chitchat"
+	// ModeClarify is routed to, never requested: the query is too short to
+	// search, so the model asks what the user means.
+	ModeClarify = "clarify"
+	// ModeRepeat is routed to, never requested either: the question was
+	// asked before in the session, and its earlier answer is returned.
+	ModeRepeat = "repeat"
+	// ModeCorpus answers from every chunk matching the filter, for broad
+	// questions no handful of retrieved chunks can answer.
+	ModeCorpus = "corpus"
+	// ModeCompare retrieves the context of each item a question compares on
+	// its own.
+	ModeCompare = "compare"
+)
+
+const (
+	agentMaxIterations = 5
+	sqlMaxRows         = 20
+)
+
+// runAgent answers msg with a ReAct agent that can search the knowledge base
+// and, when tabular data has been loaded, query it with SQL.
+func runAgent(ctx context.Context, llm llms.Model, store vectorstores.VectorStore, msg Message) (string, error) {
+	agentTools := []tools.Tool{
+		knowledgeBaseTool{store: store, filter: msg.Filter, version: msg.Version},
+	}
+
+	if supportsMaintenance(getConfig().VectorStore.Backend) {
+		agentTools = append(agentTools, documentCatalogTool{})
+	}
+	if sqlTool, err := newSQLTool(llm); err == nil {
+		defer sqlTool.db.Close()
+		agentTools = append(agentTools, sqlTool)
+	}
+
+	agent := agents.NewOneShotAgent(llm, agentTools, agents.WithMaxIterations(agentMaxIterations))
+	executor := agents.NewExecutor(agent, agents.WithMaxIterations(agentMaxIterations))
+
+	return chains.Run(ctx, executor, msg.Msg)
+}
+
+type knowledgeBaseTool struct {
+	store   vectorstores.VectorStore
+	filter  map[string]any
+	version int
+}
+
+func (knowledgeBaseTool) Name() string { return "knowledge_base" }
+
+func (knowledgeBaseTool) Description() string {
+	return "Searches the ingested documents. Input is a natural language search query; " +
+		"the output is the most relevant passages."
+}
+
+func (t knowledgeBaseTool) Call(ctx context.Context, input string) (string, error) {
+	var options []vectorstores.Option
+	if filter := storeFilter(retrievalFilter(t.filter, t.version)); filter != nil {
+		options = append(options, vectorstores.WithFilters(filter))
+	}
+
+	docs, err := t.store.SimilaritySearch(ctx, input, numRelevantDocs*2, options...)
+	if err != nil {
+		return fmt.Sprintf("search failed: %v", err), nil
+	}
+	docs = resolveQuestionHits(rescoreDocuments(docs), numRelevantDocs)
+	if getConfig().Chunking.StitchNeighbors {
+		docs = stitchNeighbors(docs)
+	}
+	docs, err = runRetrieveHooks(ctx, input, docs)
+	if err != nil {
+		return fmt.Sprintf("search failed: %v", err), nil
+	}
+	if len(docs) == 0 {
+		return "No relevant passages found.", nil
+	}
+
+	var sb strings.Builder
+	for _, doc := range docs {
+		sb.WriteString(doc.PageContent)
+		sb.WriteString("\n")
+	}
+	return sb.String(), nil
+}
+
+// documentCatalogTool lists the ingested sources so the agent can answer
+// admin-style requests such as "list documents".
+type documentCatalogTool struct{}
+
+func (documentCatalogTool) Name() string { return "document_catalog" }
+
+func (documentCatalogTool) Description() string {
+	return "Lists the ingested documents with their chunk counts and whether they are deleted. Input is ignored."
+}
+
+func (documentCatalogTool) Call(ctx context.Context, _ string) (string, error) {
+	store, err := managedStore()
+	if err != nil {
+		return fmt.Sprintf("listing failed: %v", err), nil
+	}
+	sources, err := store.Sources(ctx)
+	if err != nil {
+		return fmt.Sprintf("listing failed: %v", err), nil
+	}
+	if len(sources) == 0 {
+		return "No documents have been ingested.", nil
+	}
+
+	var sb strings.Builder
+	for _, source := range sources {
+		fmt.Fprintf(&sb, "%s: %d chunks", source.Source, source.Chunks)
+		if source.Deleted {
+			sb.WriteString(" (deleted)")
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String(), nil
+}
+
+type sqlTool struct {
+	db    *sqldatabase.SQLDatabase
+	chain *chains.SQLDatabaseChain
+}
+
+// newSQLTool opens the tabular database read-only, so generated SQL can never
+// modify the data.
+func newSQLTool(llm llms.Model) (sqlTool, error) {
+	path := getConfig().SQL.Path
+	if _, err := os.Stat(path); err != nil {
+		return sqlTool{}, err
+	}
+
+	db, err := sqldatabase.NewSQLDatabaseWithDSN("sqlite3", fmt.Sprintf("file:%s?mode=ro", path), nil)
+	if err != nil {
+		return sqlTool{}, err
+	}
+	if len(db.TableNames()) == 0 {
+		db.Close()
+		return sqlTool{}, fmt.Errorf("no tables in %s", path)
+	}
+
+	return sqlTool{db: db, chain: chains.NewSQLDatabaseChain(llm, sqlMaxRows, db)}, nil
+}
+
+func (sqlTool) Name() string { return "sql_database" }
+
+func (t sqlTool) Description() string {
+	return fmt.Sprintf("Answers counting, aggregate and lookup questions exactly by running SQL over the tables %s, "+
+		"which hold the ingested spreadsheets with one row per record. Input is the question in natural language.",
+		strings.Join(t.db.TableNames(), ", "))
+}
+
+func (t sqlTool) Call(ctx context.Context, input string) (string, error) {
+	result, err := chains.Run(ctx, t.chain, input)
+	if err != nil {
+		return fmt.Sprintf("query failed: %v", err), nil
+	}
+	return result, nil
+}
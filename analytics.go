@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SinkClickHouse = "clickhouse"
+	SinkBigQuery   = "bigquery"
+)
+
+const analyticsMaxAttempts = 3
+
+// gceTokenURL hands out access tokens for the service account of a Google
+// Cloud VM or GKE pod.
+const gceTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+type AnalyticsConfig struct {
+	Sink         string           `json:"sink"`          // "clickhouse", "bigquery", or "" to export nothing
+	BatchSize    int              `json:"batch_size"`    // Events sent per request at most
+	FlushSeconds int              `json:"flush_seconds"` // Send a smaller batch once its oldest event is this old
+	BufferSize   int              `json:"buffer_size"`   // Events waiting to be sent at most; more are dropped
+	IncludeText  bool             `json:"include_text"`  // Send the query and answer, not only their lengths
+	ClickHouse   ClickHouseConfig `json:"clickhouse"`
+	BigQuery     BigQueryConfig   `json:"bigquery"`
+}
+
+type ClickHouseConfig struct {
+	URL      string `json:"url"` // HTTP interface, e.g. "http://clickhouse:8123"
+	Table    string `json:"table"`
+	Username string `json:"username"`
+	Password string `json:"password"` // With environment variables expanded
+}
+
+type BigQueryConfig struct {
+	Project string `json:"project"`
+	Dataset string `json:"dataset"`
+	Table   string `json:"table"`
+	Token   string `json:"token"` // OAuth access token, with environment variables expanded; from the metadata server when empty
+}
+
+func validateAnalytics(cfg AnalyticsConfig) error {
+	switch cfg.Sink {
+	case "":
+		return nil
+	case SinkClickHouse:
+		if cfg.ClickHouse.URL == "" || cfg.ClickHouse.Table == "" {
+			return fmt.Errorf("analytics.clickhouse.url and table are required for clickhouse")
+		}
+	case SinkBigQuery:
+		if cfg.BigQuery.Project == "" || cfg.BigQuery.Dataset == "" || cfg.BigQuery.Table == "" {
+			return fmt.Errorf("analytics.bigquery.project, dataset and table are required for bigquery")
+		}
+	default:
+		return fmt.Errorf("unknown analytics sink %q", cfg.Sink)
+	}
+	if cfg.BatchSize < 1 || cfg.FlushSeconds < 1 || cfg.BufferSize < cfg.BatchSize {
+		return fmt.Errorf("analytics.batch_size and flush_seconds must be at least 1 and buffer_size at least batch_size")
+	}
+	return nil
+}
+
+// InteractionEvent is a chat answer as exported to the analytics sink, one
+// row per answer. Stage latencies have a column each so the table needs no
+// nested types.
+type InteractionEvent struct {
+	ID           string   `json:"id"`
+	Time         string   `json:"time"` // RFC 3339, UTC
+	SessionID    string   `json:"session_id"`
+	UserID       string   `json:"user_id"`
+	Tenant       string   `json:"tenant"`
+	Variant      string   `json:"variant"`
+	Mode         string   `json:"mode"`
+	Query        string   `json:"query"`  // With analytics.include_text
+	Answer       string   `json:"answer"` // With analytics.include_text
+	QueryChars   int      `json:"query_chars"`
+	AnswerChars  int      `json:"answer_chars"`
+	LatencyMS    float64  `json:"latency_ms"`
+	RoutingMS    float64  `json:"routing_ms"`
+	RetrievalMS  float64  `json:"retrieval_ms"`
+	GenerationMS float64  `json:"generation_ms"`
+	ScoringMS    float64  `json:"scoring_ms"`
+	Confidence   *float64 `json:"confidence"`
+	Faithfulness *float64 `json:"faithfulness"`
+	Unanswered   bool     `json:"unanswered"`
+	Failed       bool     `json:"failed"`
+	Cancelled    bool     `json:"cancelled"`
+	Degraded     bool     `json:"degraded"`
+	Sources      []string `json:"sources"`
+}
+
+// analyticsExporter batches interaction events in the background and sends
+// them to the configured sink. Events are dropped rather than slowing
+// answers down when the sink cannot keep up.
+type analyticsExporter struct {
+	cfg    AnalyticsConfig
+	events chan InteractionEvent
+	send   func(context.Context, []InteractionEvent) error
+
+	mu    sync.Mutex
+	token string
+	until time.Time
+}
+
+// analytics is started from the analytics config on startup; nil exports
+// nothing.
+var analytics *analyticsExporter
+
+var analyticsClient = &http.Client{Timeout: 30 * time.Second}
+
+func startAnalytics(cfg AnalyticsConfig) {
+	if cfg.Sink == "" {
+		return
+	}
+	e := &analyticsExporter{cfg: cfg, events: make(chan InteractionEvent, cfg.BufferSize)}
+	if cfg.Sink == SinkClickHouse {
+		e.send = e.sendClickHouse
+	} else {
+		e.send = e.sendBigQuery
+	}
+	analytics = e
+	go e.run()
+}
+
+// exportInteraction queues an answer for the analytics sink, if there is one.
+func exportInteraction(msg Message, mode string, result ChatResponse, failed bool, latency time.Duration) {
+	if analytics == nil {
+		return
+	}
+	if mode == "" {
+		mode = ModeRAG
+	}
+	stages := msg.timings.snapshot()
+	event := InteractionEvent{
+		ID:           result.ID,
+		Time:         time.Now().UTC().Format(time.RFC3339Nano),
+		SessionID:    msg.SessionID,
+		UserID:       msg.UserID,
+		Tenant:       msg.Tenant,
+		Variant:      result.Variant,
+		Mode:         mode,
+		QueryChars:   len([]rune(msg.Msg)),
+		AnswerChars:  len([]rune(result.Message)),
+		LatencyMS:    milliseconds(latency),
+		RoutingMS:    stages[TimingRouting],
+		RetrievalMS:  stages[TimingRetrieval],
+		GenerationMS: stages[TimingGeneration],
+		ScoringMS:    stages[TimingScoring],
+		Unanswered:   !failed && retrieves(mode) && isAbstention(result.Message),
+		Failed:       failed,
+		Cancelled:    result.Cancelled,
+		Degraded:     result.Degraded,
+		Sources:      documentSources(result.docs),
+	}
+	if event.SessionID == "" && len(msg.Messages) == 0 {
+		event.SessionID = defaultSession
+	}
+	if analytics.cfg.IncludeText {
+		event.Query, event.Answer = msg.Msg, result.Message
+	}
+	if result.Confidence != nil {
+		event.Confidence, event.Faithfulness = &result.Confidence.Score, result.Confidence.Faithfulness
+	}
+	if event.Sources == nil {
+		event.Sources = []string{}
+	}
+
+	select {
+	case analytics.events <- event:
+	default:
+		log.Printf("Analytics buffer is full, dropping event %s", event.ID)
+	}
+}
+
+func (e *analyticsExporter) run() {
+	ticker := time.NewTicker(time.Duration(e.cfg.FlushSeconds) * time.Second)
+	defer ticker.Stop()
+	var batch []InteractionEvent
+	for {
+		select {
+		case event := <-e.events:
+			batch = append(batch, event)
+			if len(batch) < e.cfg.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		e.flush(batch)
+		batch = nil
+	}
+}
+
+// flush sends a batch, retrying with backoff, and drops it if every attempt
+// fails.
+func (e *analyticsExporter) flush(batch []InteractionEvent) {
+	var err error
+	for attempt := 1; attempt <= analyticsMaxAttempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), analyticsClient.Timeout)
+		err = e.send(ctx, batch)
+		cancel()
+		if err == nil {
+			return
+		}
+		if attempt < analyticsMaxAttempts {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+	log.Printf("Error exporting %d analytics events to %s, dropping them: %v", len(batch), e.cfg.Sink, err)
+}
+
+func (e *analyticsExporter) sendClickHouse(ctx context.Context, batch []InteractionEvent) error {
+	cfg := e.cfg.ClickHouse
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, event := range batch {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+	query := url.Values{
+		"query":                  {"INSERT INTO " + cfg.Table + " FORMAT JSONEachRow"},
+		"date_time_input_format": {"best_effort"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(cfg.URL, "/")+"/?"+query.Encode(), &body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	if cfg.Username != "" {
+		req.SetBasicAuth(cfg.Username, os.ExpandEnv(cfg.Password))
+	}
+	resp, err := analyticsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("clickhouse returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+func (e *analyticsExporter) sendBigQuery(ctx context.Context, batch []InteractionEvent) error {
+	cfg := e.cfg.BigQuery
+	type row struct {
+		InsertID string           `json:"insertId"` // Lets BigQuery drop the rows of a retried batch
+		JSON     InteractionEvent `json:"json"`
+	}
+	rows := make([]row, len(batch))
+	for i, event := range batch {
+		rows[i] = row{InsertID: event.ID, JSON: event}
+	}
+	body, err := json.Marshal(map[string]any{"rows": rows})
+	if err != nil {
+		return err
+	}
+	token, err := e.bigQueryToken(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get a bigquery token: %v", err)
+	}
+
+	endpoint := fmt.Sprintf("https://bigquery.googleapis.com/bigquery/v2/projects/%s/datasets/%s/tables/%s/insertAll",
+		url.PathEscape(cfg.Project), url.PathEscape(cfg.Dataset), url.PathEscape(cfg.Table))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := analyticsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("bigquery returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	var result struct {
+		InsertErrors []json.RawMessage `json:"insertErrors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("invalid bigquery response: %v", err)
+	}
+	if len(result.InsertErrors) > 0 {
+		// Rows are rejected for their contents, which a retry does not change
+		log.Printf("BigQuery rejected %d of %d analytics events: %s", len(result.InsertErrors), len(batch), result.InsertErrors[0])
+	}
+	return nil
+}
+
+// bigQueryToken returns the configured access token, or one of the VM's
+// service account, cached until shortly before it expires.
+func (e *analyticsExporter) bigQueryToken(ctx context.Context) (string, error) {
+	if token := os.ExpandEnv(e.cfg.BigQuery.Token); token != "" {
+		return token, nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.token != "" && time.Now().Before(e.until) {
+		return e.token, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gceTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := analyticsClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned %s", resp.Status)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("invalid token response: %v", err)
+	}
+	e.token = token.AccessToken
+	e.until = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return e.token, nil
+}
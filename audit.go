@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tmc/langchaingo/schema"
+)
+
+type AuditConfig struct {
+	Path string `json:"path"` // JSON Lines file each chat answer is appended to; empty disables the log
+}
+
+// AuditEntry is a chat answer as logged, with what is needed to replay it.
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Model   string    `json:"model"`
+	Message Message   `json:"message"`          // After query hooks, without images
+	Images  int       `json:"images,omitempty"` // Attached images, which are not logged
+	History []string  `json:"history,omitempty"`
+	Mode    string    `json:"mode"`
+	Variant string    `json:"variant,omitempty"` // Experiment variant that answered
+	Answer  string    `json:"answer"`
+	Sources []string  `json:"sources,omitempty"` // Of the chunks in the prompt, in order
+	Error   string    `json:"error,omitempty"`
+	Purged  bool      `json:"purged,omitempty"` // Content was purged with the data of its user or a document it drew on
+}
+
+var auditMu sync.Mutex
+
+// recordAudit appends an answer to the audit log, if one is configured.
+// Failures are logged rather than failing the chat request.
+func recordAudit(msg Message, history []string, mode, answer string, docs []schema.Document, err error) {
+	path := getConfig().Audit.Path
+	if path == "" {
+		return
+	}
+
+	entry := AuditEntry{
+		Time:    time.Now().UTC(),
+		Model:   getConfig().LLM.Model,
+		Message: msg,
+		Images:  len(msg.Images),
+		History: history,
+		Mode:    mode,
+		Answer:  answer,
+		Sources: documentSources(docs),
+	}
+	entry.Message.Images = nil
+	if msg.variant != nil {
+		entry.Variant = msg.variant.Name
+	}
+	if entry.Mode == "" {
+		entry.Mode = ModeRAG
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error encoding audit entry: %v", err)
+		return
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Printf("Error opening audit log: %v", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+}
+
+func readAudit(path string) ([]AuditEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// rewriteAudit replaces the entries of the audit log at path with those edit
+// returns, unless it reports no change. Answers logged meanwhile wait.
+func rewriteAudit(path string, edit func([]AuditEntry) ([]AuditEntry, bool)) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	entries, err := readAudit(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	entries, changed := edit(entries)
+	if !changed {
+		return nil
+	}
+
+	// Renaming a complete file over the log keeps it whole if writing fails
+	temp := path + ".tmp"
+	file, err := os.OpenFile(temp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			file.Close()
+			os.Remove(temp)
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// tombstone strips an audit entry of what its user asked and was answered.
+func (e *AuditEntry) tombstone() {
+	e.Message, e.History, e.Answer, e.Error, e.Images = Message{}, nil, "", "", 0
+	e.Purged = true
+}
+
+func documentSources(docs []schema.Document) []string {
+	var sources []string
+	for _, doc := range docs {
+		if source, ok := doc.Metadata["source"].(string); ok {
+			sources = append(sources, source)
+		}
+	}
+	return sources
+}
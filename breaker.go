@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/llms/ollama"
+	"github.com/tmc/langchaingo/schema"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+type BreakerConfig struct {
+	Failures        int `json:"failures"`         // Consecutive failures that open a breaker; 0 disables the breakers
+	CooldownSeconds int `json:"cooldown_seconds"` // Time an open breaker fails fast before letting requests probe again
+}
+
+func validateBreakers(cfg BreakerConfig) error {
+	if cfg.Failures < 0 {
+		return fmt.Errorf("breakers.failures must not be negative")
+	}
+	if cfg.Failures > 0 && cfg.CooldownSeconds <= 0 {
+		return fmt.Errorf("breakers.cooldown_seconds must be positive")
+	}
+	return nil
+}
+
+// CircuitBreaker stops calling a dependency after breakers.failures
+// consecutive failures, failing fast instead of stacking up requests that
+// time out. Once the cooldown is over it is half-open: requests go through
+// again, and the first success closes it while a failure reopens it.
+type CircuitBreaker struct {
+	Name     string
+	Failures int
+	OpenedAt time.Time // Zero while closed
+
+	mu sync.Mutex
+}
+
+// Generation and embeddings have breakers of their own, since a large chat
+// model can fail (out of memory, timeouts) while the embedding model works.
+var (
+	ollamaBreaker    = &CircuitBreaker{Name: "ollama"}
+	embeddingBreaker = &CircuitBreaker{Name: "ollama embeddings"}
+	qdrantBreaker    = &CircuitBreaker{Name: "qdrant"}
+)
+
+// BreakerStatus is a breaker as reported by GET /health.
+type BreakerStatus struct {
+	State    string     `json:"state"`
+	Failures int        `json:"failures"`
+	RetryAt  *time.Time `json:"retry_at,omitempty"` // When an open breaker lets requests through again
+}
+
+// allow fails while the breaker is open.
+func (b *CircuitBreaker) allow() error {
+	status := b.status()
+	if status.State != BreakerOpen {
+		return nil
+	}
+	return fmt.Errorf("%s is degraded after %d consecutive failures; retrying after %s",
+		b.Name, status.Failures, status.RetryAt.Format(time.RFC3339))
+}
+
+// record counts the outcome of a call. Cancelled calls say nothing about the
+// dependency and are not counted.
+func (b *CircuitBreaker) record(err error) {
+	cfg := getConfig().Breakers
+	if cfg.Failures == 0 || errors.Is(err, context.Canceled) {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if !b.OpenedAt.IsZero() {
+			log.Printf("%s recovered, closing its circuit breaker", b.Name)
+		}
+		b.Failures = 0
+		b.OpenedAt = time.Time{}
+		return
+	}
+	b.Failures++
+	if b.Failures >= cfg.Failures {
+		if b.OpenedAt.IsZero() {
+			log.Printf("%s failed %d times in a row, opening its circuit breaker: %v", b.Name, b.Failures, err)
+		}
+		b.OpenedAt = time.Now()
+	}
+}
+
+// call runs fn unless the breaker is open, and records its outcome.
+func (b *CircuitBreaker) call(fn func() error) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := fn()
+	b.record(err)
+	return err
+}
+
+func (b *CircuitBreaker) status() BreakerStatus {
+	cooldown := time.Duration(getConfig().Breakers.CooldownSeconds) * time.Second
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := BreakerStatus{State: BreakerClosed, Failures: b.Failures}
+	if b.OpenedAt.IsZero() {
+		return status
+	}
+	retryAt := b.OpenedAt.Add(cooldown)
+	if time.Now().Before(retryAt) {
+		status.State = BreakerOpen
+		status.RetryAt = &retryAt
+	} else {
+		status.State = BreakerHalfOpen
+	}
+	return status
+}
+
+// breakerModel guards an Ollama model with ollamaBreaker.
+type breakerModel struct {
+	llms.Model
+}
+
+func withOllamaBreaker(llm *ollama.LLM, err error) (Generator, error) {
+	if err != nil {
+		return nil, err
+	}
+	return breakerModel{llm}, nil
+}
+
+func (m breakerModel) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	var resp *llms.ContentResponse
+	err := ollamaBreaker.call(func() error {
+		var err error
+		resp, err = m.Model.GenerateContent(ctx, messages, options...)
+		return err
+	})
+	return resp, err
+}
+
+func (m breakerModel) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, m, prompt, options...)
+}
+
+// breakerEmbedder guards an Ollama embedder with embeddingBreaker.
+type breakerEmbedder struct {
+	Embedder
+}
+
+func (e breakerEmbedder) EmbedDocuments(ctx context.Context, texts []string) ([][]float32, error) {
+	var vectors [][]float32
+	err := embeddingBreaker.call(func() error {
+		var err error
+		vectors, err = e.Embedder.EmbedDocuments(ctx, texts)
+		return err
+	})
+	return vectors, err
+}
+
+func (e breakerEmbedder) EmbedQuery(ctx context.Context, text string) ([]float32, error) {
+	var vector []float32
+	err := embeddingBreaker.call(func() error {
+		var err error
+		vector, err = e.Embedder.EmbedQuery(ctx, text)
+		return err
+	})
+	return vector, err
+}
+
+// qdrantGRPCCall runs a gRPC request guarded by qdrantBreaker. Only errors
+// showing Qdrant unreachable or overloaded count as failures.
+func qdrantGRPCCall(fn func() error) error {
+	if err := qdrantBreaker.allow(); err != nil {
+		return err
+	}
+	err := fn()
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Internal:
+		qdrantBreaker.record(err)
+	case codes.Canceled:
+	default:
+		qdrantBreaker.record(nil)
+	}
+	return err
+}
+
+// degradedDependency returns the error of the first open breaker that keeps
+// chat from answering at all. Without generation, retrieval-only answers
+// still work when they are enabled.
+func degradedDependency() error {
+	if err := embeddingBreaker.allow(); err != nil {
+		return err
+	}
+	if getConfig().VectorStore.Backend == StoreQdrant {
+		if err := qdrantBreaker.allow(); err != nil {
+			return err
+		}
+	}
+	if !getConfig().Degraded.RetrievalOnly {
+		return ollamaBreaker.allow()
+	}
+	return nil
+}
+
+// getHealth reports the circuit breakers. The status is "degraded" while any
+// is open, and the response 503 while chat cannot answer at all.
+func getHealth(c *gin.Context) {
+	breakers := map[string]*CircuitBreaker{"ollama": ollamaBreaker, "embeddings": embeddingBreaker}
+	if getConfig().VectorStore.Backend == StoreQdrant {
+		breakers["qdrant"] = qdrantBreaker
+	}
+	health := "ok"
+	dependencies := gin.H{}
+	for name, breaker := range breakers {
+		status := breaker.status()
+		if status.State == BreakerOpen {
+			health = "degraded"
+		}
+		dependencies[name] = status
+	}
+	if err := degradedDependency(); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": health, "error": err.Error(), "dependencies": dependencies})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": health, "dependencies": dependencies})
+}
+
+type DegradedConfig struct {
+	RetrievalOnly bool   `json:"retrieval_only"` // Answer with the retrieved excerpts when generation fails
+	Message       string `json:"message"`        // Introduces the excerpts
+}
+
+// retrievalOnlyAnswer lists the retrieved chunks under the degraded message,
+// for when the model cannot answer.
+func retrievalOnlyAnswer(docs []schema.Document) string {
+	var sb strings.Builder
+	sb.WriteString(getConfig().Degraded.Message)
+	for i, doc := range docs {
+		source, _ := doc.Metadata["source"].(string)
+		fmt.Fprintf(&sb, "\n\n[%d] %s\n%s", i+1, source, strings.TrimSpace(doc.PageContent))
+	}
+	return sb.String()
+}
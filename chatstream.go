@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/schema"
+)
+
+const (
+	StageSearching = "searching"
+	StageAnswering = "answering"
+	StageAgent     = "agent"
+	StageDegraded  = "degraded" // Generation failed; the answer lists the excerpts
+)
+
+// answerStream sends the stages of an answer to a POST /chat/stream client
+// as server-sent events. Its methods do nothing on a nil stream, which is
+// how the other callers of RAG run.
+type answerStream struct {
+	c        *gin.Context
+	streamed bool // The answer was sent as it was generated
+}
+
+// chatStream answers a chat message like POST /chat, streaming it: "queued"
+// events while waiting for a free generation slot, "status" events as the
+// answer moves through its stages, a "sources" event with the
+// retrieved chunks before generation starts, "delta" events with the answer
+// text and a final "done" event with the full response.
+func chatStream(c *gin.Context) {
+	msg, ok := bindChatMessage(c)
+	if !ok {
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	stream := &answerStream{c: c}
+	response := RAG(c.Request.Context(), msg, stream)
+	stream.event("done", response)
+}
+
+func (s *answerStream) event(name string, data any) {
+	if s == nil {
+		return
+	}
+	s.c.SSEvent(name, data)
+	s.c.Writer.Flush()
+}
+
+func (s *answerStream) status(stage string) {
+	s.event("status", gin.H{"stage": stage})
+}
+
+func (s *answerStream) sources(docs []schema.Document) {
+	s.event("sources", gin.H{"sources": sourceChunks(docs)})
+}
+
+func (s *answerStream) failed(err error) {
+	s.event("error", gin.H{"error": err.Error()})
+}
+
+// options adds a streaming function sending the answer as it is generated,
+// unless a response hook may still change it. Generation stops when the
+// client goes away.
+func (s *answerStream) options(options []llms.CallOption) []llms.CallOption {
+	if s == nil || !streamableResponses() {
+		return options
+	}
+	s.streamed = true
+	return append(options, llms.WithStreamingFunc(func(_ context.Context, chunk []byte) error {
+		s.event("delta", gin.H{"text": string(chunk)})
+		return s.c.Request.Context().Err()
+	}))
+}
+
+// excerpts sends a retrieval-only answer in place of whatever was streamed
+// before generation failed.
+func (s *answerStream) excerpts(response string) {
+	s.status(StageDegraded)
+	s.event("delta", gin.H{"text": response})
+}
+
+// finish sends the answer in one piece if it was not streamed.
+func (s *answerStream) finish(response string) {
+	if s == nil || s.streamed {
+		return
+	}
+	s.event("delta", gin.H{"text": response})
+}
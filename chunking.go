@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/tmc/langchaingo/schema"
+	"github.com/tmc/langchaingo/textsplitter"
+)
+
+const (
+	ChunkingRecursive = "recursive" // Fixed-size overlapping chunks split at paragraph, line and word breaks
+	ChunkingSemantic  = "semantic"  // Chunks split where consecutive sentences change topic
+)
+
+func validateChunking(size, overlap int) error {
+	if size <= 0 {
+		return fmt.Errorf("chunk size must be positive")
+	}
+	if overlap < 0 || overlap >= size {
+		return fmt.Errorf("chunk overlap must be between 0 and the chunk size")
+	}
+	return nil
+}
+
+// chunkDocuments splits long documents into overlapping chunks, copying the
+// metadata of the document to each of its chunks. Every chunk gets its own
+// "id", the chunks of the whole source are numbered in order with
+// "chunk_index" and "chunk_overlap" holds the number of bytes a chunk repeats
+// from the end of the previous one.
+func chunkDocuments(docs []schema.Document, size, overlap int) ([]schema.Document, error) {
+	splitter := textsplitter.NewRecursiveCharacter(
+		textsplitter.WithChunkSize(size),
+		textsplitter.WithChunkOverlap(overlap),
+	)
+
+	var chunks []schema.Document
+	for _, doc := range docs {
+		texts, err := splitter.SplitText(doc.PageContent)
+		if err != nil {
+			return nil, err
+		}
+		for i, text := range texts {
+			metadata := make(map[string]any, len(doc.Metadata)+3)
+			for k, v := range doc.Metadata {
+				metadata[k] = v
+			}
+			metadata["id"] = uuid.New().String()
+			metadata["chunk_index"] = len(chunks)
+			metadata["chunk_overlap"] = 0
+			if i > 0 {
+				metadata["chunk_overlap"] = sharedOverlap(texts[i-1], text, overlap)
+			}
+			chunks = append(chunks, schema.Document{PageContent: text, Metadata: metadata})
+		}
+	}
+	return chunks, nil
+}
+
+// splitDocuments chunks documents with the strategy of the ingest request.
+func splitDocuments(ctx context.Context, docs []schema.Document, req IngestRequest) ([]schema.Document, error) {
+	if req.Chunking != ChunkingSemantic {
+		return chunkDocuments(docs, req.ChunkSize, req.ChunkOverlap)
+	}
+	embedder, err := newEmbedder()
+	if err != nil {
+		return nil, err
+	}
+	return semanticChunks(ctx, embedder, docs, req.ChunkSize, getConfig().Chunking.SemanticThreshold)
+}
+
+// semanticChunks splits documents into runs of sentences, starting a new
+// chunk where the embedding similarity of consecutive sentences drops below
+// threshold or the chunk would grow past size bytes. Chunks get the same
+// metadata as in chunkDocuments, without overlap.
+func semanticChunks(ctx context.Context, embedder Embedder, docs []schema.Document, size int, threshold float64) ([]schema.Document, error) {
+	var chunks []schema.Document
+	for _, doc := range docs {
+		spans := splitSentences(doc.PageContent)
+		if len(spans) == 0 {
+			continue
+		}
+		sentences := make([]string, len(spans))
+		for i, span := range spans {
+			sentences[i] = doc.PageContent[span.Start:span.End]
+		}
+		vectors, err := embedder.EmbedDocuments(ctx, sentences)
+		if err != nil {
+			return nil, fmt.Errorf("failed to embed sentences: %v", err)
+		}
+
+		start := 0
+		for i := 1; i <= len(spans); i++ {
+			if i < len(spans) &&
+				spans[i].End-spans[start].Start <= size &&
+				cosineSimilarity(vectors[i-1], vectors[i]) >= threshold {
+				continue
+			}
+
+			metadata := make(map[string]any, len(doc.Metadata)+3)
+			for k, v := range doc.Metadata {
+				metadata[k] = v
+			}
+			metadata["id"] = uuid.New().String()
+			metadata["chunk_index"] = len(chunks)
+			metadata["chunk_overlap"] = 0
+			text := doc.PageContent[spans[start].Start:spans[i-1].End]
+			chunks = append(chunks, schema.Document{PageContent: text, Metadata: metadata})
+			start = i
+		}
+	}
+	return chunks, nil
+}
+
+// sharedOverlap returns the length of the longest suffix of prev, at most
+// limit bytes, that text starts with.
+func sharedOverlap(prev, text string, limit int) int {
+	for n := min(limit, len(prev), len(text)); n > 0; n-- {
+		if strings.HasPrefix(text, prev[len(prev)-n:]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// stitchNeighbors merges retrieved chunks that are adjacent in the same
+// source and version into one block in chunk order, dropping the text each
+// chunk repeats from the previous one. A merged block takes the place and
+// score of its best ranked chunk; chunks without a "chunk_index" are kept as
+// they are.
+func stitchNeighbors(docs []schema.Document) []schema.Document {
+	type position struct {
+		doc   int
+		index int
+	}
+	groups := map[string][]position{}
+	for i, doc := range docs {
+		index, ok := intValue(doc.Metadata["chunk_index"])
+		if !ok {
+			continue
+		}
+		key := fmt.Sprintf("%v\x00%v", doc.Metadata["source"], doc.Metadata["version"])
+		groups[key] = append(groups[key], position{doc: i, index: index})
+	}
+
+	docs = append([]schema.Document(nil), docs...)
+	merged := make([]bool, len(docs))
+	for _, positions := range groups {
+		if len(positions) < 2 {
+			continue
+		}
+		sort.Slice(positions, func(i, j int) bool { return positions[i].index < positions[j].index })
+
+		for start := 0; start < len(positions); {
+			end := start + 1
+			for end < len(positions) && positions[end].index <= positions[end-1].index+1 {
+				end++
+			}
+			if end-start > 1 {
+				best := positions[start].doc
+				for _, p := range positions[start:end] {
+					best = min(best, p.doc)
+				}
+
+				var text strings.Builder
+				text.WriteString(docs[positions[start].doc].PageContent)
+				for k := start + 1; k < end; k++ {
+					if positions[k].index == positions[k-1].index {
+						continue // The same chunk hit twice
+					}
+					content := docs[positions[k].doc].PageContent
+					overlap, _ := intValue(docs[positions[k].doc].Metadata["chunk_overlap"])
+					if overlap <= 0 || overlap > len(content) {
+						text.WriteString("\n")
+						overlap = 0
+					}
+					text.WriteString(content[overlap:])
+				}
+
+				stitched := docs[best]
+				stitched.Metadata = make(map[string]any, len(docs[best].Metadata)+1)
+				for k, v := range docs[positions[start].doc].Metadata {
+					stitched.Metadata[k] = v
+				}
+				stitched.Metadata["chunk_index_end"] = positions[end-1].index
+				stitched.PageContent = text.String()
+				for _, p := range positions[start:end] {
+					merged[p.doc] = true
+				}
+				merged[best] = false
+				docs[best] = stitched
+			}
+			start = end
+		}
+	}
+
+	result := make([]schema.Document, 0, len(docs))
+	for i, doc := range docs {
+		if !merged[i] {
+			result = append(result, doc)
+		}
+	}
+	return result
+}
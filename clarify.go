@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/tmc/langchaingo/schema"
+)
+
+const clarifyAmbiguousSystemMessage = "You are an assistant for a document question answering service. " +
+	"The user's question could be about several different topics, listed in the relevant information with an excerpt each. " +
+	"Do not answer it. Ask one brief question about which of them, or which time period, the user means, naming the topics."
+
+type ClarifyConfig struct {
+	Enabled     bool    `json:"enabled"`      // Ask which topic the user means when the top chunks are about different things
+	ScoreMargin float32 `json:"score_margin"` // Chunks scoring within this of the best one count as equally likely
+	MaxOverlap  float64 `json:"max_overlap"`  // Share of words two chunks may have in common and still be about different topics
+	MaxOptions  int     `json:"max_options"`  // Topics named in the clarifying question at most
+	TTLSeconds  int     `json:"ttl_seconds"`  // How long the next message is taken as the answer to a clarifying question
+}
+
+func validateClarify(cfg ClarifyConfig) error {
+	if cfg.ScoreMargin < 0 {
+		return fmt.Errorf("clarify.score_margin must not be negative")
+	}
+	if cfg.MaxOverlap < 0 || cfg.MaxOverlap > 1 {
+		return fmt.Errorf("clarify.max_overlap must be between 0 and 1")
+	}
+	if cfg.MaxOptions < 2 {
+		return fmt.Errorf("clarify.max_options must be at least 2")
+	}
+	if cfg.TTLSeconds < 1 {
+		return fmt.Errorf("clarify.ttl_seconds must be at least 1")
+	}
+	return nil
+}
+
+// Clarification is a clarifying question the session is waiting on an
+// answer to.
+type Clarification struct {
+	Question string   `json:"question"` // The ambiguous question
+	Options  []string `json:"options"`  // The topics it could be about
+}
+
+// ambiguousTopics returns one chunk per topic when the best chunks come from
+// different documents, score within clarify.score_margin of each other and
+// share few words, e.g. two products with the same feature name. Nil means
+// the retrieval is not ambiguous.
+func ambiguousTopics(docs []schema.Document) []schema.Document {
+	cfg := getConfig().Clarify
+	if len(docs) < 2 {
+		return nil
+	}
+	best := docs[0].Score
+	for _, doc := range docs {
+		best = max(best, doc.Score)
+	}
+
+	var topics []schema.Document
+	var words []map[string]bool
+	labels := map[string]bool{}
+	for _, doc := range docs {
+		label := topicLabel(doc)
+		if doc.Score < best-cfg.ScoreMargin || labels[label] {
+			continue
+		}
+		set := wordSet(doc.PageContent)
+		distinct := true
+		for _, other := range words {
+			if overlap(set, other) > cfg.MaxOverlap {
+				distinct = false
+				break
+			}
+		}
+		if !distinct {
+			continue
+		}
+		labels[label] = true
+		topics = append(topics, doc)
+		words = append(words, set)
+		if len(topics) == cfg.MaxOptions {
+			break
+		}
+	}
+	if len(topics) < 2 {
+		return nil
+	}
+	return topics
+}
+
+// topicLabel names the topic of a chunk after its document.
+func topicLabel(doc schema.Document) string {
+	for _, key := range []string{"title", "document", "source"} {
+		if label, _ := doc.Metadata[key].(string); label != "" {
+			return label
+		}
+	}
+	words := strings.Fields(doc.PageContent)
+	return strings.Join(words[:min(6, len(words))], " ")
+}
+
+func wordSet(text string) map[string]bool {
+	set := map[string]bool{}
+	for _, word := range tokenize(text) {
+		if !isStopword(word) {
+			set[word] = true
+		}
+	}
+	return set
+}
+
+// overlap is the Jaccard similarity of two word sets.
+func overlap(a, b map[string]bool) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	shared := 0
+	for word := range a {
+		if b[word] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
+
+// askWhichTopic asks the user which of topics an ambiguous question is about
+// and records the question as pending on the session.
+func askWhichTopic(ctx context.Context, llm Generator, msg Message, topics []schema.Document, stream *answerStream) (string, *Clarification, error) {
+	template := promptTemplateFor(queryLanguage(msg)).render(msg)
+	template.SystemMessage = strings.Replace(template.SystemMessage, defaultPromptTemplate.SystemMessage, clarifyAmbiguousSystemMessage, 1)
+	template.Examples = nil
+
+	clarification := &Clarification{Question: msg.Msg}
+	for _, doc := range topics {
+		clarification.Options = append(clarification.Options, topicLabel(doc))
+	}
+	log.Printf("Query %q is ambiguous between %s, asking the user to clarify", msg.Msg, strings.Join(clarification.Options, ", "))
+
+	prompt := constructPrompt(conversation(msg), topics, msg.Msg, template)
+	response, err := generate(ctx, llm, prompt, stream.options(generationOptions(msg))...)
+	if err != nil {
+		return "", nil, err
+	}
+	sessionContext(msg.SessionID).setClarification(ctx, clarification)
+	return response, clarification, nil
+}
+
+func (c *ChatContext) clarificationKey() string {
+	return c.key + ":clarification"
+}
+
+// takeClarification returns the clarifying question the session is waiting
+// on, if any, and clears it: the message being answered is its answer.
+func (c *ChatContext) takeClarification(ctx context.Context) *Clarification {
+	value, ok, err := sharedState.Get(ctx, c.clarificationKey())
+	if err != nil {
+		log.Printf("Error reading pending clarification: %v", err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	if _, err := sharedState.Delete(ctx, c.clarificationKey()); err != nil {
+		log.Printf("Error clearing pending clarification: %v", err)
+	}
+	var clarification Clarification
+	if err := json.Unmarshal(value, &clarification); err != nil {
+		log.Printf("Invalid pending clarification: %v", err)
+		return nil
+	}
+	return &clarification
+}
+
+func (c *ChatContext) setClarification(ctx context.Context, clarification *Clarification) {
+	value, err := json.Marshal(clarification)
+	if err == nil {
+		err = sharedState.Put(ctx, c.clarificationKey(), value, time.Duration(getConfig().Clarify.TTLSeconds)*time.Second)
+	}
+	if err != nil {
+		log.Printf("Error saving pending clarification: %v", err)
+	}
+}
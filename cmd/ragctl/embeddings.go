@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// contentKey is the payload field the server keeps chunk text under.
+const contentKey = "content"
+
+// checkpoint is how far a migration got, saved after every batch so that an
+// interrupted run resumes where it stopped.
+type checkpoint struct {
+	Source    string `json:"source"`
+	Target    string `json:"target"`
+	Model     string `json:"model"`
+	Offset    any    `json:"offset"` // Next page of the source; nil once it was walked
+	Processed int    `json:"processed"`
+	Done      bool   `json:"done"`
+}
+
+// qdrantClient calls the REST API of Qdrant.
+type qdrantClient struct {
+	url    string
+	apiKey string
+	http   *http.Client
+}
+
+func (q qdrantClient) call(method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, q.url+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if q.apiKey != "" {
+		req.Header.Set("api-key", q.apiKey)
+	}
+	resp, err := q.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("qdrant %s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("qdrant %s %s: unexpected status code %d, body: %s", method, path, resp.StatusCode, string(data))
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to decode qdrant response: %v", err)
+	}
+	return nil
+}
+
+// migrateEmbeddings re-embeds the chunks of a collection with another model
+// into a new collection, keeping point IDs and payloads, then points an
+// alias at the new collection once both hold as many points.
+func migrateEmbeddings(args []string) error {
+	flags := flag.NewFlagSet("migrate-embeddings", flag.ExitOnError)
+	qdrantURL := flags.String("qdrant", "http://localhost:6333", "Qdrant REST API")
+	apiKey := flags.String("api-key", "", "Qdrant API key; ${VAR} references are expanded")
+	alias := flags.String("alias", "", "alias the server reads as embedding.collection, switched to the target once verified")
+	source := flags.String("source", "", "collection to re-embed; defaults to the one -alias points at")
+	target := flags.String("target", "", "new collection to write")
+	ollamaURL := flags.String("ollama", "http://localhost:11434", "Ollama server")
+	model := flags.String("model", "", "new embedding model")
+	batch := flags.Int("batch", 64, "chunks embedded per request")
+	rate := flags.Float64("rate", 0, "chunks embedded per second at most; 0 for no limit")
+	checkpointPath := flags.String("checkpoint", "", "progress file an interrupted run resumes from; defaults to <target>.checkpoint.json")
+	restart := flags.Bool("restart", false, "walk the source from the start, ignoring the checkpoint")
+	flags.Parse(args)
+
+	if *target == "" || *model == "" {
+		return fmt.Errorf("-target and -model are required")
+	}
+	if *batch <= 0 || *rate < 0 {
+		return fmt.Errorf("-batch must be positive and -rate not negative")
+	}
+	q := qdrantClient{url: strings.TrimRight(*qdrantURL, "/"), apiKey: os.ExpandEnv(*apiKey), http: &http.Client{Timeout: 2 * time.Minute}}
+
+	previous := ""
+	if *alias != "" {
+		var err error
+		if previous, err = aliasCollection(q, *alias); err != nil {
+			return err
+		}
+	}
+	if *source == "" {
+		if previous == "" {
+			return fmt.Errorf("-source is required when -alias does not name an alias")
+		}
+		*source = previous
+	}
+	if *source == *target {
+		return fmt.Errorf("-target must name a collection other than the source")
+	}
+	if *checkpointPath == "" {
+		*checkpointPath = *target + ".checkpoint.json"
+	}
+
+	state := checkpoint{Source: *source, Target: *target, Model: *model}
+	if !*restart {
+		saved, err := readCheckpoint(*checkpointPath)
+		if err != nil {
+			return err
+		}
+		if saved != nil {
+			if saved.Source != *source || saved.Target != *target || saved.Model != *model {
+				return fmt.Errorf("%s is a migration of %s to %s with %s; pass -restart or another -checkpoint",
+					*checkpointPath, saved.Source, saved.Target, saved.Model)
+			}
+			state = *saved
+			fmt.Fprintf(os.Stderr, "resuming after %d chunks\n", state.Processed)
+		}
+	}
+
+	embedder := ollamaEmbedder{url: strings.TrimRight(*ollamaURL, "/"), model: *model, http: &http.Client{Timeout: 5 * time.Minute}}
+	probe, err := embedder.embed([]string{"dimension probe"})
+	if err != nil {
+		return err
+	}
+	if err := ensureTarget(q, *source, *target, len(probe[0])); err != nil {
+		return err
+	}
+
+	total, err := countPoints(q, *source)
+	if err != nil {
+		return err
+	}
+	start, startProcessed := time.Now(), state.Processed
+	for !state.Done {
+		var page struct {
+			Result struct {
+				Points []struct {
+					ID      any            `json:"id"`
+					Payload map[string]any `json:"payload"`
+				} `json:"points"`
+				NextPageOffset any `json:"next_page_offset"`
+			} `json:"result"`
+		}
+		body := map[string]any{"limit": *batch, "with_payload": true, "with_vector": false}
+		if state.Offset != nil {
+			body["offset"] = state.Offset
+		}
+		if err := q.call("POST", "/collections/"+*source+"/points/scroll", body, &page); err != nil {
+			return err
+		}
+
+		points := page.Result.Points
+		if len(points) > 0 {
+			texts := make([]string, len(points))
+			for i, point := range points {
+				texts[i], _ = point.Payload[contentKey].(string)
+			}
+			vectors, err := embedder.embed(texts)
+			if err != nil {
+				return err
+			}
+			upserts := make([]map[string]any, len(points))
+			for i, point := range points {
+				upserts[i] = map[string]any{"id": point.ID, "vector": vectors[i], "payload": point.Payload}
+			}
+			if err := q.call("PUT", "/collections/"+*target+"/points?wait=true", map[string]any{"points": upserts}, nil); err != nil {
+				return err
+			}
+		}
+
+		state.Processed += len(points)
+		state.Offset = page.Result.NextPageOffset
+		state.Done = state.Offset == nil
+		if err := writeCheckpoint(*checkpointPath, state); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%d/%d chunks\n", state.Processed, total)
+
+		// Stay under -rate on average since this run started
+		if *rate > 0 && !state.Done {
+			due := start.Add(time.Duration(float64(state.Processed-startProcessed) / *rate * float64(time.Second)))
+			time.Sleep(time.Until(due))
+		}
+	}
+
+	sourceCount, err := countPoints(q, *source)
+	if err != nil {
+		return err
+	}
+	targetCount, err := countPoints(q, *target)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d points, %s: %d points\n", *source, sourceCount, *target, targetCount)
+	if sourceCount != targetCount {
+		return fmt.Errorf("the counts differ, so the alias was not switched; chunks ingested or deleted during the migration "+
+			"are the usual cause: run again with -restart, or drop %s first if chunks were deleted", *target)
+	}
+	if *alias == "" {
+		fmt.Printf("point embedding.collection at %s and set embedding.model to %s\n", *target, *model)
+		return os.Remove(*checkpointPath)
+	}
+
+	// Both actions apply at once, so searches never miss the alias
+	actions := []map[string]any{}
+	if previous != "" {
+		actions = append(actions, map[string]any{"delete_alias": map[string]any{"alias_name": *alias}})
+	}
+	actions = append(actions, map[string]any{"create_alias": map[string]any{"collection_name": *target, "alias_name": *alias}})
+	if err := q.call("POST", "/collections/aliases", map[string]any{"actions": actions}, nil); err != nil {
+		return fmt.Errorf("failed to switch alias %s: %v", *alias, err)
+	}
+	fmt.Printf("alias %s points at %s; set embedding.model to %s and reload the server\n", *alias, *target, *model)
+	if previous != "" {
+		fmt.Printf("%s is kept for rollback; drop it once the new model is in use\n", previous)
+	}
+	return os.Remove(*checkpointPath)
+}
+
+// aliasCollection returns the collection alias points at, or "" when there
+// is no such alias.
+func aliasCollection(q qdrantClient, alias string) (string, error) {
+	var resp struct {
+		Result struct {
+			Aliases []struct {
+				AliasName      string `json:"alias_name"`
+				CollectionName string `json:"collection_name"`
+			} `json:"aliases"`
+		} `json:"result"`
+	}
+	if err := q.call("GET", "/aliases", nil, &resp); err != nil {
+		return "", err
+	}
+	for _, a := range resp.Result.Aliases {
+		if a.AliasName == alias {
+			return a.CollectionName, nil
+		}
+	}
+	return "", nil
+}
+
+// ensureTarget creates the target collection for size-dimensional vectors,
+// with the vector, HNSW and quantization options and the payload indexes of
+// the source, or checks the size of an existing one.
+func ensureTarget(q qdrantClient, source, target string, size int) error {
+	var info struct {
+		Result struct {
+			Config struct {
+				Params struct {
+					Vectors       map[string]any `json:"vectors"`
+					OnDiskPayload bool           `json:"on_disk_payload"`
+				} `json:"params"`
+				HNSWConfig         map[string]any `json:"hnsw_config"`
+				QuantizationConfig map[string]any `json:"quantization_config"`
+			} `json:"config"`
+			PayloadSchema map[string]struct {
+				DataType string `json:"data_type"`
+			} `json:"payload_schema"`
+		} `json:"result"`
+	}
+
+	var existing struct {
+		Result struct {
+			Config struct {
+				Params struct {
+					Vectors map[string]any `json:"vectors"`
+				} `json:"params"`
+			} `json:"config"`
+		} `json:"result"`
+	}
+	err := q.call("GET", "/collections/"+target, nil, &existing)
+	if err == nil {
+		if have, _ := existing.Result.Config.Params.Vectors["size"].(float64); int(have) != size {
+			return fmt.Errorf("collection %s exists with vectors of another size than %d; drop it or pick another -target", target, size)
+		}
+		return nil
+	}
+	if !strings.Contains(err.Error(), "status code 404") {
+		return err
+	}
+
+	if err := q.call("GET", "/collections/"+source, nil, &info); err != nil {
+		return err
+	}
+	params := info.Result.Config.Params
+	if _, ok := params.Vectors["size"]; !ok {
+		return errors.New("the source has named vectors, as late-interaction collections do; migrate it with POST /collections/migrate")
+	}
+	vectors := map[string]any{}
+	for key, value := range params.Vectors {
+		vectors[key] = value
+	}
+	vectors["size"] = size
+	create := map[string]any{"vectors": vectors, "on_disk_payload": params.OnDiskPayload}
+	if info.Result.Config.HNSWConfig != nil {
+		create["hnsw_config"] = info.Result.Config.HNSWConfig
+	}
+	if info.Result.Config.QuantizationConfig != nil {
+		create["quantization_config"] = info.Result.Config.QuantizationConfig
+	}
+	if err := q.call("PUT", "/collections/"+target, create, nil); err != nil {
+		return fmt.Errorf("failed to create %s: %v", target, err)
+	}
+	for field, index := range info.Result.PayloadSchema {
+		if err := q.call("PUT", "/collections/"+target+"/index?wait=true", map[string]any{"field_name": field, "field_schema": index.DataType}, nil); err != nil {
+			return fmt.Errorf("failed to index %s: %v", field, err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "created %s with %d-dimensional vectors and %d payload indexes\n", target, size, len(info.Result.PayloadSchema))
+	return nil
+}
+
+func countPoints(q qdrantClient, collection string) (int, error) {
+	var resp struct {
+		Result struct {
+			Count int `json:"count"`
+		} `json:"result"`
+	}
+	err := q.call("POST", "/collections/"+collection+"/points/count", map[string]any{"exact": true}, &resp)
+	return resp.Result.Count, err
+}
+
+func readCheckpoint(path string) (*checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state checkpoint
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %s: %v", path, err)
+	}
+	return &state, nil
+}
+
+// writeCheckpoint replaces the checkpoint file at once, so that a run killed
+// while writing it leaves the previous one.
+func writeCheckpoint(path string, state checkpoint) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// ollamaEmbedder embeds texts with Ollama's batch embedding API.
+type ollamaEmbedder struct {
+	url   string
+	model string
+	http  *http.Client
+}
+
+// embed returns a vector per text, retrying failed requests a few times
+// with growing pauses since a long migration outlives brief model restarts.
+func (e ollamaEmbedder) embed(texts []string) ([][]float32, error) {
+	data, err := json.Marshal(map[string]any{"model": e.model, "input": texts})
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 1; ; attempt++ {
+		vectors, err := e.post(data, len(texts))
+		if err == nil || attempt == 4 {
+			return vectors, err
+		}
+		fmt.Fprintf(os.Stderr, "embedding failed, retrying: %v\n", err)
+		time.Sleep(time.Duration(attempt*attempt) * time.Second)
+	}
+}
+
+func (e ollamaEmbedder) post(data []byte, n int) ([][]float32, error) {
+	resp, err := e.http.Post(e.url+"/api/embed", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to call ollama: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("ollama returned status %d, body: %s", resp.StatusCode, string(body))
+	}
+	var result struct {
+		Embeddings [][]float32 `json:"embeddings"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid ollama response: %v", err)
+	}
+	if len(result.Embeddings) != n {
+		return nil, fmt.Errorf("ollama returned %d embeddings for %d texts", len(result.Embeddings), n)
+	}
+	return result.Embeddings, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Stages of an answer, timed from the events of POST /chat/stream.
+var stages = []string{"queue", "retrieval", "first_token", "generation", "total"}
+
+// sample is the timing of one chat request.
+type sample struct {
+	stages map[string]time.Duration
+	err    string
+}
+
+// loadtest sends the questions of a file to POST /chat/stream from several
+// clients at once and reports the latency of each stage and the errors.
+func loadtest(args []string) error {
+	flags := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	server := flags.String("url", "http://localhost:8080", "server to test")
+	questionsPath := flags.String("questions", "", "file with one question, or one JSON chat request, per line")
+	concurrency := flags.Int("concurrency", 8, "requests in flight at once")
+	requests := flags.Int("requests", 0, "requests to send, cycling through the questions; defaults to one per question")
+	timeout := flags.Duration("timeout", 2*time.Minute, "timeout of a single request")
+	flags.Parse(args)
+
+	if *questionsPath == "" {
+		return fmt.Errorf("-questions is required")
+	}
+	if *concurrency <= 0 {
+		return fmt.Errorf("-concurrency must be positive")
+	}
+	questions, err := readQuestions(*questionsPath)
+	if err != nil {
+		return err
+	}
+	if *requests <= 0 {
+		*requests = len(questions)
+	}
+
+	work := make(chan json.RawMessage)
+	samples := make(chan sample)
+	client := &http.Client{Timeout: *timeout}
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for body := range work {
+				samples <- streamChat(client, strings.TrimRight(*server, "/")+"/chat/stream", body)
+			}
+		}()
+	}
+	go func() {
+		for i := 0; i < *requests; i++ {
+			work <- questions[i%len(questions)]
+		}
+		close(work)
+		wg.Wait()
+		close(samples)
+	}()
+
+	start := time.Now()
+	var results []sample
+	for s := range samples {
+		results = append(results, s)
+		if len(results)%50 == 0 {
+			fmt.Fprintf(os.Stderr, "%d/%d requests\n", len(results), *requests)
+		}
+	}
+	report(os.Stdout, results, time.Since(start))
+	return nil
+}
+
+// readQuestions reads a question file. Lines starting with "{" are sent as
+// chat requests as they are, other lines as {"msg": line}.
+func readQuestions(path string) ([]json.RawMessage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read questions: %v", err)
+	}
+	var questions []json.RawMessage
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "{"):
+			if !json.Valid([]byte(line)) {
+				return nil, fmt.Errorf("%s:%d: invalid JSON", path, i+1)
+			}
+			questions = append(questions, json.RawMessage(line))
+		default:
+			body, _ := json.Marshal(map[string]string{"msg": line})
+			questions = append(questions, body)
+		}
+	}
+	if len(questions) == 0 {
+		return nil, fmt.Errorf("no questions in %s", path)
+	}
+	return questions, nil
+}
+
+// streamChat sends one chat request and times its stages: the wait before
+// the first stage starts, retrieval up to generation, the time to the first
+// answer text, generation and the whole request.
+func streamChat(client *http.Client, url string, body json.RawMessage) sample {
+	start := time.Now()
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return sample{err: "request failed"}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return sample{err: fmt.Sprintf("status %d", resp.StatusCode)}
+	}
+
+	var started, searching, answering, firstDelta time.Time
+	var event string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if name, ok := strings.CutPrefix(line, "event:"); ok {
+			event = name
+			continue
+		}
+		data, ok := strings.CutPrefix(line, "data:")
+		if !ok {
+			continue
+		}
+		now := time.Now()
+		switch event {
+		case "status":
+			var status struct {
+				Stage string `json:"stage"`
+			}
+			json.Unmarshal([]byte(data), &status)
+			if started.IsZero() {
+				started = now
+			}
+			switch status.Stage {
+			case "searching":
+				searching = now
+			case "answering", "agent":
+				answering = now
+			}
+		case "delta":
+			if firstDelta.IsZero() {
+				firstDelta = now
+			}
+		case "error":
+			return sample{err: "error event"}
+		case "done":
+			s := sample{stages: map[string]time.Duration{"total": now.Sub(start)}}
+			if !started.IsZero() {
+				s.stages["queue"] = started.Sub(start)
+			}
+			if !searching.IsZero() && !answering.IsZero() {
+				s.stages["retrieval"] = answering.Sub(searching)
+			}
+			if !answering.IsZero() && !firstDelta.IsZero() {
+				s.stages["first_token"] = firstDelta.Sub(answering)
+				s.stages["generation"] = now.Sub(firstDelta)
+			}
+			return s
+		}
+	}
+	if scanner.Err() != nil {
+		return sample{err: "stream interrupted"}
+	}
+	return sample{err: "stream ended without done"}
+}
+
+// report prints the latency percentiles of each stage, the throughput and
+// the errors by kind.
+func report(out io.Writer, results []sample, elapsed time.Duration) {
+	durations := map[string][]time.Duration{}
+	kinds := map[string]int{}
+	failed := 0
+	for _, s := range results {
+		if s.err != "" {
+			kinds[s.err]++
+			failed++
+			continue
+		}
+		for stage, d := range s.stages {
+			durations[stage] = append(durations[stage], d)
+		}
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "stage\tcount\tp50\tp95\tp99\t")
+	for _, stage := range stages {
+		values := durations[stage]
+		if len(values) == 0 {
+			continue
+		}
+		sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t\n", stage, len(values),
+			percentile(values, 0.5), percentile(values, 0.95), percentile(values, 0.99))
+	}
+	w.Flush()
+
+	fmt.Fprintf(out, "\n%d requests in %s, %.2f/s\n", len(results), elapsed.Round(time.Millisecond),
+		float64(len(results))/elapsed.Seconds())
+	if len(results) > 0 {
+		fmt.Fprintf(out, "errors: %d (%.1f%%)\n", failed, float64(failed)*100/float64(len(results)))
+	}
+	for kind, count := range kinds {
+		fmt.Fprintf(out, "  %s: %d\n", kind, count)
+	}
+}
+
+// percentile picks the nearest-rank percentile of sorted values.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted))*p+0.5) - 1
+	i = max(0, min(i, len(sorted)-1))
+	return sorted[i].Round(time.Millisecond)
+}
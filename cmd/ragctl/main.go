@@ -0,0 +1,38 @@
+// Command ragctl holds operational tools for a running langchainGORAG
+// server.
+//
+//	ragctl loadtest -questions questions.txt -concurrency 16 -requests 500
+//	ragctl migrate -backend postgres -url 'postgres://rag@db/rag'
+//	ragctl migrate-embeddings -alias rag -target rag_m3 -model bge-m3 -rate 200
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "loadtest":
+		err = loadtest(os.Args[2:])
+	case "migrate":
+		err = migrate(os.Args[2:])
+	case "migrate-embeddings":
+		err = migrateEmbeddings(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: ragctl loadtest|migrate|migrate-embeddings [flags]")
+	os.Exit(2)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	_ "github.com/lib/pq"           // postgres driver
+	_ "github.com/mattn/go-sqlite3" // sqlite3 driver
+
+	"langchainRAG/migrations"
+)
+
+// migrate applies the pending migrations of the metadata store, or with
+// -status lists every migration and when it was applied.
+func migrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	backend := flags.String("backend", "sqlite", `metadata backend, "sqlite" or "postgres"`)
+	path := flags.String("path", "metadata.db", "SQLite database file")
+	url := flags.String("url", "", "Postgres connection string; ${VAR} references are expanded")
+	status := flags.Bool("status", false, "list the migrations instead of applying them")
+	flags.Parse(args)
+
+	var db *sql.DB
+	var err error
+	switch *backend {
+	case "sqlite":
+		db, err = sql.Open("sqlite3", *path)
+	case "postgres":
+		if *url == "" {
+			return fmt.Errorf("-url is required for postgres")
+		}
+		db, err = sql.Open("postgres", os.ExpandEnv(*url))
+	default:
+		return fmt.Errorf("unknown backend %q", *backend)
+	}
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	if *status {
+		statuses, err := migrations.List(ctx, db)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "version\tname\tapplied")
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Local().Format(time.DateTime)
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		return w.Flush()
+	}
+
+	applied, err := migrations.Up(ctx, db, *backend == "postgres")
+	for _, m := range applied {
+		fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+	}
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		fmt.Println("no pending migrations")
+	}
+	return nil
+}
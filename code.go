@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/tmc/langchaingo/schema"
+)
+
+// codePattern matches a line that starts a declaration of kind; the first
+// group is the symbol name.
+type codePattern struct {
+	kind string
+	re   *regexp.Regexp
+}
+
+type codeLanguage struct {
+	name     string
+	patterns []codePattern
+	prefixes []string // Comment, decorator and annotation lines kept with the declaration below them
+}
+
+var (
+	goLanguage = codeLanguage{
+		name: "go",
+		patterns: []codePattern{
+			{"function", regexp.MustCompile(`^func\s+(?:\([^)]*\)\s*)?([A-Za-z_]\w*)`)},
+			{"type", regexp.MustCompile(`^type\s+([A-Za-z_]\w*)`)},
+		},
+		prefixes: []string{"//"},
+	}
+	pythonLanguage = codeLanguage{
+		name: "python",
+		patterns: []codePattern{
+			{"function", regexp.MustCompile(`^(?:async\s+)?def\s+(\w+)`)},
+			{"class", regexp.MustCompile(`^class\s+(\w+)`)},
+		},
+		prefixes: []string{"#", "@"},
+	}
+	javascriptPatterns = []codePattern{
+		{"function", regexp.MustCompile(`^(?:export\s+)?(?:default\s+)?(?:async\s+)?function\*?\s+(\w+)`)},
+		{"function", regexp.MustCompile(`^(?:export\s+)?(?:const|let)\s+(\w+)\s*=\s*(?:async\s*)?(?:\([^)]*\)|\w+)\s*=>`)},
+		{"class", regexp.MustCompile(`^(?:export\s+)?(?:default\s+)?(?:abstract\s+)?class\s+(\w+)`)},
+		{"type", regexp.MustCompile(`^(?:export\s+)?(?:interface|type|enum)\s+(\w+)`)},
+	}
+	javascriptPrefixes = []string{"//", "/*", "*", "@"}
+	rustLanguage       = codeLanguage{
+		name: "rust",
+		patterns: []codePattern{
+			{"function", regexp.MustCompile(`^(?:pub(?:\([^)]*\))?\s+)?(?:const\s+)?(?:async\s+)?(?:unsafe\s+)?fn\s+(\w+)`)},
+			{"type", regexp.MustCompile(`^(?:pub(?:\([^)]*\))?\s+)?(?:struct|enum|trait|union)\s+(\w+)`)},
+			{"impl", regexp.MustCompile(`^impl(?:<[^>]*>)?\s+(?:[\w:<>]+\s+for\s+)?([\w:]+)`)},
+		},
+		prefixes: []string{"//", "#["},
+	}
+	// Java and Ruby wrap methods in classes, so their methods are split out too.
+	javaLanguage = codeLanguage{
+		name: "java",
+		patterns: []codePattern{
+			{"class", regexp.MustCompile(`^(?:(?:public|protected|private|abstract|final|static|sealed)\s+)*(?:class|interface|enum|record)\s+(\w+)`)},
+			{"method", regexp.MustCompile(`^(?:    |\t)(?:(?:public|protected|private|static|final|abstract|synchronized|default)\s+)+[\w<>\[\],.? ]+?\s+(\w+)\s*\(`)},
+		},
+		prefixes: []string{"//", "/*", "*", "@"},
+	}
+	rubyLanguage = codeLanguage{
+		name: "ruby",
+		patterns: []codePattern{
+			{"class", regexp.MustCompile(`^\s*(?:class|module)\s+([\w:]+)`)},
+			{"method", regexp.MustCompile(`^\s*def\s+(?:self\.)?(\w+[?!=]?)`)},
+		},
+		prefixes: []string{"#"},
+	}
+)
+
+var codeLanguages = map[string]codeLanguage{
+	".go":   goLanguage,
+	".py":   pythonLanguage,
+	".js":   {name: "javascript", patterns: javascriptPatterns, prefixes: javascriptPrefixes},
+	".jsx":  {name: "javascript", patterns: javascriptPatterns, prefixes: javascriptPrefixes},
+	".mjs":  {name: "javascript", patterns: javascriptPatterns, prefixes: javascriptPrefixes},
+	".ts":   {name: "typescript", patterns: javascriptPatterns, prefixes: javascriptPrefixes},
+	".tsx":  {name: "typescript", patterns: javascriptPatterns, prefixes: javascriptPrefixes},
+	".rs":   rustLanguage,
+	".java": javaLanguage,
+	".rb":   rubyLanguage,
+}
+
+func isCodeFile(path string) bool {
+	_, ok := codeLanguages[strings.ToLower(filepath.Ext(path))]
+	return ok
+}
+
+// loadCode splits a source file at its declarations into one document per
+// function, type, class or method, each with the comments and decorators
+// directly above it. Code before the first declaration (package clause,
+// imports) becomes a "preamble" document. Documents carry "path",
+// "code_language", "symbol", "symbol_kind", "start_line" and "end_line".
+func loadCode(filename string) ([]schema.Document, error) {
+	language, ok := codeLanguages[strings.ToLower(filepath.Ext(filename))]
+	if !ok {
+		return nil, fmt.Errorf("unsupported source file %s", filename)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+
+	type segment struct {
+		start        int
+		symbol, kind string
+	}
+	segments := []segment{{start: 0, kind: "preamble"}}
+	for i, line := range lines {
+		for _, pattern := range language.patterns {
+			match := pattern.re.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+			start := i
+			for start > segments[len(segments)-1].start && language.isPrefixLine(lines[start-1]) {
+				start--
+			}
+			segments = append(segments, segment{start: start, symbol: match[1], kind: pattern.kind})
+			break
+		}
+	}
+
+	var docs []schema.Document
+	for i, seg := range segments {
+		end := len(lines)
+		if i+1 < len(segments) {
+			end = segments[i+1].start
+		}
+		text := strings.TrimRight(strings.Join(lines[seg.start:end], "\n"), "\n ")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		docs = append(docs, schema.Document{
+			PageContent: fmt.Sprintf("File: %s\n%s", filename, text),
+			Metadata: map[string]any{
+				"source":        filename,
+				"path":          filename,
+				"code_language": language.name,
+				"symbol":        seg.symbol,
+				"symbol_kind":   seg.kind,
+				"start_line":    seg.start + 1,
+				"end_line":      seg.start + strings.Count(text, "\n") + 1,
+			},
+		})
+	}
+
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("no code in %s", filename)
+	}
+	return docs, nil
+}
+
+func (l codeLanguage) isPrefixLine(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	for _, prefix := range l.prefixes {
+		if strings.HasPrefix(trimmed, prefix) {
+			return true
+		}
+	}
+	return false
+}
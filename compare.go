@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/tmc/langchaingo/schema"
+	"github.com/tmc/langchaingo/vectorstores"
+)
+
+const compareSystemMessage = "The relevant information is split into one part per compared item. " +
+	"Use each part only for the item it is about, and say so when a part lacks what the comparison needs rather than filling it in from another."
+
+type CompareConfig struct {
+	MaxEntities     int    `json:"max_entities"`      // Items compared at most; further ones are left out
+	ChunksPerEntity int    `json:"chunks_per_entity"` // Retrieved for each item
+	EntityField     string `json:"entity_field"`      // Payload field chunks are filtered on by item, e.g. "entities" from enrichment; empty filters nothing
+}
+
+func validateCompare(cfg CompareConfig) error {
+	if cfg.MaxEntities < 2 {
+		return fmt.Errorf("compare.max_entities must be at least 2")
+	}
+	if cfg.ChunksPerEntity <= 0 {
+		return fmt.Errorf("compare.chunks_per_entity must be positive")
+	}
+	return nil
+}
+
+// Comparison is how the context of a comparison was retrieved.
+type Comparison struct {
+	Aspect   string           `json:"aspect,omitempty"` // What the items are compared on
+	Entities []ComparedEntity `json:"entities"`
+}
+
+type ComparedEntity struct {
+	Name     string `json:"name"`
+	Chunks   int    `json:"chunks"`
+	Filtered bool   `json:"filtered"` // The chunks were filtered on compare.entity_field; false when none matched the item and they were searched by name alone
+}
+
+// planComparison extracts the items a comparison question is about and what
+// they are compared on, falling back to the indexed entities it names,
+// known. It returns nil when the question names fewer than two, which is
+// answered with rag instead.
+func planComparison(ctx context.Context, llm Generator, msg Message, known []string) *Comparison {
+	prompt := "The question below compares several items, e.g. people, products or documents. List the items as they are named, " +
+		"and what they are compared on. Respond with JSON of the form {\"entities\": [\"...\"], \"aspect\": \"...\"}.\n\nQuestion:\n" + msg.Msg
+
+	var result struct {
+		Entities []string `json:"entities"`
+		Aspect   string   `json:"aspect"`
+	}
+	if err := generateJSON(ctx, llm, prompt, &result); err != nil {
+		log.Printf("Failed to extract the items to compare: %v", err)
+	}
+	if len(result.Entities) < 2 {
+		result.Entities = known
+	}
+	comparison := &Comparison{Aspect: strings.TrimSpace(result.Aspect)}
+	seen := map[string]bool{}
+	for _, name := range result.Entities {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[strings.ToLower(name)] {
+			continue
+		}
+		seen[strings.ToLower(name)] = true
+		comparison.Entities = append(comparison.Entities, ComparedEntity{Name: name})
+	}
+	if len(comparison.Entities) < 2 {
+		log.Printf("Question %q names fewer than two items to compare, answering with rag", msg.Msg)
+		return nil
+	}
+	if limit := getConfig().Compare.MaxEntities; len(comparison.Entities) > limit {
+		comparison.Entities = comparison.Entities[:limit]
+	}
+	return comparison
+}
+
+// answerComparison retrieves the context of each compared item on its own,
+// so that one item's chunks cannot crowd out another's, and answers from a
+// prompt with the contexts kept apart.
+func answerComparison(ctx context.Context, ollamaLLM Generator, store vectorstores.VectorStore, msg Message, comparison *Comparison, stream *answerStream) (string, []schema.Document, error) {
+	cfg := getConfig().Compare
+	var docs, parts []schema.Document
+	seen := map[any]bool{}
+	for i := range comparison.Entities {
+		entity := &comparison.Entities[i]
+		query := strings.TrimSpace(entity.Name + " " + comparison.Aspect)
+		found, err := searchEntity(ctx, ollamaLLM, store, msg, entity, query, cfg)
+		if err != nil {
+			return "", nil, err
+		}
+		entity.Chunks = len(found)
+
+		var part strings.Builder
+		fmt.Fprintf(&part, "Information about %s:\n", entity.Name)
+		for _, doc := range found {
+			part.WriteString(doc.PageContent)
+			part.WriteString("\n")
+			if id, ok := doc.Metadata["id"]; ok {
+				if seen[id] {
+					continue
+				}
+				seen[id] = true
+			}
+			docs = append(docs, doc)
+		}
+		if len(found) == 0 {
+			part.WriteString("Nothing was found.\n")
+		}
+		parts = append(parts, schema.Document{PageContent: part.String()})
+	}
+	stream.sources(docs)
+	stream.status(StageAnswering)
+
+	template := msg.variant.promptTemplate(queryLanguage(msg)).render(msg)
+	template.SystemMessage += "\n\n" + compareSystemMessage
+	prompt, err := runPromptHooks(ctx, constructPrompt(conversation(msg), parts, msg.Msg, template))
+	if err != nil {
+		return "", nil, err
+	}
+	response, err := generate(ctx, ollamaLLM, prompt, stream.options(generationOptions(msg))...)
+	return response, docs, err
+}
+
+// searchEntity retrieves the chunks on one compared item: those whose
+// compare.entity_field holds its name when the field is set, else or when
+// none does, those best matching its name.
+func searchEntity(ctx context.Context, ollamaLLM Generator, store vectorstores.VectorStore, msg Message, entity *ComparedEntity, query string, cfg CompareConfig) ([]schema.Document, error) {
+	if cfg.EntityField != "" {
+		filtered := msg
+		filtered.Filter = map[string]any{cfg.EntityField: strings.ToLower(entity.Name)}
+		for key, value := range msg.Filter {
+			filtered.Filter[key] = value
+		}
+		found, err := searchChunks(ctx, ollamaLLM, store, filtered, query, cfg.ChunksPerEntity, nil)
+		if err != nil || len(found) > 0 {
+			entity.Filtered = len(found) > 0
+			return found, err
+		}
+	}
+	return searchChunks(ctx, ollamaLLM, store, msg, query, cfg.ChunksPerEntity, nil)
+}
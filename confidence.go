@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/tmc/langchaingo/schema"
+)
+
+const (
+	ConfidenceLow    = "low"
+	ConfidenceMedium = "medium"
+	ConfidenceHigh   = "high"
+)
+
+// Confidence estimates how well an answer is supported. Score is between 0
+// and 1; Level buckets it for display.
+type Confidence struct {
+	Score        float64  `json:"score"`
+	Level        string   `json:"level"`
+	Retrieval    float64  `json:"retrieval"`              // From the similarity scores of the retrieved chunks
+	Faithfulness *float64 `json:"faithfulness,omitempty"` // Share of the answer the model judged supported by the chunks
+}
+
+type ConfidenceConfig struct {
+	Enabled           bool    `json:"enabled"`            // Return a confidence estimate with rag answers
+	FaithfulnessCheck bool    `json:"faithfulness_check"` // Also ask the model whether the answer is supported; one more call per answer
+	High              float64 `json:"high"`               // Scores from here on are "high"
+	Low               float64 `json:"low"`                // Scores below this are "low"
+}
+
+func validateConfidence(cfg ConfidenceConfig) error {
+	if cfg.Low < 0 || cfg.High > 1 || cfg.Low > cfg.High {
+		return fmt.Errorf("confidence thresholds must satisfy 0 <= low <= high <= 1")
+	}
+	return nil
+}
+
+// estimateConfidence combines the best and the average similarity of the
+// retrieved chunks with, if faithfulness is set, a check of the answer.
+// Answers that decline ("I don't know") are capped below the low threshold.
+func estimateConfidence(ctx context.Context, llm Generator, answer string, docs []schema.Document, faithfulness bool) Confidence {
+	cfg := getConfig().Confidence
+
+	var confidence Confidence
+	if len(docs) > 0 {
+		var top, sum float64
+		for _, doc := range docs {
+			score := clamp01(float64(doc.Score))
+			top = math.Max(top, score)
+			sum += score
+		}
+		confidence.Retrieval = 0.7*top + 0.3*sum/float64(len(docs))
+	}
+	confidence.Score = confidence.Retrieval
+
+	if faithfulness && len(docs) > 0 {
+		if faithfulness, err := checkFaithfulness(ctx, llm, answer, docs); err == nil {
+			confidence.Faithfulness = &faithfulness
+			confidence.Score = (confidence.Retrieval + faithfulness) / 2
+		}
+	}
+
+	if isAbstention(answer) {
+		confidence.Score = math.Min(confidence.Score, cfg.Low/2)
+	}
+
+	switch {
+	case confidence.Score >= cfg.High:
+		confidence.Level = ConfidenceHigh
+	case confidence.Score >= cfg.Low:
+		confidence.Level = ConfidenceMedium
+	default:
+		confidence.Level = ConfidenceLow
+	}
+	return confidence
+}
+
+func checkFaithfulness(ctx context.Context, llm Generator, answer string, docs []schema.Document) (float64, error) {
+	var sources strings.Builder
+	for _, doc := range docs {
+		sources.WriteString(doc.PageContent)
+		sources.WriteString("\n")
+	}
+	prompt := fmt.Sprintf("Judge how much of the answer below is supported by the information below. "+
+		"Respond with JSON of the form {\"supported\": 0.0} where supported is between 0 (nothing) and 1 (everything)."+
+		"\n\nInformation:\n%s\nAnswer:\n%s", sources.String(), answer)
+
+	var result struct {
+		Supported *float64 `json:"supported"`
+	}
+	if err := generateJSON(ctx, llm, prompt, &result); err != nil {
+		return 0, err
+	}
+	if result.Supported == nil {
+		return 0, fmt.Errorf("no faithfulness score in model response")
+	}
+	return clamp01(*result.Supported), nil
+}
+
+func isAbstention(answer string) bool {
+	answer = strings.ToLower(answer)
+	return strings.Contains(answer, "i don't know") || strings.Contains(answer, "i do not know")
+}
+
+func clamp01(x float64) float64 {
+	return math.Min(1, math.Max(0, x))
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const defaultConfigPath = "config.json"
+
+// Config holds the deployment settings read from config.json (or the file
+// named by RAG_CONFIG). Missing fields keep their defaults.
+type Config struct {
+	LLM          LLMConfig          `json:"llm"`
+	Enrichment   EnrichmentConfig   `json:"enrichment"`
+	Doc2Query    Doc2QueryConfig    `json:"doc2query"`
+	SQL          SQLConfig          `json:"sql"`
+	Chunking     ChunkingConfig     `json:"chunking"`
+	OCR          OCRConfig          `json:"ocr"`
+	Multilingual MultilingualConfig `json:"multilingual"`
+	Embedding    EmbeddingConfig    `json:"embedding"`
+	Hooks        []HookConfig       `json:"hooks"`
+	Processors   []ProcessorConfig  `json:"processors"`
+	VectorStore  VectorStoreConfig  `json:"vector_store"`
+	GC           GCConfig           `json:"gc"`
+	Scoring      ScoringConfig      `json:"scoring"`
+	Router       RouterConfig       `json:"router"`
+	Datasets     []Dataset          `json:"datasets"`
+	FollowUps    FollowUpConfig     `json:"follow_ups"`
+	Confidence   ConfidenceConfig   `json:"confidence"`
+	Highlights   HighlightConfig    `json:"highlights"`
+	Memory       MemoryConfig       `json:"memory"`
+	Git          GitConfig          `json:"git"`
+	Crawl        CrawlConfig        `json:"crawl"`
+	Feeds        FeedsConfig        `json:"feeds"`
+	API          APIConfig          `json:"api"`
+	Stream       StreamConfig       `json:"stream"`
+	Postgres     PostgresConfig     `json:"postgres"`
+	Audit        AuditConfig        `json:"audit"`
+	Experiments  ExperimentConfig   `json:"experiments"`
+	State        StateConfig        `json:"state"`
+	WarmUp       WarmUpConfig       `json:"warm_up"`
+	Ingest       IngestConfig       `json:"ingest"`
+	Admin        AdminConfig        `json:"admin"`
+	Breakers     BreakerConfig      `json:"breakers"`
+	Degraded     DegradedConfig     `json:"degraded"`
+	Metadata     MetadataConfig     `json:"metadata"`
+	Prompts      PromptsConfig      `json:"prompts"`
+	Glossary     GlossaryConfig     `json:"glossary"`
+	Normalize    NormalizeConfig    `json:"normalize"`
+	Clarify      ClarifyConfig      `json:"clarify"`
+	Flags        FlagsConfig        `json:"flags"`
+	Stats        StatsConfig        `json:"stats"`
+	Gaps         GapsConfig         `json:"gaps"`
+	Analytics    AnalyticsConfig    `json:"analytics"`
+	Retention    RetentionConfig    `json:"retention"`
+	TLS          TLSConfig          `json:"tls"`
+	Secrets      SecretsConfig      `json:"secrets"`
+	Limits       LimitsConfig       `json:"limits"`
+	Scan         ScanConfig         `json:"scan"`
+	Repeats      RepeatsConfig      `json:"repeats"`
+	Consistency  ConsistencyConfig  `json:"self_consistency"`
+	Summaries    SummariesConfig    `json:"summaries"`
+	Corpus       CorpusConfig       `json:"corpus"`
+	Compare      CompareConfig      `json:"compare"`
+	Entities     EntitiesConfig     `json:"entities"`
+	Graph        GraphConfig        `json:"graph"`
+	Temporal     TemporalConfig     `json:"temporal"`
+	Numeric      NumericConfig      `json:"numeric"`
+
+	LateInteraction LateInteractionConfig `json:"late_interaction"`
+
+	PayloadSchemas map[string]PayloadSchema `json:"payload_schemas"` // By collection
+}
+
+type LLMConfig struct {
+	Model          string `json:"model"`           // Ollama model used for answers, enrichment and embeddings
+	VisionModel    string `json:"vision_model"`    // Model used when a chat message has images
+	VisionProvider string `json:"vision_provider"` // "ollama" or "openai" (reads OPENAI_API_KEY)
+
+	MaxTokens        int `json:"max_tokens"`         // Cap and default for a chat request's max_tokens; 0 for none
+	MaxStopSequences int `json:"max_stop_sequences"` // Cap on a chat request's stop sequences; 0 for none
+	MaxConcurrent    int `json:"max_concurrent"`     // Answers generated at once, others queue; 0 means no limit
+
+	Ollama ProviderConfig `json:"ollama"`
+	OpenAI ProviderConfig `json:"openai"`
+}
+
+type EnrichmentConfig struct {
+	Extractors  []string `json:"extractors"`   // Extractors run on every chunk unless the ingest request overrides them
+	MaxKeywords int      `json:"max_keywords"` // Keywords kept per chunk by the keywords extractor
+}
+
+type Doc2QueryConfig struct {
+	Questions int    `json:"questions"` // Synthetic questions generated per chunk, 0 disables
+	Mode      string `json:"mode"`      // "alongside" or "instead"
+}
+
+type SQLConfig struct {
+	Path string `json:"path"` // SQLite database tabular sources are loaded into for the agent's SQL tool
+}
+
+type ChunkingConfig struct {
+	Size    int `json:"size"`    // Maximum chunk length in characters for prose sources (HTML, EPUB, email, PDF, images)
+	Overlap int `json:"overlap"` // Characters shared by consecutive chunks
+
+	StitchNeighbors bool `json:"stitch_neighbors"` // Merge retrieved chunks that are adjacent in their source
+
+	Strategy          string  `json:"strategy"`           // "recursive" or "semantic"; ingest requests may override it
+	SemanticThreshold float64 `json:"semantic_threshold"` // Semantic chunking starts a new chunk below this sentence similarity
+}
+
+type OCRConfig struct {
+	Engine        string  `json:"engine"`         // "tesseract" or "remote"
+	Language      string  `json:"language"`       // Tesseract language, e.g. "eng" or "eng+deu"
+	RemoteURL     string  `json:"remote_url"`     // OCR service for the remote engine
+	APIKey        string  `json:"api_key"`        // Bearer token for the OCR service, with environment variables expanded
+	MinConfidence float64 `json:"min_confidence"` // Pages below this mean word confidence are flagged
+	MinPageText   int     `json:"min_page_text"`  // PDF pages with less extractable text are OCR'd
+}
+
+type MultilingualConfig struct {
+	Enabled         bool                      `json:"enabled"`          // Instruct the model to answer in the query language
+	DefaultLanguage string                    `json:"default_language"` // Used when the query language cannot be detected
+	TranslateChunks bool                      `json:"translate_chunks"` // Translate retrieved chunks written in another language
+	Templates       map[string]PromptTemplate `json:"templates"`        // Prompt template variants by language code
+}
+
+type VectorStoreConfig struct {
+	Backend  string        `json:"backend"`   // "qdrant" or "redis"
+	RedisURL string        `json:"redis_url"` // Redis Stack URL, e.g. "redis://localhost:6379"
+	Qdrant   QdrantConfig  `json:"qdrant"`
+	Milvus   MilvusConfig  `json:"milvus"`
+	Elastic  ElasticConfig `json:"elastic"`
+
+	SQLitePath string `json:"sqlite_path"` // sqlite-vec database; defaults to sql.path so everything lives in one file
+}
+
+type GCConfig struct {
+	IntervalMinutes int `json:"interval_minutes"` // Remove chunks of deleted source files periodically; 0 disables
+	RetentionDays   int `json:"retention_days"`   // Soft-deleted documents are purged by GC after this many days
+}
+
+type EmbeddingConfig struct {
+	Model      string `json:"model"`      // Ollama embedding model, e.g. "bge-m3"; defaults to llm.model
+	Dimensions int    `json:"dimensions"` // Vector size; probed from the model when 0
+	Collection string `json:"collection"` // Qdrant collection chunks are stored in
+}
+
+// defaultConfig returns the defaults in a new Config, so that unmarshalling a
+// file into it cannot change the slices of the next one.
+func defaultConfig() Config {
+	return Config{
+		LLM: LLMConfig{
+			Model:            "llama3",
+			VisionModel:      "llava",
+			VisionProvider:   VisionProviderOllama,
+			MaxTokens:        1024,
+			MaxStopSequences: 4,
+		},
+		Enrichment: EnrichmentConfig{
+			Extractors:  []string{},
+			MaxKeywords: 8,
+		},
+		Doc2Query: Doc2QueryConfig{
+			Questions: 0,
+			Mode:      QuestionsAlongside,
+		},
+		SQL: SQLConfig{
+			Path: "tabular.db",
+		},
+		Chunking: ChunkingConfig{
+			Size:            1000,
+			Overlap:         200,
+			StitchNeighbors: true,
+
+			Strategy:          ChunkingRecursive,
+			SemanticThreshold: 0.5,
+		},
+		OCR: OCRConfig{
+			Engine:        OCREngineTesseract,
+			Language:      "eng",
+			MinConfidence: 60,
+			MinPageText:   20,
+		},
+		Multilingual: MultilingualConfig{
+			Enabled:         true,
+			DefaultLanguage: "en",
+		},
+		Embedding: EmbeddingConfig{
+			Collection: collectionName,
+		},
+		GC: GCConfig{
+			RetentionDays: 30,
+		},
+		Scoring: ScoringConfig{
+			Recency: RecencyConfig{
+				Field:  "updated_at",
+				Weight: 0.5,
+			},
+		},
+		Router: RouterConfig{
+			Enabled:        true,
+			Classifier:     ClassifierRules,
+			DatasetRouting: DatasetRoutingEmbedding,
+			MaxDatasets:    2,
+			MinQueryTerms:  1,
+		},
+		FollowUps: FollowUpConfig{
+			Count: 3,
+		},
+		Confidence: ConfidenceConfig{
+			Enabled: true,
+			High:    0.7,
+			Low:     0.4,
+		},
+		Highlights: HighlightConfig{
+			Method:        HighlightEmbedding,
+			MinSimilarity: 0.6,
+		},
+		Memory: MemoryConfig{
+			MaxTokens:        1000,
+			MaxRequestTokens: 4000,
+			MaxTurns:         100,
+			MaxMessages:      500,
+			MaxFacts:         20,
+			MaxFactLength:    300,
+		},
+		Git: GitConfig{
+			Directory: "repos",
+		},
+		Crawl: CrawlConfig{
+			UserAgent: "langchainGORAG-crawler/1.0",
+			MaxPages:  200,
+			MaxDepth:  2,
+			DelayMS:   500,
+		},
+		Feeds: FeedsConfig{
+			IntervalMinutes: 30,
+			RetentionDays:   30,
+		},
+		API: APIConfig{
+			MaxPages: 50,
+		},
+		Stream: StreamConfig{
+			Group:     "langchainGORAG",
+			BatchSize: 32,
+			FlushMS:   1000,
+		},
+		Postgres: PostgresConfig{
+			Channel: "rag_changes",
+		},
+		Experiments: ExperimentConfig{
+			Header: "X-RAG-Variant",
+			Canary: CanaryConfig{
+				MinRequests: 50,
+				MinFeedback: 20,
+			},
+		},
+		State: StateConfig{
+			Backend:      StateMemory,
+			Prefix:       "rag:",
+			LeaseSeconds: 30,
+		},
+		WarmUp: WarmUpConfig{
+			TimeoutSeconds: 120,
+		},
+		Ingest: IngestConfig{
+			Root:           "data",
+			BatchSize:      64,
+			Retries:        2,
+			RetryBackoffMS: 500,
+		},
+		Admin: AdminConfig{
+			StatsIntervalSeconds: 30,
+		},
+		Breakers: BreakerConfig{
+			Failures:        5,
+			CooldownSeconds: 30,
+		},
+		Degraded: DegradedConfig{
+			Message: "The model is unavailable right now, so here are the most relevant excerpts instead:",
+		},
+		Prompts: PromptsConfig{
+			MaxExamples:       4,
+			MaxVariableLength: 200,
+			CurrentTime:       true,
+		},
+		Normalize: NormalizeConfig{
+			Lowercase:  true,
+			SpellCheck: true,
+			MinCount:   3,
+		},
+		Flags: FlagsConfig{
+			Header: "X-RAG-Flags",
+		},
+		Stats: StatsConfig{
+			Enabled:   true,
+			Top:       10,
+			Documents: true,
+		},
+		Gaps: GapsConfig{
+			Enabled:       true,
+			LowConfidence: true,
+		},
+		Analytics: AnalyticsConfig{
+			BatchSize:    500,
+			FlushSeconds: 10,
+			BufferSize:   10000,
+		},
+		Retention: RetentionConfig{
+			IntervalMinutes: 60,
+		},
+		Secrets: SecretsConfig{
+			RefreshMinutes: 60,
+		},
+		Limits: LimitsConfig{
+			ChatBytes:    10 << 20,
+			UploadBytes:  100 << 20,
+			RequestBytes: 1 << 20,
+		},
+		Scan: ScanConfig{
+			TimeoutSeconds: 60,
+		},
+		Repeats: RepeatsConfig{
+			Similarity: 0.95,
+		},
+		Consistency: ConsistencyConfig{
+			Samples:     1,
+			MaxSamples:  5,
+			Temperature: 0.8,
+		},
+		Summaries: SummariesConfig{
+			Words:         200,
+			MaxWords:      1000,
+			BatchChunks:   8,
+			DensityRounds: 2,
+			MaxChunks:     2000,
+		},
+		Corpus: CorpusConfig{
+			BatchChunks:    10,
+			MaxChunks:      500,
+			Concurrency:    2,
+			TimeoutSeconds: 300,
+		},
+		Compare: CompareConfig{
+			MaxEntities:     4,
+			ChunksPerEntity: 4,
+			EntityField:     "entities",
+		},
+		Graph: GraphConfig{
+			TriplesPerChunk: 10,
+			Hops:            2,
+			MaxTriples:      30,
+			MaxChunks:       3,
+		},
+		Temporal: TemporalConfig{
+			Fields: []string{"date"},
+		},
+		LateInteraction: LateInteractionConfig{
+			Candidates: 100,
+		},
+		Clarify: ClarifyConfig{
+			ScoreMargin: 0.05,
+			MaxOverlap:  0.2,
+			MaxOptions:  3,
+			TTLSeconds:  600,
+		},
+		Metadata: MetadataConfig{
+			Backend: MetadataSQLite,
+			Path:    "metadata.db",
+			Migrate: true,
+		},
+		VectorStore: VectorStoreConfig{
+			Backend: StoreQdrant,
+			Qdrant:  defaultQdrantConfig,
+			Milvus:  defaultMilvusConfig,
+			Elastic: defaultElasticConfig,
+		},
+	}
+}
+
+var (
+	config   = defaultConfig()
+	configMu sync.RWMutex
+)
+
+func getConfig() Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return config
+}
+
+func configPath() string {
+	if path := os.Getenv("RAG_CONFIG"); path != "" {
+		return path
+	}
+	return defaultConfigPath
+}
+
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse config %s: %v", path, err)
+	}
+
+	if cfg.LLM.MaxConcurrent < 0 {
+		return cfg, fmt.Errorf("llm.max_concurrent must not be negative")
+	}
+	if cfg.LLM.MaxTokens < 0 || cfg.LLM.MaxStopSequences < 0 {
+		return cfg, fmt.Errorf("llm.max_tokens and max_stop_sequences must not be negative")
+	}
+	for _, name := range cfg.Enrichment.Extractors {
+		if _, ok := extractorFactories[name]; !ok {
+			return cfg, fmt.Errorf("unknown extractor %q in config", name)
+		}
+	}
+
+	if err := validateDoc2Query(cfg.Doc2Query.Questions, cfg.Doc2Query.Mode); err != nil {
+		return cfg, err
+	}
+	if err := validateChunking(cfg.Chunking.Size, cfg.Chunking.Overlap); err != nil {
+		return cfg, err
+	}
+	if s := cfg.Chunking.Strategy; s != ChunkingRecursive && s != ChunkingSemantic {
+		return cfg, fmt.Errorf("unknown chunking strategy %q", s)
+	}
+	if t := cfg.Chunking.SemanticThreshold; t < -1 || t > 1 {
+		return cfg, fmt.Errorf("chunking.semantic_threshold must be between -1 and 1")
+	}
+	if err := validateVectorStore(cfg.VectorStore); err != nil {
+		return cfg, err
+	}
+	if err := validateRouter(cfg.Router); err != nil {
+		return cfg, err
+	}
+	if err := validateDatasets(cfg.Datasets); err != nil {
+		return cfg, err
+	}
+	if err := validateFollowUps(cfg.FollowUps); err != nil {
+		return cfg, err
+	}
+	if err := validateConfidence(cfg.Confidence); err != nil {
+		return cfg, err
+	}
+	if err := validateHighlights(cfg.Highlights); err != nil {
+		return cfg, err
+	}
+	if err := validateMemory(cfg.Memory); err != nil {
+		return cfg, err
+	}
+	if err := validateFeeds(cfg.Feeds); err != nil {
+		return cfg, err
+	}
+	if err := validateAPISources(cfg.API.Sources); err != nil {
+		return cfg, err
+	}
+	if err := validateStream(cfg.Stream); err != nil {
+		return cfg, err
+	}
+	if err := validatePostgres(cfg.Postgres); err != nil {
+		return cfg, err
+	}
+	if err := validateExperiments(cfg.Experiments); err != nil {
+		return cfg, err
+	}
+	if err := validateState(cfg.State); err != nil {
+		return cfg, err
+	}
+	if err := validateWarmUp(cfg.WarmUp); err != nil {
+		return cfg, err
+	}
+	if err := validateIngest(cfg.Ingest); err != nil {
+		return cfg, err
+	}
+	if err := validateAdmin(cfg.Admin); err != nil {
+		return cfg, err
+	}
+	if err := validateBreakers(cfg.Breakers); err != nil {
+		return cfg, err
+	}
+	if err := validateMetadata(cfg.Metadata); err != nil {
+		return cfg, err
+	}
+	if err := validatePrompts(cfg); err != nil {
+		return cfg, err
+	}
+	if err := validateGlossary(cfg.Glossary); err != nil {
+		return cfg, err
+	}
+	if err := validateNormalize(cfg.Normalize); err != nil {
+		return cfg, err
+	}
+	if err := validateClarify(cfg.Clarify); err != nil {
+		return cfg, err
+	}
+	if err := validateFlags(cfg); err != nil {
+		return cfg, err
+	}
+	if err := validateStats(cfg.Stats); err != nil {
+		return cfg, err
+	}
+	if err := validateAnalytics(cfg.Analytics); err != nil {
+		return cfg, err
+	}
+	if err := validateRetention(cfg.Retention); err != nil {
+		return cfg, err
+	}
+	if err := validateTLS(cfg.TLS); err != nil {
+		return cfg, err
+	}
+	if err := validateSecrets(cfg.Secrets); err != nil {
+		return cfg, err
+	}
+	if err := validateLimits(cfg.Limits); err != nil {
+		return cfg, err
+	}
+	if err := validateScan(cfg.Scan); err != nil {
+		return cfg, err
+	}
+	if err := validateRepeats(cfg.Repeats); err != nil {
+		return cfg, err
+	}
+	if err := validateConsistency(cfg.Consistency); err != nil {
+		return cfg, err
+	}
+	if err := validateSummaries(cfg.Summaries); err != nil {
+		return cfg, err
+	}
+	if err := validateCorpus(cfg.Corpus); err != nil {
+		return cfg, err
+	}
+	if err := validateCompare(cfg.Compare); err != nil {
+		return cfg, err
+	}
+	if err := validateGraph(cfg); err != nil {
+		return cfg, err
+	}
+	if err := validateTemporal(cfg.Temporal); err != nil {
+		return cfg, err
+	}
+	if err := validateNumeric(cfg.Numeric); err != nil {
+		return cfg, err
+	}
+	if err := validateLateInteraction(cfg); err != nil {
+		return cfg, err
+	}
+	if err := validatePayloadSchemas(cfg); err != nil {
+		return cfg, err
+	}
+	if err := validateProvider("llm.ollama", cfg.LLM.Ollama); err != nil {
+		return cfg, err
+	}
+	if err := validateProvider("llm.openai", cfg.LLM.OpenAI); err != nil {
+		return cfg, err
+	}
+	if err := validateProcessors(cfg.Processors); err != nil {
+		return cfg, err
+	}
+	if _, err := newHooks(cfg.Hooks); err != nil {
+		return cfg, err
+	}
+	if w := cfg.Scoring.Recency.Weight; w < 0 || w > 1 {
+		return cfg, fmt.Errorf("scoring.recency.weight must be between 0 and 1")
+	}
+	for _, rule := range cfg.Scoring.Boosts {
+		if rule.Field == "" || rule.Value == nil {
+			return cfg, fmt.Errorf("scoring boost rules need a field and a value")
+		}
+	}
+	if cfg.Embedding.Collection == "" {
+		return cfg, fmt.Errorf("embedding.collection must not be empty")
+	}
+
+	return cfg, nil
+}
+
+func setConfig(cfg Config) {
+	configMu.Lock()
+	config = cfg
+	configMu.Unlock()
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadConfigKeepsDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"temporal": {"fields": ["published"]}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"published"}; !reflect.DeepEqual(cfg.Temporal.Fields, want) {
+		t.Errorf("fields = %v, want %v", cfg.Temporal.Fields, want)
+	}
+
+	// A reload without the setting gets the default again
+	if err := os.WriteFile(path, []byte(`{}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err = loadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"date"}; !reflect.DeepEqual(cfg.Temporal.Fields, want) {
+		t.Errorf("fields = %v, want %v", cfg.Temporal.Fields, want)
+	}
+}
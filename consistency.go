@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/schema"
+)
+
+type ConsistencyConfig struct {
+	Samples     int     `json:"samples"`     // Answers sampled for every rag answer, the best grounded returned; 1 samples one as usual
+	MaxSamples  int     `json:"max_samples"` // Cap on a chat request's samples
+	Temperature float64 `json:"temperature"` // Of the samples, so that they differ
+}
+
+func validateConsistency(cfg ConsistencyConfig) error {
+	if cfg.Samples < 1 || cfg.MaxSamples < cfg.Samples {
+		return fmt.Errorf("self_consistency must satisfy 1 <= samples <= max_samples")
+	}
+	if cfg.Temperature < 0 || cfg.Temperature > 2 {
+		return fmt.Errorf("self_consistency.temperature must be between 0 and 2")
+	}
+	return nil
+}
+
+// Consistency is how the sampled answers of a self-consistent answer scored.
+type Consistency struct {
+	Chosen  int           `json:"chosen"` // Index of the returned answer among the samples
+	Samples []SampleScore `json:"samples"`
+}
+
+type SampleScore struct {
+	Faithfulness *float64 `json:"faithfulness,omitempty"` // Share of the answer the model judged supported by the chunks
+	Agreement    float64  `json:"agreement"`              // Mean word overlap with the other answers
+	Abstained    bool     `json:"abstained,omitempty"`    // The answer said it does not know
+	Error        string   `json:"error,omitempty"`        // Why no answer was sampled
+}
+
+// sampleCount is the number of answers to sample for msg.
+func sampleCount(msg Message) int {
+	if msg.Samples > 0 {
+		return msg.Samples
+	}
+	return getConfig().Consistency.Samples
+}
+
+// sampleAnswers generates n answers to prompt at once, each with its own
+// seed at self_consistency.temperature, and returns the one most grounded in
+// docs as judged by judge. Answers that abstain come last and ties go to the
+// answer agreeing most with the others. It fails only when every sample
+// does.
+func sampleAnswers(ctx context.Context, model llms.Model, judge Generator, prompt []llms.MessageContent, msg Message, docs []schema.Document, n int) (string, *Consistency, error) {
+	base := 1
+	if msg.Seed != nil {
+		base = *msg.Seed
+	}
+	answers := make([]string, n)
+	scores := make([]SampleScore, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Later options win over the pinned temperature of a seeded request
+			options := append(generationOptions(msg), llms.WithSeed(base+i), llms.WithTemperature(getConfig().Consistency.Temperature))
+			if answers[i], errs[i] = generate(ctx, model, prompt, options...); errs[i] != nil {
+				scores[i].Error = errs[i].Error()
+				return
+			}
+			scores[i].Abstained = isAbstention(answers[i])
+			if scores[i].Abstained {
+				return
+			}
+			faithfulness, err := checkFaithfulness(ctx, judge, answers[i], docs)
+			if err != nil {
+				log.Printf("Error judging sampled answer %d: %v", i, err)
+				return
+			}
+			scores[i].Faithfulness = &faithfulness
+		}()
+	}
+	wg.Wait()
+
+	chosen := -1
+	for i := range answers {
+		if errs[i] != nil {
+			continue
+		}
+		scores[i].Agreement = agreement(answers, errs, i)
+		if chosen < 0 || betterSample(scores[i], scores[chosen]) {
+			chosen = i
+		}
+	}
+	if chosen < 0 {
+		return "", nil, errs[0]
+	}
+	return answers[chosen], &Consistency{Chosen: chosen, Samples: scores}, nil
+}
+
+// betterSample reports whether a ranks before b.
+func betterSample(a, b SampleScore) bool {
+	if a.Abstained != b.Abstained {
+		return !a.Abstained
+	}
+	faithfulness := func(s SampleScore) float64 {
+		if s.Faithfulness == nil {
+			return 0
+		}
+		return *s.Faithfulness
+	}
+	if faithfulness(a) != faithfulness(b) {
+		return faithfulness(a) > faithfulness(b)
+	}
+	return a.Agreement > b.Agreement
+}
+
+// agreement is the mean Jaccard overlap of the words of answer i with those
+// of the other answers sampled.
+func agreement(answers []string, errs []error, i int) float64 {
+	words := func(text string) map[string]bool {
+		set := map[string]bool{}
+		for _, word := range tokenize(text) {
+			set[word] = true
+		}
+		return set
+	}
+	own := words(answers[i])
+	var sum float64
+	others := 0
+	for j := range answers {
+		if j == i || errs[j] != nil {
+			continue
+		}
+		other := words(answers[j])
+		shared := 0
+		for word := range own {
+			if other[word] {
+				shared++
+			}
+		}
+		if union := len(own) + len(other) - shared; union > 0 {
+			sum += float64(shared) / float64(union)
+		}
+		others++
+	}
+	if others == 0 {
+		return 0
+	}
+	return sum / float64(others)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/schema"
+)
+
+// corpusNothing is what the model answers for a batch with nothing on the
+// question.
+const corpusNothing = "NONE"
+
+type CorpusConfig struct {
+	BatchChunks    int `json:"batch_chunks"`    // Chunks, then notes, read in one call
+	MaxChunks      int `json:"max_chunks"`      // Questions whose filter matches more chunks are refused
+	Concurrency    int `json:"concurrency"`     // Calls made at once
+	TimeoutSeconds int `json:"timeout_seconds"` // For the whole answer
+}
+
+func validateCorpus(cfg CorpusConfig) error {
+	if cfg.BatchChunks < 2 {
+		return fmt.Errorf("corpus.batch_chunks must be at least 2")
+	}
+	if cfg.MaxChunks <= 0 || cfg.Concurrency <= 0 || cfg.TimeoutSeconds <= 0 {
+		return fmt.Errorf("corpus.max_chunks, concurrency and timeout_seconds must be positive")
+	}
+	return nil
+}
+
+// CorpusScan is what a corpus answer read.
+type CorpusScan struct {
+	Chunks   int  `json:"chunks"`   // Matching the filter
+	Relevant int  `json:"relevant"` // In batches the model found something on the question in
+	Calls    int  `json:"calls"`    // To the model, the answer included
+	TooMany  bool `json:"too_many,omitempty"`
+}
+
+// answerCorpus answers a broad question from every chunk matching the
+// message's filter rather than the top few retrieved: batches of chunks are
+// read for what they say on the question, the notes merged batch by batch
+// until one call can answer from them. Questions matching more than
+// corpus.max_chunks chunks get an answer asking to narrow them down.
+func answerCorpus(ctx context.Context, llm Generator, msg Message, stream *answerStream) (string, []schema.Document, *CorpusScan, error) {
+	cfg := getConfig().Corpus
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.TimeoutSeconds)*time.Second)
+	defer cancel()
+
+	reading := time.Now()
+	store, err := managedStore()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	filter := chunkFilter(msg.Filter, msg.Version)
+	filter.Ranges = queryRanges(msg)
+	chunks, err := store.Chunks(ctx, filter, cfg.MaxChunks+1)
+	msg.timings.since(TimingRetrieval, reading)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("failed to read chunks: %v", err)
+	}
+	scan := &CorpusScan{Chunks: len(chunks)}
+	if len(chunks) > cfg.MaxChunks {
+		scan.TooMany = true
+		return fmt.Sprintf("This question covers more than %d chunks, too many to read for one answer. "+
+			"Narrow it down with a filter, e.g. on a dataset, document or date.", cfg.MaxChunks), nil, scan, nil
+	}
+	if len(chunks) == 0 {
+		return "I don't know.", nil, scan, nil
+	}
+	sort.SliceStable(chunks, func(i, j int) bool {
+		a, _ := chunks[i].Metadata["source"].(string)
+		b, _ := chunks[j].Metadata["source"].(string)
+		if a != b {
+			return a < b
+		}
+		x, _ := intValue(chunks[i].Metadata["chunk_index"])
+		y, _ := intValue(chunks[j].Metadata["chunk_index"])
+		return x < y
+	})
+
+	stream.status(StageAnswering)
+	answering := time.Now()
+	defer msg.timings.since(TimingGeneration, answering)
+	texts := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		source, _ := chunk.Metadata["source"].(string)
+		texts[i] = fmt.Sprintf("[%s]\n%s", source, chunk.PageContent)
+	}
+	notes, err := readBatches(ctx, llm, texts, scan, func(batch string) string {
+		return fmt.Sprintf("Below are excerpts of documents, each after its source in brackets. Write notes of everything they say "+
+			"that helps answer the question, with the sources. If they say nothing on it, respond with %s only.\n\nQuestion: %s\n\n%s",
+			corpusNothing, msg.Msg, batch)
+	})
+	if err != nil {
+		return "", nil, scan, err
+	}
+	var relevant []schema.Document
+	batch := cfg.BatchChunks
+	for i, note := range notes {
+		if note != "" {
+			relevant = append(relevant, chunks[i*batch:min((i+1)*batch, len(chunks))]...)
+		}
+	}
+	scan.Relevant = len(relevant)
+	notes = nonEmpty(notes)
+	for len(notes) > batch {
+		if notes, err = readBatches(ctx, llm, notes, scan, func(batch string) string {
+			return fmt.Sprintf("Below are notes on parts of a document collection. Merge them into one set of notes keeping everything "+
+				"that helps answer the question, with the sources.\n\nQuestion: %s\n\n%s", msg.Msg, batch)
+		}); err != nil {
+			return "", nil, scan, err
+		}
+		notes = nonEmpty(notes)
+	}
+	if len(notes) == 0 {
+		return "I don't know.", nil, scan, nil
+	}
+
+	docs := make([]schema.Document, len(notes))
+	for i, note := range notes {
+		docs[i] = schema.Document{PageContent: note}
+	}
+	prompt := constructPrompt(conversation(msg), docs, msg.Msg, msg.variant.promptTemplate(queryLanguage(msg)).render(msg))
+	if prompt, err = runPromptHooks(ctx, prompt); err != nil {
+		return "", nil, scan, err
+	}
+	scan.Calls++
+	response, err := generate(ctx, llm, prompt, stream.options(generationOptions(msg))...)
+	if err != nil {
+		// Too many chunks to list as excerpts in place of the answer
+		return "", nil, scan, err
+	}
+	return response, relevant, scan, nil
+}
+
+// readBatches has the model read texts corpus.batch_chunks at a time, up to
+// corpus.concurrency batches at once, and returns a note per batch, empty
+// for those with nothing on the question.
+func readBatches(ctx context.Context, llm Generator, texts []string, scan *CorpusScan, prompt func(batch string) string) ([]string, error) {
+	cfg := getConfig().Corpus
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	notes := make([]string, (len(texts)+cfg.BatchChunks-1)/cfg.BatchChunks)
+	var failure error
+	var once sync.Once
+	slots := make(chan struct{}, cfg.Concurrency)
+	var wg sync.WaitGroup
+	for i := range notes {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			first := i * cfg.BatchChunks
+			batch := strings.Join(texts[first:min(first+cfg.BatchChunks, len(texts))], "\n\n---\n\n")
+			note, err := llms.GenerateFromSinglePrompt(ctx, llm, prompt(batch))
+			if err != nil {
+				// The first failure stops the batches still running
+				once.Do(func() {
+					failure = fmt.Errorf("failed to read batch %d of %d: %v", i+1, len(notes), err)
+					cancel()
+				})
+				return
+			}
+			if note = strings.TrimSpace(note); !strings.EqualFold(strings.Trim(note, ".* "), corpusNothing) {
+				notes[i] = note
+			}
+		}()
+	}
+	wg.Wait()
+	scan.Calls += len(notes)
+	return notes, failure
+}
+
+func nonEmpty(texts []string) []string {
+	kept := texts[:0]
+	for _, text := range texts {
+		if text != "" {
+			kept = append(kept, text)
+		}
+	}
+	return kept
+}
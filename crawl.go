@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tmc/langchaingo/schema"
+	"golang.org/x/net/html"
+)
+
+const (
+	crawlMaxPageBytes    = 5 << 20
+	crawlMaxSitemapDepth = 3 // Nesting of sitemap indexes followed
+)
+
+var errRobotsDisallowed = errors.New("disallowed by robots.txt")
+
+type CrawlConfig struct {
+	UserAgent string `json:"user_agent"`
+	MaxPages  int    `json:"max_pages"` // Cap and default for a crawl's max_pages
+	MaxDepth  int    `json:"max_depth"` // Default link depth of a crawl without sitemap
+	DelayMS   int    `json:"delay_ms"`  // Pause between requests unless robots.txt asks for more
+}
+
+type CrawlRequest struct {
+	URL      string `json:"url"`                 // A sitemap (.xml) or the page to start from
+	Prefix   string `json:"prefix,omitempty"`    // Only pages under this URL are ingested; defaults to the start URL's directory
+	MaxDepth int    `json:"max_depth,omitempty"` // Link depth from the start page
+	MaxPages int    `json:"max_pages,omitempty"`
+	Dataset  string `json:"dataset,omitempty"`
+	Tenant   string `json:"tenant,omitempty"`
+}
+
+type crawlPage struct {
+	URL          string
+	Depth        int
+	LastModified string
+}
+
+// crawlWebsite ingests the pages listed in a sitemap, or found by following
+// links from a start page, as a background job.
+func crawlWebsite(c *gin.Context) {
+	var req CrawlRequest
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	start, err := url.Parse(req.URL)
+	if err != nil || (start.Scheme != "http" && start.Scheme != "https") || start.Host == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url must be an http(s) URL"})
+		return
+	}
+
+	cfg := getConfig().Crawl
+	if req.MaxPages <= 0 || req.MaxPages > cfg.MaxPages {
+		req.MaxPages = cfg.MaxPages
+	}
+	if req.MaxDepth <= 0 {
+		req.MaxDepth = cfg.MaxDepth
+	}
+	if req.Prefix != "" {
+		req.Prefix = normalizeRawURL(req.Prefix)
+	} else if !isSitemap(req.URL) {
+		req.Prefix = normalizeURL(start.ResolveReference(&url.URL{Path: "./"}))
+	}
+
+	ingest := IngestRequest{Dataset: req.Dataset, Tenant: req.Tenant}
+	if err := completeIngestRequest(&ingest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	job := jobRegistry.create("crawl:" + req.URL)
+	go runJob(job.ID, func(ctx context.Context) error {
+		return crawl(ctx, job.ID, req, ingest)
+	})
+
+	c.JSON(http.StatusAccepted, job)
+}
+
+func isSitemap(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && strings.HasSuffix(strings.ToLower(u.Path), ".xml")
+}
+
+func crawl(ctx context.Context, jobID string, req CrawlRequest, ingest IngestRequest) error {
+	crawler := &crawler{robots: map[string]*robotsRules{}}
+
+	var queue []crawlPage
+	if isSitemap(req.URL) {
+		pages, err := crawler.sitemapPages(ctx, req.URL, 0)
+		if err != nil {
+			return err
+		}
+		queue = pages
+	} else {
+		queue = []crawlPage{{URL: req.URL}}
+	}
+
+	queued := map[string]bool{}
+	for _, page := range queue {
+		queued[normalizeRawURL(page.URL)] = true
+	}
+	canonical := map[string]bool{}
+	var docs []schema.Document
+	pages := 0
+
+	for len(queue) > 0 && pages < req.MaxPages {
+		page := queue[0]
+		queue = queue[1:]
+		if req.Prefix != "" && !strings.HasPrefix(normalizeRawURL(page.URL), req.Prefix) {
+			continue
+		}
+
+		pageDocs, links, err := crawler.fetchPage(ctx, page, canonical)
+		if errors.Is(err, errRobotsDisallowed) {
+			jobRegistry.update(jobID, func(job *Job) {
+				job.Warnings = append(job.Warnings, fmt.Sprintf("%s: %v", page.URL, err))
+			})
+			continue
+		}
+		if err != nil {
+			jobRegistry.update(jobID, func(job *Job) {
+				job.recordError(fmt.Sprintf("%s: %v", page.URL, err))
+			})
+			continue
+		}
+		if pageDocs == nil {
+			continue
+		}
+		pages++
+		docs = append(docs, pageDocs...)
+		jobRegistry.update(jobID, func(job *Job) { job.Processed = pages })
+
+		if page.Depth < req.MaxDepth && !isSitemap(req.URL) {
+			for _, link := range links {
+				if key := normalizeRawURL(link); !queued[key] {
+					queued[key] = true
+					queue = append(queue, crawlPage{URL: link, Depth: page.Depth + 1})
+				}
+			}
+		}
+	}
+
+	if len(docs) == 0 {
+		return fmt.Errorf("no pages with text found")
+	}
+	return indexDocuments(ctx, jobID, ingest, docs)
+}
+
+type crawler struct {
+	robots      map[string]*robotsRules
+	lastRequest time.Time
+}
+
+// get fetches rawURL if robots.txt allows it, pausing between requests.
+func (c *crawler) get(ctx context.Context, rawURL string) (*http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	rules := c.robotsFor(ctx, u)
+	if !rules.allowed(u.RequestURI()) {
+		return nil, errRobotsDisallowed
+	}
+
+	delay := time.Duration(getConfig().Crawl.DelayMS) * time.Millisecond
+	if rules.delay > delay {
+		delay = rules.delay
+	}
+	if wait := time.Until(c.lastRequest.Add(delay)); wait > 0 {
+		time.Sleep(wait)
+	}
+	c.lastRequest = time.Now()
+
+	return c.request(ctx, rawURL)
+}
+
+func (c *crawler) request(ctx context.Context, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", getConfig().Crawl.UserAgent)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// fetchPage returns the documents and links of an HTML page, or no documents
+// when the page is not HTML or its canonical URL was already ingested.
+func (c *crawler) fetchPage(ctx context.Context, page crawlPage, seen map[string]bool) ([]schema.Document, []string, error) {
+	resp, err := c.get(ctx, page.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if !strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		return nil, nil, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, crawlMaxPageBytes))
+	if err != nil {
+		return nil, nil, err
+	}
+	root, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	base := resp.Request.URL
+	canonical := normalizeURL(base)
+	var links []string
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "a":
+				if link, ok := resolveLink(base, htmlAttr(n, "href")); ok {
+					links = append(links, link)
+				}
+			case "link":
+				if strings.EqualFold(htmlAttr(n, "rel"), "canonical") {
+					if link, ok := resolveLink(base, htmlAttr(n, "href")); ok {
+						canonical = link
+					}
+				}
+			}
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(root)
+
+	if seen[canonical] {
+		return nil, links, nil
+	}
+	seen[canonical] = true
+
+	docs, err := htmlDocuments(bytes.NewReader(body), canonical)
+	if err != nil {
+		return nil, nil, err
+	}
+	updatedAt := page.LastModified
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil && updatedAt == "" {
+		updatedAt = modified.UTC().Format(time.RFC3339)
+	}
+	for i := range docs {
+		docs[i].Metadata["url"] = canonical
+		docs[i].Metadata["document"] = canonical
+		docs[i].Metadata["crawl_depth"] = page.Depth
+		if updatedAt != "" {
+			docs[i].Metadata["updated_at"] = updatedAt
+		}
+	}
+	return docs, links, nil
+}
+
+type sitemapXML struct {
+	URLs []struct {
+		Loc     string `xml:"loc"`
+		LastMod string `xml:"lastmod"`
+	} `xml:"url"`
+	Sitemaps []struct {
+		Loc string `xml:"loc"`
+	} `xml:"sitemap"`
+}
+
+// sitemapPages lists the pages of a sitemap, following sitemap indexes.
+func (c *crawler) sitemapPages(ctx context.Context, sitemapURL string, depth int) ([]crawlPage, error) {
+	resp, err := c.get(ctx, sitemapURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch sitemap %s: %v", sitemapURL, err)
+	}
+	defer resp.Body.Close()
+
+	var sitemap sitemapXML
+	if err := xml.NewDecoder(resp.Body).Decode(&sitemap); err != nil {
+		return nil, fmt.Errorf("failed to parse sitemap %s: %v", sitemapURL, err)
+	}
+
+	var pages []crawlPage
+	for _, entry := range sitemap.URLs {
+		page := crawlPage{URL: strings.TrimSpace(entry.Loc)}
+		if lastMod := strings.TrimSpace(entry.LastMod); lastMod != "" {
+			for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+				if t, err := time.Parse(layout, lastMod); err == nil {
+					page.LastModified = t.UTC().Format(time.RFC3339)
+					break
+				}
+			}
+		}
+		pages = append(pages, page)
+	}
+	for _, nested := range sitemap.Sitemaps {
+		if depth+1 >= crawlMaxSitemapDepth {
+			break
+		}
+		nestedPages, err := c.sitemapPages(ctx, strings.TrimSpace(nested.Loc), depth+1)
+		if err != nil {
+			log.Printf("Skipping sitemap: %v", err)
+			continue
+		}
+		pages = append(pages, nestedPages...)
+	}
+	return pages, nil
+}
+
+func htmlAttr(n *html.Node, name string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == name {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+// resolveLink resolves href against base and normalizes it, accepting only
+// http(s) links.
+func resolveLink(base *url.URL, href string) (string, bool) {
+	ref, err := url.Parse(strings.TrimSpace(href))
+	if err != nil || href == "" {
+		return "", false
+	}
+	u := base.ResolveReference(ref)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", false
+	}
+	return normalizeURL(u), true
+}
+
+// normalizeURL drops the fragment and default port and lowercases the scheme
+// and host, so the same page is not fetched under several spellings.
+func normalizeURL(u *url.URL) string {
+	n := *u
+	n.Fragment = ""
+	n.RawFragment = ""
+	n.Scheme = strings.ToLower(n.Scheme)
+	n.Host = strings.ToLower(n.Host)
+	if port := n.Port(); (n.Scheme == "http" && port == "80") || (n.Scheme == "https" && port == "443") {
+		n.Host = n.Hostname()
+	}
+	if n.Path == "" {
+		n.Path = "/"
+	}
+	return n.String()
+}
+
+func normalizeRawURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return normalizeURL(u)
+}
+
+// robotsRules are the robots.txt rules that apply to the crawler's user
+// agent on one host.
+type robotsRules struct {
+	allow, disallow []robotsRule
+	delay           time.Duration
+}
+
+// robotsRule is an Allow or Disallow path as a pattern, and the length of
+// the path as written, which decides between rules that both match.
+type robotsRule struct {
+	pattern *regexp.Regexp
+	length  int
+}
+
+func (c *crawler) robotsFor(ctx context.Context, u *url.URL) *robotsRules {
+	origin := u.Scheme + "://" + u.Host
+	if rules, ok := c.robots[origin]; ok {
+		return rules
+	}
+	rules := &robotsRules{}
+	if resp, err := c.request(ctx, origin+"/robots.txt"); err == nil {
+		rules = parseRobots(io.LimitReader(resp.Body, 512<<10), getConfig().Crawl.UserAgent)
+		resp.Body.Close()
+	}
+	c.robots[origin] = rules
+	return rules
+}
+
+// parseRobots reads the group of a robots.txt that names userAgent, or the
+// "*" group when none does.
+func parseRobots(r io.Reader, userAgent string) *robotsRules {
+	agent := strings.ToLower(strings.SplitN(userAgent, "/", 2)[0])
+	groups := map[string]*robotsRules{}
+	var current []*robotsRules
+	inAgents := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		if key == "user-agent" {
+			if !inAgents {
+				current = nil
+			}
+			inAgents = true
+			name := strings.ToLower(value)
+			if groups[name] == nil {
+				groups[name] = &robotsRules{}
+			}
+			current = append(current, groups[name])
+			continue
+		}
+		inAgents = false
+		for _, rules := range current {
+			switch key {
+			case "allow":
+				if value != "" {
+					rules.allow = append(rules.allow, robotsPattern(value))
+				}
+			case "disallow":
+				if value != "" {
+					rules.disallow = append(rules.disallow, robotsPattern(value))
+				}
+			case "crawl-delay":
+				if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+					rules.delay = time.Duration(seconds * float64(time.Second))
+				}
+			}
+		}
+	}
+
+	for name, rules := range groups {
+		if name != "*" && strings.Contains(agent, name) {
+			return rules
+		}
+	}
+	if rules, ok := groups["*"]; ok {
+		return rules
+	}
+	return &robotsRules{}
+}
+
+func robotsPattern(path string) robotsRule {
+	length := len(path)
+	anchored := strings.HasSuffix(path, "$")
+	path = strings.TrimSuffix(path, "$")
+	pattern := "^" + strings.ReplaceAll(regexp.QuoteMeta(path), `\*`, ".*")
+	if anchored {
+		pattern += "$"
+	}
+	return robotsRule{pattern: regexp.MustCompile(pattern), length: length}
+}
+
+// allowed applies the longest matching rule, with Allow winning ties.
+func (r *robotsRules) allowed(path string) bool {
+	longest := func(rules []robotsRule) int {
+		best := -1
+		for _, rule := range rules {
+			if rule.pattern.MatchString(path) {
+				best = max(best, rule.length)
+			}
+		}
+		return best
+	}
+	return longest(r.allow) >= longest(r.disallow)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRobotsAllowed(t *testing.T) {
+	tests := []struct {
+		name      string
+		robots    string
+		userAgent string
+		path      string
+		want      bool
+	}{
+		{"no rules", "", "ragbot", "/a", true},
+		{"disallowed prefix", "User-agent: *\nDisallow: /private/", "ragbot", "/private/a", false},
+		{"other prefix", "User-agent: *\nDisallow: /private/", "ragbot", "/public/a", true},
+		{"empty disallow", "User-agent: *\nDisallow:", "ragbot", "/a", true},
+		{"longer allow wins", "User-agent: *\nDisallow: /docs/\nAllow: /docs/public/", "ragbot", "/docs/public/a", true},
+		{"longer disallow wins", "User-agent: *\nAllow: /docs/\nDisallow: /docs/private/", "ragbot", "/docs/private/a", false},
+		{"allow wins ties", "User-agent: *\nDisallow: /a\nAllow: /a", "ragbot", "/a", true},
+		{"wildcard", "User-agent: *\nDisallow: /*/drafts", "ragbot", "/blog/drafts/1", false},
+		{"end anchor", "User-agent: *\nDisallow: /*.pdf$", "ragbot", "/a.pdf", false},
+		{"end anchor not at end", "User-agent: *\nDisallow: /*.pdf$", "ragbot", "/a.pdf.html", true},
+		// Rules are compared by their length as written, 8 against 7, not
+		// by the length of the patterns they compile to
+		{"rule length", "User-agent: *\nDisallow: /*.pdf$\nAllow: /public/", "ragbot", "/public/a.pdf", true},
+		{"named group", "User-agent: *\nDisallow: /\n\nUser-agent: RAGBot\nDisallow: /private/", "ragbot/1.0", "/a", true},
+		{"other group", "User-agent: otherbot\nDisallow: /\n\nUser-agent: *\nDisallow: /private/", "ragbot", "/a", true},
+		{"shared group", "User-agent: otherbot\nUser-agent: ragbot\nDisallow: /", "ragbot", "/a", false},
+		{"comments", "User-agent: * # everyone\nDisallow: /private/ # not this", "ragbot", "/private/a", false},
+		{"case-insensitive keys", "USER-AGENT: *\nDISALLOW: /a", "ragbot", "/a", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := parseRobots(strings.NewReader(tt.robots), tt.userAgent)
+			if got := rules.allowed(tt.path); got != tt.want {
+				t.Errorf("allowed(%q) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRobotsDelay(t *testing.T) {
+	rules := parseRobots(strings.NewReader("User-agent: *\nCrawl-delay: 1.5"), "ragbot")
+	if rules.delay != 1500*time.Millisecond {
+		t.Errorf("delay = %v, want 1.5s", rules.delay)
+	}
+}
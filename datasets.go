@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	DatasetRoutingEmbedding = "embedding"
+	DatasetRoutingLLM       = "llm"
+)
+
+// datasetMargin is how far below the best match another dataset's similarity
+// may be and still be searched.
+const datasetMargin = 0.05
+
+// Dataset is a named group of ingested documents. Chunks carry the dataset
+// name in their "dataset" field; the description is what queries are routed
+// by.
+type Dataset struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// DatasetRegistry keeps the datasets in the shared state and caches their
+// embedded descriptions.
+type DatasetRegistry struct {
+	vectors map[string]datasetVector
+	mu      sync.Mutex
+}
+
+type datasetVector struct {
+	vector      []float32
+	model       string // Embedding model the vector came from
+	description string // Description it was embedded from
+}
+
+var datasetRegistry = DatasetRegistry{
+	vectors: make(map[string]datasetVector),
+}
+
+// setConfiguredDatasets registers the datasets listed in the config, so
+// they survive restarts.
+func setConfiguredDatasets(datasets []Dataset) error {
+	for _, dataset := range datasets {
+		dataset.CreatedAt = time.Now()
+		if err := saveState(context.Background(), "dataset:"+dataset.Name, dataset, 0); err != nil {
+			return fmt.Errorf("failed to register dataset %s: %v", dataset.Name, err)
+		}
+	}
+	return nil
+}
+
+func validateDatasets(datasets []Dataset) error {
+	seen := map[string]bool{}
+	for _, dataset := range datasets {
+		if dataset.Name == "" || dataset.Description == "" {
+			return fmt.Errorf("datasets need a name and a description")
+		}
+		if seen[dataset.Name] {
+			return fmt.Errorf("dataset %q is listed twice", dataset.Name)
+		}
+		seen[dataset.Name] = true
+	}
+	return nil
+}
+
+// exists reports whether a dataset is registered; a failing state backend
+// is logged and counts as no.
+func (r *DatasetRegistry) exists(name string) bool {
+	_, ok, err := sharedState.Get(context.Background(), "dataset:"+name)
+	if err != nil {
+		log.Printf("Error looking up dataset %s: %v", name, err)
+	}
+	return ok
+}
+
+// list returns the datasets by name.
+func (r *DatasetRegistry) list() ([]Dataset, error) {
+	values, err := sharedState.Scan(context.Background(), "dataset:")
+	if err != nil {
+		return nil, err
+	}
+	datasets := make([]Dataset, 0, len(values))
+	for _, value := range values {
+		var dataset Dataset
+		if err := json.Unmarshal(value, &dataset); err != nil {
+			return nil, err
+		}
+		datasets = append(datasets, dataset)
+	}
+	sort.Slice(datasets, func(i, j int) bool { return datasets[i].Name < datasets[j].Name })
+	return datasets, nil
+}
+
+func createDataset(c *gin.Context) {
+	var dataset Dataset
+	if err := c.BindJSON(&dataset); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if err := validateDatasets([]Dataset{dataset}); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	dataset.CreatedAt = time.Now()
+	data, err := json.Marshal(dataset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	created, err := sharedState.PutNew(c.Request.Context(), "dataset:"+dataset.Name, data)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !created {
+		c.JSON(http.StatusConflict, gin.H{"error": "Dataset already exists"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, dataset)
+}
+
+func listDatasets(c *gin.Context) {
+	datasets, err := datasetRegistry.list()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, datasets)
+}
+
+// routeDatasets returns the datasets to search for msg: the ones the client
+// asked for, else the ones whose descriptions match the query. Nothing is
+// returned, and every chunk is searched, when fewer than two datasets exist.
+func routeDatasets(ctx context.Context, llm Generator, embedder Embedder, msg Message) []string {
+	if len(msg.Datasets) > 0 {
+		return msg.Datasets
+	}
+	if !flagOn(msg, FlagDatasetRouting, true) {
+		return nil
+	}
+	datasets, err := datasetRegistry.list()
+	if err != nil {
+		log.Printf("Error listing datasets, searching all datasets: %v", err)
+		return nil
+	}
+	if len(datasets) < 2 {
+		return nil
+	}
+
+	cfg := getConfig().Router
+	if cfg.DatasetRouting == DatasetRoutingLLM {
+		names, err := datasetsByLLM(ctx, llm, datasets, msg.Msg, cfg.MaxDatasets)
+		if err == nil && len(names) > 0 {
+			return names
+		}
+		log.Printf("Dataset routing by LLM failed, using embeddings: %v", err)
+	}
+
+	names, err := datasetsByEmbedding(ctx, embedder, datasets, msg.Msg, cfg.MaxDatasets)
+	if err != nil {
+		log.Printf("Dataset routing failed, searching all datasets: %v", err)
+		return nil
+	}
+	return names
+}
+
+func datasetsByEmbedding(ctx context.Context, embedder Embedder, datasets []Dataset, query string, limit int) ([]string, error) {
+	queryVector, err := embedder.EmbedQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	model := embeddingModel()
+
+	type scored struct {
+		name  string
+		score float64
+	}
+	var scores []scored
+
+	datasetRegistry.mu.Lock()
+	for _, dataset := range datasets {
+		cached, ok := datasetRegistry.vectors[dataset.Name]
+		if !ok || cached.model != model || cached.description != dataset.Description {
+			vector, err := embedder.EmbedQuery(ctx, dataset.Description)
+			if err != nil {
+				datasetRegistry.mu.Unlock()
+				return nil, fmt.Errorf("failed to embed description of %s: %v", dataset.Name, err)
+			}
+			cached = datasetVector{vector: vector, model: model, description: dataset.Description}
+			datasetRegistry.vectors[dataset.Name] = cached
+		}
+		scores = append(scores, scored{name: dataset.Name, score: cosineSimilarity(queryVector, cached.vector)})
+	}
+	datasetRegistry.mu.Unlock()
+
+	sort.Slice(scores, func(i, j int) bool { return scores[i].score > scores[j].score })
+	var names []string
+	for _, s := range scores {
+		if len(names) == limit || s.score < scores[0].score-datasetMargin {
+			break
+		}
+		names = append(names, s.name)
+	}
+	return names, nil
+}
+
+func datasetsByLLM(ctx context.Context, llm Generator, datasets []Dataset, query string, limit int) ([]string, error) {
+	prompt := fmt.Sprintf("Pick the datasets, at most %d, that are likely to answer the question below. "+
+		"Respond with JSON of the form {\"datasets\": [\"name\"]}.\n\nDatasets:\n", limit)
+	known := make([]string, 0, len(datasets))
+	for _, dataset := range datasets {
+		prompt += fmt.Sprintf("- %s: %s\n", dataset.Name, dataset.Description)
+		known = append(known, dataset.Name)
+	}
+	prompt += "\nQuestion:\n" + query
+
+	var result struct {
+		Datasets []string `json:"datasets"`
+	}
+	if err := generateJSON(ctx, llm, prompt, &result); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, name := range result.Datasets {
+		if slices.Contains(known, name) && !slices.Contains(names, name) && len(names) < limit {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// withDatasets adds a match on the "dataset" field to a chat filter.
+func withDatasets(filter map[string]any, datasets []string) map[string]any {
+	result := make(map[string]any, len(filter)+1)
+	for key, value := range filter {
+		result[key] = value
+	}
+	values := make([]any, len(datasets))
+	for i, name := range datasets {
+		values[i] = name
+	}
+	result["dataset"] = values
+	return result
+}
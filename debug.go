@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tmc/langchaingo/schema"
+)
+
+// traceCandidateKey tags the copies of the candidates a trace follows through
+// the retrieval stages with their position in the search results.
+const traceCandidateKey = "_trace_candidate"
+
+// RetrievalTrace records what each stage of the retrieval of a rag answer
+// did with the candidate chunks.
+type RetrievalTrace struct {
+	Message     string           `json:"message"`            // The message as sent
+	Query       string           `json:"query"`              // The searched text, after query hooks and with any image description
+	Mode        string           `json:"mode"`               // Mode the message is routed to; retrieval is traced regardless
+	Datasets    []string         `json:"datasets,omitempty"` // Datasets the search is limited to
+	Filter      TraceFilter      `json:"filter"`
+	EmbeddingMS float64          `json:"embedding_ms"`    // Embedding the query
+	SearchMS    float64          `json:"search_ms"`       // The whole store search, embedding included
+	Requested   int              `json:"requested"`       // Candidates asked of the store
+	Candidates  []TraceCandidate `json:"candidates"`      // In the store's order
+	Graph       *GraphExpansion  `json:"graph,omitempty"` // What expanding along the knowledge graph added
+	Context     []SourceChunk    `json:"context"`         // The chunks in the prompt, after stitching and translation
+	Prompt      []ChatMessage    `json:"prompt"`
+}
+
+type TraceFilter struct {
+	Match   map[string]any `json:"match,omitempty"`
+	Exclude map[string]any `json:"exclude,omitempty"` // Deleted and superseded chunks
+	Ranges  []Range        `json:"ranges,omitempty"`  // e.g. parsed from the dates of the question
+}
+
+type TraceCandidate struct {
+	ID       any            `json:"id,omitempty"`
+	Source   string         `json:"source,omitempty"`
+	Content  string         `json:"content"`
+	Metadata map[string]any `json:"metadata"`
+	RawScore float32        `json:"raw_score"` // Similarity from the store
+	Score    float32        `json:"score"`     // After recency and boost rules
+	Rank     int            `json:"rank"`      // By score, from 1
+	InPrompt bool           `json:"in_prompt"`
+	Stitched bool           `json:"stitched,omitempty"` // Merged into the block of an adjacent chunk
+	Dropped  string         `json:"dropped,omitempty"`  // Why it is not in the prompt
+
+	mergedInto int // Candidate whose block it was merged into
+}
+
+// timedEmbedder adds up the time spent embedding queries.
+type timedEmbedder struct {
+	Embedder
+	elapsed *time.Duration
+}
+
+func (e timedEmbedder) EmbedQuery(ctx context.Context, text string) ([]float32, error) {
+	start := time.Now()
+	defer func() { *e.elapsed += time.Since(start) }()
+	return e.Embedder.EmbedQuery(ctx, text)
+}
+
+// debugRetrieve runs the retrieval of a chat message without generating an
+// answer or touching the conversation, and returns its trace.
+func debugRetrieve(c *gin.Context) {
+	var msg Message
+	if err := c.ShouldBindJSON(&msg); err != nil {
+		if !bodyTooLarge(c, err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		}
+		return
+	}
+	if err := bindMessages(&msg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !bindFlags(c, &msg) {
+		return
+	}
+	if err := bindSession(c.Request.Context(), &msg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateVariables(msg.Variables); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	parseEntityFilters(&msg)
+	if strings.TrimSpace(msg.Msg) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "msg is required"})
+		return
+	}
+	for _, name := range msg.Datasets {
+		if !datasetRegistry.exists(name) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown dataset %q", name)})
+			return
+		}
+	}
+
+	ctx := c.Request.Context()
+	trace := RetrievalTrace{Message: msg.Msg}
+	if err := runQueryHooks(ctx, &msg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	followSession(ctx, &msg)
+	msg.facts = requestFacts(ctx, msg)
+	msg.query, _ = normalizeQuery(ctx, msg)
+
+	llm, err := newLLM()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	embedder, err := newEmbedder()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var embedding time.Duration
+	store, err := newStore(timedEmbedder{Embedder: embedder, elapsed: &embedding}, msg.Tenant)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	trace.Mode = routeQuery(ctx, llm, msg)
+	if trace.Mode == "" {
+		trace.Mode = ModeRAG
+	}
+	trace.Mode, _ = routeEntities(ctx, &msg, trace.Mode)
+	if trace.Mode != ModeChitchat {
+		trace.Datasets = routeDatasets(ctx, llm, embedder, msg)
+		if len(trace.Datasets) > 0 {
+			msg.Filter = withDatasets(msg.Filter, trace.Datasets)
+		}
+	}
+
+	_, err = retrieveContext(ctx, llm, store, msg, &trace)
+	trace.EmbeddingMS = milliseconds(embedding)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "trace": trace})
+		return
+	}
+	c.JSON(http.StatusOK, trace)
+}
+
+// The stage methods below record a stage and return the documents to carry
+// on with; on a nil trace they return the documents as they are.
+
+// searched records the store's results as the candidates and returns tagged
+// copies of them.
+func (t *RetrievalTrace) searched(query string, filter Filter, requested int, elapsed time.Duration, docs []schema.Document) []schema.Document {
+	if t == nil {
+		return docs
+	}
+	t.Query = query
+	t.Filter = TraceFilter(filter)
+	t.Requested = requested
+	t.SearchMS = milliseconds(elapsed)
+
+	tagged := make([]schema.Document, len(docs))
+	for i, doc := range docs {
+		source, _ := doc.Metadata["source"].(string)
+		t.Candidates = append(t.Candidates, TraceCandidate{
+			ID:         doc.Metadata["id"],
+			Source:     source,
+			Content:    doc.PageContent,
+			Metadata:   doc.Metadata,
+			RawScore:   doc.Score,
+			Score:      doc.Score,
+			Rank:       i + 1,
+			mergedInto: -1,
+		})
+		metadata := make(map[string]any, len(doc.Metadata)+1)
+		for k, v := range doc.Metadata {
+			metadata[k] = v
+		}
+		metadata[traceCandidateKey] = i
+		tagged[i] = schema.Document{PageContent: doc.PageContent, Metadata: metadata, Score: doc.Score}
+	}
+	return tagged
+}
+
+func (t *RetrievalTrace) rescored(docs []schema.Document) []schema.Document {
+	if t == nil {
+		return docs
+	}
+	for rank, doc := range docs {
+		if candidate := t.candidate(doc); candidate != nil {
+			candidate.Score = doc.Score
+			candidate.Rank = rank + 1
+		}
+	}
+	return docs
+}
+
+// resolved records the candidates resolveQuestionHits dropped, either as
+// repeated hits on a chunk that was kept or as past the cut.
+func (t *RetrievalTrace) resolved(docs []schema.Document) []schema.Document {
+	if t == nil {
+		return docs
+	}
+	kept := map[string]bool{}
+	for _, doc := range docs {
+		if id, ok := doc.Metadata["id"]; ok {
+			kept[fmt.Sprint(id)] = true
+		}
+	}
+	present := t.present(docs)
+	for i := range t.Candidates {
+		candidate := &t.Candidates[i]
+		if present[i] || candidate.Dropped != "" {
+			continue
+		}
+		if candidate.ID != nil && kept[fmt.Sprint(candidate.ID)] {
+			candidate.Dropped = "repeated hit on a chunk ranked higher"
+		} else {
+			candidate.Dropped = fmt.Sprintf("not in the top %d", t.Requested/2)
+		}
+	}
+	return docs
+}
+
+// stitched records which block each candidate stitchNeighbors merged into.
+func (t *RetrievalTrace) stitched(docs []schema.Document) []schema.Document {
+	if t == nil {
+		return docs
+	}
+	present := t.present(docs)
+	for i := range t.Candidates {
+		candidate := &t.Candidates[i]
+		if present[i] || candidate.Dropped != "" {
+			continue
+		}
+		index, _ := intValue(candidate.Metadata["chunk_index"])
+		for _, doc := range docs {
+			first, _ := intValue(doc.Metadata["chunk_index"])
+			last, ok := intValue(doc.Metadata["chunk_index_end"])
+			if ok && index >= first && index <= last &&
+				fmt.Sprint(doc.Metadata["source"]) == fmt.Sprint(candidate.Metadata["source"]) &&
+				fmt.Sprint(doc.Metadata["version"]) == fmt.Sprint(candidate.Metadata["version"]) {
+				candidate.Stitched = true
+				candidate.mergedInto, _ = doc.Metadata[traceCandidateKey].(int)
+				break
+			}
+		}
+	}
+	return docs
+}
+
+// dropped records the candidates missing from docs with reason.
+func (t *RetrievalTrace) dropped(docs []schema.Document, reason string) []schema.Document {
+	if t == nil {
+		return docs
+	}
+	present := t.present(docs)
+	for i := range t.Candidates {
+		if !present[i] && !t.Candidates[i].Stitched && t.Candidates[i].Dropped == "" {
+			t.Candidates[i].Dropped = reason
+		}
+	}
+	return docs
+}
+
+// selected marks the candidates that are left as in the prompt and returns
+// the documents without their tags.
+func (t *RetrievalTrace) selected(docs []schema.Document) []schema.Document {
+	if t == nil {
+		return docs
+	}
+	t.dropped(docs, "removed by a retrieve hook")
+	present := t.present(docs)
+	for i := range t.Candidates {
+		candidate := &t.Candidates[i]
+		if candidate.Stitched && !present[candidate.mergedInto] {
+			candidate.Dropped = "removed by a retrieve hook"
+		}
+		candidate.InPrompt = present[i] || (candidate.Stitched && present[candidate.mergedInto])
+	}
+
+	untagged := make([]schema.Document, len(docs))
+	for i, doc := range docs {
+		untagged[i] = doc
+		if _, ok := doc.Metadata[traceCandidateKey]; ok {
+			untagged[i].Metadata = make(map[string]any, len(doc.Metadata))
+			for k, v := range doc.Metadata {
+				if k != traceCandidateKey {
+					untagged[i].Metadata[k] = v
+				}
+			}
+		}
+	}
+	return untagged
+}
+
+func (t *RetrievalTrace) candidate(doc schema.Document) *TraceCandidate {
+	i, ok := doc.Metadata[traceCandidateKey].(int)
+	if !ok || i < 0 || i >= len(t.Candidates) {
+		return nil
+	}
+	return &t.Candidates[i]
+}
+
+func (t *RetrievalTrace) present(docs []schema.Document) map[int]bool {
+	present := map[int]bool{}
+	for _, doc := range docs {
+		if i, ok := doc.Metadata[traceCandidateKey].(int); ok {
+			present[i] = true
+		}
+	}
+	return present
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/tmc/langchaingo/schema"
+)
+
+const (
+	QuestionsAlongside   = "alongside" // Embed the chunk and its questions
+	QuestionsInstead     = "instead"   // Embed only the questions
+	maxQuestionsPerChunk = 3
+)
+
+func validateDoc2Query(questions int, mode string) error {
+	if questions < 0 || questions > maxQuestionsPerChunk {
+		return fmt.Errorf("questions per chunk must be between 0 and %d", maxQuestionsPerChunk)
+	}
+	if mode != QuestionsAlongside && mode != QuestionsInstead {
+		return fmt.Errorf("unknown question mode %q", mode)
+	}
+	return nil
+}
+
+// generateQuestionDocuments asks the LLM for n questions each chunk answers
+// and returns one document per question. The question is what gets embedded;
+// the chunk text travels in the "chunk_text" payload field so retrieval can
+// hand the original chunk to the prompt.
+func generateQuestionDocuments(ctx context.Context, llm Generator, docs []schema.Document, n int) ([]schema.Document, []error) {
+	var questionDocs []schema.Document
+	var errs []error
+
+	for _, doc := range docs {
+		prompt := fmt.Sprintf("Write %d distinct, self-contained questions that the text below answers. "+
+			"Respond with JSON of the form {\"questions\": [\"...\"]}.\n\nText:\n%s", n, doc.PageContent)
+
+		var result struct {
+			Questions []string `json:"questions"`
+		}
+		if err := generateJSON(ctx, llm, prompt, &result); err != nil {
+			errs = append(errs, fmt.Errorf("question generation: %v", err))
+			continue
+		}
+
+		for i, question := range result.Questions {
+			question = strings.TrimSpace(question)
+			if i >= n || question == "" {
+				continue
+			}
+			metadata := make(map[string]any, len(doc.Metadata)+2)
+			for k, v := range doc.Metadata {
+				metadata[k] = v
+			}
+			metadata["synthetic_question"] = true
+			metadata["chunk_text"] = doc.PageContent
+			questionDocs = append(questionDocs, schema.Document{PageContent: question, Metadata: metadata})
+		}
+	}
+
+	return questionDocs, errs
+}
+
+// resolveQuestionHits replaces synthetic question hits with the chunk they
+// were generated from and drops repeated hits on the same chunk, keeping the
+// best scored one. At most k documents are returned.
+func resolveQuestionHits(docs []schema.Document, k int) []schema.Document {
+	resolved := make([]schema.Document, 0, len(docs))
+	seen := map[any]bool{}
+
+	for _, doc := range docs {
+		if synthetic, _ := doc.Metadata["synthetic_question"].(bool); synthetic {
+			if text, ok := doc.Metadata["chunk_text"].(string); ok {
+				doc.PageContent = text
+			}
+		}
+		if id, ok := doc.Metadata["id"]; ok {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+		}
+		resolved = append(resolved, doc)
+		if len(resolved) == k {
+			break
+		}
+	}
+	return resolved
+}
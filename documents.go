@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type RestoreRequest struct {
+	Source string `json:"source"`
+}
+
+func listDocuments(c *gin.Context) {
+	store, err := managedStore()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sources, err := store.Sources(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	for i := range sources {
+		sources[i].ID = documentID(sources[i].Source)
+	}
+	c.JSON(http.StatusOK, sources)
+}
+
+// deleteDocument soft-deletes the chunks of ?source=, which hides them from
+// retrieval until they are restored or purged. With purge=true they are
+// removed right away.
+func deleteDocument(c *gin.Context) {
+	source := c.Query("source")
+	if source == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "source is required"})
+		return
+	}
+	store, err := managedStore()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var chunks int
+	if c.Query("purge") == "true" {
+		chunks, err = store.DeleteWhere(c.Request.Context(), map[string]any{"source": source})
+	} else {
+		chunks, err = store.UpdateWhere(c.Request.Context(), map[string]any{"source": source}, map[string]any{
+			"deleted":    true,
+			"deleted_at": time.Now().UTC().Format(time.RFC3339),
+		})
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	if chunks == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Document not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"source": source, "chunks": chunks, "purged": c.Query("purge") == "true"})
+}
+
+func restoreDocument(c *gin.Context) {
+	var req RestoreRequest
+	if err := c.BindJSON(&req); err != nil || req.Source == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "source is required"})
+		return
+	}
+	store, err := managedStore()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	chunks, err := store.UpdateWhere(c.Request.Context(), map[string]any{"source": req.Source, "deleted": true}, map[string]any{
+		"deleted":    false,
+		"deleted_at": nil,
+	})
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	if chunks == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No deleted document with that source"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"source": req.Source, "chunks": chunks})
+}
+
+func managedStore() (ManagedStore, error) {
+	embedder, err := newEmbedder()
+	if err != nil {
+		return nil, err
+	}
+	return newManagedStore(embedder)
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tmc/langchaingo/schema"
+	"github.com/tmc/langchaingo/vectorstores"
+)
+
+const (
+	FlavorElasticsearch = "elasticsearch"
+	FlavorOpenSearch    = "opensearch"
+)
+
+type ElasticConfig struct {
+	URL          string  `json:"url"`    // e.g. "http://localhost:9200"
+	Flavor       string  `json:"flavor"` // "elasticsearch" (8.x) or "opensearch" (2.x)
+	Username     string  `json:"username"`
+	Password     string  `json:"password"`      // With environment variables expanded
+	APIKey       string  `json:"api_key"`       // Elasticsearch API key, instead of username/password; with environment variables expanded
+	VectorWeight float64 `json:"vector_weight"` // Share of the hybrid score from vector similarity; the rest is BM25
+}
+
+var defaultElasticConfig = ElasticConfig{
+	URL:          "http://localhost:9200",
+	Flavor:       FlavorElasticsearch,
+	VectorWeight: 0.7,
+}
+
+var elasticClient = &http.Client{Timeout: 30 * time.Second}
+
+func validateElastic(cfg ElasticConfig) error {
+	if cfg.URL == "" {
+		return fmt.Errorf("vector_store.elastic.url is required for the elastic backend")
+	}
+	if cfg.Flavor != FlavorElasticsearch && cfg.Flavor != FlavorOpenSearch {
+		return fmt.Errorf("unknown elastic flavor %q", cfg.Flavor)
+	}
+	if cfg.VectorWeight < 0 || cfg.VectorWeight > 1 {
+		return fmt.Errorf("vector_store.elastic.vector_weight must be between 0 and 1")
+	}
+	return nil
+}
+
+// elasticStore keeps chunks in an Elasticsearch or OpenSearch index with the
+// text analysed for BM25, the embedding as a dense vector and the metadata
+// as a flattened object, and searches both in one hybrid query.
+type elasticStore struct {
+	cfg      ElasticConfig
+	index    string
+	embedder Embedder
+}
+
+func newElasticStore(embedder Embedder) elasticStore {
+	return elasticStore{
+		cfg:      getConfig().VectorStore.Elastic,
+		index:    getConfig().Embedding.Collection,
+		embedder: embedder,
+	}
+}
+
+func (s elasticStore) request(ctx context.Context, method, path, contentType string, body io.Reader, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(s.cfg.URL, "/")+path, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if s.cfg.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+os.ExpandEnv(s.cfg.APIKey))
+	} else if s.cfg.Username != "" {
+		req.SetBasicAuth(s.cfg.Username, os.ExpandEnv(s.cfg.Password))
+	}
+
+	resp, err := elasticClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: unexpected status code %d, body: %s", method, path, resp.StatusCode, string(respBody))
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
+
+func (s elasticStore) requestJSON(ctx context.Context, method, path string, body any, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	return s.request(ctx, method, path, "application/json", reader, out)
+}
+
+// ensureIndex creates the index with vector, text and metadata mappings
+// unless it exists.
+func (s elasticStore) ensureIndex(ctx context.Context) error {
+	err := s.requestJSON(ctx, "HEAD", "/"+s.index, nil, nil)
+	if err == nil {
+		return nil
+	}
+
+	dims, err := embeddingDimensions(ctx, s.embedder)
+	if err != nil {
+		return err
+	}
+
+	var body map[string]any
+	if s.cfg.Flavor == FlavorOpenSearch {
+		body = map[string]any{
+			"settings": map[string]any{"index": map[string]any{"knn": true}},
+			"mappings": map[string]any{"properties": map[string]any{
+				"content": map[string]any{"type": "text"},
+				"vector": map[string]any{
+					"type":      "knn_vector",
+					"dimension": dims,
+					"method":    map[string]any{"name": "hnsw", "space_type": "cosinesimil", "engine": "lucene"},
+				},
+				"metadata": map[string]any{"type": "flat_object"},
+			}},
+		}
+	} else {
+		body = map[string]any{
+			"mappings": map[string]any{"properties": map[string]any{
+				"content":  map[string]any{"type": "text"},
+				"vector":   map[string]any{"type": "dense_vector", "dims": dims, "index": true, "similarity": "cosine"},
+				"metadata": map[string]any{"type": "flattened"},
+			}},
+		}
+	}
+
+	if err := s.requestJSON(ctx, "PUT", "/"+s.index, body, nil); err != nil {
+		return fmt.Errorf("failed to create index %s: %v", s.index, err)
+	}
+	return nil
+}
+
+func (s elasticStore) AddDocuments(ctx context.Context, docs []schema.Document, _ ...vectorstores.Option) ([]string, error) {
+	texts := make([]string, len(docs))
+	for i, doc := range docs {
+		texts[i] = doc.PageContent
+	}
+	vectors, err := s.embedder.EmbedDocuments(ctx, texts)
+	if err != nil {
+		return nil, err
+	}
+
+	var bulk bytes.Buffer
+	encoder := json.NewEncoder(&bulk)
+	ids := make([]string, len(docs))
+	for i, doc := range docs {
+		ids[i] = uuid.New().String()
+		if id, ok := doc.Metadata["id"].(string); ok {
+			ids[i] = id
+		}
+		encoder.Encode(map[string]any{"index": map[string]any{"_index": s.index, "_id": ids[i]}})
+		encoder.Encode(map[string]any{"content": doc.PageContent, "vector": vectors[i], "metadata": doc.Metadata})
+	}
+
+	var resp struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Error any `json:"error"`
+		} `json:"items"`
+	}
+	if err := s.request(ctx, "POST", "/_bulk?refresh=true", "application/x-ndjson", &bulk, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Errors {
+		for _, item := range resp.Items {
+			for _, result := range item {
+				if result.Error != nil {
+					return nil, fmt.Errorf("bulk indexing failed: %v", result.Error)
+				}
+			}
+		}
+	}
+	return ids, nil
+}
+
+func (s elasticStore) SimilaritySearch(ctx context.Context, query string, numDocuments int, options ...vectorstores.Option) ([]schema.Document, error) {
+	opts := vectorstores.Options{}
+	for _, option := range options {
+		option(&opts)
+	}
+	filter, _ := opts.Filters.(map[string]any)
+
+	vector, err := s.embedder.EmbedQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	vectorWeight := s.cfg.VectorWeight
+	textQuery := map[string]any{"match": map[string]any{"content": map[string]any{"query": query, "boost": 1 - vectorWeight}}}
+
+	var body map[string]any
+	if s.cfg.Flavor == FlavorOpenSearch {
+		knn := map[string]any{"knn": map[string]any{"vector": map[string]any{"vector": vector, "k": numDocuments, "boost": vectorWeight}}}
+		body = map[string]any{
+			"size":  numDocuments,
+			"query": map[string]any{"bool": boolQuery([]any{knn, textQuery}, filter)},
+		}
+	} else {
+		knn := map[string]any{
+			"field":          "vector",
+			"query_vector":   vector,
+			"k":              numDocuments,
+			"num_candidates": numDocuments * 10,
+			"boost":          vectorWeight,
+		}
+		if len(filter) > 0 {
+			knn["filter"] = map[string]any{"bool": filter}
+		}
+		body = map[string]any{
+			"size":  numDocuments,
+			"knn":   knn,
+			"query": map[string]any{"bool": boolQuery([]any{textQuery}, filter)},
+		}
+	}
+	body["_source"] = []string{"content", "metadata"}
+
+	var resp struct {
+		Hits struct {
+			Hits []struct {
+				Score  float32 `json:"_score"`
+				Source struct {
+					Content  string         `json:"content"`
+					Metadata map[string]any `json:"metadata"`
+				} `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := s.requestJSON(ctx, "POST", "/"+s.index+"/_search", body, &resp); err != nil {
+		return nil, err
+	}
+
+	docs := make([]schema.Document, 0, len(resp.Hits.Hits))
+	for _, hit := range resp.Hits.Hits {
+		docs = append(docs, schema.Document{
+			PageContent: hit.Source.Content,
+			Metadata:    hit.Source.Metadata,
+			Score:       hit.Score,
+		})
+	}
+	return docs, nil
+}
+
+func boolQuery(should []any, filter map[string]any) map[string]any {
+	query := map[string]any{"should": should}
+	for clause, conditions := range filter {
+		query[clause] = conditions
+	}
+	return query
+}
+
+func (s elasticStore) Chunks(ctx context.Context, filter Filter, limit int) ([]schema.Document, error) {
+	clauses, _ := elasticFilter(filter).(map[string]any)
+	var docs []schema.Document
+	var after any
+	for len(docs) < limit {
+		size := min(1000, limit-len(docs))
+		body := map[string]any{
+			"size":    size,
+			"query":   map[string]any{"bool": clauses},
+			"sort":    []any{"_doc"},
+			"_source": []string{"content", "metadata"},
+		}
+		if after != nil {
+			body["search_after"] = after
+		}
+
+		var resp struct {
+			Hits struct {
+				Hits []struct {
+					Sort   any `json:"sort"`
+					Source struct {
+						Content  string         `json:"content"`
+						Metadata map[string]any `json:"metadata"`
+					} `json:"_source"`
+				} `json:"hits"`
+			} `json:"hits"`
+		}
+		if err := s.requestJSON(ctx, "POST", "/"+s.index+"/_search", body, &resp); err != nil {
+			return nil, err
+		}
+		for _, hit := range resp.Hits.Hits {
+			docs = append(docs, schema.Document{PageContent: hit.Source.Content, Metadata: hit.Source.Metadata})
+			after = hit.Sort
+		}
+		if len(resp.Hits.Hits) < size {
+			break
+		}
+	}
+	return docs, nil
+}
+
+// elasticFilter turns a Filter into the "filter" and "must_not" clauses of a
+// bool query over the flattened metadata.
+func elasticFilter(filter Filter) any {
+	if filter.empty() {
+		return nil
+	}
+
+	clauses := map[string]any{}
+	conditions := elasticConditions(filter.Match)
+	for _, r := range filter.Ranges {
+		var anyOf []map[string]any
+		for _, field := range r.Fields {
+			anyOf = append(anyOf, map[string]any{"range": map[string]any{"metadata." + field: r.bounds(rfc3339)}})
+		}
+		conditions = append(conditions, map[string]any{"bool": map[string]any{"should": anyOf, "minimum_should_match": 1}})
+	}
+	if len(conditions) > 0 {
+		clauses["filter"] = conditions
+	}
+	if conditions := elasticConditions(filter.Exclude); len(conditions) > 0 {
+		clauses["must_not"] = conditions
+	}
+	return clauses
+}
+
+func elasticConditions(pairs map[string]any) []map[string]any {
+	conditions := make([]map[string]any, 0, len(pairs))
+	for key, value := range pairs {
+		field := "metadata." + key
+		if values, ok := value.([]any); ok {
+			conditions = append(conditions, map[string]any{"terms": map[string]any{field: values}})
+			continue
+		}
+		conditions = append(conditions, map[string]any{"term": map[string]any{field: value}})
+	}
+	return conditions
+}
+
+func (s elasticStore) Sources(ctx context.Context) ([]SourceInfo, error) {
+	sources := sourceAccumulator{}
+	var after any
+	for {
+		composite := map[string]any{
+			"size": 1000,
+			"sources": []any{
+				map[string]any{"source": map[string]any{"terms": map[string]any{"field": "metadata.source"}}},
+				map[string]any{"deleted_at": map[string]any{"terms": map[string]any{"field": "metadata.deleted_at", "missing_bucket": true}}},
+			},
+		}
+		if after != nil {
+			composite["after"] = after
+		}
+		body := map[string]any{"size": 0, "aggs": map[string]any{"sources": map[string]any{"composite": composite}}}
+
+		var resp struct {
+			Aggregations struct {
+				Sources struct {
+					AfterKey any `json:"after_key"`
+					Buckets  []struct {
+						Key struct {
+							Source    string `json:"source"`
+							DeletedAt string `json:"deleted_at"`
+						} `json:"key"`
+						DocCount int `json:"doc_count"`
+					} `json:"buckets"`
+				} `json:"sources"`
+			} `json:"aggregations"`
+		}
+		if err := s.requestJSON(ctx, "POST", "/"+s.index+"/_search", body, &resp); err != nil {
+			return nil, err
+		}
+		for _, bucket := range resp.Aggregations.Sources.Buckets {
+			// Soft deletion sets deleted_at and restoring clears it
+			sources.add(bucket.Key.Source, bucket.DocCount, bucket.Key.DeletedAt != "", bucket.Key.DeletedAt)
+		}
+		if len(resp.Aggregations.Sources.Buckets) == 0 || resp.Aggregations.Sources.AfterKey == nil {
+			return sources.list(), nil
+		}
+		after = resp.Aggregations.Sources.AfterKey
+	}
+}
+
+func (s elasticStore) DeleteWhere(ctx context.Context, filter map[string]any) (int, error) {
+	clauses, _ := elasticFilter(Filter{Match: filter}).(map[string]any)
+	body := map[string]any{"query": map[string]any{"bool": clauses}}
+
+	var resp struct {
+		Deleted int `json:"deleted"`
+	}
+	err := s.requestJSON(ctx, "POST", "/"+s.index+"/_delete_by_query?refresh=true", body, &resp)
+	return resp.Deleted, err
+}
+
+func (s elasticStore) UpdateWhere(ctx context.Context, filter map[string]any, fields map[string]any) (int, error) {
+	clauses, _ := elasticFilter(Filter{Match: filter}).(map[string]any)
+	body := map[string]any{
+		"query": map[string]any{"bool": clauses},
+		"script": map[string]any{
+			"source": "for (entry in params.fields.entrySet()) { ctx._source.metadata[entry.getKey()] = entry.getValue() }",
+			"params": map[string]any{"fields": fields},
+		},
+	}
+
+	var resp struct {
+		Updated int `json:"updated"`
+	}
+	err := s.requestJSON(ctx, "POST", "/"+s.index+"/_update_by_query?refresh=true&conflicts=proceed", body, &resp)
+	return resp.Updated, err
+}
+
+func (s elasticStore) Values(ctx context.Context, filter map[string]any, field string) ([]any, error) {
+	clauses, _ := elasticFilter(Filter{Match: filter}).(map[string]any)
+	body := map[string]any{
+		"size":  0,
+		"query": map[string]any{"bool": clauses},
+		"aggs":  map[string]any{"values": map[string]any{"terms": map[string]any{"field": "metadata." + field, "size": 10000}}},
+	}
+
+	var resp struct {
+		Aggregations struct {
+			Values struct {
+				Buckets []struct {
+					Key any `json:"key"`
+				} `json:"buckets"`
+			} `json:"values"`
+		} `json:"aggregations"`
+	}
+	if err := s.requestJSON(ctx, "POST", "/"+s.index+"/_search", body, &resp); err != nil {
+		return nil, err
+	}
+
+	values := make([]any, 0, len(resp.Aggregations.Values.Buckets))
+	for _, bucket := range resp.Aggregations.Values.Buckets {
+		values = append(values, bucket.Key)
+	}
+	return values, nil
+}
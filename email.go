@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/tmc/langchaingo/schema"
+)
+
+var (
+	// Lines that introduce a quoted earlier message; everything after them is dropped
+	replyHeaderPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`^On .+ wrote:\s*$`),
+		regexp.MustCompile(`^-{2,}\s*Original Message\s*-{2,}`),
+		regexp.MustCompile(`^-{2,}\s*Forwarded message\s*-{2,}`),
+		regexp.MustCompile(`^From: .+`), // Outlook style quoted header block
+		regexp.MustCompile(`^_{10,}\s*$`),
+	}
+	// Lines that start a signature; everything after them is dropped
+	signaturePatterns = []*regexp.Regexp{
+		regexp.MustCompile(`^-- ?$`),
+		regexp.MustCompile(`^Sent from my .+`),
+		regexp.MustCompile(`^Get Outlook for .+`),
+	}
+	messageIDPattern = regexp.MustCompile(`<[^>]+>`)
+)
+
+var headerDecoder = mime.WordDecoder{}
+
+// loadEmails parses an .eml message or an .mbox mailbox into one document per
+// message, with quoted replies and signatures removed so each chunk holds
+// only what that message added.
+func loadEmails(filename string) ([]schema.Document, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := [][]byte{data}
+	if strings.EqualFold(filepath.Ext(filename), ".mbox") {
+		raw = splitMbox(data)
+	}
+
+	var docs []schema.Document
+	for i, message := range raw {
+		doc, err := parseEmail(message)
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %v", i+1, err)
+		}
+		if doc.PageContent == "" {
+			continue
+		}
+		doc.Metadata["source"] = filename
+		docs = append(docs, doc)
+	}
+
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("no messages with text in %s", filename)
+	}
+	return docs, nil
+}
+
+func parseEmail(raw []byte) (schema.Document, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return schema.Document{}, err
+	}
+
+	body, err := emailText(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	if err != nil {
+		return schema.Document{}, err
+	}
+
+	subject := decodeHeader(msg.Header.Get("Subject"))
+	messageID := strings.TrimSpace(msg.Header.Get("Message-Id"))
+
+	metadata := map[string]any{
+		"subject":    subject,
+		"message_id": messageID,
+		"thread_id":  threadID(msg.Header, messageID),
+	}
+	if from, err := mail.ParseAddress(decodeHeader(msg.Header.Get("From"))); err == nil {
+		metadata["sender"] = strings.ToLower(from.Address)
+		metadata["sender_name"] = from.Name
+	}
+	if to, err := msg.Header.AddressList("To"); err == nil {
+		recipients := make([]string, 0, len(to))
+		for _, addr := range to {
+			recipients = append(recipients, strings.ToLower(addr.Address))
+		}
+		metadata["recipients"] = recipients
+	}
+	if date, err := msg.Header.Date(); err == nil {
+		metadata["date"] = date.UTC().Format(time.RFC3339)
+		metadata["updated_at"] = metadata["date"]
+	}
+
+	text := stripQuotedReplies(body)
+	if text != "" && subject != "" {
+		text = "Subject: " + subject + "\n" + text
+	}
+	return schema.Document{PageContent: text, Metadata: metadata}, nil
+}
+
+// threadID identifies the conversation a message belongs to: the first
+// message referenced, falling back to the message it replies to and then to
+// the message itself.
+func threadID(header mail.Header, messageID string) string {
+	if ids := messageIDPattern.FindAllString(header.Get("References"), -1); len(ids) > 0 {
+		return ids[0]
+	}
+	if id := messageIDPattern.FindString(header.Get("In-Reply-To")); id != "" {
+		return id
+	}
+	return messageID
+}
+
+// emailText returns the plain text of a message body, preferring text/plain
+// parts and falling back to the readable text of text/html parts.
+func emailText(contentType, encoding string, body io.Reader) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		var plain, htmlText string
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", err
+			}
+			if strings.HasPrefix(part.Header.Get("Content-Disposition"), "attachment") {
+				continue
+			}
+			text, err := emailText(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+			if err != nil {
+				return "", err
+			}
+			partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			switch {
+			case plain == "" && (partType == "text/plain" || strings.HasPrefix(partType, "multipart/")):
+				plain = text
+			case htmlText == "" && partType == "text/html":
+				htmlText = text
+			}
+		}
+		if plain != "" {
+			return plain, nil
+		}
+		return htmlText, nil
+	}
+
+	if !strings.HasPrefix(mediaType, "text/") {
+		return "", nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+
+	if mediaType == "text/html" {
+		_, sections, err := parseHTML(bytes.NewReader(data))
+		if err != nil {
+			return "", err
+		}
+		parts := make([]string, 0, len(sections))
+		for _, section := range sections {
+			parts = append(parts, strings.TrimSpace(section.Heading+"\n"+section.Text))
+		}
+		return strings.Join(parts, "\n"), nil
+	}
+	return string(data), nil
+}
+
+// stripQuotedReplies drops quoted lines, everything after a reply header
+// ("On ... wrote:", "-----Original Message-----") and the signature.
+func stripQuotedReplies(body string) string {
+	var kept []string
+	scanner := bufio.NewScanner(strings.NewReader(strings.ReplaceAll(body, "\r\n", "\n")))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+lines:
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, ">") {
+			continue
+		}
+		for _, pattern := range replyHeaderPatterns {
+			if pattern.MatchString(trimmed) {
+				break lines
+			}
+		}
+		for _, pattern := range signaturePatterns {
+			if pattern.MatchString(strings.TrimRight(line, " \t")) || pattern.MatchString(trimmed) {
+				break lines
+			}
+		}
+		kept = append(kept, line)
+	}
+
+	return normalizeWhitespace(strings.Join(kept, "\n"))
+}
+
+// splitMbox splits an mbox file at its "From " separator lines and undoes
+// the ">From " quoting of body lines.
+func splitMbox(data []byte) [][]byte {
+	var messages [][]byte
+	var current bytes.Buffer
+	inMessage := false
+
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if bytes.HasPrefix(line, []byte("From ")) {
+			if inMessage && current.Len() > 0 {
+				messages = append(messages, append([]byte(nil), current.Bytes()...))
+			}
+			current.Reset()
+			inMessage = true
+			continue
+		}
+		if !inMessage {
+			continue
+		}
+		if bytes.HasPrefix(line, []byte(">From ")) {
+			line = line[1:]
+		}
+		current.Write(line)
+	}
+	if inMessage && current.Len() > 0 {
+		messages = append(messages, current.Bytes())
+	}
+	return messages
+}
+
+func decodeHeader(value string) string {
+	decoded, err := headerDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tmc/langchaingo/embeddings"
+)
+
+const migrateScrollSize = 128
+
+// crossLingualPairs are translations of the same sentence, used to check that
+// the embedding model maps languages into a shared space.
+var crossLingualPairs = [][2]string{
+	{"The patient was admitted to the hospital with chest pain.", "El paciente ingresó en el hospital con dolor en el pecho."},
+	{"How much does the treatment cost?", "Combien coûte le traitement ?"},
+	{"The invoice must be paid within thirty days.", "Die Rechnung muss innerhalb von dreißig Tagen bezahlt werden."},
+}
+
+// newEmbedder returns the configured embedding model, or the chat model when
+// none is set.
+func newEmbedder() (Embedder, error) {
+	if fakeLLMMode {
+		return FakeEmbedder{}, nil
+	}
+
+	embeddingLLM, err := newOllama(embeddingModel())
+	if err != nil {
+		return nil, err
+	}
+	embedder, err := embeddings.NewEmbedder(embeddingLLM)
+	if err != nil {
+		return nil, err
+	}
+	return breakerEmbedder{embedder}, nil
+}
+
+func embeddingModel() string {
+	if model := getConfig().Embedding.Model; model != "" {
+		return model
+	}
+	return getConfig().LLM.Model
+}
+
+// embeddingDimensions returns the configured vector size, or probes the
+// embedder for it.
+func embeddingDimensions(ctx context.Context, embedder Embedder) (int, error) {
+	if dims := getConfig().Embedding.Dimensions; dims > 0 {
+		return dims, nil
+	}
+	vector, err := embedder.EmbedQuery(ctx, "dimension probe")
+	if err != nil {
+		return 0, fmt.Errorf("failed to embed probe: %v", err)
+	}
+	return len(vector), nil
+}
+
+// collectionVectors returns the vector sizes of an existing collection by
+// name, "" naming the unnamed vector of collections with a single one, and
+// whether the collection exists.
+func collectionVectors(ctx context.Context, collection string) (map[string]int, bool, error) {
+	resp, err := qdrantDo(ctx, "GET", "/collections/"+collection, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to check collection: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, false, fmt.Errorf("failed to check collection: unexpected status code %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	var info struct {
+		Result struct {
+			Config struct {
+				Params struct {
+					Vectors map[string]json.RawMessage `json:"vectors"`
+				} `json:"params"`
+			} `json:"config"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, true, fmt.Errorf("failed to decode collection info: %v", err)
+	}
+	vectors := info.Result.Config.Params.Vectors
+	sizes := map[string]int{}
+	if size, ok := vectors["size"]; ok {
+		var n int
+		if err := json.Unmarshal(size, &n); err != nil {
+			return nil, true, fmt.Errorf("failed to decode collection info: %v", err)
+		}
+		sizes[""] = n
+		return sizes, true, nil
+	}
+	for name, raw := range vectors {
+		var params struct {
+			Size int `json:"size"`
+		}
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, true, fmt.Errorf("failed to decode collection info: %v", err)
+		}
+		sizes[name] = params.Size
+	}
+	return sizes, true, nil
+}
+
+// ensureCollection creates the collection sized for the embedder, or checks
+// that an existing one matches it, and the payload indexes its schema
+// declares.
+func ensureCollection(ctx context.Context, embedder Embedder, collection string) error {
+	dims, err := embeddingDimensions(ctx, embedder)
+	if err != nil {
+		return err
+	}
+
+	sizes, exists, err := collectionVectors(ctx, collection)
+	if err != nil {
+		return err
+	}
+	size := sizes[""]
+	if lateInteraction(collection) {
+		size = sizes[denseVector]
+	}
+	if _, ok := sizes[tokenVector]; exists && ok != lateInteraction(collection) {
+		return fmt.Errorf("collection %s does not match late_interaction.collections: it must be created anew, "+
+			"e.g. by re-embedding it into a new collection with POST /collections/migrate", collection)
+	}
+	if exists && size != dims {
+		return fmt.Errorf("collection %s holds %d-dimensional vectors but the embedding model produces %d; "+
+			"re-embed it into a new collection with POST /collections/migrate", collection, size, dims)
+	}
+	if !exists {
+		if err := createCollectionIfNotExists(ctx, collection, dims); err != nil {
+			return err
+		}
+	}
+	return ensurePayloadIndexes(ctx, collection)
+}
+
+func cosineSimilarity(a, b []float32) float64 {
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// checkEmbeddings reports the embedding model's dimensions and how well it
+// aligns translations: each sentence should be closer to its translation
+// than to the other sentences.
+func checkEmbeddings(c *gin.Context) {
+	embedder, err := newEmbedder()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	var texts []string
+	for _, pair := range crossLingualPairs {
+		texts = append(texts, pair[0], pair[1])
+	}
+	vectors, err := embedder.EmbedDocuments(c.Request.Context(), texts)
+	if err != nil {
+		c.JSON(502, gin.H{"error": fmt.Sprintf("failed to embed: %v", err)})
+		return
+	}
+
+	var aligned, unrelated float64
+	var unrelatedCount, matched int
+	for i := range crossLingualPairs {
+		source, translation := vectors[2*i], vectors[2*i+1]
+		pairScore := cosineSimilarity(source, translation)
+		aligned += pairScore
+
+		best := true
+		for j := range crossLingualPairs {
+			if j == i {
+				continue
+			}
+			score := cosineSimilarity(source, vectors[2*j+1])
+			unrelated += score
+			unrelatedCount++
+			if score >= pairScore {
+				best = false
+			}
+		}
+		if best {
+			matched++
+		}
+	}
+
+	cfg := getConfig()
+	model := embeddingModel()
+	if fakeLLMMode {
+		model = "fake"
+	}
+	c.JSON(200, gin.H{
+		"model":      model,
+		"dimensions": len(vectors[0]),
+		"collection": cfg.Embedding.Collection,
+		"cross_lingual": gin.H{
+			"aligned_similarity":   aligned / float64(len(crossLingualPairs)),
+			"unrelated_similarity": unrelated / float64(unrelatedCount),
+			"matched":              matched,
+			"pairs":                len(crossLingualPairs),
+			"ok":                   matched == len(crossLingualPairs),
+		},
+	})
+}
+
+type MigrateRequest struct {
+	Source string `json:"source"` // Defaults to the configured collection
+	Target string `json:"target"`
+}
+
+// migrateCollection re-embeds every chunk of the source collection with the
+// configured embedding model into the target collection, as a background
+// job. Point IDs and payloads are kept; point embedding.collection at the
+// target once the job completes.
+func migrateCollection(c *gin.Context) {
+	var req MigrateRequest
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	if req.Source == "" {
+		req.Source = getConfig().Embedding.Collection
+	}
+	if getConfig().VectorStore.Backend != StoreQdrant {
+		c.JSON(400, gin.H{"error": "collection migration is only supported on qdrant"})
+		return
+	}
+	if req.Target == "" || req.Target == req.Source {
+		c.JSON(400, gin.H{"error": "target must name a collection other than the source"})
+		return
+	}
+
+	job := jobRegistry.create(fmt.Sprintf("migrate:%s->%s", req.Source, req.Target))
+	go runMigrateJob(job.ID, req)
+
+	c.JSON(202, job)
+}
+
+func runMigrateJob(jobID string, req MigrateRequest) {
+	job := jobRegistry.update(jobID, func(job *Job) { job.Status = JobRunning })
+	emitJobEvent(EventIngestionStarted, job)
+
+	if err := migrateEmbeddings(context.Background(), jobID, req); err != nil {
+		log.Printf("Migration job %s failed: %v", jobID, err)
+		job = jobRegistry.update(jobID, func(job *Job) {
+			job.Status = JobFailed
+			job.recordError(err.Error())
+		})
+		emitJobEvent(EventIngestionFailed, job)
+		return
+	}
+
+	job = jobRegistry.update(jobID, func(job *Job) {
+		job.Status = JobCompleted
+		job.Progress = 100
+	})
+	emitJobEvent(EventIngestionCompleted, job)
+}
+
+type qdrantPoint struct {
+	ID      any            `json:"id"`
+	Vector  any            `json:"vector,omitempty"` // []float32, or vectors by name in late-interaction collections
+	Payload map[string]any `json:"payload"`
+}
+
+func migrateEmbeddings(ctx context.Context, jobID string, req MigrateRequest) error {
+	embedder, err := newEmbedder()
+	if err != nil {
+		return err
+	}
+
+	total, err := countPoints(req.Source, nil)
+	if err != nil {
+		return err
+	}
+	jobRegistry.update(jobID, func(job *Job) { job.Total = total })
+
+	if err := ensureCollection(ctx, embedder, req.Target); err != nil {
+		return err
+	}
+
+	var offset any
+	processed := 0
+	for {
+		points, next, err := scrollPoints(req.Source, offset, migrateScrollSize, true, nil)
+		if err != nil {
+			return err
+		}
+		if len(points) == 0 {
+			return nil
+		}
+
+		texts := make([]string, len(points))
+		for i, point := range points {
+			texts[i], _ = point.Payload["content"].(string)
+		}
+		dense, err := embedder.EmbedDocuments(ctx, texts)
+		if err != nil {
+			return fmt.Errorf("failed to embed batch: %v", err)
+		}
+		vectors, err := pointVectors(ctx, req.Target, texts, dense)
+		if err != nil {
+			return fmt.Errorf("failed to embed batch: %v", err)
+		}
+		for i := range points {
+			points[i].Vector = vectors[i]
+		}
+		if err := upsertPoints(req.Target, points); err != nil {
+			return err
+		}
+
+		processed += len(points)
+		jobRegistry.update(jobID, func(job *Job) {
+			job.Processed = processed
+			if job.Total > 0 {
+				job.Progress = float64(processed) / float64(job.Total) * 100
+			}
+		})
+
+		if next == nil {
+			return nil
+		}
+		offset = next
+	}
+}
+
+func countPoints(collection string, filter any) (int, error) {
+	body := map[string]any{"exact": true}
+	if filter != nil {
+		body["filter"] = filter
+	}
+
+	var resp struct {
+		Result struct {
+			Count int `json:"count"`
+		} `json:"result"`
+	}
+	err := qdrantRequest("POST", fmt.Sprintf("/collections/%s/points/count", collection), body, &resp)
+	return resp.Result.Count, err
+}
+
+// scrollPoints pages through a collection. withPayload is true or the list
+// of payload fields to return; filter is a Qdrant filter or nil.
+func scrollPoints(collection string, offset any, limit int, withPayload any, filter any) ([]qdrantPoint, any, error) {
+	body := map[string]any{"limit": limit, "with_payload": withPayload, "with_vector": false}
+	if offset != nil {
+		body["offset"] = offset
+	}
+	if filter != nil {
+		body["filter"] = filter
+	}
+
+	var resp struct {
+		Result struct {
+			Points         []qdrantPoint `json:"points"`
+			NextPageOffset any           `json:"next_page_offset"`
+		} `json:"result"`
+	}
+	if err := qdrantRequest("POST", fmt.Sprintf("/collections/%s/points/scroll", collection), body, &resp); err != nil {
+		return nil, nil, err
+	}
+	return resp.Result.Points, resp.Result.NextPageOffset, nil
+}
+
+func upsertPoints(collection string, points []qdrantPoint) error {
+	return qdrantRequest("PUT", fmt.Sprintf("/collections/%s/points?wait=true", collection), map[string]any{"points": points}, nil)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/schema"
+)
+
+// Extractor derives metadata from a chunk during ingestion. Whatever it
+// writes to doc.Metadata is stored in the vector store payload and can be
+// used as a chat filter.
+type Extractor interface {
+	Name() string
+	Extract(ctx context.Context, doc *schema.Document) error
+}
+
+var extractorFactories = map[string]func(llm Generator, cfg EnrichmentConfig) Extractor{
+	"keywords": func(_ Generator, cfg EnrichmentConfig) Extractor { return keywordExtractor{max: cfg.MaxKeywords} },
+	"language": func(_ Generator, _ EnrichmentConfig) Extractor { return languageExtractor{} },
+	"summary":  func(llm Generator, _ EnrichmentConfig) Extractor { return summaryExtractor{llm: llm} },
+	"entities": func(llm Generator, _ EnrichmentConfig) Extractor { return entityExtractor{llm: llm} },
+}
+
+func newExtractors(names []string, llm Generator) ([]Extractor, error) {
+	cfg := getConfig().Enrichment
+
+	extractors := make([]Extractor, 0, len(names))
+	for _, name := range names {
+		factory, ok := extractorFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown extractor %q", name)
+		}
+		extractors = append(extractors, factory(llm, cfg))
+	}
+	return extractors, nil
+}
+
+// enrichDocuments runs every extractor over every document. A failing
+// extractor leaves that document without its fields; the errors are returned
+// so the job can report them.
+func enrichDocuments(ctx context.Context, docs []schema.Document, extractors []Extractor) []error {
+	var errs []error
+	for i := range docs {
+		if docs[i].Metadata == nil {
+			docs[i].Metadata = map[string]any{}
+		}
+		for _, extractor := range extractors {
+			if err := extractor.Extract(ctx, &docs[i]); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", extractor.Name(), err))
+			}
+		}
+	}
+	return errs
+}
+
+type keywordExtractor struct {
+	max int
+}
+
+func (keywordExtractor) Name() string { return "keywords" }
+
+func (e keywordExtractor) Extract(_ context.Context, doc *schema.Document) error {
+	doc.Metadata["keywords"] = extractKeywords(doc.PageContent, e.max)
+	return nil
+}
+
+// extractKeywords returns the most frequent non-stopword terms of text.
+func extractKeywords(text string, max int) []string {
+	counts := map[string]int{}
+	var order []string
+	for _, word := range tokenize(text) {
+		if len(word) < 3 || isStopword(word) || isNumeric(word) {
+			continue
+		}
+		if counts[word] == 0 {
+			order = append(order, word)
+		}
+		counts[word]++
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		return counts[order[i]] > counts[order[j]]
+	})
+	if len(order) > max {
+		order = order[:max]
+	}
+	return order
+}
+
+type languageExtractor struct{}
+
+func (languageExtractor) Name() string { return "language" }
+
+func (languageExtractor) Extract(_ context.Context, doc *schema.Document) error {
+	doc.Metadata["language"] = detectLanguage(doc.PageContent)
+	return nil
+}
+
+type summaryExtractor struct {
+	llm Generator
+}
+
+func (summaryExtractor) Name() string { return "summary" }
+
+func (e summaryExtractor) Extract(ctx context.Context, doc *schema.Document) error {
+	prompt := "Write a short title (at most 8 words) and a one-sentence summary of the text below. " +
+		"Respond with JSON of the form {\"title\": \"...\", \"summary\": \"...\"}.\n\nText:\n" + doc.PageContent
+
+	var result struct {
+		Title   string `json:"title"`
+		Summary string `json:"summary"`
+	}
+	if err := generateJSON(ctx, e.llm, prompt, &result); err != nil {
+		return err
+	}
+
+	doc.Metadata["title"] = result.Title
+	doc.Metadata["summary"] = result.Summary
+	return nil
+}
+
+type entityExtractor struct {
+	llm Generator
+}
+
+func (entityExtractor) Name() string { return "entities" }
+
+func (e entityExtractor) Extract(ctx context.Context, doc *schema.Document) error {
+	prompt := "Extract the named entities mentioned in the text below. " +
+		"Respond with JSON of the form {\"people\": [], \"organizations\": [], \"medications\": [], \"conditions\": []}. " +
+		"Use empty lists when there are none.\n\nText:\n" + doc.PageContent
+
+	var result map[string][]string
+	if err := generateJSON(ctx, e.llm, prompt, &result); err != nil {
+		return err
+	}
+
+	var all []string
+	seen := map[string]bool{}
+	byType := map[string]any{}
+	for kind, names := range result {
+		normalized := make([]string, 0, len(names))
+		for _, name := range names {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			normalized = append(normalized, name)
+			if !seen[name] {
+				seen[name] = true
+				all = append(all, name)
+			}
+		}
+		byType[kind] = normalized
+	}
+
+	doc.Metadata["entities"] = all
+	doc.Metadata["entities_by_type"] = byType
+	return nil
+}
+
+func generateJSON(ctx context.Context, llm Generator, prompt string, v any) error {
+	response, err := llms.GenerateFromSinglePrompt(ctx, llm, prompt, llms.WithJSONMode())
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(response), v); err != nil {
+		return fmt.Errorf("invalid JSON from model: %v", err)
+	}
+	return nil
+}
+
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func isNumeric(word string) bool {
+	for _, r := range word {
+		if !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
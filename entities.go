@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tmc/langchaingo/schema"
+)
+
+// entityField is the payload field the entities enrichment lists a chunk's
+// entities in, lower-cased.
+const entityField = "entities"
+
+// entityNameWords is the length of the longest entity names questions are
+// searched for.
+const entityNameWords = 4
+
+// entityFilterPattern matches entity:"name" and entity:name in a question.
+var entityFilterPattern = regexp.MustCompile(`(?i)\bentity:(?:"([^"]*)"|(\S+))`)
+
+type EntitiesConfig struct {
+	Routing bool `json:"routing"` // Filter questions naming indexed entities on them, and route those comparing several to compare mode
+}
+
+// EntityRecord is an entity of the index and how widely the latest versions
+// of the documents mention it.
+type EntityRecord struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"` // e.g. "people" or "medications"
+	Chunks    int    `json:"chunks"`
+	Documents int    `json:"documents"`
+}
+
+// EntityMention is a document mentioning an entity.
+type EntityMention struct {
+	Document string `json:"document"`
+	Version  int    `json:"version"`
+	Chunks   int    `json:"chunks"`
+}
+
+// parseEntityFilters takes the entity:"name" terms out of a question and
+// filters its chunks on them: chunks mentioning any of the entities match.
+// A question of entity terms alone asks about the entities.
+func parseEntityFilters(msg *Message) {
+	matches := entityFilterPattern.FindAllStringSubmatch(msg.Msg, -1)
+	if len(matches) == 0 {
+		return
+	}
+	var names []string
+	for _, match := range matches {
+		if name := strings.ToLower(strings.TrimSpace(match[1] + match[2])); name != "" {
+			names = append(names, name)
+		}
+	}
+	msg.Msg = strings.Join(strings.Fields(entityFilterPattern.ReplaceAllString(msg.Msg, "")), " ")
+	if msg.Msg == "" {
+		msg.Msg = strings.Join(names, ", ")
+	}
+	if len(names) > 0 {
+		msg.Filter = withEntities(msg.Filter, names)
+	}
+}
+
+func withEntities(filter map[string]any, names []string) map[string]any {
+	result := make(map[string]any, len(filter)+1)
+	for key, value := range filter {
+		result[key] = value
+	}
+	values := make([]any, len(names))
+	for i, name := range names {
+		values[i] = name
+	}
+	result[entityField] = values
+	return result
+}
+
+// routeEntities looks up the indexed entities a question sent without an
+// entity filter names, with entities.routing on. A question naming several
+// sent without a mode that compares them goes to compare mode; otherwise its
+// chunks are filtered on them. It returns the mode and the entities.
+func routeEntities(ctx context.Context, msg *Message, mode string) (string, []string) {
+	if !getConfig().Entities.Routing || (mode != "" && mode != ModeRAG) || msg.Filter[entityField] != nil {
+		return mode, nil
+	}
+	names, err := metadataStore.mentionedEntities(ctx, msg.Msg)
+	if err != nil {
+		log.Printf("Error looking up the entities of %q: %v", msg.Msg, err)
+		return mode, nil
+	}
+	if len(names) == 0 {
+		return mode, nil
+	}
+	if msg.Mode == "" && len(names) > 1 && classifyQuestion(msg.Msg) == QuestionComparison {
+		log.Printf("Routed query naming %s to compare mode", strings.Join(names, ", "))
+		return ModeCompare, names
+	}
+	log.Printf("Filtering query on the entities %s", strings.Join(names, ", "))
+	msg.Filter = withEntities(msg.Filter, names)
+	return mode, names
+}
+
+// addEntities indexes the entities the entities enrichment found in a
+// stored batch.
+func (s *MetadataStore) addEntities(ctx context.Context, batch []schema.Document) error {
+	if s == nil {
+		return nil
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, doc := range batch {
+		byType, _ := doc.Metadata["entities_by_type"].(map[string]any)
+		id, _ := doc.Metadata["id"].(string)
+		if len(byType) == 0 || id == "" {
+			continue
+		}
+		document, _ := doc.Metadata["document"].(string)
+		version, _ := intValue(doc.Metadata["version"])
+		for kind, names := range byType {
+			names, _ := names.([]string)
+			for _, name := range names {
+				if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO entities (name, type, document, version, chunk_id) VALUES (?, ?, ?, ?, ?)
+					ON CONFLICT (name, type, chunk_id) DO NOTHING`), name, kind, document, version, id); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// latestVersion restricts a query over a table of chunk records, by its
+// alias, to the latest version of each document.
+func latestVersion(alias string) string {
+	return alias + ".version = (SELECT MAX(d.version) FROM documents d WHERE d.name = " + alias + ".document)"
+}
+
+// entities lists the indexed entities starting with prefix and of kind,
+// when given, the most mentioned first.
+func (s *MetadataStore) entities(ctx context.Context, prefix, kind string, limit int) ([]EntityRecord, error) {
+	query := `SELECT e.name, e.type, COUNT(DISTINCT e.chunk_id), COUNT(DISTINCT e.document) FROM entities e WHERE ` + latestVersion("e") + ` AND e.name LIKE ?`
+	args := []any{strings.ToLower(prefix) + "%"}
+	if kind != "" {
+		query += ` AND e.type = ?`
+		args = append(args, kind)
+	}
+	query += ` GROUP BY e.name, e.type ORDER BY 3 DESC, 1 LIMIT ?`
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []EntityRecord{}
+	for rows.Next() {
+		var record EntityRecord
+		if err := rows.Scan(&record.Name, &record.Type, &record.Chunks, &record.Documents); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// entityMentions lists the documents whose latest version mentions name.
+func (s *MetadataStore) entityMentions(ctx context.Context, name string) ([]EntityMention, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT e.document, e.version, COUNT(DISTINCT e.chunk_id) FROM entities e
+		WHERE `+latestVersion("e")+` AND e.name = ? GROUP BY e.document, e.version ORDER BY 3 DESC, 1`), strings.ToLower(name))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mentions := []EntityMention{}
+	for rows.Next() {
+		var mention EntityMention
+		if err := rows.Scan(&mention.Document, &mention.Version, &mention.Chunks); err != nil {
+			return nil, err
+		}
+		mentions = append(mentions, mention)
+	}
+	return mentions, rows.Err()
+}
+
+// mentionedEntities returns the entities of the latest document versions
+// text names: its runs of up to entityNameWords words that are entity names.
+func (s *MetadataStore) mentionedEntities(ctx context.Context, text string) ([]string, error) {
+	if s == nil {
+		return nil, nil
+	}
+	candidates := nameCandidates(text)
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(candidates)), ", ")
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT DISTINCT e.name FROM entities e WHERE `+latestVersion("e")+` AND e.name IN (`+placeholders+`) ORDER BY e.name`), candidates...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// nameCandidates returns the runs of up to entityNameWords words of text
+// that could be entity names, lower-cased, as query arguments.
+func nameCandidates(text string) []any {
+	words := strings.Fields(strings.ToLower(text))
+	for i := range words {
+		words[i] = strings.Trim(words[i], `.,;:!?()[]"'`)
+	}
+	seen := map[string]bool{}
+	var candidates []any
+	for i := range words {
+		for n := 1; n <= entityNameWords && i+n <= len(words); n++ {
+			candidate := strings.Join(words[i:i+n], " ")
+			if candidate != "" && !isStopword(candidate) && !seen[candidate] {
+				seen[candidate] = true
+				candidates = append(candidates, candidate)
+			}
+		}
+	}
+	return candidates
+}
+
+// listEntities returns the indexed entities, filtered by ?q= prefix and
+// ?type=, up to ?limit= (100 by default).
+func listEntities(c *gin.Context) {
+	if metadataStore == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the metadata store is disabled"})
+		return
+	}
+	limit := 100
+	if value := c.Query("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive number"})
+			return
+		}
+	}
+	entities, err := metadataStore.entities(c.Request.Context(), c.Query("q"), c.Query("type"), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, entities)
+}
+
+// getEntity returns the documents mentioning the entity :name.
+func getEntity(c *gin.Context) {
+	if metadataStore == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the metadata store is disabled"})
+		return
+	}
+	name := strings.ToLower(c.Param("name"))
+	mentions, err := metadataStore.entityMentions(c.Request.Context(), name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(mentions) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("No document mentions %q", name)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"name": name, "documents": mentions})
+}
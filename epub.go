@@ -0,0 +1,146 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/tmc/langchaingo/schema"
+)
+
+type epubContainer struct {
+	Rootfiles []struct {
+		FullPath string `xml:"full-path,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+type epubPackage struct {
+	Title    string `xml:"metadata>title"`
+	Creator  string `xml:"metadata>creator"`
+	Language string `xml:"metadata>language"`
+	Manifest []struct {
+		ID        string `xml:"id,attr"`
+		Href      string `xml:"href,attr"`
+		MediaType string `xml:"media-type,attr"`
+	} `xml:"manifest>item"`
+	Spine []struct {
+		IDRef string `xml:"idref,attr"`
+	} `xml:"spine>itemref"`
+}
+
+// loadEPUB reads the chapters of an EPUB in reading (spine) order. Each
+// chapter section becomes a document carrying the book, chapter and section
+// titles.
+func loadEPUB(filename string) ([]schema.Document, error) {
+	archive, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	files := make(map[string]*zip.File, len(archive.File))
+	for _, f := range archive.File {
+		files[f.Name] = f
+	}
+
+	var container epubContainer
+	if err := decodeZipXML(files, "META-INF/container.xml", &container); err != nil {
+		return nil, err
+	}
+	if len(container.Rootfiles) == 0 {
+		return nil, fmt.Errorf("%s has no package document", filename)
+	}
+	opfPath := container.Rootfiles[0].FullPath
+
+	var pkg epubPackage
+	if err := decodeZipXML(files, opfPath, &pkg); err != nil {
+		return nil, err
+	}
+
+	hrefs := make(map[string]string, len(pkg.Manifest))
+	for _, item := range pkg.Manifest {
+		if strings.Contains(item.MediaType, "html") {
+			hrefs[item.ID] = path.Join(path.Dir(opfPath), item.Href)
+		}
+	}
+
+	var docs []schema.Document
+	chapter := 0
+	for _, ref := range pkg.Spine {
+		href, ok := hrefs[ref.IDRef]
+		if !ok {
+			continue
+		}
+		f, ok := files[href]
+		if !ok {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		title, sections, err := parseHTML(rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", href, err)
+		}
+
+		chapterTitle := title
+		if len(sections) > 0 && sections[0].Heading != "" {
+			chapterTitle = sections[0].Heading
+		}
+
+		hasText := false
+		for i, section := range sections {
+			if section.Text == "" {
+				continue
+			}
+			hasText = true
+			docs = append(docs, schema.Document{
+				PageContent: section.Text,
+				Metadata: map[string]any{
+					"source":        filename,
+					"title":         pkg.Title,
+					"author":        pkg.Creator,
+					"chapter":       chapterTitle,
+					"chapter_index": chapter,
+					"section":       section.Heading,
+					"section_index": i,
+				},
+			})
+		}
+		if hasText {
+			chapter++
+		}
+	}
+
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("no readable chapters in %s", filename)
+	}
+	return docs, nil
+}
+
+func decodeZipXML(files map[string]*zip.File, name string, v any) error {
+	f, ok := files[name]
+	if !ok {
+		return fmt.Errorf("missing %s", name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	if err := xml.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	FeedbackUp   = "up"
+	FeedbackDown = "down"
+)
+
+// answerFeedbackTTL is how long answers can be rated after they are given.
+const answerFeedbackTTL = 7 * 24 * time.Hour
+
+type ExperimentConfig struct {
+	Header   string       `json:"header"`   // Request header that picks a variant by name, bypassing the split
+	Variants []Variant    `json:"variants"` // Empty disables experiments
+	Canary   CanaryConfig `json:"canary"`
+}
+
+// CanaryConfig rolls a variant back, moving its traffic to the baseline, when
+// its answers fall below the quality thresholds.
+type CanaryConfig struct {
+	Variant         string  `json:"variant"`            // Variant under rollout; empty disables the checks
+	Baseline        string  `json:"baseline"`           // Variant that takes over its traffic
+	MinRequests     int     `json:"min_requests"`       // Answers before groundedness is judged
+	MinFeedback     int     `json:"min_feedback"`       // Ratings before the thumbs-up rate is judged
+	MinGroundedness float64 `json:"min_groundedness"`   // Average faithfulness, or confidence without the faithfulness check; 0 disables
+	MinThumbsUpRate float64 `json:"min_thumbs_up_rate"` // 0 disables
+}
+
+// Variant is a named pipeline configuration chat traffic can be split to.
+// Unset fields keep the main configuration.
+type Variant struct {
+	Name    string          `json:"name"`
+	Percent int             `json:"percent"`           // Share of chat requests without the header
+	Model   string          `json:"model,omitempty"`   // Instead of llm.model
+	K       int             `json:"k,omitempty"`       // Chunks passed to the prompt, instead of 3
+	Rescore *bool           `json:"rescore,omitempty"` // Rerank hits by recency and boost rules; defaults to true
+	Prompt  *PromptTemplate `json:"prompt,omitempty"`  // Replaces the prompt template, including language variants
+
+	Flags map[string]bool `json:"flags,omitempty"` // Pipeline stages turned on or off, over flags.defaults
+}
+
+// VariantStats are the metrics of a variant since startup.
+type VariantStats struct {
+	Name         string   `json:"name"`
+	Percent      int      `json:"percent"`
+	Requests     int      `json:"requests"`
+	Errors       int      `json:"errors"`
+	LatencyMS    float64  `json:"latency_ms"`             // Average
+	Confidence   *float64 `json:"confidence,omitempty"`   // Average confidence score of its rag answers
+	Faithfulness *float64 `json:"faithfulness,omitempty"` // Average, when confidence.faithfulness_check is on
+	ThumbsUp     int      `json:"thumbs_up"`
+	ThumbsDown   int      `json:"thumbs_down"`
+	ThumbsUpRate *float64 `json:"thumbs_up_rate,omitempty"`
+	RolledBack   string   `json:"rolled_back,omitempty"` // Why the canary was rolled back
+}
+
+type Feedback struct {
+	ID      string `json:"id"`     // Of the chat answer
+	Rating  string `json:"rating"` // "up" or "down"
+	Comment string `json:"comment,omitempty"`
+}
+
+// ExperimentRegistry holds the configured variants. Their metrics, the
+// variant of each answer and canary rollbacks are kept in the shared state.
+type ExperimentRegistry struct {
+	Variants []Variant
+	Canary   CanaryConfig
+	mu       sync.Mutex
+}
+
+var experimentRegistry = ExperimentRegistry{}
+
+func validateExperiments(cfg ExperimentConfig) error {
+	if len(cfg.Variants) == 0 {
+		return nil
+	}
+	if cfg.Header == "" {
+		return fmt.Errorf("experiments.header is required")
+	}
+	seen := map[string]bool{}
+	total := 0
+	for _, variant := range cfg.Variants {
+		if variant.Name == "" {
+			return fmt.Errorf("experiment variants need a name")
+		}
+		if seen[variant.Name] {
+			return fmt.Errorf("variant %q is listed twice", variant.Name)
+		}
+		seen[variant.Name] = true
+		if variant.Percent < 0 || variant.K < 0 {
+			return fmt.Errorf("variant %q: percent and k must not be negative", variant.Name)
+		}
+		total += variant.Percent
+	}
+	if total != 100 {
+		return fmt.Errorf("variant percentages add up to %d, not 100", total)
+	}
+
+	canary := cfg.Canary
+	if canary.Variant == "" {
+		return nil
+	}
+	if !seen[canary.Variant] || !seen[canary.Baseline] || canary.Variant == canary.Baseline {
+		return fmt.Errorf("experiments.canary needs two different variants as variant and baseline")
+	}
+	if canary.MinRequests <= 0 || canary.MinFeedback <= 0 {
+		return fmt.Errorf("experiments.canary.min_requests and min_feedback must be positive")
+	}
+	if canary.MinGroundedness < 0 || canary.MinGroundedness > 1 || canary.MinThumbsUpRate < 0 || canary.MinThumbsUpRate > 1 {
+		return fmt.Errorf("experiments.canary thresholds must be between 0 and 1")
+	}
+	return nil
+}
+
+func setConfiguredExperiments(cfg ExperimentConfig) {
+	experimentRegistry.mu.Lock()
+	defer experimentRegistry.mu.Unlock()
+	experimentRegistry.Variants = cfg.Variants
+	experimentRegistry.Canary = cfg.Canary
+}
+
+// variants returns the variants with the canary's share moved to the
+// baseline if it was rolled back, and the rollback reason.
+func (r *ExperimentRegistry) variants(ctx context.Context) ([]Variant, string) {
+	r.mu.Lock()
+	variants := append([]Variant(nil), r.Variants...)
+	canary := r.Canary
+	r.mu.Unlock()
+	if canary.Variant == "" {
+		return variants, ""
+	}
+
+	reason, rolledBack, err := sharedState.Get(ctx, "experiment:rollback:"+canary.Variant)
+	if err != nil {
+		log.Printf("Error looking up canary rollback: %v", err)
+	}
+	if !rolledBack {
+		return variants, ""
+	}
+	moved := 0
+	for i := range variants {
+		if variants[i].Name == canary.Variant {
+			moved = variants[i].Percent
+			variants[i].Percent = 0
+		}
+	}
+	for i := range variants {
+		if variants[i].Name == canary.Baseline {
+			variants[i].Percent += moved
+		}
+	}
+	return variants, string(reason)
+}
+
+// pick returns the variant named by the request header, or else one drawn by
+// percentage. It returns nil when there are no variants.
+func (r *ExperimentRegistry) pick(ctx context.Context, name string) (*Variant, error) {
+	variants, _ := r.variants(ctx)
+	if len(variants) == 0 {
+		return nil, nil
+	}
+	if name != "" {
+		for i := range variants {
+			if variants[i].Name == name {
+				return &variants[i], nil
+			}
+		}
+		return nil, fmt.Errorf("unknown variant %q", name)
+	}
+
+	n := rand.Intn(100)
+	for i := range variants {
+		if n < variants[i].Percent {
+			return &variants[i], nil
+		}
+		n -= variants[i].Percent
+	}
+	return &variants[len(variants)-1], nil
+}
+
+// record adds a chat answer to its variant's metrics and remembers which
+// variant gave it, for feedback. Failures are logged.
+func (r *ExperimentRegistry) record(variant *Variant, result ChatResponse, failed bool, latency time.Duration) {
+	ctx := context.Background()
+	name := ""
+	if variant != nil {
+		name = variant.Name
+	}
+	if err := sharedState.Put(ctx, "answer:"+result.ID, []byte(name), answerFeedbackTTL); err != nil {
+		log.Printf("Error saving answer %s: %v", result.ID, err)
+	}
+	if variant == nil {
+		return
+	}
+
+	deltas := map[string]float64{"requests": 1, "latency_ms": milliseconds(latency)}
+	if failed {
+		deltas["errors"] = 1
+	}
+	if result.Confidence != nil {
+		deltas["confidence"] = result.Confidence.Score
+		deltas["confident"] = 1
+		if result.Confidence.Faithfulness != nil {
+			deltas["faithfulness"] = *result.Confidence.Faithfulness
+			deltas["faithful"] = 1
+		}
+	}
+	if err := sharedState.Increment(ctx, "experiment:"+name, deltas); err != nil {
+		log.Printf("Error recording metrics of variant %s: %v", name, err)
+		return
+	}
+	r.checkCanary(ctx, name)
+}
+
+// feedback counts a rating against the variant that gave the answer. It
+// reports false for unknown answers.
+func (r *ExperimentRegistry) feedback(ctx context.Context, id, rating string) (bool, error) {
+	name, ok, err := sharedState.Get(ctx, "answer:"+id)
+	if err != nil || !ok {
+		return false, err
+	}
+	if len(name) == 0 {
+		return true, nil
+	}
+	if err := sharedState.Increment(ctx, "experiment:"+string(name), map[string]float64{rating: 1}); err != nil {
+		return false, err
+	}
+	r.checkCanary(ctx, string(name))
+	return true, nil
+}
+
+// checkCanary rolls the canary back once it has enough answers or ratings to
+// judge and falls below a threshold, if name is the canary.
+func (r *ExperimentRegistry) checkCanary(ctx context.Context, name string) {
+	r.mu.Lock()
+	canary := r.Canary
+	r.mu.Unlock()
+	if name != canary.Variant {
+		return
+	}
+	counters, err := sharedState.Counters(ctx, "experiment:"+name)
+	if err != nil {
+		log.Printf("Error reading metrics of canary %s: %v", name, err)
+		return
+	}
+	stats := variantStats(Variant{Name: name}, counters)
+
+	reason := ""
+	groundedness, judged := groundedness(counters)
+	if canary.MinGroundedness > 0 && judged >= canary.MinRequests && groundedness < canary.MinGroundedness {
+		reason = fmt.Sprintf("groundedness %.2f is below %.2f", groundedness, canary.MinGroundedness)
+	}
+	if rated := stats.ThumbsUp + stats.ThumbsDown; reason == "" && canary.MinThumbsUpRate > 0 && rated >= canary.MinFeedback {
+		if *stats.ThumbsUpRate < canary.MinThumbsUpRate {
+			reason = fmt.Sprintf("thumbs-up rate %.2f is below %.2f", *stats.ThumbsUpRate, canary.MinThumbsUpRate)
+		}
+	}
+	if reason == "" {
+		return
+	}
+
+	// Replicas can judge the canary at the same time; only the first
+	// rollback counts
+	rolledBack, err := sharedState.PutNew(ctx, "experiment:rollback:"+name, []byte(reason))
+	if err != nil {
+		log.Printf("Error rolling back canary %s: %v", name, err)
+		return
+	}
+	if rolledBack {
+		log.Printf("Rolled back canary %s to %s: %s", name, canary.Baseline, reason)
+	}
+}
+
+// groundedness is the average faithfulness of a variant's answers, or their
+// average confidence when faithfulness is not checked, and the number of
+// answers it is over.
+func groundedness(counters map[string]float64) (float64, int) {
+	if counters["faithful"] > 0 {
+		return counters["faithfulness"] / counters["faithful"], int(counters["faithful"])
+	}
+	if counters["confident"] > 0 {
+		return counters["confidence"] / counters["confident"], int(counters["confident"])
+	}
+	return 0, 0
+}
+
+func variantStats(variant Variant, counters map[string]float64) VariantStats {
+	stats := VariantStats{
+		Name:       variant.Name,
+		Percent:    variant.Percent,
+		Requests:   int(counters["requests"]),
+		Errors:     int(counters["errors"]),
+		ThumbsUp:   int(counters[FeedbackUp]),
+		ThumbsDown: int(counters[FeedbackDown]),
+	}
+	if stats.Requests > 0 {
+		stats.LatencyMS = counters["latency_ms"] / float64(stats.Requests)
+	}
+	if counters["confident"] > 0 {
+		average := counters["confidence"] / counters["confident"]
+		stats.Confidence = &average
+	}
+	if counters["faithful"] > 0 {
+		average := counters["faithfulness"] / counters["faithful"]
+		stats.Faithfulness = &average
+	}
+	if rated := stats.ThumbsUp + stats.ThumbsDown; rated > 0 {
+		rate := float64(stats.ThumbsUp) / float64(rated)
+		stats.ThumbsUpRate = &rate
+	}
+	return stats
+}
+
+func (r *ExperimentRegistry) list(ctx context.Context) ([]VariantStats, error) {
+	variants, reason := r.variants(ctx)
+	r.mu.Lock()
+	canary := r.Canary.Variant
+	r.mu.Unlock()
+	list := make([]VariantStats, 0, len(variants))
+	for _, variant := range variants {
+		counters, err := sharedState.Counters(ctx, "experiment:"+variant.Name)
+		if err != nil {
+			return nil, err
+		}
+		stats := variantStats(variant, counters)
+		if variant.Name == canary {
+			stats.RolledBack = reason
+		}
+		list = append(list, stats)
+	}
+	return list, nil
+}
+
+func listExperiments(c *gin.Context) {
+	variants, err := experimentRegistry.list(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"variants": variants})
+}
+
+func submitFeedback(c *gin.Context) {
+	var feedback Feedback
+	if err := c.BindJSON(&feedback); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if feedback.Rating != FeedbackUp && feedback.Rating != FeedbackDown {
+		c.JSON(http.StatusBadRequest, gin.H{"error": `rating must be "up" or "down"`})
+		return
+	}
+	ok, err := experimentRegistry.feedback(c.Request.Context(), feedback.ID, feedback.Rating)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Answer not found"})
+		return
+	}
+	if err := metadataStore.saveFeedback(c.Request.Context(), feedback); err != nil {
+		log.Printf("Error recording feedback on %s: %v", feedback.ID, err)
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// The methods below apply a variant's overrides; on a nil variant they
+// return the main configuration.
+
+func (v *Variant) llm() (Generator, error) {
+	if v == nil || v.Model == "" || fakeLLMMode {
+		return newLLM()
+	}
+	return withOllamaBreaker(newOllama(v.Model))
+}
+
+func (v *Variant) k() int {
+	if v == nil || v.K == 0 {
+		return numRelevantDocs
+	}
+	return v.K
+}
+
+func (v *Variant) rescore() bool {
+	return v == nil || v.Rescore == nil || *v.Rescore
+}
+
+func (v *Variant) promptTemplate(lang string) PromptTemplate {
+	if v == nil || v.Prompt == nil {
+		return promptTemplateFor(lang)
+	}
+	return *v.Prompt
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Fact scopes: whose answers a pinned fact is shown to.
+const (
+	ScopeUser    = "user"    // Every conversation of a user_id
+	ScopeSession = "session" // One session
+)
+
+// Fact sources
+const (
+	FactPinned    = "pinned"    // Added through the API
+	FactExtracted = "extracted" // Taken from a conversation by the model
+)
+
+const factExtractionPrompt = `Below is an exchange between a user and an assistant. List the durable facts about the user and the lasting preferences or instructions they state, such as their job, their field or the language they want answers in, that would still matter in later conversations. Leave out the question itself, anything the documents say and anything temporary. Respond with JSON of the form {"facts": ["..."]}, each fact a short sentence about "the user", and an empty list when there are none.
+
+User: %s
+Assistant: %s`
+
+var errTooManyFacts = errors.New("too many facts")
+
+// Fact is a piece of long-term memory, such as "the user is an ICU nurse" or
+// "always answer in Spanish", pinned through the API or extracted from a
+// conversation. Unlike the conversation, which is windowed by
+// the memory budget, the facts of a request's user and session are always
+// in the system message.
+type Fact struct {
+	ID        string    `json:"id"`
+	Scope     string    `json:"scope"` // "user" or "session"
+	Owner     string    `json:"owner"` // The user or session id
+	Text      string    `json:"text"`
+	Source    string    `json:"source"` // "pinned" or "extracted"
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func factPrefix(scope, owner string) string {
+	return "fact:" + scope + ":" + owner + ":"
+}
+
+// loadFacts returns the facts of a user or session, oldest first.
+func loadFacts(ctx context.Context, scope, owner string) ([]Fact, error) {
+	values, err := sharedState.Scan(ctx, factPrefix(scope, owner))
+	if err != nil {
+		return nil, err
+	}
+	facts := make([]Fact, 0, len(values))
+	for _, value := range values {
+		var fact Fact
+		if err := json.Unmarshal(value, &fact); err != nil {
+			return nil, err
+		}
+		facts = append(facts, fact)
+	}
+	sort.Slice(facts, func(i, j int) bool {
+		return facts[i].CreatedAt.Before(facts[j].CreatedAt)
+	})
+	return facts, nil
+}
+
+// requestFacts returns the texts of the facts pinned to a chat request's
+// user and session. Failures are logged and the answer goes on without them.
+func requestFacts(ctx context.Context, msg Message) []string {
+	owners := map[string]string{}
+	if msg.UserID != "" {
+		owners[ScopeUser] = msg.UserID
+	}
+	if len(msg.Messages) == 0 {
+		owners[ScopeSession] = sessionContext(msg.SessionID).id
+	}
+
+	var texts []string
+	for _, scope := range []string{ScopeUser, ScopeSession} {
+		owner, ok := owners[scope]
+		if !ok {
+			continue
+		}
+		facts, err := loadFacts(ctx, scope, owner)
+		if err != nil {
+			log.Printf("Error loading the facts of %s %s: %v", scope, owner, err)
+			continue
+		}
+		for _, fact := range facts {
+			texts = append(texts, fact.Text)
+		}
+	}
+	return texts
+}
+
+// factOwner reads the user or session id of a facts route.
+func factOwner(c *gin.Context) (string, bool) {
+	owner := c.Param("id")
+	if !idPattern.MatchString(owner) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return "", false
+	}
+	return owner, true
+}
+
+// addFact stores a fact, unless its owner has memory.max_facts already.
+func addFact(ctx context.Context, fact Fact) (Fact, error) {
+	facts, err := loadFacts(ctx, fact.Scope, fact.Owner)
+	if err != nil {
+		return fact, err
+	}
+	if len(facts) >= getConfig().Memory.MaxFacts {
+		return fact, errTooManyFacts
+	}
+	fact.ID, fact.CreatedAt = uuid.New().String(), time.Now()
+	return fact, saveState(ctx, factPrefix(fact.Scope, fact.Owner)+fact.ID, fact, 0)
+}
+
+// extractFacts asks the model for durable facts about the user in an
+// exchange and remembers the new ones, for the user if the request names one
+// and else for its session. It runs after the answer, so failures are only
+// logged.
+func extractFacts(ctx context.Context, llm Generator, msg Message, answer string) {
+	scope, owner := ScopeUser, msg.UserID
+	if owner == "" {
+		if len(msg.Messages) > 0 {
+			return
+		}
+		scope, owner = ScopeSession, sessionContext(msg.SessionID).id
+	}
+
+	var extracted struct {
+		Facts []string `json:"facts"`
+	}
+	if err := generateJSON(ctx, llm, fmt.Sprintf(factExtractionPrompt, msg.Msg, answer), &extracted); err != nil {
+		log.Printf("Error extracting facts: %v", err)
+		return
+	}
+	if len(extracted.Facts) == 0 {
+		return
+	}
+	facts, err := loadFacts(ctx, scope, owner)
+	if err != nil {
+		log.Printf("Error loading the facts of %s %s: %v", scope, owner, err)
+		return
+	}
+	known := map[string]bool{}
+	for _, fact := range facts {
+		known[strings.ToLower(fact.Text)] = true
+	}
+	for _, text := range extracted.Facts {
+		text = strings.TrimSpace(text)
+		if text == "" || known[strings.ToLower(text)] || utf8.RuneCountInString(text) > getConfig().Memory.MaxFactLength {
+			continue
+		}
+		if _, err := addFact(ctx, Fact{Scope: scope, Owner: owner, Text: text, Source: FactExtracted}); err != nil {
+			log.Printf("Error remembering a fact of %s %s: %v", scope, owner, err)
+			return
+		}
+		known[strings.ToLower(text)] = true
+		log.Printf("Remembered for %s %s: %s", scope, owner, text)
+	}
+}
+
+// pinFact adds a fact to a user or session: {"text": "..."}.
+func pinFact(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		owner, ok := factOwner(c)
+		if !ok {
+			return
+		}
+		var request struct {
+			Text string `json:"text"`
+		}
+		if err := c.BindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+		text := strings.TrimSpace(request.Text)
+		cfg := getConfig().Memory
+		if text == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "text is required"})
+			return
+		}
+		if utf8.RuneCountInString(text) > cfg.MaxFactLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Facts are at most %d characters", cfg.MaxFactLength)})
+			return
+		}
+
+		fact, err := addFact(c.Request.Context(), Fact{Scope: scope, Owner: owner, Text: text, Source: FactPinned})
+		if err == errTooManyFacts {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("At most %d facts can be pinned", cfg.MaxFacts)})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, fact)
+	}
+}
+
+// listFacts returns the facts of a user or session, only those of
+// ?source= when set, for review.
+func listFacts(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		owner, ok := factOwner(c)
+		if !ok {
+			return
+		}
+		facts, err := loadFacts(c.Request.Context(), scope, owner)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if source := c.Query("source"); source != "" {
+			facts = slices.DeleteFunc(facts, func(fact Fact) bool { return fact.Source != source })
+		}
+		c.JSON(http.StatusOK, gin.H{"facts": facts})
+	}
+}
+
+// forgetFacts removes the facts of a user or session, only those of
+// ?source= when set.
+func forgetFacts(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		owner, ok := factOwner(c)
+		if !ok {
+			return
+		}
+		deleted, err := deleteFacts(c.Request.Context(), scope, owner, c.Query("source"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "deleted": deleted})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"deleted": deleted})
+	}
+}
+
+// deleteFacts removes the facts of a user or session, only those of source
+// when set, and returns how many it removed.
+func deleteFacts(ctx context.Context, scope, owner, source string) (int, error) {
+	facts, err := loadFacts(ctx, scope, owner)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, fact := range facts {
+		if source != "" && fact.Source != source {
+			continue
+		}
+		if _, err := sharedState.Delete(ctx, factPrefix(scope, owner)+fact.ID); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// unpinFact removes a fact of a user or session.
+func unpinFact(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		owner, ok := factOwner(c)
+		if !ok {
+			return
+		}
+		ok, err := sharedState.Delete(c.Request.Context(), factPrefix(scope, owner)+c.Param("fact_id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Fact not found"})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+
+	"github.com/tmc/langchaingo/embeddings"
+	"github.com/tmc/langchaingo/llms"
+)
+
+const fakeEmbeddingDimensions = 256
+
+// Generator produces text for answers, enrichment and the agent.
+// *ollama.LLM, the OpenAI client and FakeGenerator implement it.
+type Generator interface {
+	llms.Model
+}
+
+// Embedder turns text into vectors for the vector store.
+type Embedder interface {
+	embeddings.Embedder
+}
+
+// fakeLLMMode swaps Ollama for FakeGenerator and FakeEmbedder (--fake-llm).
+var fakeLLMMode bool
+
+// FakeGenerator answers without a model. Answers depend only on the prompt:
+// JSON mode gets "{}", agent prompts get a final answer, and RAG prompts get
+// the first line of the retrieved context, so tests can check retrieval.
+type FakeGenerator struct{}
+
+func (g FakeGenerator) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, g, prompt, options...)
+}
+
+func (g FakeGenerator) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	opts := llms.CallOptions{}
+	for _, option := range options {
+		option(&opts)
+	}
+
+	var prompt strings.Builder
+	for _, message := range messages {
+		for _, part := range message.Parts {
+			if text, ok := part.(llms.TextContent); ok {
+				prompt.WriteString(text.Text)
+			}
+		}
+	}
+
+	content := fakeAnswer(prompt.String(), opts.JSONMode)
+	if opts.StreamingFunc != nil {
+		if err := opts.StreamingFunc(ctx, []byte(content)); err != nil {
+			return nil, err
+		}
+	}
+	return &llms.ContentResponse{Choices: []*llms.ContentChoice{{Content: content, StopReason: "stop"}}}, nil
+}
+
+func fakeAnswer(prompt string, jsonMode bool) string {
+	if jsonMode {
+		return "{}"
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(prompt))
+	if strings.Contains(prompt, "Final Answer:") {
+		return fmt.Sprintf("Final Answer: fake answer %08x", hash.Sum32())
+	}
+
+	_, context, found := strings.Cut(prompt, "Relevant information:\n")
+	if !found {
+		return "I don't know."
+	}
+	line, _, _ := strings.Cut(context, "\n")
+	return fmt.Sprintf("Fake answer %08x: %s", hash.Sum32(), strings.TrimSpace(line))
+}
+
+// FakeEmbedder hashes words into a fixed-size bag-of-words vector, so texts
+// sharing words are close and identical texts always get the same vector.
+type FakeEmbedder struct{}
+
+func (e FakeEmbedder) EmbedDocuments(_ context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vectors[i] = fakeEmbedding(text)
+	}
+	return vectors, nil
+}
+
+func (e FakeEmbedder) EmbedQuery(_ context.Context, text string) ([]float32, error) {
+	return fakeEmbedding(text), nil
+}
+
+func fakeEmbedding(text string) []float32 {
+	vector := make([]float32, fakeEmbeddingDimensions)
+	for _, word := range tokenize(text) {
+		hash := fnv.New32a()
+		hash.Write([]byte(word))
+		vector[hash.Sum32()%fakeEmbeddingDimensions]++
+	}
+
+	var norm float64
+	for _, v := range vector {
+		norm += float64(v) * float64(v)
+	}
+	if norm == 0 {
+		vector[0] = 1
+		return vector
+	}
+	for i := range vector {
+		vector[i] = float32(float64(vector[i]) / math.Sqrt(norm))
+	}
+	return vector
+}
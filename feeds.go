@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tmc/langchaingo/schema"
+)
+
+const feedMaxBytes = 10 << 20
+
+type FeedsConfig struct {
+	IntervalMinutes int          `json:"interval_minutes"` // Poll the configured feeds periodically; 0 disables
+	RetentionDays   int          `json:"retention_days"`   // Items published longer ago are skipped and expired
+	Sources         []FeedSource `json:"sources"`
+}
+
+type FeedSource struct {
+	URL     string `json:"url"`
+	Dataset string `json:"dataset,omitempty"`
+	Tenant  string `json:"tenant,omitempty"`
+}
+
+// feedXML holds the parts of RSS 2.0 and Atom documents that are ingested.
+type feedXML struct {
+	Channel struct {
+		Title string    `xml:"title"`
+		Items []feedRSS `xml:"item"`
+	} `xml:"channel"`
+	Title   string     `xml:"title"`
+	Entries []feedAtom `xml:"entry"`
+}
+
+type feedRSS struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	GUID        string `xml:"guid"`
+	PubDate     string `xml:"pubDate"`
+	Description string `xml:"description"`
+	Content     string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+}
+
+type feedAtom struct {
+	Title string `xml:"title"`
+	ID    string `xml:"id"`
+	Links []struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr"`
+	} `xml:"link"`
+	Published string `xml:"published"`
+	Updated   string `xml:"updated"`
+	Summary   string `xml:"summary"`
+	Content   string `xml:"content"`
+}
+
+type feedItem struct {
+	ID, Title, Link, Text string
+	Published             time.Time
+}
+
+var feedDateLayouts = []string{time.RFC1123Z, time.RFC1123, time.RFC3339, "Mon, 2 Jan 2006 15:04:05 -0700", "Mon, 2 Jan 2006 15:04:05 MST", "2006-01-02"}
+
+func validateFeeds(cfg FeedsConfig) error {
+	for _, source := range cfg.Sources {
+		if !strings.HasPrefix(source.URL, "http://") && !strings.HasPrefix(source.URL, "https://") {
+			return fmt.Errorf("feed url %q must be an http(s) URL", source.URL)
+		}
+	}
+	if cfg.RetentionDays < 0 {
+		return fmt.Errorf("feeds.retention_days must not be negative")
+	}
+	return nil
+}
+
+// pollFeeds polls the feed in the request body, or every configured feed, as
+// a background job.
+func pollFeeds(c *gin.Context) {
+	var source FeedSource
+	if err := c.ShouldBindJSON(&source); err != nil && c.Request.ContentLength > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	sources := getConfig().Feeds.Sources
+	if source.URL != "" {
+		sources = []FeedSource{source}
+	}
+	if err := validateFeeds(FeedsConfig{Sources: sources}); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(sources) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No feeds configured"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, startFeedJob(sources))
+}
+
+func startFeedJob(sources []FeedSource) Job {
+	job := jobRegistry.create("feeds")
+	go runJob(job.ID, func(ctx context.Context) error {
+		return ingestFeeds(ctx, job.ID, sources)
+	})
+	return job
+}
+
+// scheduleFeeds polls the configured feeds every interval.
+func scheduleFeeds(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			startFeedJob(getConfig().Feeds.Sources)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ingestFeeds ingests the items of each feed that are new and within the
+// retention window, then expires older ones. A failing feed does not stop
+// the others.
+func ingestFeeds(ctx context.Context, jobID string, sources []FeedSource) error {
+	failed := 0
+	for _, source := range sources {
+		if err := ingestFeed(ctx, jobID, source); err != nil {
+			failed++
+			jobRegistry.update(jobID, func(job *Job) {
+				job.recordError(fmt.Sprintf("%s: %v", source.URL, err))
+			})
+		}
+	}
+	if failed == len(sources) {
+		return fmt.Errorf("all %d feeds failed", failed)
+	}
+	return nil
+}
+
+func ingestFeed(ctx context.Context, jobID string, source FeedSource) error {
+	title, items, err := fetchFeed(ctx, source.URL)
+	if err != nil {
+		return err
+	}
+
+	var cutoff time.Time
+	if days := getConfig().Feeds.RetentionDays; days > 0 {
+		cutoff = time.Now().AddDate(0, 0, -days)
+	}
+	req := IngestRequest{Dataset: source.Dataset, Tenant: source.Tenant, Path: source.URL}
+	if err := completeIngestRequest(&req); err != nil {
+		return err
+	}
+
+	// The lookups below need the store to exist before the first item is indexed
+	embedder, err := newEmbedder()
+	if err != nil {
+		return err
+	}
+	if err := prepareStore(ctx, embedder, req.Tenant); err != nil {
+		return err
+	}
+	known, err := knownFeedItems(ctx, source.URL)
+	if err != nil {
+		return err
+	}
+
+	var docs []schema.Document
+	for _, item := range items {
+		if known[item.ID] || (!item.Published.IsZero() && item.Published.Before(cutoff)) {
+			continue
+		}
+		metadata := map[string]any{
+			"source":    item.Link,
+			"url":       item.Link,
+			"title":     item.Title,
+			"feed":      source.URL,
+			"feed_item": item.ID,
+			"document":  "feed:" + item.ID,
+		}
+		if title != "" {
+			metadata["feed_title"] = title
+		}
+		if !item.Published.IsZero() {
+			metadata["published"] = item.Published.UTC().Format(time.RFC3339)
+			metadata["updated_at"] = metadata["published"]
+		}
+		docs = append(docs, schema.Document{PageContent: strings.TrimSpace(item.Title + "\n" + item.Text), Metadata: metadata})
+	}
+
+	if len(docs) > 0 {
+		chunks, err := splitDocuments(ctx, docs, req)
+		if err != nil {
+			return err
+		}
+		if err := indexDocuments(ctx, jobID, req, chunks); err != nil {
+			return err
+		}
+	}
+	if !cutoff.IsZero() {
+		return expireFeedItems(ctx, source.URL, cutoff)
+	}
+	return nil
+}
+
+func fetchFeed(ctx context.Context, feedURL string) (string, []feedItem, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feedURL, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("User-Agent", getConfig().Crawl.UserAgent)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	var feed feedXML
+	decoder := xml.NewDecoder(io.LimitReader(resp.Body, feedMaxBytes))
+	decoder.Strict = false
+	if err := decoder.Decode(&feed); err != nil {
+		return "", nil, fmt.Errorf("failed to parse feed: %v", err)
+	}
+
+	var items []feedItem
+	for _, entry := range feed.Channel.Items {
+		item := feedItem{ID: firstNonEmpty(entry.GUID, entry.Link), Title: entry.Title, Link: entry.Link,
+			Text: feedText(firstNonEmpty(entry.Content, entry.Description)), Published: parseFeedDate(entry.PubDate)}
+		items = append(items, item)
+	}
+	for _, entry := range feed.Entries {
+		item := feedItem{ID: entry.ID, Title: entry.Title, Text: feedText(firstNonEmpty(entry.Content, entry.Summary)),
+			Published: parseFeedDate(firstNonEmpty(entry.Published, entry.Updated))}
+		for _, link := range entry.Links {
+			if link.Rel == "" || link.Rel == "alternate" {
+				item.Link = link.Href
+				break
+			}
+		}
+		item.ID = firstNonEmpty(item.ID, item.Link)
+		items = append(items, item)
+	}
+
+	kept := items[:0]
+	for _, item := range items {
+		if item.ID != "" {
+			item.Link = firstNonEmpty(item.Link, feedURL)
+			kept = append(kept, item)
+		}
+	}
+	return firstNonEmpty(feed.Channel.Title, feed.Title), kept, nil
+}
+
+// feedText reduces an item's HTML description or content to plain text.
+func feedText(content string) string {
+	_, sections, err := parseHTML(strings.NewReader(content))
+	if err != nil {
+		return normalizeWhitespace(content)
+	}
+	parts := make([]string, 0, len(sections))
+	for _, section := range sections {
+		parts = append(parts, strings.TrimSpace(section.Heading+"\n"+section.Text))
+	}
+	return strings.Join(parts, "\n")
+}
+
+func parseFeedDate(value string) time.Time {
+	value = strings.TrimSpace(value)
+	for _, layout := range feedDateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// knownFeedItems returns the IDs of the feed's items that are already
+// ingested. Backends without maintenance support cannot tell, so their items
+// are ingested again on every poll.
+func knownFeedItems(ctx context.Context, feedURL string) (map[string]bool, error) {
+	known := map[string]bool{}
+	if !supportsMaintenance(getConfig().VectorStore.Backend) {
+		return known, nil
+	}
+	store, err := managedStore()
+	if err != nil {
+		return nil, err
+	}
+	values, err := store.Values(ctx, map[string]any{"feed": feedURL}, "feed_item")
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up ingested items: %v", err)
+	}
+	for _, value := range values {
+		if id, ok := value.(string); ok {
+			known[id] = true
+		}
+	}
+	return known, nil
+}
+
+// expireFeedItems removes the chunks of the feed's items published before
+// cutoff.
+func expireFeedItems(ctx context.Context, feedURL string, cutoff time.Time) error {
+	if !supportsMaintenance(getConfig().VectorStore.Backend) {
+		return nil
+	}
+	store, err := managedStore()
+	if err != nil {
+		return err
+	}
+	values, err := store.Values(ctx, map[string]any{"feed": feedURL}, "published")
+	if err != nil {
+		return err
+	}
+	var expired []any
+	for _, value := range values {
+		if published, ok := value.(string); ok {
+			if t, err := time.Parse(time.RFC3339, published); err == nil && t.Before(cutoff) {
+				expired = append(expired, published)
+			}
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+	_, err = store.DeleteWhere(ctx, map[string]any{"feed": feedURL, "published": expired})
+	return err
+}
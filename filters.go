@@ -0,0 +1,132 @@
+package main
+
+import (
+	"time"
+)
+
+// Filter selects chunks by their payload. Match holds key/value pairs chunks
+// must have and Exclude pairs they must not have. A list value matches when
+// the payload field holds any of the listed values; for list payload fields
+// (keywords, entities) a value matches when any element equals it. Chunks
+// must also be within each of Ranges, which only the backends supporting
+// maintenance apply.
+type Filter struct {
+	Match   map[string]any
+	Exclude map[string]any
+	Ranges  []Range
+}
+
+func (f Filter) empty() bool {
+	return len(f.Match) == 0 && len(f.Exclude) == 0 && len(f.Ranges) == 0
+}
+
+// Range bounds payload fields: a chunk is within it when any of Fields holds
+// a value within the bounds. Bounds are numbers, or times for fields holding
+// RFC 3339 dates; unset ones are open.
+type Range struct {
+	Fields []string `json:"fields"`
+	GT     any      `json:"gt,omitempty"`
+	GTE    any      `json:"gte,omitempty"`
+	LT     any      `json:"lt,omitempty"`
+	LTE    any      `json:"lte,omitempty"`
+}
+
+// bounds returns the set bounds by operator, "gt", "gte", "lt" and "lte",
+// with times formatted by format.
+func (r Range) bounds(format func(time.Time) any) map[string]any {
+	bounds := map[string]any{}
+	for op, value := range map[string]any{"gt": r.GT, "gte": r.GTE, "lt": r.LT, "lte": r.LTE} {
+		switch v := value.(type) {
+		case nil:
+		case time.Time:
+			bounds[op] = format(v)
+		default:
+			bounds[op] = v
+		}
+	}
+	return bounds
+}
+
+// dates reports whether r bounds dates rather than numbers.
+func (r Range) dates() bool {
+	for _, value := range []any{r.GT, r.GTE, r.LT, r.LTE} {
+		if _, ok := value.(time.Time); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func rfc3339(t time.Time) any {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// retrievalFilter is the filter for a chat request: the client's key/value
+// pairs and, on backends that support deletion and versioning, no
+// soft-deleted chunks and only the latest version of each document unless a
+// version is asked for.
+func retrievalFilter(match map[string]any, version int) Filter {
+	filter := Filter{Match: match}
+	if version > 0 {
+		filter.Match = map[string]any{"version": version}
+		for key, value := range match {
+			filter.Match[key] = value
+		}
+	}
+	if supportsMaintenance(getConfig().VectorStore.Backend) {
+		filter.Exclude = map[string]any{"deleted": true}
+		if version == 0 {
+			filter.Exclude["latest"] = false
+		}
+	}
+	return filter
+}
+
+// chunkFilter is the retrieval filter for reading chunks themselves rather
+// than searching them: the synthetic questions stored alongside them are
+// left out. It needs a backend that supports maintenance.
+func chunkFilter(match map[string]any, version int) Filter {
+	filter := retrievalFilter(match, version)
+	filter.Exclude["synthetic_question"] = true
+	return filter
+}
+
+// qdrantFilter turns a Filter into a Qdrant filter.
+func qdrantFilter(filter Filter) any {
+	if filter.empty() {
+		return nil
+	}
+
+	result := map[string]any{}
+	if must := qdrantConditions(filter.Match); len(must) > 0 {
+		result["must"] = must
+	}
+	if mustNot := qdrantConditions(filter.Exclude); len(mustNot) > 0 {
+		result["must_not"] = mustNot
+	}
+	for _, r := range filter.Ranges {
+		var anyOf []map[string]any
+		for _, field := range r.Fields {
+			anyOf = append(anyOf, map[string]any{"key": field, "range": r.bounds(rfc3339)})
+		}
+		must, _ := result["must"].([]map[string]any)
+		if len(anyOf) == 1 {
+			result["must"] = append(must, anyOf[0])
+		} else {
+			result["must"] = append(must, map[string]any{"should": anyOf})
+		}
+	}
+	return result
+}
+
+func qdrantConditions(pairs map[string]any) []map[string]any {
+	conditions := make([]map[string]any, 0, len(pairs))
+	for key, value := range pairs {
+		match := map[string]any{"value": value}
+		if values, ok := value.([]any); ok {
+			match = map[string]any{"any": values}
+		}
+		conditions = append(conditions, map[string]any{"key": key, "match": match})
+	}
+	return conditions
+}
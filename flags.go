@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Flags turn pipeline stages on or off without touching their settings.
+const (
+	FlagNormalize      = "normalize"       // Query normalization
+	FlagSpellCheck     = "spell_check"     // Spell correction, when normalizing
+	FlagGlossary       = "glossary"        // Glossary expansion of the query
+	FlagDatasetRouting = "dataset_routing" // Picking datasets for queries that name none
+	FlagRescore        = "rescore"         // Reranking hits by recency and boost rules
+	FlagStitch         = "stitch"          // Stitching neighboring chunks
+	FlagGraph          = "graph"           // Expanding retrieval along the knowledge graph
+	FlagTemporal       = "temporal"        // Filtering questions naming a period on it
+	FlagNumeric        = "numeric"         // Filtering questions comparing a field to a number on it
+	FlagTranslate      = "translate"       // Translating chunks into the answer language
+	FlagClarify        = "clarify"         // Clarifying questions for ambiguous retrievals
+	FlagConfidence     = "confidence"      // Confidence estimates
+	FlagFaithfulness   = "faithfulness"    // The faithfulness check of confidence estimates
+)
+
+var pipelineFlags = []string{
+	FlagNormalize, FlagSpellCheck, FlagGlossary, FlagDatasetRouting, FlagRescore,
+	FlagStitch, FlagGraph, FlagTemporal, FlagNumeric, FlagTranslate, FlagClarify, FlagConfidence, FlagFaithfulness,
+}
+
+type FlagsConfig struct {
+	Defaults map[string]bool `json:"defaults"` // Flags applied to every request, over the stages' own settings
+	Header   string          `json:"header"`   // Header admins set flags with per request, e.g. "rescore=off, faithfulness=on"
+}
+
+func validateFlags(cfg Config) error {
+	if cfg.Flags.Header == "" {
+		return fmt.Errorf("flags.header must not be empty")
+	}
+	flags := map[string]map[string]bool{"flags.defaults": cfg.Flags.Defaults}
+	for _, variant := range cfg.Experiments.Variants {
+		flags["variant "+variant.Name] = variant.Flags
+	}
+	for where, set := range flags {
+		for name := range set {
+			if !slices.Contains(pipelineFlags, name) {
+				return fmt.Errorf("%s: unknown flag %q", where, name)
+			}
+		}
+	}
+	return nil
+}
+
+// parseFlags reads a flags header: comma-separated name=on|off pairs.
+func parseFlags(header string) (map[string]bool, error) {
+	flags := map[string]bool{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !slices.Contains(pipelineFlags, name) {
+			return nil, fmt.Errorf("unknown flag %q", name)
+		}
+		switch strings.TrimSpace(value) {
+		case "on", "true", "1":
+			flags[name] = true
+		case "off", "false", "0":
+			flags[name] = false
+		default:
+			return nil, fmt.Errorf("flag %s must be on or off", name)
+		}
+	}
+	return flags, nil
+}
+
+// bindFlags reads the flags header of a request into msg. Only requests with
+// the admin token may set flags, responding with an error otherwise.
+func bindFlags(c *gin.Context, msg *Message) bool {
+	cfg := getConfig()
+	header := c.GetHeader(cfg.Flags.Header)
+	if header == "" {
+		return true
+	}
+	if !isAdmin(c, cfg.Admin.Token) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Setting flags requires the admin token"})
+		return false
+	}
+	flags, err := parseFlags(header)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	msg.flags = flags
+	return true
+}
+
+// flagOn reports whether a stage runs for msg: as its request flags say, else
+// its experiment variant's, else flags.defaults, else fallback, the stage's
+// own setting.
+func flagOn(msg Message, name string, fallback bool) bool {
+	if on, ok := msg.flags[name]; ok {
+		return on
+	}
+	if msg.variant != nil {
+		if on, ok := msg.variant.Flags[name]; ok {
+			return on
+		}
+	}
+	if on, ok := getConfig().Flags.Defaults[name]; ok {
+		return on
+	}
+	return fallback
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/tmc/langchaingo/schema"
+)
+
+const maxFollowUps = 3
+
+type FollowUpConfig struct {
+	Enabled bool `json:"enabled"` // Suggest follow-up questions unless the chat request turns them off
+	Count   int  `json:"count"`   // Questions suggested per answer
+}
+
+func validateFollowUps(cfg FollowUpConfig) error {
+	if cfg.Count < 1 || cfg.Count > maxFollowUps {
+		return fmt.Errorf("follow_ups.count must be between 1 and %d", maxFollowUps)
+	}
+	return nil
+}
+
+func wantFollowUps(msg Message) bool {
+	if msg.FollowUps != nil {
+		return *msg.FollowUps
+	}
+	return getConfig().FollowUps.Enabled
+}
+
+// suggestFollowUps asks the LLM for questions the user might ask next that
+// the retrieved chunks can answer, so chat UIs can offer them as chips.
+func suggestFollowUps(ctx context.Context, llm Generator, question, answer string, docs []schema.Document) ([]string, error) {
+	n := getConfig().FollowUps.Count
+
+	var sources strings.Builder
+	for _, doc := range docs {
+		sources.WriteString(doc.PageContent)
+		sources.WriteString("\n")
+	}
+	prompt := fmt.Sprintf("A user asked a question and got the answer below. Suggest %d short follow-up questions "+
+		"the user might ask next that the information below can answer. Do not repeat the original question. "+
+		"Respond with JSON of the form {\"questions\": [\"...\"]}.\n\nInformation:\n%s\nQuestion: %s\nAnswer: %s",
+		n, sources.String(), question, answer)
+
+	var result struct {
+		Questions []string `json:"questions"`
+	}
+	if err := generateJSON(ctx, llm, prompt, &result); err != nil {
+		return nil, err
+	}
+
+	var questions []string
+	for _, q := range result.Questions {
+		q = strings.TrimSpace(q)
+		if q == "" || strings.EqualFold(q, strings.TrimSpace(question)) {
+			continue
+		}
+		questions = append(questions, q)
+		if len(questions) == n {
+			break
+		}
+	}
+	return questions, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Why a question is in the review queue
+const (
+	GapUnanswered    = "unanswered"     // The model said it does not know
+	GapLowConfidence = "low_confidence" // The answer's confidence was low
+)
+
+// maxGapTag is the length of a review queue tag at most.
+const maxGapTag = 50
+
+type GapsConfig struct {
+	Enabled       bool `json:"enabled"`        // Queue questions the model could not answer for review
+	LowConfidence bool `json:"low_confidence"` // Also queue answers of low confidence, when confidence estimates are on
+}
+
+// Gap is a question the documents did not answer, kept until a content
+// owner marks it resolved. Asking the same question again, in any casing or
+// spacing, counts towards the same gap and reopens it if it was resolved.
+type Gap struct {
+	ID         string     `json:"id"`
+	Query      string     `json:"query"`                // As first asked
+	Reason     string     `json:"reason"`               // "unanswered" or "low_confidence", of the latest answer
+	Count      int        `json:"count"`                // Times asked and not answered
+	Answer     string     `json:"answer"`               // The latest answer
+	Confidence *float64   `json:"confidence,omitempty"` // Of the latest answer
+	Sources    []string   `json:"sources,omitempty"`    // Documents retrieved for the latest answer
+	Tags       []string   `json:"tags"`
+	Resolved   bool       `json:"resolved"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	Note       string     `json:"note,omitempty"` // Left when resolving, e.g. the document added
+	FirstSeen  time.Time  `json:"first_seen"`
+	LastSeen   time.Time  `json:"last_seen"`
+}
+
+func gapKey(id string) string {
+	return "gap:" + id
+}
+
+// gapID identifies a question by its lowercased text.
+func gapID(query string) string {
+	sum := sha256.Sum256([]byte(statsQuery(query)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// gapReason says why an answer belongs in the review queue, "" if it does
+// not.
+func gapReason(mode string, result ChatResponse, failed bool) string {
+	cfg := getConfig().Gaps
+	if !cfg.Enabled || failed || result.Cancelled || !retrieves(mode) {
+		return ""
+	}
+	if isAbstention(result.Message) {
+		return GapUnanswered
+	}
+	if cfg.LowConfidence && result.Confidence != nil && result.Confidence.Level == ConfidenceLow {
+		return GapLowConfidence
+	}
+	return ""
+}
+
+// recordGap adds a question the model could not answer, or answered with
+// low confidence, to the review queue. Failures are logged rather than
+// failing the chat request.
+func recordGap(msg Message, mode string, result ChatResponse, failed bool) {
+	reason := gapReason(mode, result, failed)
+	if reason == "" {
+		return
+	}
+	id := gapID(msg.Msg)
+	now := time.Now().UTC()
+	reopened := false
+	_, err := updateState(context.Background(), gapKey(id), func(gap *Gap, ok bool) bool {
+		if !ok {
+			*gap = Gap{ID: id, Query: msg.Msg, Tags: []string{}, FirstSeen: now}
+		}
+		reopened = gap.Resolved
+		if gap.Resolved {
+			gap.Resolved, gap.ResolvedAt = false, nil
+		}
+		gap.Reason, gap.Answer, gap.LastSeen = reason, result.Message, now
+		gap.Count++
+		gap.Sources = documentSources(result.docs)
+		gap.Confidence = nil
+		if result.Confidence != nil {
+			gap.Confidence = &result.Confidence.Score
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("Error saving gap %s: %v", id, err)
+		return
+	}
+	if reopened {
+		log.Printf("Reopened gap %s: %q is still not answered", id, msg.Msg)
+	}
+}
+
+// listGaps returns the review queue, the most asked questions first: the
+// open ones, or those of ?status=resolved or all, only those tagged ?tag=
+// when set.
+func listGaps(c *gin.Context) {
+	status := c.DefaultQuery("status", "open")
+	if status != "open" && status != "resolved" && status != "all" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": `status must be "open", "resolved" or "all"`})
+		return
+	}
+	values, err := sharedState.Scan(c.Request.Context(), gapKey(""))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	tag := c.Query("tag")
+	gaps := make([]Gap, 0, len(values))
+	for _, value := range values {
+		var gap Gap
+		if err := json.Unmarshal(value, &gap); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if status != "all" && gap.Resolved != (status == "resolved") {
+			continue
+		}
+		if tag != "" && !slices.Contains(gap.Tags, tag) {
+			continue
+		}
+		gaps = append(gaps, gap)
+	}
+	sort.Slice(gaps, func(i, j int) bool {
+		if gaps[i].Count != gaps[j].Count {
+			return gaps[i].Count > gaps[j].Count
+		}
+		return gaps[i].LastSeen.After(gaps[j].LastSeen)
+	})
+	c.JSON(http.StatusOK, gin.H{"gaps": gaps})
+}
+
+// updateGap loads a gap of the review queue, applies change and saves it. It
+// responds with the updated gap or an error.
+func updateGap(c *gin.Context, change func(*Gap)) {
+	found := false
+	gap, err := updateState(c.Request.Context(), gapKey(c.Param("id")), func(gap *Gap, ok bool) bool {
+		if found = ok; ok {
+			change(gap)
+		}
+		return ok
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Gap not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gap)
+}
+
+// tagGap replaces the tags of a gap: {"tags": ["billing", "needs-doc"]}.
+func tagGap(c *gin.Context) {
+	var request struct {
+		Tags []string `json:"tags"`
+	}
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	tags := []string{}
+	for _, tag := range request.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || len(tag) > maxGapTag {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Tags must be 1 to 50 characters"})
+			return
+		}
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	updateGap(c, func(gap *Gap) { gap.Tags = tags })
+}
+
+// resolveGap marks a gap resolved, with an optional {"note": "..."}, or
+// open again with {"resolved": false}.
+func resolveGap(c *gin.Context) {
+	var request struct {
+		Resolved *bool  `json:"resolved"`
+		Note     string `json:"note"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.BindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+	resolved := request.Resolved == nil || *request.Resolved
+	updateGap(c, func(gap *Gap) {
+		gap.Resolved, gap.ResolvedAt, gap.Note = resolved, nil, request.Note
+		if resolved {
+			now := time.Now().UTC()
+			gap.ResolvedAt = &now
+		}
+	})
+}
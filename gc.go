@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type GCRequest struct {
+	Prefix string `json:"prefix,omitempty"`  // Only consider sources under this path, e.g. a synced directory
+	DryRun bool   `json:"dry_run,omitempty"` // Report orphaned sources without deleting them
+}
+
+// collectGarbage starts a job removing the chunks of sources whose file no
+// longer exists.
+func collectGarbage(c *gin.Context) {
+	var req GCRequest
+	if err := c.ShouldBindJSON(&req); err != nil && c.Request.ContentLength > 0 {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	job := startGCJob(req)
+	c.JSON(202, job)
+}
+
+func startGCJob(req GCRequest) Job {
+	job := jobRegistry.create("gc:" + req.Prefix)
+	go runGCJob(job.ID, req)
+	return job
+}
+
+func runGCJob(jobID string, req GCRequest) {
+	jobRegistry.update(jobID, func(job *Job) { job.Status = JobRunning })
+
+	if err := removeOrphans(context.Background(), jobID, req); err != nil {
+		log.Printf("GC job %s failed: %v", jobID, err)
+		jobRegistry.update(jobID, func(job *Job) {
+			job.Status = JobFailed
+			job.recordError(err.Error())
+		})
+		return
+	}
+
+	jobRegistry.update(jobID, func(job *Job) {
+		job.Status = JobCompleted
+		job.Progress = 100
+	})
+}
+
+// removeOrphans deletes the chunks of every local source that disappeared,
+// and of documents soft-deleted longer ago than the retention period.
+// Sources that are not local paths (URLs, connector IDs) are left alone.
+// Each removal is reported as a job warning.
+func removeOrphans(ctx context.Context, jobID string, req GCRequest) error {
+	store, err := managedStore()
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().AddDate(0, 0, -getConfig().GC.RetentionDays)
+
+	sources, err := store.Sources(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list sources: %v", err)
+	}
+	jobRegistry.update(jobID, func(job *Job) { job.Total = len(sources) })
+
+	for i, info := range sources {
+		source := info.Source
+		if !strings.HasPrefix(source, req.Prefix) {
+			continue
+		}
+
+		var message string
+		if deletedAt, err := time.Parse(time.RFC3339, info.DeletedAt); info.Deleted && err == nil && deletedAt.Before(cutoff) {
+			message = fmt.Sprintf("%s was deleted on %s", source, info.DeletedAt)
+		} else if _, err := os.Stat(source); errors.Is(err, os.ErrNotExist) && !strings.Contains(source, "://") {
+			message = fmt.Sprintf("%s is gone", source)
+		} else {
+			continue
+		}
+
+		if !req.DryRun {
+			removed, err := store.DeleteWhere(ctx, map[string]any{"source": source})
+			if err != nil {
+				return fmt.Errorf("failed to remove chunks of %s: %v", source, err)
+			}
+			message = fmt.Sprintf("%s: removed %d chunks", message, removed)
+		}
+
+		jobRegistry.update(jobID, func(job *Job) {
+			job.Warnings = append(job.Warnings, message)
+			job.Processed = i + 1
+			job.Progress = float64(i+1) * 100 / float64(len(sources))
+		})
+	}
+	return nil
+}
+
+// scheduleGC runs a GC job every interval.
+func scheduleGC(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			startGCJob(GCRequest{})
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// validateGeneration checks the client's generation controls and clamps
+// max_tokens to the server cap.
+func validateGeneration(msg *Message) error {
+	cfg := getConfig().LLM
+	if msg.MaxTokens < 0 {
+		return fmt.Errorf("max_tokens must not be negative")
+	}
+	if cfg.MaxTokens > 0 && (msg.MaxTokens == 0 || msg.MaxTokens > cfg.MaxTokens) {
+		msg.MaxTokens = cfg.MaxTokens
+	}
+	if cfg.MaxStopSequences > 0 && len(msg.Stop) > cfg.MaxStopSequences {
+		return fmt.Errorf("at most %d stop sequences are allowed", cfg.MaxStopSequences)
+	}
+	for _, stop := range msg.Stop {
+		if stop == "" {
+			return fmt.Errorf("stop sequences must not be empty")
+		}
+	}
+	if max := getConfig().Consistency.MaxSamples; msg.Samples < 0 || msg.Samples > max {
+		return fmt.Errorf("samples must be between 0 and %d", max)
+	}
+	return nil
+}
+
+// generationOptions turns the message's generation controls into LLM call
+// options. A seed also pins the temperature to 0 so that answers are
+// reproducible.
+func generationOptions(msg Message) []llms.CallOption {
+	var options []llms.CallOption
+	if msg.MaxTokens > 0 {
+		options = append(options, llms.WithMaxTokens(msg.MaxTokens))
+	}
+	if len(msg.Stop) > 0 {
+		options = append(options, llms.WithStopWords(msg.Stop))
+	}
+	if msg.Seed != nil {
+		options = append(options, llms.WithSeed(*msg.Seed), llms.WithTemperature(0))
+	}
+	return options
+}
+
+// generate sends the messages of a prompt to model and returns the answer.
+func generate(ctx context.Context, model llms.Model, prompt []llms.MessageContent, options ...llms.CallOption) (string, error) {
+	resp, err := model.GenerateContent(ctx, prompt, options...)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("empty response from model")
+	}
+	return resp.Choices[0].Content, nil
+}
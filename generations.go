@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// generationTTL bounds how long a generation is announced in the shared
+	// state, in case its replica dies before removing it.
+	generationTTL = 30 * time.Minute
+	// cancelPollInterval is how often a generation checks the shared state
+	// for cancellations sent to other replicas.
+	cancelPollInterval = time.Second
+)
+
+// GenerationRegistry tracks the answers being generated on this replica, so
+// they can be cancelled.
+type GenerationRegistry struct {
+	Cancels map[string]context.CancelFunc
+	mu      sync.Mutex
+}
+
+var generationRegistry = GenerationRegistry{
+	Cancels: make(map[string]context.CancelFunc),
+}
+
+// start registers a generation and returns its context, cancelled by
+// POST /chat/:generation_id/cancel or with parent, and a function to call
+// once it is done.
+func (r *GenerationRegistry) start(parent context.Context, id string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(parent)
+	r.mu.Lock()
+	r.Cancels[id] = cancel
+	r.mu.Unlock()
+
+	if err := sharedState.Put(ctx, "generation:"+id, []byte{}, generationTTL); err != nil {
+		log.Printf("Error announcing generation %s: %v", id, err)
+	}
+	// A single replica cancels its generations directly
+	if _, local := sharedState.(*memoryState); !local {
+		go r.watch(ctx, id, cancel)
+	}
+
+	return ctx, func() {
+		cancel()
+		r.mu.Lock()
+		delete(r.Cancels, id)
+		r.mu.Unlock()
+		if _, err := sharedState.Delete(context.Background(), "generation:"+id); err != nil {
+			log.Printf("Error removing generation %s: %v", id, err)
+		}
+	}
+}
+
+// watch cancels a generation once another replica asks for it.
+func (r *GenerationRegistry) watch(ctx context.Context, id string, cancel context.CancelFunc) {
+	ticker := time.NewTicker(cancelPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, ok, err := sharedState.Get(ctx, "cancel:"+id); ok && err == nil {
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+func (r *GenerationRegistry) running(id string) bool {
+	r.mu.Lock()
+	_, ok := r.Cancels[id]
+	r.mu.Unlock()
+	if ok {
+		return true
+	}
+	_, ok, err := sharedState.Get(context.Background(), "generation:"+id)
+	if err != nil {
+		log.Printf("Error looking up generation %s: %v", id, err)
+	}
+	return ok
+}
+
+// cancelGeneration stops an answer being generated, closing the request to
+// the model. Generations on other replicas are cancelled within a second.
+func cancelGeneration(c *gin.Context) {
+	id := c.Param("generation_id")
+
+	generationRegistry.mu.Lock()
+	cancel, ok := generationRegistry.Cancels[id]
+	generationRegistry.mu.Unlock()
+	if ok {
+		cancel()
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	_, ok, err := sharedState.Get(c.Request.Context(), "generation:"+id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Generation not found"})
+		return
+	}
+	if err := sharedState.Put(c.Request.Context(), "cancel:"+id, []byte{}, time.Minute); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusAccepted)
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tmc/langchaingo/schema"
+)
+
+// gitIngestedRef marks, in each clone, the commit that was last ingested so
+// the next run only ingests what changed since.
+const gitIngestedRef = "refs/rag/ingested"
+
+// gitSCPURL matches the scp-like syntax of SSH URLs, [user@]host:path.
+var gitSCPURL = regexp.MustCompile(`^([A-Za-z0-9._~-]+@)?[A-Za-z0-9][A-Za-z0-9.-]*:[^:]`)
+
+// gitLocks serializes the jobs of each clone, as jobs for the same URL and
+// branch share its directory.
+var gitLocks = struct {
+	sync.Mutex
+	dirs map[string]*sync.Mutex
+}{dirs: map[string]*sync.Mutex{}}
+
+type GitConfig struct {
+	Directory string `json:"directory"` // Where repositories are cloned
+}
+
+type GitRequest struct {
+	URL      string   `json:"url"`
+	Branch   string   `json:"branch,omitempty"`   // Defaults to the remote's default branch
+	Paths    []string `json:"paths,omitempty"`    // Path prefixes or glob patterns to ingest; default all files
+	Username string   `json:"username,omitempty"` // HTTPS user for the token; default "x-access-token"
+	Token    string   `json:"token,omitempty"`    // HTTPS access token; SSH URLs use the server's keys
+	Full     bool     `json:"full,omitempty"`     // Ingest every file instead of the changes since the last run
+	Dataset  string   `json:"dataset,omitempty"`
+	Tenant   string   `json:"tenant,omitempty"`
+}
+
+// gitChange is a file added, modified or deleted between two commits.
+type gitChange struct {
+	Path    string
+	Deleted bool
+}
+
+// ingestGitRepository clones or pulls a Git repository and ingests the files
+// changed since the last run, as a background job.
+func ingestGitRepository(c *gin.Context) {
+	var req GitRequest
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	if req.URL == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url is required"})
+		return
+	}
+	if err := validateGitURL(req.URL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if strings.HasPrefix(req.Branch, "-") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid branch"})
+		return
+	}
+
+	ingest := IngestRequest{Dataset: req.Dataset, Tenant: req.Tenant}
+	if err := completeIngestRequest(&ingest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	job := jobRegistry.create("git:" + req.URL)
+	go runJob(job.ID, func(ctx context.Context) error {
+		return ingestGit(ctx, job.ID, req, ingest)
+	})
+
+	c.JSON(http.StatusAccepted, job)
+}
+
+// validateGitURL accepts https:// and SSH URLs only, so that a request cannot
+// clone a local path of the server or run a command through ext::.
+func validateGitURL(rawURL string) error {
+	if !strings.Contains(rawURL, "://") && gitSCPURL.MatchString(rawURL) {
+		return nil
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "ssh") ||
+		parsed.Host == "" || strings.HasPrefix(parsed.Host, "-") {
+		return fmt.Errorf("url must be an https:// or SSH URL")
+	}
+	return nil
+}
+
+func ingestGit(ctx context.Context, jobID string, req GitRequest, ingest IngestRequest) error {
+	dir := gitDir(req)
+	unlock := lockGitDir(dir)
+	defer unlock()
+
+	err := syncRepository(ctx, req, dir)
+	if err != nil {
+		return err
+	}
+	head, err := runGit(ctx, req, dir, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+
+	changes, err := gitChanges(ctx, req, dir)
+	if err != nil {
+		return err
+	}
+
+	var docs []schema.Document
+	var deleted []string
+	failed := 0
+	for _, change := range changes {
+		if !matchesGitPaths(change.Path, req.Paths) {
+			continue
+		}
+		localPath := filepath.Join(dir, filepath.FromSlash(change.Path))
+		if change.Deleted {
+			deleted = append(deleted, localPath)
+			continue
+		}
+		// A symlink of the repository could point at any file of the server
+		if info, err := os.Lstat(localPath); err != nil || info.Mode()&os.ModeSymlink != 0 || !withinDir(dir, localPath) {
+			continue
+		}
+		if !canLoad(localPath) {
+			continue
+		}
+
+		fileReq := ingest
+		fileReq.Path = localPath
+		fileDocs, err := loadDocuments(ctx, fileReq)
+		if err != nil {
+			failed++
+			jobRegistry.update(jobID, func(job *Job) {
+				job.recordError(fmt.Sprintf("%s: %v", change.Path, err))
+			})
+			continue
+		}
+
+		commit, err := gitFileCommit(ctx, req, dir, change.Path)
+		if err != nil {
+			return err
+		}
+		for i := range fileDocs {
+			for key, value := range commit {
+				fileDocs[i].Metadata[key] = value
+			}
+			fileDocs[i].Metadata["path"] = change.Path
+			fileDocs[i].Metadata["document"] = req.URL + "/" + change.Path
+		}
+		docs = append(docs, fileDocs...)
+	}
+
+	if len(deleted) > 0 {
+		if err := deleteSources(ctx, deleted); err != nil {
+			return err
+		}
+	}
+	if len(docs) > 0 {
+		ingest.Path = dir
+		if err := indexDocuments(ctx, jobID, ingest, docs); err != nil {
+			return err
+		}
+	}
+
+	// Files that failed to load are retried by the next run
+	if failed == 0 {
+		if _, err := runGit(ctx, req, dir, "update-ref", gitIngestedRef, strings.TrimSpace(head)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gitDir is where the repository and branch of req are cloned.
+func gitDir(req GitRequest) string {
+	sum := sha256.Sum256([]byte(req.URL + "#" + req.Branch))
+	return filepath.Join(getConfig().Git.Directory, hex.EncodeToString(sum[:8]))
+}
+
+// lockGitDir waits for the other jobs using the clone in dir and returns the
+// function releasing it.
+func lockGitDir(dir string) func() {
+	gitLocks.Lock()
+	lock, ok := gitLocks.dirs[dir]
+	if !ok {
+		lock = &sync.Mutex{}
+		gitLocks.dirs[dir] = lock
+	}
+	gitLocks.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// syncRepository clones the repository into dir, or fetches the branch into
+// the existing clone, and checks it out.
+func syncRepository(ctx context.Context, req GitRequest, dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		args := []string{"clone", "--single-branch"}
+		if req.Branch != "" {
+			args = append(args, "--branch", req.Branch)
+		}
+		if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+			return err
+		}
+		_, err := runGit(ctx, req, "", append(args, "--", req.URL, dir)...)
+		return err
+	}
+
+	ref := req.Branch
+	if ref == "" {
+		ref = "HEAD"
+	}
+	if _, err := runGit(ctx, req, dir, "fetch", "origin", ref); err != nil {
+		return err
+	}
+	_, err := runGit(ctx, req, dir, "reset", "--hard", "FETCH_HEAD")
+	return err
+}
+
+// gitChanges lists the files changed since the last ingested commit, or
+// every file on the first run and with Full.
+func gitChanges(ctx context.Context, req GitRequest, dir string) ([]gitChange, error) {
+	previous, err := runGit(ctx, req, dir, "rev-parse", "--verify", "--quiet", gitIngestedRef)
+	if err != nil || req.Full {
+		out, err := runGit(ctx, req, dir, "ls-files", "-z")
+		if err != nil {
+			return nil, err
+		}
+		var changes []gitChange
+		for _, name := range strings.Split(out, "\x00") {
+			if name != "" {
+				changes = append(changes, gitChange{Path: name})
+			}
+		}
+		return changes, nil
+	}
+
+	out, err := runGit(ctx, req, dir, "diff", "--name-status", "-z", "--no-renames", strings.TrimSpace(previous), "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Split(strings.TrimSuffix(out, "\x00"), "\x00")
+	var changes []gitChange
+	for i := 0; i+1 < len(fields); i += 2 {
+		changes = append(changes, gitChange{Path: fields[i+1], Deleted: fields[i] == "D"})
+	}
+	return changes, nil
+}
+
+// gitFileCommit returns the metadata of the last commit that touched file.
+// The commit date becomes the chunks' "updated_at", for recency scoring.
+func gitFileCommit(ctx context.Context, req GitRequest, dir, file string) (map[string]any, error) {
+	out, err := runGit(ctx, req, dir, "log", "-1", "--format=%H%x00%an%x00%aI%x00%s", "--", file)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(strings.TrimSpace(out), "\x00", 4)
+	if len(parts) < 4 {
+		return nil, fmt.Errorf("no commit found for %s", file)
+	}
+
+	metadata := map[string]any{
+		"repository":     req.URL,
+		"commit":         parts[0],
+		"commit_author":  parts[1],
+		"commit_message": parts[3],
+	}
+	if req.Branch != "" {
+		metadata["branch"] = req.Branch
+	}
+	if date, err := time.Parse(time.RFC3339, parts[2]); err == nil {
+		metadata["updated_at"] = date.UTC().Format(time.RFC3339)
+	}
+	return metadata, nil
+}
+
+func matchesGitPaths(file string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, file); ok {
+			return true
+		}
+		if strings.HasPrefix(file, strings.TrimSuffix(pattern, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteSources soft-deletes the chunks of files removed from a source, like
+// DELETE /documents, so GC purges them after the retention period.
+func deleteSources(ctx context.Context, sources []string) error {
+	if !supportsMaintenance(getConfig().VectorStore.Backend) {
+		return nil
+	}
+	store, err := managedStore()
+	if err != nil {
+		return err
+	}
+	values := make([]any, len(sources))
+	for i, source := range sources {
+		values[i] = source
+	}
+	_, err = store.UpdateWhere(ctx, map[string]any{"source": values}, map[string]any{
+		"deleted":    true,
+		"deleted_at": time.Now().UTC().Format(time.RFC3339),
+	})
+	return err
+}
+
+// runGit runs git in dir, passing the request's token as an HTTP
+// authorization header so it never ends up in the clone's config. The header
+// is set through the environment, which unlike arguments other users cannot
+// read from ps or /proc. Only the https and ssh transports are allowed, for
+// submodules and redirects too.
+func runGit(ctx context.Context, req GitRequest, dir string, args ...string) (string, error) {
+	var options []string
+	if dir != "" {
+		options = append(options, "-C", dir)
+	}
+
+	cmd := exec.CommandContext(ctx, "git", append(options, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ALLOW_PROTOCOL=https:ssh")
+	if req.Token != "" {
+		username := req.Username
+		if username == "" {
+			username = "x-access-token"
+		}
+		credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + req.Token))
+		cmd.Env = append(cmd.Env, "GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+credentials)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s failed: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
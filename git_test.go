@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestValidateGitURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://github.com/org/repo.git", true},
+		{"ssh://git@github.com/org/repo.git", true},
+		{"git@github.com:org/repo.git", true},
+		{"github.com:org/repo.git", true},
+		{"http://github.com/org/repo.git", false},
+		{"file:///etc", false},
+		{"/var/lib/repo", false},
+		{"../repo", false},
+		{"ext::sh -c touch% /tmp/pwned", false},
+		{"ssh://-oProxyCommand=touch/repo", false},
+		{"-u/repo:path", false},
+	}
+	for _, tt := range tests {
+		if err := validateGitURL(tt.url); (err == nil) != tt.want {
+			t.Errorf("validateGitURL(%q) = %v, want accepted %v", tt.url, err, tt.want)
+		}
+	}
+}
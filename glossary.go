@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// GlossaryConfig holds the glossaries used to expand acronyms and domain
+// synonyms in queries before they are embedded.
+type GlossaryConfig struct {
+	Collections map[string]map[string][]string `json:"collections"` // Term → expansions, by collection or Milvus tenant
+}
+
+// glossaryTerm is a glossary entry with the pattern finding it in a query.
+type glossaryTerm struct {
+	term       string
+	pattern    *regexp.Regexp
+	expansions []string
+}
+
+// GlossaryRegistry holds the compiled glossaries.
+type GlossaryRegistry struct {
+	Glossaries map[string][]glossaryTerm
+	mu         sync.RWMutex
+}
+
+var glossaryRegistry = GlossaryRegistry{}
+
+func validateGlossary(cfg GlossaryConfig) error {
+	for collection, terms := range cfg.Collections {
+		for term, expansions := range terms {
+			if strings.TrimSpace(term) == "" {
+				return fmt.Errorf("glossary %s has an empty term", collection)
+			}
+			if len(expansions) == 0 {
+				return fmt.Errorf("glossary %s: %q has no expansions", collection, term)
+			}
+		}
+	}
+	return nil
+}
+
+// setConfiguredGlossaries replaces the glossaries with those of the config.
+// Terms written in capitals, like acronyms, match only in capitals, so "IT"
+// does not expand "it"; other terms match in any case.
+func setConfiguredGlossaries(cfg GlossaryConfig) {
+	glossaries := make(map[string][]glossaryTerm, len(cfg.Collections))
+	for collection, terms := range cfg.Collections {
+		for term, expansions := range terms {
+			flags := "(?i)"
+			if strings.ToUpper(term) == term && strings.ContainsFunc(term, unicode.IsLetter) {
+				flags = ""
+			}
+			glossaries[collection] = append(glossaries[collection], glossaryTerm{
+				term:       term,
+				pattern:    regexp.MustCompile(flags + `\b` + regexp.QuoteMeta(term) + `\b`),
+				expansions: expansions,
+			})
+		}
+		// Expand in a fixed order, longest terms first
+		sort.Slice(glossaries[collection], func(i, j int) bool {
+			a, b := glossaries[collection][i].term, glossaries[collection][j].term
+			return len(a) > len(b) || len(a) == len(b) && a < b
+		})
+	}
+	glossaryRegistry.mu.Lock()
+	glossaryRegistry.Glossaries = glossaries
+	glossaryRegistry.mu.Unlock()
+}
+
+// expand adds the expansions of the glossary terms in query after them, e.g.
+// "BP (blood pressure)", keeping the term for keyword matches. The glossary
+// of the message's tenant is used if there is one, else that of the
+// collection. Expansions the query already has are not added again.
+func (r *GlossaryRegistry) expand(msg Message, query string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	terms, ok := r.Glossaries[msg.Tenant]
+	if !ok || msg.Tenant == "" {
+		terms = r.Glossaries[getConfig().Embedding.Collection]
+	}
+
+	lower := strings.ToLower(query)
+	for _, term := range terms {
+		var missing []string
+		for _, expansion := range term.expansions {
+			if !strings.Contains(lower, strings.ToLower(expansion)) {
+				missing = append(missing, expansion)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		query = term.pattern.ReplaceAllStringFunc(query, func(match string) string {
+			return match + " (" + strings.Join(missing, ", ") + ")"
+		})
+	}
+	return query
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tmc/langchaingo/schema"
+)
+
+// graphSource is the source of the context listing the relations a graph
+// expansion found.
+const graphSource = "knowledge graph"
+
+type GraphConfig struct {
+	Enabled         bool `json:"enabled"`           // Extract triples at ingestion and expand retrieval along them; the graph flag turns expansion on or off per request
+	TriplesPerChunk int  `json:"triples_per_chunk"` // Extracted from a chunk at most
+	Hops            int  `json:"hops"`              // How far from the entities a question names expansion goes
+	MaxTriples      int  `json:"max_triples"`       // Relations an expansion lists at most
+	MaxChunks       int  `json:"max_chunks"`        // Chunks supporting them an expansion adds to the context at most
+}
+
+func validateGraph(cfg Config) error {
+	graph := cfg.Graph
+	if graph.TriplesPerChunk <= 0 || graph.Hops <= 0 || graph.MaxTriples <= 0 || graph.MaxChunks < 0 {
+		return fmt.Errorf("graph.triples_per_chunk, hops and max_triples must be positive and max_chunks not negative")
+	}
+	if graph.Enabled && cfg.Metadata.Backend == "" {
+		return fmt.Errorf("graph.enabled needs a metadata store")
+	}
+	return nil
+}
+
+// Triple is a relation a chunk states between two entities.
+type Triple struct {
+	Subject  string `json:"subject"`
+	Relation string `json:"relation"`
+	Object   string `json:"object"`
+}
+
+func (t Triple) String() string {
+	return fmt.Sprintf("%s %s %s", t.Subject, t.Relation, t.Object)
+}
+
+// GraphRelation is a triple of the graph and where it was found.
+type GraphRelation struct {
+	Triple
+	Hop       int      `json:"hop"` // Steps from the entities the expansion started at
+	Documents []string `json:"documents"`
+	chunks    []string
+}
+
+// GraphExpansion is what a graph expansion added to the retrieved context.
+type GraphExpansion struct {
+	Entities  []string `json:"entities"`  // Named by the question, that the expansion started at
+	Relations []string `json:"relations"` // Listed in the context
+	Chunks    int      `json:"chunks"`    // Supporting chunks added
+}
+
+// extractTriples has the model list the relations each chunk states, as
+// subject-relation-object triples with lower-cased entity names. The result
+// has an entry per doc, empty for those it failed on.
+func extractTriples(ctx context.Context, llm Generator, docs []schema.Document) ([][]Triple, []error) {
+	limit := getConfig().Graph.TriplesPerChunk
+	triples := make([][]Triple, len(docs))
+	var errs []error
+	for i, doc := range docs {
+		prompt := fmt.Sprintf("List up to %d facts the text below states about how named entities (people, organizations, places, "+
+			"products, concepts) relate to each other, as subject-relation-object triples. Name the entities as they would be searched for, "+
+			"and write the relation as a short verb phrase, e.g. \"works for\" or \"treats\". "+
+			"Respond with JSON of the form {\"triples\": [{\"subject\": \"...\", \"relation\": \"...\", \"object\": \"...\"}]}.\n\nText:\n%s",
+			limit, doc.PageContent)
+
+		var result struct {
+			Triples []Triple `json:"triples"`
+		}
+		if err := generateJSON(ctx, llm, prompt, &result); err != nil {
+			errs = append(errs, fmt.Errorf("triple extraction: %v", err))
+			continue
+		}
+		for _, triple := range result.Triples {
+			triple.Subject = strings.ToLower(strings.TrimSpace(triple.Subject))
+			triple.Relation = strings.ToLower(strings.TrimSpace(triple.Relation))
+			triple.Object = strings.ToLower(strings.TrimSpace(triple.Object))
+			if triple.Subject == "" || triple.Relation == "" || triple.Object == "" || triple.Subject == triple.Object {
+				continue
+			}
+			if len(triples[i]) < limit {
+				triples[i] = append(triples[i], triple)
+			}
+		}
+	}
+	return triples, errs
+}
+
+// expandGraph adds to the retrieved docs what the knowledge graph knows
+// around the entities the question names: the relations up to graph.hops
+// steps from them, listed in one context document, and the chunks stating
+// the nearest of them. Only relations stated in chunks the message's filter
+// matches are used. The docs are returned unchanged when the question names
+// no entity of the graph.
+func expandGraph(ctx context.Context, msg Message, query string, docs []schema.Document) ([]schema.Document, *GraphExpansion) {
+	cfg := getConfig().Graph
+	store, err := managedStore()
+	if err != nil {
+		log.Printf("Skipping graph expansion: %v", err)
+		return docs, nil
+	}
+	seeds, relations, err := metadataStore.neighborhood(ctx, nameCandidates(query), cfg.Hops, cfg.MaxTriples)
+	if err != nil {
+		log.Printf("Error expanding %q along the knowledge graph: %v", query, err)
+		return docs, nil
+	}
+	if len(relations) == 0 {
+		return docs, nil
+	}
+
+	var ids []any
+	seen := map[string]bool{}
+	for _, relation := range relations {
+		for _, id := range relation.chunks {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	match := map[string]any{}
+	for key, value := range msg.Filter {
+		match[key] = value
+	}
+	match["id"] = ids
+	filter := chunkFilter(match, msg.Version)
+	filter.Ranges = queryRanges(msg)
+	chunks, err := store.Chunks(ctx, filter, len(ids))
+	if err != nil {
+		log.Printf("Error reading the chunks of graph relations: %v", err)
+		return docs, nil
+	}
+	byID := make(map[string]schema.Document, len(chunks))
+	for _, chunk := range chunks {
+		byID[fmt.Sprint(chunk.Metadata["id"])] = chunk
+	}
+	retrieved := map[string]bool{}
+	for _, doc := range docs {
+		if id, ok := doc.Metadata["id"]; ok {
+			retrieved[fmt.Sprint(id)] = true
+		}
+	}
+
+	expansion := &GraphExpansion{Entities: seeds}
+	var added []schema.Document
+	var listing strings.Builder
+	listing.WriteString("Relations between the entities of the question and related ones:\n")
+	for _, relation := range relations {
+		allowed := false
+		for _, id := range relation.chunks {
+			chunk, ok := byID[id]
+			if !ok {
+				continue
+			}
+			allowed = true
+			// Relations are nearest first, so are the chunks added for them
+			if !retrieved[id] && expansion.Chunks < cfg.MaxChunks {
+				retrieved[id] = true
+				expansion.Chunks++
+				added = append(added, chunk)
+			}
+		}
+		if allowed {
+			expansion.Relations = append(expansion.Relations, relation.String())
+			fmt.Fprintf(&listing, "- %s\n", relation)
+		}
+	}
+	if len(expansion.Relations) == 0 {
+		return docs, nil
+	}
+	log.Printf("Graph expansion from %s added %d relations and %d chunks", strings.Join(seeds, ", "), len(expansion.Relations), expansion.Chunks)
+	docs = append(docs[:len(docs):len(docs)], added...)
+	docs = append(docs, schema.Document{PageContent: listing.String(), Metadata: map[string]any{"source": graphSource}})
+	return docs, expansion
+}
+
+// addTriples records the triples extracted from a stored batch, triples
+// holding an entry per doc.
+func (s *MetadataStore) addTriples(ctx context.Context, batch []schema.Document, triples [][]Triple) error {
+	if s == nil || len(triples) == 0 {
+		return nil
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, doc := range batch {
+		id, _ := doc.Metadata["id"].(string)
+		if i >= len(triples) || id == "" {
+			continue
+		}
+		document, _ := doc.Metadata["document"].(string)
+		version, _ := intValue(doc.Metadata["version"])
+		for _, triple := range triples[i] {
+			if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO triples (subject, relation, object, document, version, chunk_id) VALUES (?, ?, ?, ?, ?, ?)
+				ON CONFLICT (subject, relation, object, chunk_id) DO NOTHING`), triple.Subject, triple.Relation, triple.Object, document, version, id); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// neighborhood walks the graph of the latest document versions breadth
+// first from the entities among names, up to hops steps, and returns those
+// entities and the relations met, nearest first, up to limit.
+func (s *MetadataStore) neighborhood(ctx context.Context, names []any, hops, limit int) ([]string, []GraphRelation, error) {
+	if s == nil || len(names) == 0 {
+		return nil, nil, nil
+	}
+	visited := map[string]bool{}
+	for _, name := range names {
+		visited[name.(string)] = true
+	}
+	var seeds []string
+	var relations []GraphRelation
+	index := map[Triple]int{}
+	frontier := names
+	for hop := 1; hop <= hops && len(frontier) > 0 && len(relations) < limit; hop++ {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(frontier)), ", ")
+		rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT t.subject, t.relation, t.object, t.document, t.chunk_id FROM triples t
+			WHERE `+latestVersion("t")+` AND (t.subject IN (`+placeholders+`) OR t.object IN (`+placeholders+`))
+			ORDER BY t.subject, t.relation, t.object`), append(frontier[:len(frontier):len(frontier)], frontier...)...)
+		if err != nil {
+			return nil, nil, err
+		}
+		inFrontier := map[string]bool{}
+		for _, name := range frontier {
+			inFrontier[name.(string)] = true
+		}
+		var next []any
+		for rows.Next() {
+			var triple Triple
+			var document, chunk string
+			if err := rows.Scan(&triple.Subject, &triple.Relation, &triple.Object, &document, &chunk); err != nil {
+				rows.Close()
+				return nil, nil, err
+			}
+			if hop == 1 {
+				for _, name := range []string{triple.Subject, triple.Object} {
+					if inFrontier[name] && !slices.Contains(seeds, name) {
+						seeds = append(seeds, name)
+					}
+				}
+			}
+			i, ok := index[triple]
+			if !ok {
+				if len(relations) >= limit {
+					continue
+				}
+				i = len(relations)
+				index[triple] = i
+				relations = append(relations, GraphRelation{Triple: triple, Hop: hop})
+			}
+			relation := &relations[i]
+			if !slices.Contains(relation.Documents, document) {
+				relation.Documents = append(relation.Documents, document)
+			}
+			if !slices.Contains(relation.chunks, chunk) {
+				relation.chunks = append(relation.chunks, chunk)
+			}
+			for _, name := range []string{triple.Subject, triple.Object} {
+				if !visited[name] {
+					visited[name] = true
+					next = append(next, name)
+				}
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, nil, err
+		}
+		frontier = next
+	}
+	sort.Strings(seeds)
+	return seeds, relations, nil
+}
+
+// getGraph returns the relations around the entity :name, up to ?hops=
+// steps away (graph.hops by default).
+func getGraph(c *gin.Context) {
+	if metadataStore == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the metadata store is disabled"})
+		return
+	}
+	cfg := getConfig().Graph
+	hops := cfg.Hops
+	if value := c.Query("hops"); value != "" {
+		var err error
+		if hops, err = strconv.Atoi(value); err != nil || hops <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "hops must be a positive number"})
+			return
+		}
+	}
+	name := strings.ToLower(c.Param("name"))
+	_, relations, err := metadataStore.neighborhood(c.Request.Context(), []any{name}, hops, cfg.MaxTriples)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(relations) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("The graph has no relation of %q", name)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"name": name, "relations": relations})
+}
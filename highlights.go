@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/tmc/langchaingo/schema"
+)
+
+const (
+	HighlightEmbedding = "embedding"
+	HighlightLLM       = "llm"
+)
+
+type HighlightConfig struct {
+	Enabled       bool    `json:"enabled"`        // Map answer sentences to source text unless the chat request turns it off
+	Method        string  `json:"method"`         // "embedding" or "llm"
+	MinSimilarity float64 `json:"min_similarity"` // Embedding method: weakest sentence match that counts as support
+}
+
+// SourceChunk is a retrieved chunk returned with an answer, for highlights to
+// point into.
+type SourceChunk struct {
+	ID      any    `json:"id,omitempty"`
+	Source  string `json:"source,omitempty"`
+	Content string `json:"content"`
+}
+
+// Highlight maps a sentence of the answer to the text of a source chunk that
+// backs it. Offsets count characters (runes), end exclusive; Chunk indexes
+// the response's sources.
+type Highlight struct {
+	AnswerStart int     `json:"answer_start"`
+	AnswerEnd   int     `json:"answer_end"`
+	Chunk       int     `json:"chunk"`
+	ChunkStart  int     `json:"chunk_start"`
+	ChunkEnd    int     `json:"chunk_end"`
+	Score       float64 `json:"score,omitempty"` // Embedding similarity; not set by the llm method
+}
+
+type textSpan struct {
+	Start, End int // Byte offsets
+}
+
+func validateHighlights(cfg HighlightConfig) error {
+	if cfg.Method != HighlightEmbedding && cfg.Method != HighlightLLM {
+		return fmt.Errorf("unknown highlight method %q", cfg.Method)
+	}
+	if cfg.MinSimilarity < 0 || cfg.MinSimilarity > 1 {
+		return fmt.Errorf("highlights.min_similarity must be between 0 and 1")
+	}
+	return nil
+}
+
+func wantHighlights(msg Message) bool {
+	if msg.Highlights != nil {
+		return *msg.Highlights
+	}
+	return getConfig().Highlights.Enabled
+}
+
+func sourceChunks(docs []schema.Document) []SourceChunk {
+	sources := make([]SourceChunk, len(docs))
+	for i, doc := range docs {
+		source, _ := doc.Metadata["source"].(string)
+		sources[i] = SourceChunk{ID: doc.Metadata["id"], Source: source, Content: doc.PageContent}
+	}
+	return sources
+}
+
+// highlightAnswer maps each sentence of the answer to the chunk sentences
+// that support it.
+func highlightAnswer(ctx context.Context, llm Generator, embedder Embedder, answer string, docs []schema.Document) ([]Highlight, error) {
+	if getConfig().Highlights.Method == HighlightLLM {
+		return highlightWithLLM(ctx, llm, answer, docs)
+	}
+	return highlightWithEmbeddings(ctx, embedder, answer, docs)
+}
+
+// highlightWithEmbeddings embeds the sentences of the answer and of the
+// chunks and keeps, per answer sentence and chunk, the most similar chunk
+// sentence when it reaches the configured similarity.
+func highlightWithEmbeddings(ctx context.Context, embedder Embedder, answer string, docs []schema.Document) ([]Highlight, error) {
+	answerSpans := splitSentences(answer)
+	if len(answerSpans) == 0 {
+		return nil, nil
+	}
+
+	texts := make([]string, 0, len(answerSpans))
+	for _, span := range answerSpans {
+		texts = append(texts, answer[span.Start:span.End])
+	}
+	chunkSpans := make([][]textSpan, len(docs))
+	for i, doc := range docs {
+		chunkSpans[i] = splitSentences(doc.PageContent)
+		for _, span := range chunkSpans[i] {
+			texts = append(texts, doc.PageContent[span.Start:span.End])
+		}
+	}
+
+	vectors, err := embedder.EmbedDocuments(ctx, texts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed sentences: %v", err)
+	}
+
+	minSimilarity := getConfig().Highlights.MinSimilarity
+	var highlights []Highlight
+	for a, answerSpan := range answerSpans {
+		next := len(answerSpans)
+		for c, spans := range chunkSpans {
+			best, bestScore := -1, minSimilarity
+			for s := range spans {
+				if score := cosineSimilarity(vectors[a], vectors[next+s]); score >= bestScore {
+					best, bestScore = s, score
+				}
+			}
+			if best >= 0 {
+				highlights = append(highlights, newHighlight(answer, answerSpan, c, docs[c].PageContent, spans[best], bestScore))
+			}
+			next += len(spans)
+		}
+	}
+	return highlights, nil
+}
+
+// highlightWithLLM asks the model to quote, for each answer sentence, the
+// chunk text that supports it and locates the quotes in the chunks. Quotes
+// that cannot be found verbatim are dropped.
+func highlightWithLLM(ctx context.Context, llm Generator, answer string, docs []schema.Document) ([]Highlight, error) {
+	answerSpans := splitSentences(answer)
+	if len(answerSpans) == 0 {
+		return nil, nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString("For each numbered answer sentence below, quote verbatim the text of the numbered sources that supports it. " +
+		"Leave out sentences no source supports. Respond with JSON of the form " +
+		"{\"highlights\": [{\"sentence\": 1, \"source\": 1, \"quote\": \"...\"}]}.\n\nSources:\n")
+	for i, doc := range docs {
+		fmt.Fprintf(&sb, "[%d] %s\n", i+1, doc.PageContent)
+	}
+	sb.WriteString("\nAnswer sentences:\n")
+	for i, span := range answerSpans {
+		fmt.Fprintf(&sb, "[%d] %s\n", i+1, answer[span.Start:span.End])
+	}
+
+	var result struct {
+		Highlights []struct {
+			Sentence int    `json:"sentence"`
+			Source   int    `json:"source"`
+			Quote    string `json:"quote"`
+		} `json:"highlights"`
+	}
+	if err := generateJSON(ctx, llm, sb.String(), &result); err != nil {
+		return nil, err
+	}
+
+	var highlights []Highlight
+	for _, h := range result.Highlights {
+		if h.Sentence < 1 || h.Sentence > len(answerSpans) || h.Source < 1 || h.Source > len(docs) {
+			continue
+		}
+		content := docs[h.Source-1].PageContent
+		quote := strings.TrimSpace(h.Quote)
+		start := strings.Index(content, quote)
+		if quote == "" || start < 0 {
+			continue
+		}
+		chunkSpan := textSpan{Start: start, End: start + len(quote)}
+		highlights = append(highlights, newHighlight(answer, answerSpans[h.Sentence-1], h.Source-1, content, chunkSpan, 0))
+	}
+	return highlights, nil
+}
+
+func newHighlight(answer string, answerSpan textSpan, chunk int, content string, chunkSpan textSpan, score float64) Highlight {
+	return Highlight{
+		AnswerStart: utf8.RuneCountInString(answer[:answerSpan.Start]),
+		AnswerEnd:   utf8.RuneCountInString(answer[:answerSpan.End]),
+		Chunk:       chunk,
+		ChunkStart:  utf8.RuneCountInString(content[:chunkSpan.Start]),
+		ChunkEnd:    utf8.RuneCountInString(content[:chunkSpan.End]),
+		Score:       score,
+	}
+}
+
+// splitSentences returns the byte spans of the sentences in text, split after
+// ".", "!" or "?" followed by whitespace and at line breaks. Spans exclude
+// surrounding whitespace.
+func splitSentences(text string) []textSpan {
+	var spans []textSpan
+	start := -1
+	for i, r := range text {
+		if start < 0 {
+			if !unicode.IsSpace(r) {
+				start = i
+			}
+			continue
+		}
+		end := -1
+		switch r {
+		case '\n':
+			end = i
+		case '.', '!', '?':
+			next := i + utf8.RuneLen(r)
+			if next == len(text) || unicode.IsSpace(rune(text[next])) {
+				end = next
+			}
+		}
+		if end >= 0 {
+			if span := trimSpan(text, start, end); span.End > span.Start {
+				spans = append(spans, span)
+			}
+			start = -1
+		}
+	}
+	if start >= 0 {
+		if span := trimSpan(text, start, len(text)); span.End > span.Start {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+func trimSpan(text string, start, end int) textSpan {
+	trimmed := strings.TrimRightFunc(text[start:end], unicode.IsSpace)
+	return textSpan{Start: start, End: start + len(trimmed)}
+}
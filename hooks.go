@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/schema"
+)
+
+// Hook plugs custom logic into the RAG pipeline. Each method may inspect or
+// replace what it is given; an error aborts the request. Embed NopHook to
+// implement only some of them.
+type Hook interface {
+	// OnQuery runs before retrieval; an error rejects the chat request.
+	OnQuery(ctx context.Context, msg *Message) error
+	// OnRetrieve runs on the chunks retrieved for query.
+	OnRetrieve(ctx context.Context, query string, docs []schema.Document) ([]schema.Document, error)
+	// OnPromptBuilt runs on the messages of the final prompt before they are
+	// sent to the LLM.
+	OnPromptBuilt(ctx context.Context, prompt []llms.MessageContent) ([]llms.MessageContent, error)
+	// OnResponse runs on the answer before it is returned and remembered.
+	OnResponse(ctx context.Context, msg Message, response string) (string, error)
+}
+
+// StreamableHook is implemented by hooks whose OnResponse leaves answers as
+// they are, so streamed answers can be sent token by token while they are
+// active. With any other hook, streamed answers are sent once the hooks ran.
+type StreamableHook interface {
+	Hook
+	StreamsResponses() bool
+}
+
+// NopHook implements Hook without changing anything.
+type NopHook struct{}
+
+func (NopHook) OnQuery(context.Context, *Message) error { return nil }
+
+func (NopHook) OnRetrieve(_ context.Context, _ string, docs []schema.Document) ([]schema.Document, error) {
+	return docs, nil
+}
+
+func (NopHook) OnPromptBuilt(_ context.Context, prompt []llms.MessageContent) ([]llms.MessageContent, error) {
+	return prompt, nil
+}
+
+func (NopHook) OnResponse(_ context.Context, _ Message, response string) (string, error) {
+	return response, nil
+}
+
+type HookConfig struct {
+	Name   string         `json:"name"`
+	Params map[string]any `json:"params"`
+}
+
+// hookFactories are the hooks that can be enabled from the "hooks" config.
+var hookFactories = map[string]func(params map[string]any) (Hook, error){
+	"log":       newLogHook,
+	"blocklist": newBlocklistHook,
+	"redact":    newRedactHook,
+}
+
+type HookRegistry struct {
+	Hooks      []Hook
+	Configured []Hook
+	mu         sync.RWMutex
+}
+
+var hookRegistry = HookRegistry{}
+
+// RegisterHook adds a hook that runs after the configured ones, for
+// deployments that embed the pipeline in their own binary.
+func RegisterHook(hook Hook) {
+	hookRegistry.mu.Lock()
+	hookRegistry.Hooks = append(hookRegistry.Hooks, hook)
+	hookRegistry.mu.Unlock()
+}
+
+func newHooks(configs []HookConfig) ([]Hook, error) {
+	hooks := make([]Hook, 0, len(configs))
+	for _, cfg := range configs {
+		factory, ok := hookFactories[cfg.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown hook %q", cfg.Name)
+		}
+		hook, err := factory(cfg.Params)
+		if err != nil {
+			return nil, fmt.Errorf("hook %s: %v", cfg.Name, err)
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+// setConfiguredHooks replaces the hooks built from the config.
+func setConfiguredHooks(configs []HookConfig) error {
+	hooks, err := newHooks(configs)
+	if err != nil {
+		return err
+	}
+	hookRegistry.mu.Lock()
+	hookRegistry.Configured = hooks
+	hookRegistry.mu.Unlock()
+	return nil
+}
+
+func activeHooks() []Hook {
+	hookRegistry.mu.RLock()
+	defer hookRegistry.mu.RUnlock()
+	return append(append([]Hook{}, hookRegistry.Configured...), hookRegistry.Hooks...)
+}
+
+func runQueryHooks(ctx context.Context, msg *Message) error {
+	for _, hook := range activeHooks() {
+		if err := hook.OnQuery(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runRetrieveHooks(ctx context.Context, query string, docs []schema.Document) ([]schema.Document, error) {
+	var err error
+	for _, hook := range activeHooks() {
+		if docs, err = hook.OnRetrieve(ctx, query, docs); err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+func runPromptHooks(ctx context.Context, prompt []llms.MessageContent) ([]llms.MessageContent, error) {
+	var err error
+	for _, hook := range activeHooks() {
+		if prompt, err = hook.OnPromptBuilt(ctx, prompt); err != nil {
+			return nil, err
+		}
+	}
+	return prompt, nil
+}
+
+// streamableResponses reports whether answers can be streamed before the
+// response hooks run.
+func streamableResponses() bool {
+	for _, hook := range activeHooks() {
+		if streamable, ok := hook.(StreamableHook); !ok || !streamable.StreamsResponses() {
+			return false
+		}
+	}
+	return true
+}
+
+func runResponseHooks(ctx context.Context, msg Message, response string) (string, error) {
+	var err error
+	for _, hook := range activeHooks() {
+		if response, err = hook.OnResponse(ctx, msg, response); err != nil {
+			return "", err
+		}
+	}
+	return response, nil
+}
+
+// logHook logs each stage of the pipeline.
+type logHook struct {
+	NopHook
+}
+
+func newLogHook(map[string]any) (Hook, error) { return logHook{}, nil }
+
+func (logHook) OnQuery(_ context.Context, msg *Message) error {
+	log.Printf("Query (mode %q): %s", msg.Mode, msg.Msg)
+	return nil
+}
+
+func (logHook) OnRetrieve(_ context.Context, query string, docs []schema.Document) ([]schema.Document, error) {
+	log.Printf("Retrieved %d chunks for %q", len(docs), query)
+	return docs, nil
+}
+
+func (logHook) OnResponse(_ context.Context, _ Message, response string) (string, error) {
+	log.Printf("Response: %d characters", len(response))
+	return response, nil
+}
+
+func (logHook) StreamsResponses() bool { return true }
+
+// blocklistHook rejects queries containing any of the "terms" param.
+type blocklistHook struct {
+	NopHook
+	terms []string
+}
+
+func newBlocklistHook(params map[string]any) (Hook, error) {
+	terms, err := stringListParam(params, "terms")
+	if err != nil {
+		return nil, err
+	}
+	for i := range terms {
+		terms[i] = strings.ToLower(terms[i])
+	}
+	return blocklistHook{terms: terms}, nil
+}
+
+func (blocklistHook) StreamsResponses() bool { return true }
+
+func (h blocklistHook) OnQuery(_ context.Context, msg *Message) error {
+	query := strings.ToLower(msg.Msg)
+	for _, term := range h.terms {
+		if strings.Contains(query, term) {
+			return fmt.Errorf("query contains blocked term %q", term)
+		}
+	}
+	return nil
+}
+
+// redactHook replaces matches of the "patterns" param in retrieved chunks
+// and responses with "replacement" (default "[REDACTED]").
+type redactHook struct {
+	NopHook
+	patterns    []*regexp.Regexp
+	replacement string
+}
+
+func newRedactHook(params map[string]any) (Hook, error) {
+	sources, err := stringListParam(params, "patterns")
+	if err != nil {
+		return nil, err
+	}
+
+	hook := redactHook{replacement: "[REDACTED]"}
+	if replacement, ok := params["replacement"].(string); ok {
+		hook.replacement = replacement
+	}
+	for _, source := range sources {
+		pattern, err := regexp.Compile(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", source, err)
+		}
+		hook.patterns = append(hook.patterns, pattern)
+	}
+	return hook, nil
+}
+
+func (h redactHook) redact(text string) string {
+	for _, pattern := range h.patterns {
+		text = pattern.ReplaceAllString(text, h.replacement)
+	}
+	return text
+}
+
+func (h redactHook) OnRetrieve(_ context.Context, _ string, docs []schema.Document) ([]schema.Document, error) {
+	for i := range docs {
+		docs[i].PageContent = h.redact(docs[i].PageContent)
+	}
+	return docs, nil
+}
+
+func (h redactHook) OnResponse(_ context.Context, _ Message, response string) (string, error) {
+	return h.redact(response), nil
+}
+
+func stringListParam(params map[string]any, name string) ([]string, error) {
+	values, ok := params[name].([]any)
+	if !ok || len(values) == 0 {
+		return nil, fmt.Errorf("%q must be a non-empty list of strings", name)
+	}
+
+	list := make([]string, 0, len(values))
+	for _, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%q must be a non-empty list of strings", name)
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+
+	"github.com/tmc/langchaingo/schema"
+	"golang.org/x/net/html"
+)
+
+// htmlSkipElements hold navigation and non-content markup that would only
+// add noise to the chunks.
+var htmlSkipElements = map[string]bool{
+	"script": true, "style": true, "noscript": true, "template": true,
+	"nav": true, "footer": true, "aside": true, "form": true,
+	"svg": true, "iframe": true, "head": true,
+}
+
+var htmlBlockElements = map[string]bool{
+	"p": true, "div": true, "section": true, "article": true, "li": true,
+	"tr": true, "br": true, "pre": true, "blockquote": true, "table": true,
+	"ul": true, "ol": true, "dd": true, "dt": true, "figcaption": true,
+}
+
+type htmlSection struct {
+	Heading string
+	Text    string
+}
+
+// parseHTML extracts the page title and the readable text of an HTML
+// document, split into sections at every h1-h3 heading.
+func parseHTML(r io.Reader) (string, []htmlSection, error) {
+	root, err := html.Parse(r)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var title string
+	var sections []htmlSection
+	current := &htmlSection{}
+	var text strings.Builder
+
+	flush := func() {
+		current.Text = normalizeWhitespace(text.String())
+		if current.Text != "" || current.Heading != "" {
+			sections = append(sections, *current)
+		}
+		text.Reset()
+	}
+
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			if htmlSkipElements[n.Data] {
+				return
+			}
+			switch n.Data {
+			case "h1", "h2", "h3":
+				flush()
+				current = &htmlSection{Heading: normalizeWhitespace(nodeText(n))}
+				return
+			}
+		}
+		if n.Type == html.TextNode {
+			text.WriteString(n.Data)
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+		if n.Type == html.ElementNode && htmlBlockElements[n.Data] {
+			text.WriteString("\n")
+		}
+	}
+
+	// The title lives in <head>, which is otherwise skipped
+	if head := findElement(root, "head"); head != nil {
+		if t := findElement(head, "title"); t != nil {
+			title = normalizeWhitespace(nodeText(t))
+		}
+	}
+	walk(root)
+	flush()
+
+	return title, sections, nil
+}
+
+func loadHTML(filename string) ([]schema.Document, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return htmlDocuments(file, filename)
+}
+
+// htmlDocuments returns one document per section of an HTML page with text.
+func htmlDocuments(r io.Reader, source string) ([]schema.Document, error) {
+	title, sections, err := parseHTML(r)
+	if err != nil {
+		return nil, err
+	}
+
+	docs := make([]schema.Document, 0, len(sections))
+	for i, section := range sections {
+		if section.Text == "" {
+			continue
+		}
+		metadata := map[string]any{
+			"source":        source,
+			"section":       section.Heading,
+			"section_index": i,
+		}
+		if title != "" {
+			metadata["title"] = title
+		}
+		docs = append(docs, schema.Document{PageContent: section.Text, Metadata: metadata})
+	}
+	return docs, nil
+}
+
+func findElement(n *html.Node, name string) *html.Node {
+	if n.Type == html.ElementNode && n.Data == name {
+		return n
+	}
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if found := findElement(child, name); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func nodeText(n *html.Node) string {
+	var sb strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			sb.WriteString(n.Data)
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(n)
+	return sb.String()
+}
+
+// normalizeWhitespace collapses runs of spaces within lines and drops empty
+// lines, keeping paragraph breaks as single newlines.
+func normalizeWhitespace(s string) string {
+	lines := strings.Split(s, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
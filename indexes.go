@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FilterUsage is a payload field searches filter on and whether a payload
+// index serves it.
+type FilterUsage struct {
+	Field       string `json:"field"`
+	Uses        int    `json:"uses"`              // Searches filtering on the field
+	Type        string `json:"type"`              // Index type for it: the declared one, else the one its filter values suggest
+	Indexed     string `json:"indexed,omitempty"` // Type of its payload index
+	Recommended bool   `json:"recommended"`       // Filtered on but not indexed
+}
+
+type CreateIndexRequest struct {
+	Collection string `json:"collection"` // embedding.collection when empty
+	Field      string `json:"field"`
+	Type       string `json:"type"` // The type filters on the field suggest when empty
+}
+
+func filterUsageKey(collection string) string {
+	return "filter_fields:" + collection
+}
+
+// countFilterFields counts the fields of a search's filter, with the index
+// type their values suggest, toward GET /collections/indexes.
+func countFilterFields(ctx context.Context, filter Filter) {
+	counts := map[string]float64{}
+	for _, pairs := range []map[string]any{filter.Match, filter.Exclude} {
+		for field, value := range pairs {
+			counts[field+":"+filterKind(value)]++
+		}
+	}
+	for _, r := range filter.Ranges {
+		kind := FieldFloat
+		if r.dates() {
+			kind = FieldDatetime
+		}
+		for _, field := range r.Fields {
+			counts[field+":"+kind]++
+		}
+	}
+	if len(counts) == 0 {
+		return
+	}
+	collection := getConfig().Embedding.Collection
+	if err := sharedState.Increment(ctx, filterUsageKey(collection), counts); err != nil {
+		log.Printf("Error counting the filters of %s: %v", collection, err)
+	}
+}
+
+// filterKind returns the payload index type that serves matching value.
+func filterKind(value any) string {
+	if values, ok := value.([]any); ok && len(values) > 0 {
+		value = values[0]
+	}
+	if _, ok := value.(bool); ok {
+		return FieldBool
+	}
+	if f, ok := floatValue(value); ok {
+		if f == math.Trunc(f) {
+			return FieldInteger
+		}
+		return FieldFloat
+	}
+	return FieldKeyword
+}
+
+// filterUsage returns the fields searches of collection filtered on, the
+// most used first, against its payload indexes.
+func filterUsage(ctx context.Context, collection string, indexes map[string]PayloadIndex) ([]FilterUsage, error) {
+	counts, err := sharedState.Counters(ctx, filterUsageKey(collection))
+	if err != nil {
+		return nil, err
+	}
+	declared := map[string]string{}
+	for _, field := range getConfig().PayloadSchemas[collection].Fields {
+		declared[field.Name] = field.Type
+	}
+
+	byField := map[string]*FilterUsage{}
+	kindUses := map[string]float64{}
+	fractional := map[string]bool{}
+	for key, uses := range counts {
+		i := strings.LastIndex(key, ":")
+		if i < 0 {
+			continue
+		}
+		field, kind := key[:i], key[i+1:]
+		usage, ok := byField[field]
+		if !ok {
+			usage = &FilterUsage{Field: field}
+			byField[field] = usage
+		}
+		usage.Uses += int(uses)
+		fractional[field] = fractional[field] || kind == FieldFloat
+		// The type most filters on the field suggest
+		if uses > kindUses[field] {
+			kindUses[field] = uses
+			usage.Type = kind
+		}
+	}
+
+	usages := make([]FilterUsage, 0, len(byField))
+	for field, usage := range byField {
+		if usage.Type == FieldInteger && fractional[field] {
+			// An integer index would not serve the fractional values
+			usage.Type = FieldFloat
+		}
+		if kind, ok := declared[field]; ok {
+			usage.Type = kind
+		}
+		usage.Indexed = indexes[field].Type
+		usage.Recommended = usage.Indexed == ""
+		usages = append(usages, *usage)
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		if usages[i].Uses != usages[j].Uses {
+			return usages[i].Uses > usages[j].Uses
+		}
+		return usages[i].Field < usages[j].Field
+	})
+	return usages, nil
+}
+
+// indexCollection returns the collection a payload index request is on,
+// answering the request itself when the backend has no payload indexes.
+func indexCollection(c *gin.Context, collection string) (string, bool) {
+	if backend := getConfig().VectorStore.Backend; backend != StoreQdrant {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("The %s backend has no payload indexes", backend)})
+		return "", false
+	}
+	if collection == "" {
+		collection = getConfig().Embedding.Collection
+	}
+	return collection, true
+}
+
+// listPayloadIndexes returns the payload indexes of ?collection= and the
+// fields searches filter on, flagging those an index would speed up.
+func listPayloadIndexes(c *gin.Context) {
+	collection, ok := indexCollection(c, c.Query("collection"))
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	indexes, err := payloadIndexes(ctx, collection)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	usages, err := filterUsage(ctx, collection, indexes)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"collection": collection, "indexes": indexes, "filters": usages})
+}
+
+// createIndex creates a payload index on a field of a collection's existing
+// points, without re-ingesting them.
+func createIndex(c *gin.Context) {
+	var req CreateIndexRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		if !bodyTooLarge(c, err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		}
+		return
+	}
+	collection, ok := indexCollection(c, req.Collection)
+	if !ok {
+		return
+	}
+	if strings.TrimSpace(req.Field) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "field is required"})
+		return
+	}
+	ctx := c.Request.Context()
+	if req.Type == "" {
+		usages, err := filterUsage(ctx, collection, nil)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for _, usage := range usages {
+			if usage.Field == req.Field {
+				req.Type = usage.Type
+			}
+		}
+		if req.Type == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("No search has filtered on %s; give its type", req.Field)})
+			return
+		}
+	}
+	switch req.Type {
+	case FieldKeyword, FieldInteger, FieldFloat, FieldBool, FieldDatetime, FieldText:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown index type %q", req.Type)})
+		return
+	}
+	if err := createPayloadIndex(ctx, collection, req.Field, req.Type); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("Created %s payload index on %s of collection %s", req.Type, req.Field, collection)
+	c.JSON(http.StatusCreated, gin.H{"collection": collection, "field": req.Field, "type": req.Type})
+}
+
+// dropIndex drops the payload index on :field of ?collection=.
+func dropIndex(c *gin.Context) {
+	collection, ok := indexCollection(c, c.Query("collection"))
+	if !ok {
+		return
+	}
+	field := c.Param("field")
+	resp, err := qdrantDo(c.Request.Context(), "DELETE", "/collections/"+collection+"/index/"+url.PathEscape(field)+"?wait=true", nil)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("failed to drop the index on %s: unexpected status code %d, body: %s", field, resp.StatusCode, string(body))})
+		return
+	}
+	log.Printf("Dropped the payload index on %s of collection %s", field, collection)
+	c.Status(http.StatusNoContent)
+}
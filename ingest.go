@@ -0,0 +1,583 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tmc/langchaingo/schema"
+	"github.com/tmc/langchaingo/vectorstores"
+)
+
+const (
+	progressEventStep = 10 // Emit a progress webhook every 10%
+	defaultIngestFile = "healthcare_dataset.csv"
+	uploadDirectory   = "uploads"
+	maxRecordedErrors = 20
+)
+
+type IngestConfig struct {
+	Root           string `json:"root"`             // Directory the paths of JSON ingestion requests are resolved in and must stay under; "" allows uploads only
+	BatchSize      int    `json:"batch_size"`       // Chunks embedded and stored per request to the vector store
+	Retries        int    `json:"retries"`          // Further attempts for a batch the vector store rejected
+	RetryBackoffMS int    `json:"retry_backoff_ms"` // Wait before the first retry, doubled for each further one
+}
+
+func validateIngest(cfg IngestConfig) error {
+	if cfg.BatchSize <= 0 {
+		return fmt.Errorf("ingest.batch_size must be positive")
+	}
+	if cfg.Retries < 0 || cfg.RetryBackoffMS < 0 {
+		return fmt.Errorf("ingest.retries and retry_backoff_ms must not be negative")
+	}
+	return nil
+}
+
+type IngestRequest struct {
+	Path        string   `json:"path"`
+	Mode        string   `json:"mode,omitempty"`         // "rows" (default) or "table"
+	RowTemplate string   `json:"row_template,omitempty"` // Table mode row rendering, e.g. "{Name} is {Age} years old"
+	SQL         bool     `json:"sql,omitempty"`          // Also load the table(s) into the SQLite database used by the agent
+	Sheets      []string `json:"sheets,omitempty"`       // Worksheets to ingest from an Excel workbook, default all
+	Processor   string   `json:"processor,omitempty"`    // External processor to parse the file with; default by extension
+	Tenant      string   `json:"tenant,omitempty"`       // Milvus partition or collection to write to
+	Document    string   `json:"document,omitempty"`     // Document identity for versioning; defaults to the path or upload name
+	Dataset     string   `json:"dataset,omitempty"`      // Registered dataset the chunks belong to
+
+	// Chunking of prose sources; default to the chunking config
+	Chunking     string   `json:"chunking,omitempty"` // "recursive" or "semantic"
+	ChunkSize    int      `json:"chunk_size,omitempty"`
+	ChunkOverlap int      `json:"chunk_overlap,omitempty"`
+	Enrich       []string `json:"enrich,omitempty"` // Extractors to run per chunk; defaults to the configured ones
+
+	// Synthetic questions per chunk and whether they are embedded alongside
+	// or instead of the chunk; default to the doc2query config
+	Questions    *int   `json:"questions,omitempty"`
+	QuestionMode string `json:"question_mode,omitempty"`
+}
+
+// ingestDocuments starts an ingestion job for a file on the server (JSON body
+// with "path") or for an uploaded multipart "file", and returns the job.
+func ingestDocuments(c *gin.Context) {
+	req, uploaded, ok := bindIngestRequest(c)
+	if !ok {
+		if uploaded {
+			os.Remove(req.Path)
+		}
+		return
+	}
+
+	job := jobRegistry.create(req.Path)
+	go runIngestJob(job.ID, req)
+
+	c.JSON(http.StatusAccepted, job)
+}
+
+// bindIngestRequest reads an ingestion request from a JSON body or a
+// multipart upload, which it stores under uploadDirectory, and completes it.
+// It reports whether the file was uploaded, and responds with an error
+// itself when the request is invalid.
+func bindIngestRequest(c *gin.Context) (IngestRequest, bool, bool) {
+	var req IngestRequest
+	uploaded := strings.HasPrefix(c.ContentType(), "multipart/")
+
+	if uploaded {
+		up, ok := receiveUpload(c)
+		if !ok {
+			return req, false, false
+		}
+		req.Path = up.Path
+		if enrich := up.Form.Get("enrich"); enrich != "" {
+			req.Enrich = strings.Split(enrich, ",")
+		}
+		if questions := up.Form.Get("questions"); questions != "" {
+			n, err := strconv.Atoi(questions)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "questions must be a number"})
+				return req, true, false
+			}
+			req.Questions = &n
+		}
+		req.QuestionMode = up.Form.Get("question_mode")
+		req.Mode = up.Form.Get("mode")
+		req.RowTemplate = up.Form.Get("row_template")
+		req.SQL = up.Form.Get("sql") == "true"
+		if sheets := up.Form.Get("sheets"); sheets != "" {
+			req.Sheets = strings.Split(sheets, ",")
+		}
+		req.Chunking = up.Form.Get("chunking")
+		req.ChunkSize, _ = strconv.Atoi(up.Form.Get("chunk_size"))
+		req.ChunkOverlap, _ = strconv.Atoi(up.Form.Get("chunk_overlap"))
+		req.Processor = up.Form.Get("processor")
+		req.Tenant = up.Form.Get("tenant")
+		req.Document = up.Form.Get("document")
+		req.Dataset = up.Form.Get("dataset")
+		if req.Document == "" {
+			req.Document = documentName(req.Path, up.Filename)
+		}
+	} else {
+		if err := c.ShouldBindJSON(&req); err != nil && c.Request.ContentLength > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return req, false, false
+		}
+		if req.Path == "" {
+			req.Path = defaultIngestFile
+		}
+		if req.Document == "" {
+			req.Document = documentName(req.Path, "")
+		}
+		path, err := ingestPath(req.Path)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return req, false, false
+		}
+		req.Path = path
+	}
+
+	if err := completeIngestRequest(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return req, uploaded, false
+	}
+	return req, uploaded, true
+}
+
+// ingestPath resolves the path of a JSON ingestion request in ingest.root
+// and checks that the file, once symlinks are followed, is inside it, so
+// that clients cannot index other files of the server. Missing files and
+// files outside the root get the same error.
+func ingestPath(path string) (string, error) {
+	root := getConfig().Ingest.Root
+	if root == "" {
+		return "", fmt.Errorf("Ingesting files of the server is disabled; upload the file instead")
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	if !withinDir(root, path) {
+		return "", fmt.Errorf("Cannot read %s", path)
+	}
+	return path, nil
+}
+
+// withinDir reports whether path exists and is inside dir once both have
+// their symlinks followed.
+func withinDir(dir, path string) bool {
+	realDir, err := filepath.Abs(dir)
+	if err == nil {
+		realDir, err = filepath.EvalSymlinks(realDir)
+	}
+	if err != nil {
+		return false
+	}
+	real, err := filepath.Abs(path)
+	if err == nil {
+		real, err = filepath.EvalSymlinks(real)
+	}
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(realDir, real)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// completeIngestRequest fills in the defaults of an ingestion request and
+// validates it.
+func completeIngestRequest(req *IngestRequest) error {
+	if req.Mode == "" {
+		req.Mode = IngestModeRows
+	}
+	if req.Mode != IngestModeRows && req.Mode != IngestModeTable {
+		return fmt.Errorf("Unknown mode %q", req.Mode)
+	}
+
+	if req.Dataset != "" && !datasetRegistry.exists(req.Dataset) {
+		return fmt.Errorf("Unknown dataset %q", req.Dataset)
+	}
+
+	if _, _, err := findProcessor(req.Processor, req.Path); err != nil {
+		return err
+	}
+	if req.SQL && getConfig().SQL.Path == "" {
+		return fmt.Errorf("Loading tables for the agent is disabled: sql.path is not set")
+	}
+
+	if req.Enrich == nil {
+		req.Enrich = getConfig().Enrichment.Extractors
+	}
+	for _, name := range req.Enrich {
+		if _, ok := extractorFactories[name]; !ok {
+			return fmt.Errorf("Unknown extractor %q", name)
+		}
+	}
+
+	if req.Chunking == "" {
+		req.Chunking = getConfig().Chunking.Strategy
+	}
+	if req.Chunking != ChunkingRecursive && req.Chunking != ChunkingSemantic {
+		return fmt.Errorf("Unknown chunking strategy %q", req.Chunking)
+	}
+	if req.ChunkSize == 0 {
+		req.ChunkSize = getConfig().Chunking.Size
+	}
+	if req.ChunkOverlap == 0 {
+		req.ChunkOverlap = min(getConfig().Chunking.Overlap, req.ChunkSize-1)
+	}
+	if err := validateChunking(req.ChunkSize, req.ChunkOverlap); err != nil {
+		return err
+	}
+
+	if req.Questions == nil {
+		questions := getConfig().Doc2Query.Questions
+		req.Questions = &questions
+	}
+	if req.QuestionMode == "" {
+		req.QuestionMode = getConfig().Doc2Query.Mode
+	}
+	return validateDoc2Query(*req.Questions, req.QuestionMode)
+}
+
+func runIngestJob(jobID string, req IngestRequest) {
+	runJob(jobID, func(ctx context.Context) error {
+		return ingestFile(ctx, jobID, req)
+	})
+}
+
+// runJob runs an ingestion job, keeping its status up to date and emitting
+// the ingestion webhook events.
+func runJob(jobID string, run func(ctx context.Context) error) {
+	ctx := context.Background()
+
+	job := jobRegistry.update(jobID, func(job *Job) {
+		job.Status = JobRunning
+	})
+	emitJobEvent(EventIngestionStarted, job)
+
+	err := run(ctx)
+	if err != nil {
+		log.Printf("Ingestion job %s failed: %v", jobID, err)
+		job = jobRegistry.update(jobID, func(job *Job) {
+			job.Status = JobFailed
+			job.Errors = append(job.Errors, err.Error())
+		})
+		emitJobEvent(EventIngestionFailed, job)
+		return
+	}
+
+	job = jobRegistry.update(jobID, func(job *Job) {
+		job.Status = JobCompleted
+		job.Progress = 100
+	})
+	emitJobEvent(EventIngestionCompleted, job)
+}
+
+func ingestFile(ctx context.Context, jobID string, req IngestRequest) error {
+	docs, err := loadDocuments(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", req.Path, err)
+	}
+
+	if req.SQL {
+		tables, err := loadTables(req)
+		if err != nil {
+			return err
+		}
+		for _, table := range tables {
+			if _, err := loadTableIntoSQLite(ctx, getConfig().SQL.Path, table); err != nil {
+				return fmt.Errorf("failed to load %s into SQLite: %v", table.Name, err)
+			}
+		}
+	}
+
+	return indexDocuments(ctx, jobID, req, docs)
+}
+
+// indexDocuments versions, enriches and stores docs, reporting progress on
+// the job. Docs are versioned per their "document" field, or as
+// req.Document when they have none, so connectors can index several
+// documents in one job.
+func indexDocuments(ctx context.Context, jobID string, req IngestRequest, docs []schema.Document) error {
+	ollamaLLM, err := newLLM()
+	if err != nil {
+		return err
+	}
+
+	embedder, err := newEmbedder()
+	if err != nil {
+		return err
+	}
+
+	err = prepareStore(ctx, embedder, req.Tenant)
+	if err != nil {
+		return err
+	}
+	store, err := newStore(embedder, req.Tenant)
+	if err != nil {
+		return err
+	}
+	if err := enforcePayloadSchema(docs); err != nil {
+		return err
+	}
+
+	groups := map[string][]schema.Document{}
+	var names []string
+	for i := range docs {
+		if docs[i].Metadata == nil {
+			docs[i].Metadata = map[string]any{} // Shared with the group, which is stamped below
+		}
+		name, _ := docs[i].Metadata["document"].(string)
+		if name == "" {
+			name = req.Document
+		}
+		if _, ok := groups[name]; !ok {
+			names = append(names, name)
+		}
+		groups[name] = append(groups[name], docs[i])
+	}
+	superseded := map[string][]any{}
+	records := make([]DocumentRecord, 0, len(names))
+	for _, name := range names {
+		version, older, err := nextVersion(ctx, name)
+		if err != nil {
+			return err
+		}
+		stampVersion(groups[name], req.Path, name, version)
+		superseded[name] = older
+		records = append(records, DocumentRecord{Name: name, Version: version, Tenant: req.Tenant, Chunks: len(groups[name])})
+	}
+	if req.Dataset != "" {
+		for i := range docs {
+			docs[i].Metadata["dataset"] = req.Dataset
+		}
+	}
+
+	if warnings := lowConfidenceWarnings(docs); len(warnings) > 0 {
+		jobRegistry.update(jobID, func(job *Job) {
+			job.Warnings = append(job.Warnings, warnings...)
+		})
+	}
+
+	extractors, err := newExtractors(req.Enrich, ollamaLLM)
+	if err != nil {
+		return err
+	}
+
+	jobRegistry.update(jobID, func(job *Job) {
+		job.Total = len(docs)
+	})
+
+	batchSize := getConfig().Ingest.BatchSize
+	failed := 0
+	lastStep := 0
+	for start := 0; start < len(docs); start += batchSize {
+		end := min(start+batchSize, len(docs))
+		batch := docs[start:end]
+
+		enrichErrs := enrichDocuments(ctx, batch, extractors)
+
+		var triples [][]Triple
+		if getConfig().Graph.Enabled {
+			var graphErrs []error
+			triples, graphErrs = extractTriples(ctx, ollamaLLM, docs[start:end])
+			enrichErrs = append(enrichErrs, graphErrs...)
+		}
+
+		if *req.Questions > 0 {
+			questionDocs, questionErrs := generateQuestionDocuments(ctx, ollamaLLM, batch, *req.Questions)
+			enrichErrs = append(enrichErrs, questionErrs...)
+			if req.QuestionMode == QuestionsInstead {
+				batch = questionDocs
+			} else {
+				batch = append(batch[:len(batch):len(batch)], questionDocs...)
+			}
+		}
+
+		ids, attempts, err := storeBatch(ctx, store, batch)
+		if err != nil {
+			failed += end - start
+		} else {
+			if err := metadataStore.addChunks(ctx, jobID, batch, ids); err != nil {
+				log.Printf("Error recording chunks of job %s: %v", jobID, err)
+			}
+			if err := metadataStore.addEntities(ctx, batch); err != nil {
+				log.Printf("Error indexing entities of job %s: %v", jobID, err)
+			}
+			if err := metadataStore.addTriples(ctx, docs[start:end], triples); err != nil {
+				log.Printf("Error recording the knowledge graph of job %s: %v", jobID, err)
+			}
+			countVocabulary(ctx, docs[start:end])
+		}
+
+		job := jobRegistry.update(jobID, func(job *Job) {
+			job.Processed = end
+			job.Progress = float64(end) * 100 / float64(len(docs))
+			job.recordBatch(start, end-1, attempts, err)
+			if err != nil {
+				job.recordError(fmt.Sprintf("documents %d-%d: %v", start, end-1, err))
+			}
+			for _, enrichErr := range enrichErrs {
+				job.recordError(fmt.Sprintf("enrichment of documents %d-%d: %v", start, end-1, enrichErr))
+			}
+		})
+
+		if step := int(job.Progress) / progressEventStep; step > lastStep && end < len(docs) {
+			lastStep = step
+			emitJobEvent(EventIngestionProgress, job)
+		}
+	}
+
+	if failed == len(docs) && failed > 0 {
+		return fmt.Errorf("all %d documents failed to ingest", failed)
+	}
+	for _, name := range names {
+		supersede(ctx, name, superseded[name])
+	}
+	if job, ok, _ := jobRegistry.get(jobID); ok {
+		if err := metadataStore.saveIngestion(ctx, job.Source, jobID, records); err != nil {
+			log.Printf("Error recording documents of job %s: %v", jobID, err)
+		}
+	}
+
+	return nil
+}
+
+// storeBatch adds a batch to the store, retrying with backoff up to
+// ingest.retries times, and returns the ids of the stored chunks and the
+// attempts made.
+func storeBatch(ctx context.Context, store vectorstores.VectorStore, batch []schema.Document) ([]string, int, error) {
+	cfg := getConfig().Ingest
+	backoff := time.Duration(cfg.RetryBackoffMS) * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		ids, err := store.AddDocuments(ctx, batch)
+		if err == nil || attempt > cfg.Retries {
+			return ids, attempt, err
+		}
+		log.Printf("Storing a batch failed (attempt %d), retrying: %v", attempt, err)
+		select {
+		case <-ctx.Done():
+			return nil, attempt, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// loadDocuments reads the file of an ingestion request. HTML, EPUB, email,
+// PDF, image (the latter two through OCR where needed) and plain text files
+// are split into chunks; source code is split at its declarations; Excel
+// workbooks are always ingested as tables; CSV files follow the requested
+// mode.
+func loadDocuments(ctx context.Context, req IngestRequest) ([]schema.Document, error) {
+	processor, ok, err := findProcessor(req.Processor, req.Path)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		docs, err := loadWithProcessor(ctx, processor, req.Path)
+		if err != nil {
+			return nil, err
+		}
+		return splitDocuments(ctx, docs, req)
+	}
+
+	ext := strings.ToLower(filepath.Ext(req.Path))
+	if imageExtensions[ext] {
+		docs, err := loadImage(ctx, req.Path)
+		if err != nil {
+			return nil, err
+		}
+		return splitDocuments(ctx, docs, req)
+	}
+
+	if isCodeFile(req.Path) {
+		docs, err := loadCode(req.Path)
+		if err != nil {
+			return nil, err
+		}
+		// Symbols are the natural units of code, so only oversized ones are split further
+		return chunkDocuments(docs, req.ChunkSize, req.ChunkOverlap)
+	}
+
+	switch ext {
+	case ".pdf":
+		docs, err := loadPDF(ctx, req.Path)
+		if err != nil {
+			return nil, err
+		}
+		return splitDocuments(ctx, docs, req)
+	case ".html", ".htm", ".xhtml":
+		docs, err := loadHTML(req.Path)
+		if err != nil {
+			return nil, err
+		}
+		return splitDocuments(ctx, docs, req)
+	case ".epub":
+		docs, err := loadEPUB(req.Path)
+		if err != nil {
+			return nil, err
+		}
+		return splitDocuments(ctx, docs, req)
+	case ".eml", ".mbox":
+		docs, err := loadEmails(req.Path)
+		if err != nil {
+			return nil, err
+		}
+		return splitDocuments(ctx, docs, req)
+	case ".txt", ".md", ".markdown", ".rst":
+		content, err := os.ReadFile(req.Path)
+		if err != nil {
+			return nil, err
+		}
+		docs := []schema.Document{{PageContent: string(content), Metadata: map[string]any{"source": req.Path}}}
+		return splitDocuments(ctx, docs, req)
+	}
+
+	if req.Mode == IngestModeTable || isExcelFile(req.Path) {
+		tables, err := loadTables(req)
+		if err != nil {
+			return nil, err
+		}
+		var docs []schema.Document
+		for _, table := range tables {
+			docs = append(docs, tableDocuments(table, req.Path, req.RowTemplate)...)
+		}
+		return docs, nil
+	}
+	return readDocumentsFromCSV(req.Path)
+}
+
+func loadTables(req IngestRequest) ([]Table, error) {
+	if isExcelFile(req.Path) {
+		return readTablesXLSX(req.Path, req.Sheets)
+	}
+	table, err := readTableCSV(req.Path)
+	if err != nil {
+		return nil, err
+	}
+	return []Table{table}, nil
+}
+
+// canLoad reports whether loadDocuments can read the file, which lets
+// connectors skip files of other types.
+func canLoad(path string) bool {
+	if _, ok, _ := findProcessor("", path); ok {
+		return true
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	switch ext {
+	case ".pdf", ".html", ".htm", ".xhtml", ".epub", ".eml", ".mbox", ".txt", ".md", ".markdown", ".rst", ".csv":
+		return true
+	}
+	return imageExtensions[ext] || isCodeFile(path) || isExcelFile(path)
+}
+
+func isExcelFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".xlsx" || ext == ".xlsm"
+}
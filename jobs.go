@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobCompleted JobStatus = "completed"
+	JobFailed    JobStatus = "failed"
+)
+
+// BatchOutcome is how storing one batch of an ingestion went.
+type BatchOutcome struct {
+	First    int    `json:"first"` // Index of the batch's first document
+	Last     int    `json:"last"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"` // Of the last attempt; empty when a retry succeeded
+}
+
+type Job struct {
+	ID        string    `json:"id"`
+	Source    string    `json:"source"`
+	Status    JobStatus `json:"status"`
+	Progress  float64   `json:"progress"`
+	Total     int       `json:"total"`
+	Processed int       `json:"processed"`
+	Errors    []string  `json:"errors,omitempty"`
+	Warnings  []string  `json:"warnings,omitempty"`
+
+	Batches       int            `json:"batches,omitempty"`        // Batches sent to the vector store so far
+	FailedBatches int            `json:"failed_batches,omitempty"` // Batches that failed every attempt
+	BatchOutcomes []BatchOutcome `json:"batch_outcomes,omitempty"` // Batches that were retried or failed
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// finishedJobTTL is how long a replica keeps a completed or failed job in
+// memory. It can still be read from the shared state afterwards.
+const finishedJobTTL = time.Hour
+
+// JobRegistry tracks the jobs this replica runs and saves a snapshot of each
+// change to the shared state, where every replica can read them.
+type JobRegistry struct {
+	Jobs map[string]*Job
+	mu   sync.Mutex
+
+	// saveMu orders the saves, which happen outside mu
+	saveMu sync.Mutex
+}
+
+var jobRegistry = JobRegistry{
+	Jobs: make(map[string]*Job),
+}
+
+func (r *JobRegistry) create(source string) Job {
+	now := time.Now()
+	job := &Job{
+		ID:        uuid.New().String(),
+		Source:    source,
+		Status:    JobQueued,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	r.mu.Lock()
+	for id, old := range r.Jobs {
+		if (old.Status == JobCompleted || old.Status == JobFailed) && now.Sub(old.UpdatedAt) > finishedJobTTL {
+			delete(r.Jobs, id)
+		}
+	}
+	r.Jobs[job.ID] = job
+	snapshot := job.snapshot()
+	r.mu.Unlock()
+
+	r.save(job.ID)
+	return snapshot
+}
+
+// update applies fn to the job under lock and returns a snapshot of the result.
+func (r *JobRegistry) update(id string, fn func(job *Job)) Job {
+	r.mu.Lock()
+	job := r.Jobs[id]
+	fn(job)
+	job.UpdatedAt = time.Now()
+	snapshot := job.snapshot()
+	r.mu.Unlock()
+
+	r.save(id)
+	return snapshot
+}
+
+// save saves the latest snapshot of the job, so that of two updates saving
+// at once the last save is never the older one.
+func (r *JobRegistry) save(id string) {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+
+	r.mu.Lock()
+	job, ok := r.Jobs[id]
+	var snapshot Job
+	if ok {
+		snapshot = job.snapshot()
+	}
+	r.mu.Unlock()
+	if ok {
+		saveJob(snapshot)
+	}
+}
+
+// get returns a job run by any replica.
+func (r *JobRegistry) get(id string) (Job, bool, error) {
+	r.mu.Lock()
+	job, ok := r.Jobs[id]
+	r.mu.Unlock()
+	if ok {
+		return job.snapshot(), true, nil
+	}
+
+	var shared Job
+	ok, err := loadState(context.Background(), "job:"+id, &shared)
+	return shared, ok, err
+}
+
+// list returns the jobs of every replica, newest first.
+func (r *JobRegistry) list() ([]Job, error) {
+	values, err := sharedState.Scan(context.Background(), "job:")
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]Job, 0, len(values))
+	for _, value := range values {
+		var job Job
+		if err := json.Unmarshal(value, &job); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.After(jobs[j].CreatedAt)
+	})
+	return jobs, nil
+}
+
+// saveJob shares a job snapshot and records it in the metadata store.
+// Failures are logged: the job itself goes on.
+func saveJob(job Job) {
+	if err := saveState(context.Background(), "job:"+job.ID, job, 0); err != nil {
+		log.Printf("Error saving job %s: %v", job.ID, err)
+	}
+	if err := metadataStore.saveJob(context.Background(), job); err != nil {
+		log.Printf("Error recording job %s: %v", job.ID, err)
+	}
+}
+
+// recordError appends msg to the job errors, keeping at most
+// maxRecordedErrors so a bad file cannot grow the job without bound.
+func (j *Job) recordError(msg string) {
+	if len(j.Errors) < maxRecordedErrors {
+		j.Errors = append(j.Errors, msg)
+	}
+}
+
+// recordBatch counts a stored batch and keeps the outcome of batches that
+// needed retries or failed, up to maxRecordedErrors of them.
+func (j *Job) recordBatch(first, last, attempts int, err error) {
+	j.Batches++
+	if err != nil {
+		j.FailedBatches++
+	}
+	if attempts == 1 && err == nil || len(j.BatchOutcomes) >= maxRecordedErrors {
+		return
+	}
+	outcome := BatchOutcome{First: first, Last: last, Attempts: attempts}
+	if err != nil {
+		outcome.Error = err.Error()
+	}
+	j.BatchOutcomes = append(j.BatchOutcomes, outcome)
+}
+
+func (j *Job) snapshot() Job {
+	s := *j
+	s.BatchOutcomes = append([]BatchOutcome(nil), j.BatchOutcomes...)
+	s.Errors = append([]string(nil), j.Errors...)
+	s.Warnings = append([]string(nil), j.Warnings...)
+	return s
+}
+
+func listJobs(c *gin.Context) {
+	jobs, err := jobRegistry.list()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"jobs": jobs})
+}
+
+func getJob(c *gin.Context) {
+	job, ok, err := jobRegistry.get(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
@@ -0,0 +1,59 @@
+package main
+
+// languageStopwords holds a small set of very frequent function words per
+// language. Counting them is enough to tell these languages apart on anything
+// longer than a few words.
+var languageStopwords = map[string][]string{
+	"en": {"the", "and", "is", "of", "to", "in", "that", "it", "for", "with", "was", "on", "are", "as", "this", "be", "what", "how", "who", "which"},
+	"es": {"el", "la", "de", "que", "y", "en", "los", "las", "es", "por", "con", "para", "una", "del", "se", "como", "qué", "cuál", "cómo", "quién"},
+	"fr": {"le", "la", "les", "de", "et", "est", "des", "en", "un", "une", "du", "que", "pour", "dans", "qui", "pas", "avec", "quel", "quelle", "comment"},
+	"de": {"der", "die", "das", "und", "ist", "nicht", "ein", "eine", "zu", "den", "mit", "von", "sich", "auf", "für", "wie", "was", "wer", "welche", "dem"},
+	"it": {"il", "di", "che", "e", "la", "per", "un", "una", "sono", "non", "con", "del", "della", "gli", "come", "cosa", "chi", "quale", "è", "nel"},
+	"pt": {"o", "a", "de", "que", "e", "do", "da", "em", "um", "uma", "para", "com", "não", "os", "no", "na", "como", "qual", "quem", "são"},
+	"nl": {"de", "het", "een", "en", "van", "is", "dat", "niet", "op", "te", "met", "voor", "zijn", "er", "wat", "hoe", "wie", "welke", "ook", "maar"},
+}
+
+var stopwordSets = func() map[string]map[string]bool {
+	sets := make(map[string]map[string]bool, len(languageStopwords))
+	for lang, words := range languageStopwords {
+		set := make(map[string]bool, len(words))
+		for _, w := range words {
+			set[w] = true
+		}
+		sets[lang] = set
+	}
+	return sets
+}()
+
+// detectLanguage returns the ISO 639-1 code of the most likely language of
+// text, or "und" when no language stands out.
+func detectLanguage(text string) string {
+	best, bestScore, secondScore := "und", 0, 0
+	words := tokenize(text)
+	for lang, set := range stopwordSets {
+		score := 0
+		for _, w := range words {
+			if set[w] {
+				score++
+			}
+		}
+		if score > bestScore {
+			best, secondScore, bestScore = lang, bestScore, score
+		} else if score > secondScore {
+			secondScore = score
+		}
+	}
+	if bestScore == 0 || bestScore == secondScore {
+		return "und"
+	}
+	return best
+}
+
+func isStopword(word string) bool {
+	for _, set := range stopwordSets {
+		if set[word] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/tmc/langchaingo/schema"
+)
+
+// Vector names of late-interaction collections: the dense vector candidates
+// are searched on, and the token vectors they are rescored with.
+const (
+	denseVector = "dense"
+	tokenVector = "colbert"
+)
+
+type LateInteractionConfig struct {
+	Collections []string `json:"collections"` // Qdrant collections indexing token vectors alongside the dense ones; new collections only, see README
+	URL         string   `json:"url"`         // Token embedding service, e.g. an infinity server running a ColBERT model
+	APIKey      string   `json:"api_key"`     // Bearer token for the service, with environment variables expanded
+	Model       string   `json:"model"`       // Token embedding model, e.g. "colbert-ir/colbertv2.0"
+	Candidates  int      `json:"candidates"`  // Found by dense search and rescored per question
+}
+
+func validateLateInteraction(cfg Config) error {
+	late := cfg.LateInteraction
+	if len(late.Collections) == 0 {
+		return nil
+	}
+	if cfg.VectorStore.Backend != StoreQdrant {
+		return fmt.Errorf("late_interaction.collections needs the qdrant backend")
+	}
+	if late.URL == "" || late.Model == "" {
+		return fmt.Errorf("late_interaction.url and model are required")
+	}
+	if late.Candidates <= 0 {
+		return fmt.Errorf("late_interaction.candidates must be positive")
+	}
+	return nil
+}
+
+// lateInteraction reports whether a collection is scored by late interaction.
+func lateInteraction(collection string) bool {
+	return slices.Contains(getConfig().LateInteraction.Collections, collection)
+}
+
+// embedTokens returns a vector per token of each text. Questions and
+// passages are encoded differently by ColBERT models, so query tells which
+// texts are.
+func embedTokens(ctx context.Context, texts []string, query bool) ([][][]float32, error) {
+	if fakeLLMMode {
+		tokens := make([][][]float32, len(texts))
+		for i, text := range texts {
+			for _, word := range strings.Fields(text) {
+				tokens[i] = append(tokens[i], fakeEmbedding(word))
+			}
+			if len(tokens[i]) == 0 {
+				tokens[i] = [][]float32{fakeEmbedding(text)}
+			}
+		}
+		return tokens, nil
+	}
+
+	cfg := getConfig().LateInteraction
+	inputType := "document"
+	if query {
+		inputType = "query"
+	}
+	data, err := json.Marshal(map[string]any{"model": cfg.Model, "input": texts, "input_type": inputType})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(cfg.URL, "/")+"/embeddings", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey := os.ExpandEnv(cfg.APIKey); apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call token embedding service: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("token embedding service returned status %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		Data []struct {
+			Embedding [][]float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid token embedding service response: %v", err)
+	}
+	if len(result.Data) != len(texts) {
+		return nil, fmt.Errorf("token embedding service returned %d embeddings for %d texts", len(result.Data), len(texts))
+	}
+	tokens := make([][][]float32, len(texts))
+	for i, item := range result.Data {
+		if len(item.Embedding) == 0 {
+			return nil, fmt.Errorf("token embedding service returned no vectors for text %d", i)
+		}
+		tokens[i] = item.Embedding
+	}
+	return tokens, nil
+}
+
+// lateVectorsConfig is the vectors of a late-interaction collection: dense
+// vectors of size, indexed for the candidate search, and token vectors of
+// tokenSize compared by MaxSim, left out of the HNSW graph since they only
+// rescore candidates.
+func lateVectorsConfig(size, tokenSize int) map[string]any {
+	onDisk := getConfig().VectorStore.Qdrant.OnDisk
+	return map[string]any{
+		denseVector: map[string]any{"size": size, "distance": "Cosine", "on_disk": onDisk},
+		tokenVector: map[string]any{
+			"size":               tokenSize,
+			"distance":           "Cosine",
+			"on_disk":            onDisk,
+			"multivector_config": map[string]any{"comparator": "max_sim"},
+			"hnsw_config":        map[string]any{"m": 0},
+		},
+	}
+}
+
+// tokenDimensions probes the token embedding service for its vector size.
+func tokenDimensions(ctx context.Context) (int, error) {
+	tokens, err := embedTokens(ctx, []string{"dimension probe"}, false)
+	if err != nil {
+		return 0, fmt.Errorf("failed to embed probe: %v", err)
+	}
+	return len(tokens[0][0]), nil
+}
+
+// pointVectors returns the vectors to upsert for texts into collection:
+// their dense vectors, with the token vectors of the texts alongside them
+// in late-interaction collections.
+func pointVectors(ctx context.Context, collection string, texts []string, dense [][]float32) ([]any, error) {
+	vectors := make([]any, len(dense))
+	if !lateInteraction(collection) {
+		for i, vector := range dense {
+			vectors[i] = vector
+		}
+		return vectors, nil
+	}
+	tokens, err := embedTokens(ctx, texts, false)
+	if err != nil {
+		return nil, err
+	}
+	for i, vector := range dense {
+		vectors[i] = map[string]any{denseVector: vector, tokenVector: tokens[i]}
+	}
+	return vectors, nil
+}
+
+// lateInteractionSearch finds the candidates nearest to the dense vector of
+// a question and ranks them by how well their tokens match the question's.
+// Scores are the mean over the question's tokens of their best cosine
+// similarity, so that score thresholds mean what they do for dense search.
+func (s qdrantStore) lateInteractionSearch(ctx context.Context, query string, vector []float32, numDocuments int, filter any, scoreThreshold float32) ([]schema.Document, error) {
+	tokens, err := embedTokens(ctx, []string{query}, true)
+	if err != nil {
+		return nil, err
+	}
+	prefetch := map[string]any{"query": vector, "using": denseVector, "limit": max(getConfig().LateInteraction.Candidates, numDocuments)}
+	body := map[string]any{"prefetch": prefetch, "query": tokens[0], "using": tokenVector, "limit": numDocuments, "with_payload": true}
+	if filter != nil {
+		prefetch["filter"] = filter
+		body["filter"] = filter
+	}
+	if params := qdrantSearchParams(); params != nil {
+		prefetch["params"] = params
+	}
+	var resp struct {
+		Result struct {
+			Points []struct {
+				Score   float32        `json:"score"`
+				Payload map[string]any `json:"payload"`
+			} `json:"points"`
+		} `json:"result"`
+	}
+	path := fmt.Sprintf("/collections/%s/points/query", s.collection)
+	if err := qdrantRequestContext(ctx, "POST", path, body, &resp); err != nil {
+		return nil, err
+	}
+
+	docs := make([]schema.Document, 0, len(resp.Result.Points))
+	for _, match := range resp.Result.Points {
+		score := match.Score / float32(len(tokens[0]))
+		if score < scoreThreshold {
+			continue
+		}
+		content, ok := match.Payload[qdrantContentKey].(string)
+		if !ok {
+			return nil, fmt.Errorf("payload does not contain content key '%s'", qdrantContentKey)
+		}
+		delete(match.Payload, qdrantContentKey)
+		docs = append(docs, schema.Document{PageContent: content, Metadata: match.Payload, Score: score})
+	}
+	return docs, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// Renew and release the lead only while this replica's token holds it.
+var (
+	redisRenewLead   = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) end return 0`)
+	redisReleaseLead = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`)
+)
+
+// runAsLeader runs a background job on one replica at a time. Every replica
+// calls it; the one that takes the lead runs the job until it returns or the
+// lead is lost, when the job's context is cancelled and the replicas contend
+// again. Another replica takes over within state.lease_seconds of the leader
+// failing.
+func runAsLeader(name string, run func(ctx context.Context)) {
+	retry := time.Duration(getConfig().State.LeaseSeconds) * time.Second / 3
+	for {
+		ctx, release, ok, err := sharedState.TryLead(context.Background(), name)
+		if err != nil {
+			log.Printf("Error taking the lead of %s: %v", name, err)
+		}
+		if !ok {
+			time.Sleep(retry)
+			continue
+		}
+
+		log.Printf("Leading %s", name)
+		run(ctx)
+		lost := ctx.Err() != nil
+		release()
+		if !lost {
+			return
+		}
+		log.Printf("Lost the lead of %s", name)
+	}
+}
+
+// A single replica always leads.
+func (s *memoryState) TryLead(ctx context.Context, _ string) (context.Context, func(), bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	return ctx, cancel, true, nil
+}
+
+// TryLead sets a key with a token that expires after the lease unless the
+// leader keeps renewing it.
+func (s *redisState) TryLead(ctx context.Context, name string) (context.Context, func(), bool, error) {
+	key := s.prefix + "leader:" + name
+	token := uuid.New().String()
+	ok, err := s.client.SetNX(ctx, key, token, s.lease).Result()
+	if err != nil || !ok {
+		return nil, nil, false, err
+	}
+
+	leadCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(s.lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-leadCtx.Done():
+				return
+			case <-ticker.C:
+				renewed, err := redisRenewLead.Run(leadCtx, s.client, []string{key}, token, s.lease.Milliseconds()).Int()
+				if err != nil || renewed == 0 {
+					if err != nil && leadCtx.Err() == nil {
+						log.Printf("Error renewing the lead of %s: %v", name, err)
+					}
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	release := func() {
+		cancel()
+		if err := redisReleaseLead.Run(context.Background(), s.client, []string{key}, token).Err(); err != nil {
+			log.Printf("Error releasing the lead of %s: %v", name, err)
+		}
+	}
+	return leadCtx, release, true, nil
+}
+
+// TryLead takes a session advisory lock on a connection of its own, which
+// Postgres releases if the connection drops.
+func (s *postgresState) TryLead(ctx context.Context, name string) (context.Context, func(), bool, error) {
+	hash := fnv.New64a()
+	hash.Write([]byte(s.prefix + "leader:" + name))
+	lockID := int64(hash.Sum64())
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	var ok bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, lockID).Scan(&ok); err != nil || !ok {
+		conn.Close()
+		return nil, nil, false, err
+	}
+
+	leadCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(s.lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-leadCtx.Done():
+				return
+			case <-ticker.C:
+				if _, err := conn.ExecContext(leadCtx, `SELECT 1`); err != nil {
+					if leadCtx.Err() == nil {
+						log.Printf("Lost the connection holding the lead of %s: %v", name, err)
+					}
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	release := func() {
+		cancel()
+		if _, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, lockID); err != nil {
+			log.Printf("Error releasing the lead of %s: %v", name, err)
+		}
+		conn.Close()
+	}
+	return leadCtx, release, true, nil
+}
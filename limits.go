@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// maxFormValue is the size of a form field of an upload at most, the file
+// aside.
+const maxFormValue = 64 << 10
+
+type LimitsConfig struct {
+	ChatBytes    int64    `json:"chat_bytes"`    // Body of a chat request, images included; 0 means no limit
+	UploadBytes  int64    `json:"upload_bytes"`  // Body of a file upload, the form fields included; 0 means no limit
+	RequestBytes int64    `json:"request_bytes"` // Body of any other request; 0 means no limit
+	UploadTypes  []string `json:"upload_types"`  // MIME types accepted for uploads, as sniffed from their content, e.g. "application/pdf" or "text/*"; any when empty
+}
+
+func validateLimits(cfg LimitsConfig) error {
+	if cfg.ChatBytes < 0 || cfg.UploadBytes < 0 || cfg.RequestBytes < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	for _, t := range cfg.UploadTypes {
+		major, minor, ok := strings.Cut(t, "/")
+		if !ok || major == "" || major == "*" || minor == "" {
+			return fmt.Errorf(`limits.upload_types has an invalid MIME type %q; use e.g. "application/pdf" or "text/*"`, t)
+		}
+	}
+	return nil
+}
+
+// chatRoutes are the routes whose bodies are chat messages.
+var chatRoutes = map[string]bool{
+	"/chat":                          true,
+	"/chat/stream":                   true,
+	"/debug/retrieve":                true,
+	"/sessions/:id/messages/:msg_id": true,
+	"/sessions/:id/messages/:msg_id/regenerate": true,
+}
+
+// limitBodies caps the size of request bodies: requests declaring a larger
+// body are refused right away, and reading past the limit fails otherwise.
+func limitBodies(c *gin.Context) {
+	cfg := getConfig().Limits
+	limit := cfg.RequestBytes
+	switch {
+	case strings.HasPrefix(c.ContentType(), "multipart/"):
+		limit = cfg.UploadBytes
+	case chatRoutes[c.FullPath()]:
+		limit = cfg.ChatBytes
+	}
+	if limit == 0 || c.Request.Body == nil {
+		return
+	}
+	if c.Request.ContentLength > limit {
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Request body exceeds %d bytes", limit)})
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+}
+
+// bodyTooLarge responds with 413 and reports true when err is from reading
+// past the body limit.
+func bodyTooLarge(c *gin.Context, err error) bool {
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		return false
+	}
+	c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Request body exceeds %d bytes", tooLarge.Limit)})
+	return true
+}
+
+// upload is a file received in a multipart request.
+type upload struct {
+	Path     string     // Where it is stored, under uploadDirectory
+	Filename string     // As sent
+	Form     url.Values // The other form fields
+}
+
+// receiveUpload streams the "file" part of a multipart request to
+// uploadDirectory, so that large files are never held in memory, reads the
+// other form fields and scans the file for malware. It responds with an
+// error itself and reports false when the upload is refused, leaving
+// nothing stored.
+func receiveUpload(c *gin.Context) (upload, bool) {
+	up := upload{Form: url.Values{}}
+	fail := func(err error, status int, message string) (upload, bool) {
+		if up.Path != "" {
+			os.Remove(up.Path)
+		}
+		if !bodyTooLarge(c, err) {
+			c.JSON(status, gin.H{"error": message})
+		}
+		return upload{}, false
+	}
+
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		return fail(err, http.StatusBadRequest, "Invalid multipart request")
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(err, http.StatusBadRequest, "Invalid multipart request")
+		}
+		name := part.FormName()
+		if name != "file" {
+			value, err := io.ReadAll(io.LimitReader(part, maxFormValue+1))
+			if err != nil || len(value) > maxFormValue {
+				return fail(err, http.StatusBadRequest, fmt.Sprintf("Invalid form field %q", name))
+			}
+			up.Form.Add(name, string(value))
+			continue
+		}
+		if up.Path != "" {
+			return fail(nil, http.StatusBadRequest, "Send one file")
+		}
+		if part.FileName() == "" {
+			return fail(nil, http.StatusBadRequest, "Missing file")
+		}
+		up.Filename = part.FileName()
+		up.Path = filepath.Join(uploadDirectory, uuid.New().String()+"_"+filepath.Base(up.Filename))
+		if status, err := storeUpload(part, up.Path); err != nil {
+			return fail(err, status, err.Error())
+		}
+	}
+	if up.Path == "" {
+		return fail(nil, http.StatusBadRequest, "Missing file")
+	}
+	if status, err := scanUpload(c.Request.Context(), up); err != nil {
+		return fail(nil, status, err.Error())
+	}
+	return up, true
+}
+
+// storeUpload checks the type of an uploaded file and writes it to path. It
+// returns the status to respond with when it fails, unless the body was too
+// large.
+func storeUpload(part io.Reader, path string) (int, error) {
+	// Types are sniffed from the first 512 bytes at most
+	head := make([]byte, 512)
+	n, err := io.ReadFull(part, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return http.StatusBadRequest, fmt.Errorf("Failed to receive upload: %w", err)
+	}
+	head = head[:n]
+	if types := getConfig().Limits.UploadTypes; len(types) > 0 {
+		detected, _, _ := strings.Cut(http.DetectContentType(head), ";")
+		if !mimeAccepted(types, detected) {
+			return http.StatusUnsupportedMediaType, fmt.Errorf("Files of type %s are not accepted", detected)
+		}
+	}
+
+	if err := os.MkdirAll(uploadDirectory, 0o755); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("Failed to store upload")
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("Failed to store upload")
+	}
+	defer file.Close()
+	if _, err := file.Write(head); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("Failed to store upload")
+	}
+	if _, err := io.Copy(file, part); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("Failed to receive upload: %w", err)
+	}
+	return 0, nil
+}
+
+// mimeAccepted reports whether detected is one of types, which may end in
+// "/*" to accept a whole family.
+func mimeAccepted(types []string, detected string) bool {
+	for _, t := range types {
+		if t == detected || (strings.HasSuffix(t, "/*") && strings.HasPrefix(detected, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+	return false
+}
@@ -3,142 +3,769 @@ package main
 import (
 	"context"
 	"encoding/csv"
+	"flag"
 	"fmt"
 	"log"
-	"net/url"
 	"os"
 	"strings"
-	"sync"
+	"time"
 
-	"bytes"
-	"encoding/json"
 	"io"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
-	"github.com/tmc/langchaingo/embeddings"
-	"github.com/tmc/langchaingo/llms/ollama"
+	"github.com/tmc/langchaingo/llms"
 	"github.com/tmc/langchaingo/schema"
-	"github.com/tmc/langchaingo/vectorstores/qdrant"
+	"github.com/tmc/langchaingo/vectorstores"
 )
 
-const maxContextLength = 5 // Number of previous exchanges to keep in context
+const numRelevantDocs = 3 // Number of chunks passed to the prompt
+
+const (
+	qdrantAddress  = "http://localhost:6333"
+	collectionName = "rag"
+)
 
 type Message struct {
-	Msg string `json:"msg"`
+	Msg      string         `json:"msg"`
+	Messages []ChatMessage  `json:"messages,omitempty"` // The conversation ending with the question, in place of msg and the server's chat context
+	Filter   map[string]any `json:"filter,omitempty"`   // Payload key/value pairs the retrieved chunks must match
+	Mode     string         `json:"mode,omitempty"`     // "rag", "agent", "chitchat", "corpus" or "compare"; routed by intent when empty
+	Images   []string       `json:"images,omitempty"`   // Base64 or data URL image attachments for the vision model
+	Language string         `json:"language,omitempty"` // ISO 639-1 answer language; detected from msg when empty
+	Tenant   string         `json:"tenant,omitempty"`   // Milvus partition or collection to search
+	Version  int            `json:"version,omitempty"`  // Search this document version instead of the latest, for audits
+	Datasets []string       `json:"datasets,omitempty"` // Datasets to search; routed by the query when empty
+
+	Variables map[string]string `json:"variables,omitempty"` // Values of the template variables allowed by prompts.variables
+
+	FollowUps  *bool `json:"follow_ups,omitempty"` // Suggest follow-up questions; defaults to follow_ups.enabled
+	Highlights *bool `json:"highlights,omitempty"` // Map answer sentences to source text; defaults to highlights.enabled
+
+	MemoryTokens *int `json:"memory_tokens,omitempty"` // Token budget for previous turns; defaults to memory.max_tokens
+
+	MaxTokens int      `json:"max_tokens,omitempty"` // Capped at llm.max_tokens
+	Stop      []string `json:"stop,omitempty"`       // Stop sequences
+	Seed      *int     `json:"seed,omitempty"`       // Fixed seed for reproducible answers
+	Samples   int      `json:"samples,omitempty"`    // Answers sampled, the best grounded returned; defaults to self_consistency.samples
+
+	GenerationID string `json:"generation_id,omitempty"` // Lets the client cancel the answer before it returns; generated when empty
+
+	SessionID string `json:"session_id,omitempty"` // Conversation to continue; the default one when empty
+	ParentID  string `json:"parent_id,omitempty"`  // Answer of the session to branch from; the latest message when empty
+	UserID    string `json:"user_id,omitempty"`    // User whose pinned facts the answer keeps in mind
+
+	variant   *Variant        // Experiment variant the request was split to
+	query     string          // The text searched for Msg, once normalized
+	parent    string          // Session message the question follows; "" starts the conversation
+	answering string          // Session message of the question, once recorded
+	facts     []string        // Pinned facts of the user and session
+	repeat    *Repeat         // The earlier exchange of the session the question repeats
+	flags     map[string]bool // Stage flags set by an admin's request header
+	timings   *stageTimings   // How long the stages of the answer took, for the stats
+}
+
+type ChatResponse struct {
+	ID         string        `json:"id"` // Generation ID, for POST /feedback
+	Variant    string        `json:"variant,omitempty"`
+	Message    string        `json:"message"`
+	FollowUps  []string      `json:"follow_ups,omitempty"` // Suggested next questions, grounded in the retrieved chunks
+	Confidence *Confidence   `json:"confidence,omitempty"` // How well the answer is supported, for rag answers
+	Sources    []SourceChunk `json:"sources,omitempty"`    // Retrieved chunks, returned with highlights
+	Highlights []Highlight   `json:"highlights,omitempty"`
+	Cancelled  bool          `json:"cancelled,omitempty"`
+	Degraded   bool          `json:"degraded,omitempty"` // The message lists retrieved excerpts because generation failed
+	Error      string        `json:"error,omitempty"`    // Why no answer was generated
+
+	CorrectedQuery string         `json:"corrected_query,omitempty"` // The question as searched, when spell correction changed it
+	Clarification  *Clarification `json:"clarification,omitempty"`   // Set when the message asks which topic an ambiguous question is about
+	Repeat         *Repeat        `json:"repeat,omitempty"`          // Set when the question was asked before in the session
+	Consistency    *Consistency   `json:"consistency,omitempty"`     // Scores of the sampled answers, when several were
+	Corpus         *CorpusScan    `json:"corpus,omitempty"`          // What a corpus answer read
+	Comparison     *Comparison    `json:"comparison,omitempty"`      // The items a compare answer retrieved context for
+	Entities       []string       `json:"entities,omitempty"`        // Indexed entities the question named, when routed by them
+	Ranges         []Range        `json:"ranges,omitempty"`          // Ranges parsed from the question its chunks were filtered on
+
+	QuestionID string `json:"question_id,omitempty"` // The question in the session
+	MessageID  string `json:"message_id,omitempty"`  // The answer in the session, to branch from or regenerate
+
+	docs []schema.Document // The chunks in the prompt, for replays
 }
 
 type PromptTemplate struct {
-	SystemMessage      string
-	ContextFormat      string
-	RelevantInfoFormat string
-	UserQueryFormat    string
+	SystemMessage      string `json:"system_message"`
+	RelevantInfoFormat string `json:"relevant_info_format"`
+	UserQueryFormat    string `json:"user_query_format"`
+
+	Examples []string `json:"examples,omitempty"` // Example sets shown before the conversation when the question matches them
 }
 
 var defaultPromptTemplate = PromptTemplate{
 	SystemMessage:      "You are a helpful AI assistant. Provide concise and accurate responses based on the given context and relevant information.Only answer from the given data donot answer from anywhere else or your prior memory. If you are unable to find the answer in the data then simply answer 'I don't know.' How can I assist you further?",
-	ContextFormat:      "Previous conversation:\n%s\n",
 	RelevantInfoFormat: "Relevant information:\n%s\n",
 	// UserQueryFormat: "User Query: %s\nAssistant Response:",
 }
 
+// ChatContext is a chat session, kept in the shared state under key.
 type ChatContext struct {
-	Context []string
-	mu      sync.Mutex
+	id  string
+	key string
 }
 
-var chatContext = ChatContext{
-	Context: make([]string, 0, maxContextLength*2),
-}
+// chatContext is the session of chat requests sent without a session_id.
+var chatContext = ChatContext{id: defaultSession, key: "chat:context"}
 
 func chat(c *gin.Context) {
-	var msg Message
-	err := c.BindJSON(&msg)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+	msg, ok := bindChatMessage(c)
+	if !ok {
 		return
 	}
-	response := RAG(msg.Msg)
-	c.JSON(201, gin.H{"message": response})
+	response := RAG(c.Request.Context(), msg, nil)
+	c.JSON(chatStatus(response), response)
 }
 
-func main() {
-	r := gin.New()
-	r.POST("/chat", chat)
-	r.Run(":8080")
+// chatStatus is the status of a chat response: 503 when the model or the
+// vector store could not be reached.
+func chatStatus(response ChatResponse) int {
+	if response.Error != "" {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusCreated
 }
 
-func RAG(msg string) string {
-	ctx := context.Background()
-	collectionName := "rag"
-	address := "http://localhost:6333"
+// bindChatMessage reads and checks a chat request, responding with an error
+// if it is invalid.
+func bindChatMessage(c *gin.Context) (Message, bool) {
+	var msg Message
+	if err := c.ShouldBindJSON(&msg); err != nil {
+		if !bodyTooLarge(c, err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		}
+		return msg, false
+	}
+	if err := bindMessages(&msg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return msg, false
+	}
+	if err := bindSession(c.Request.Context(), &msg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return msg, false
+	}
+	return msg, checkChatMessage(c, &msg)
+}
 
-	ollamaLLM, err := ollama.New(ollama.WithModel("llama3"))
-	// ollamaLLM,err = ollama.makeOllamaOptionsFroTell the capitals of countries in europe ?mOptions(ollama.WithModel("llama3"))
+// checkChatMessage validates a bound chat request, picks its experiment
+// variant and runs the query hooks, responding with an error if any of it
+// fails.
+func checkChatMessage(c *gin.Context, msg *Message) bool {
+	var err error
+	if !bindFlags(c, msg) {
+		return false
+	}
+	parseEntityFilters(msg)
+	if strings.TrimSpace(msg.Msg) == "" && len(msg.Images) == 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "The message is empty"})
+		return false
+	}
+	if msg.Mode != "" && msg.Mode != ModeRAG && msg.Mode != ModeAgent && msg.Mode != ModeChitchat && msg.Mode != ModeCorpus && msg.Mode != ModeCompare {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown mode"})
+		return false
+	}
+	if msg.Mode == ModeCorpus && !supportsMaintenance(getConfig().VectorStore.Backend) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("The %s backend does not support corpus mode", getConfig().VectorStore.Backend)})
+		return false
+	}
+	if err := validateGeneration(msg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	if err := validateVariables(msg.Variables); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	if err := validateFilterSchema(msg.Filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	if len(msg.Images) > 0 {
+		if msg.Mode == ModeAgent || msg.Mode == ModeCorpus || msg.Mode == ModeCompare {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Images are not supported in %s mode", msg.Mode)})
+			return false
+		}
+		if _, err := decodeImages(msg.Images); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return false
+		}
+	}
+	if msg.MemoryTokens != nil && (*msg.MemoryTokens < 0 || *msg.MemoryTokens > getConfig().Memory.MaxRequestTokens) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("memory_tokens must be between 0 and %d", getConfig().Memory.MaxRequestTokens)})
+		return false
+	}
+	for _, name := range msg.Datasets {
+		if !datasetRegistry.exists(name) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown dataset %q", name)})
+			return false
+		}
+	}
+	if err := degradedDependency(); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error(), "status": "degraded"})
+		return false
+	}
+	if msg.GenerationID != "" && generationRegistry.running(msg.GenerationID) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A generation with this ID is running"})
+		return false
+	}
+	if msg.variant, err = experimentRegistry.pick(c.Request.Context(), c.GetHeader(getConfig().Experiments.Header)); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	if err := runQueryHooks(c.Request.Context(), msg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
 
+func main() {
+	flag.BoolVar(&fakeLLMMode, "fake-llm", false, "answer and embed with deterministic fakes instead of Ollama")
+	replayPath := flag.String("replay", "", "replay the queries of an audit log against the current config and exit")
+	replayLimit := flag.Int("replay-limit", 0, "replay only the last N audit entries")
+	replayMin := flag.Float64("replay-min-similarity", 0.8, "fail the replay when an answer is less similar than this to the logged one")
+	stateless := flag.Bool("stateless", false, "refuse to start unless state is shared, for running several replicas")
+	flag.Parse()
+
+	cfg, err := loadConfig(configPath())
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	ollamaEmbedder, err := embeddings.NewEmbedder(ollamaLLM)
-	if err != nil {
+	if err := loadSecrets(cfg.Secrets); err != nil {
 		log.Fatal(err)
 	}
+	if fakeLLMMode {
+		// Fake vectors have their own size, so keep them out of the real collection.
+		cfg.Embedding.Collection += "_fake"
+		log.Printf("Using fake LLM and embedder, collection %s", cfg.Embedding.Collection)
+	}
+	if *stateless {
+		if err := validateStateless(cfg); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *replayPath != "" {
+		// Replayed answers are not new traffic
+		cfg.Audit.Path = ""
+		cfg.Stats.Enabled = false
+		cfg.Gaps.Enabled = false
+		cfg.Analytics.Sink = ""
+	}
+	setConfig(cfg)
+	if err := configureQdrant(cfg.VectorStore.Qdrant); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureProviders(cfg.LLM); err != nil {
+		log.Fatal(err)
+	}
+	if sharedState, err = newStateStore(cfg.State); err != nil {
+		log.Fatal(err)
+	}
+	if metadataStore, err = openMetadataStore(cfg.Metadata); err != nil {
+		log.Fatal(err)
+	}
+	if err := setConfiguredHooks(cfg.Hooks); err != nil {
+		log.Fatal(err)
+	}
+	if err := setConfiguredDatasets(cfg.Datasets); err != nil {
+		log.Fatal(err)
+	}
+	setConfiguredExperiments(cfg.Experiments)
+	setConfiguredPrompts(cfg.Prompts)
+	setConfiguredGlossaries(cfg.Glossary)
+	startAnalytics(cfg.Analytics)
+	if *replayPath != "" {
+		if err := replayAudit(*replayPath, *replayLimit, *replayMin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if cfg.WarmUp.Enabled {
+		warmUp(context.Background(), cfg.WarmUp)
+	}
 
-	url, err := url.Parse(address)
-	if err != nil {
+	r := newRouter(cfg)
+	if cfg.Admin.StatsIntervalSeconds > 0 {
+		go recordRuntimeStats(time.Duration(cfg.Admin.StatsIntervalSeconds) * time.Second)
+	}
+	if cfg.Admin.WatchConfigSeconds > 0 {
+		go watchConfig(context.Background(), time.Duration(cfg.Admin.WatchConfigSeconds)*time.Second)
+	}
+
+	// Scheduled and change-following jobs run on one replica; stream
+	// consumers are balanced by their consumer group instead
+	if cfg.GC.IntervalMinutes > 0 {
+		go runAsLeader("gc", func(ctx context.Context) {
+			scheduleGC(ctx, time.Duration(cfg.GC.IntervalMinutes)*time.Minute)
+		})
+	}
+	if cfg.Feeds.IntervalMinutes > 0 && len(cfg.Feeds.Sources) > 0 {
+		go runAsLeader("feeds", func(ctx context.Context) {
+			scheduleFeeds(ctx, time.Duration(cfg.Feeds.IntervalMinutes)*time.Minute)
+		})
+	}
+	if cfg.Retention.IntervalMinutes > 0 {
+		interval := time.Duration(cfg.Retention.IntervalMinutes) * time.Minute
+		go runAsLeader("retention", func(ctx context.Context) {
+			scheduleRetention(ctx, interval, expireSessions)
+		})
+		// Audit logs are kept per replica
+		go scheduleRetention(context.Background(), interval, trimAudit)
+	}
+	if cfg.Stream.Enabled {
+		go consumeStream(cfg.Stream)
+	}
+	if cfg.Postgres.Enabled {
+		go runAsLeader("postgres:"+cfg.Postgres.Channel, func(ctx context.Context) {
+			followPostgres(ctx, cfg.Postgres)
+		})
+	}
+	if err := serve(":8080", r, cfg.TLS); err != nil {
 		log.Fatal(err)
 	}
+	closeStores()
+}
+
+// newRouter registers the API, and the admin endpoints cfg turns on.
+func newRouter(cfg Config) *gin.Engine {
+	r := gin.New()
+	r.Use(limitBodies)
+	r.POST("/chat", chat)
+	r.POST("/chat/stream", chatStream)
+	r.POST("/chat/:generation_id/cancel", cancelGeneration)
+	r.GET("/sessions/:id", getSession)
+	r.PUT("/sessions/:id/messages/:msg_id", editMessage)
+	r.POST("/sessions/:id/facts", pinFact(ScopeSession))
+	r.GET("/sessions/:id/facts", listFacts(ScopeSession))
+	r.DELETE("/sessions/:id/facts", forgetFacts(ScopeSession))
+	r.DELETE("/sessions/:id/facts/:fact_id", unpinFact(ScopeSession))
+	r.POST("/users/:id/facts", pinFact(ScopeUser))
+	r.GET("/users/:id/facts", listFacts(ScopeUser))
+	r.DELETE("/users/:id/facts", forgetFacts(ScopeUser))
+	r.DELETE("/users/:id/facts/:fact_id", unpinFact(ScopeUser))
+	r.DELETE("/users/:id/data", deleteUserData)
+	r.POST("/sessions/:id/messages/:msg_id/regenerate", regenerateMessage)
+	r.POST("/documents", ingestDocuments)
+	r.GET("/documents", listDocuments)
+	r.DELETE("/documents", deleteDocument)
+	r.POST("/documents/restore", restoreDocument)
+	r.POST("/documents/preview", previewDocuments)
+	r.GET("/documents/never-retrieved", neverRetrieved)
+	r.GET("/documents/:id/analytics", documentAnalytics)
+	r.POST("/documents/:id/summarize", summarizeDocument)
+	r.GET("/documents/:id/summary", getDocumentSummary)
+	r.POST("/connectors/git", ingestGitRepository)
+	r.POST("/connectors/crawl", crawlWebsite)
+	r.POST("/connectors/feeds", pollFeeds)
+	r.POST("/connectors/api", ingestAPI)
+	r.POST("/connectors/postgres/sync", syncPostgres)
+	r.GET("/sources", listSources)
+	r.GET("/entities", listEntities)
+	r.GET("/entities/:name", getEntity)
+	r.GET("/graph/:name", getGraph)
+	r.GET("/jobs", listJobs)
+	r.GET("/jobs/:id", getJob)
+	r.POST("/webhooks", registerWebhook)
+	r.GET("/webhooks", listWebhooks)
+	r.DELETE("/webhooks/:id", deleteWebhook)
+	r.GET("/embeddings", checkEmbeddings)
+	r.POST("/datasets", createDataset)
+	r.GET("/datasets", listDatasets)
+	r.POST("/collections/migrate", migrateCollection)
+	r.POST("/collections/convert", convertCollection)
+	r.GET("/collections/indexes", listPayloadIndexes)
+	r.POST("/collections/indexes", createIndex)
+	r.DELETE("/collections/indexes/:field", dropIndex)
+	r.POST("/gc", collectGarbage)
+	r.POST("/purge", purge)
+	r.POST("/debug/retrieve", debugRetrieve)
+	r.POST("/feedback", submitFeedback)
+	r.GET("/experiments", listExperiments)
+	r.GET("/gaps", listGaps)
+	r.PUT("/gaps/:id/tags", tagGap)
+	r.POST("/gaps/:id/resolve", resolveGap)
+	r.GET("/health", getHealth)
+	if cfg.Admin.StatsIntervalSeconds > 0 {
+		r.GET("/metrics/runtime", getRuntimeStats)
+	}
+	if cfg.Admin.Pprof {
+		r.Any("/debug/pprof/*name", requireAdmin(cfg.Admin.Token), servePprof)
+	}
+	if cfg.Admin.Reload {
+		r.POST("/admin/reload", requireAdmin(cfg.Admin.Token), reloadConfigHandler)
+	}
+	if cfg.Admin.Dashboard {
+		r.GET("/admin/stats", requireAdmin(cfg.Admin.Token), adminStats)
+	}
+	return r
+}
 
-	store, err := qdrant.New(
-		qdrant.WithURL(*url),
-		qdrant.WithCollectionName(collectionName),
-		qdrant.WithEmbedder(ollamaEmbedder),
-	)
+// chatBackends opens the model, embedder and vector store answering msg.
+func chatBackends(msg Message) (Generator, Embedder, vectorstores.VectorStore, error) {
+	llm, err := msg.variant.llm()
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, nil, fmt.Errorf("failed to open the model: %v", err)
+	}
+	embedder, err := newEmbedder()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to open the embedding model: %v", err)
+	}
+	store, err := newStore(embedder, msg.Tenant)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to open the vector store: %v", err)
+	}
+	return llm, embedder, store, nil
+}
+
+// RAG answers a chat message. It stops generating when ctx is done or the
+// generation is cancelled.
+func RAG(ctx context.Context, msg Message, stream *answerStream) ChatResponse {
+	start := time.Now()
+	id := msg.GenerationID
+	if id == "" {
+		id = uuid.New().String()
 	}
+	ctx, done := generationRegistry.start(ctx, id)
+	defer done()
+	stream.event("generation", gin.H{"id": id})
 
-	err = createCollectionIfNotExists(address, collectionName)
+	release, err := generationQueue.acquire(ctx, stream)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Gave up waiting for generation %s: %v", id, err)
+		stream.failed(err)
+		return ChatResponse{ID: id, Cancelled: true}
 	}
+	defer release()
 
-	docs, err := readDocumentsFromCSV("healthcare_dataset.csv")
+	ollamaLLM, embedder, store, err := chatBackends(msg)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Error preparing generation %s: %v", id, err)
+		stream.failed(err)
+		return ChatResponse{ID: id, Error: err.Error()}
+	}
+
+	// Regenerated answers follow the question already in the session
+	session := sessionContext(msg.SessionID)
+	regenerating := msg.answering != ""
+	followSession(ctx, &msg)
+	msg.facts = requestFacts(ctx, msg)
+	history := conversation(msg)
+	logged := msg
+	msg.timings = newStageTimings()
+	routing := time.Now()
+	if len(msg.Messages) == 0 && !regenerating {
+		msg.answering = session.add(ctx, RoleUser, msg.Msg, msg.parent)
+		session.claim(ctx, msg.UserID)
+	}
+
+	// A question asked before in the session gets its earlier answer back,
+	// or is answered knowing it
+	msg.repeat = findRepeat(ctx, embedder, msg, regenerating)
+	mode := ModeRepeat
+	var comparison *Comparison
+	var entities []string
+	var corrected string
+	var askable bool
+	if msg.repeat == nil || !msg.repeat.Cached {
+		msg.query, corrected = normalizeQuery(ctx, msg)
+
+		// A message answering a clarifying question narrows down the question
+		// asked before it, which is searched again with it
+		askable = flagOn(msg, FlagClarify, getConfig().Clarify.Enabled) && len(msg.Messages) == 0
+		if askable && !regenerating {
+			if pending := session.takeClarification(ctx); pending != nil {
+				msg.query = pending.Question + " " + msg.query
+				askable = false
+			}
+		}
+
+		mode = routeQuery(ctx, ollamaLLM, msg)
+		if retrieves(mode) && needsClarification(msg, history) {
+			log.Printf("Query %q is too short to search, asking the user to clarify", msg.Msg)
+			mode = ModeClarify
+		}
+		mode, entities = routeEntities(ctx, &msg, mode)
+		if mode != ModeChitchat && mode != ModeClarify {
+			if datasets := routeDatasets(ctx, ollamaLLM, embedder, msg); len(datasets) > 0 {
+				log.Printf("Searching datasets %s", strings.Join(datasets, ", "))
+				msg.Filter = withDatasets(msg.Filter, datasets)
+			}
+		}
+		if mode == ModeCompare {
+			if comparison = planComparison(ctx, ollamaLLM, msg, entities); comparison == nil {
+				mode = ModeRAG
+			}
+		}
+	}
+	msg.timings.since(TimingRouting, routing)
+
+	var response string
+	var relevantDocs []schema.Document
+	var clarification *Clarification
+	var consistency *Consistency
+	var scan *CorpusScan
+	answering := time.Now()
+	switch mode {
+	case ModeRepeat:
+		response = msg.repeat.answer
+	case ModeAgent:
+		stream.status(StageAgent)
+		response, err = runAgent(ctx, ollamaLLM, store, msg)
+		msg.timings.since(TimingGeneration, answering)
+	case ModeChitchat:
+		stream.status(StageAnswering)
+		response, err = answerChitchat(ctx, ollamaLLM, msg, stream)
+		msg.timings.since(TimingGeneration, answering)
+	case ModeClarify:
+		stream.status(StageAnswering)
+		response, err = answerClarify(ctx, ollamaLLM, msg, stream)
+		msg.timings.since(TimingGeneration, answering)
+	case ModeCorpus:
+		stream.status(StageSearching)
+		response, relevantDocs, scan, err = answerCorpus(ctx, ollamaLLM, msg, stream)
+	case ModeCompare:
+		stream.status(StageSearching)
+		response, relevantDocs, err = answerComparison(ctx, ollamaLLM, store, msg, comparison, stream)
+		msg.timings.since(TimingGeneration, answering)
+	default:
+		stream.status(StageSearching)
+		response, relevantDocs, clarification, consistency, err = answerWithRetrieval(ctx, ollamaLLM, store, msg, askable, stream)
+		if clarification != nil {
+			mode = ModeClarify
+		}
+	}
+	degraded := false
+	if err != nil && len(relevantDocs) > 0 && ctx.Err() == nil && getConfig().Degraded.RetrievalOnly {
+		log.Printf("Error generating response, answering with excerpts: %v", err)
+		response, degraded, err = retrievalOnlyAnswer(relevantDocs), true, nil
+	}
+	if err == nil {
+		response, err = runResponseHooks(ctx, msg, response)
+	}
+	switch {
+	case err != nil:
+		log.Printf("Error generating response: %v", err)
+		stream.failed(err)
+	case degraded:
+		stream.excerpts(response)
+	default:
+		stream.finish(response)
+	}
+	recordAudit(logged, history, mode, response, relevantDocs, err)
+
+	result := ChatResponse{ID: id, Message: response, Cancelled: ctx.Err() != nil, Degraded: degraded, docs: relevantDocs}
+	if msg.variant != nil {
+		result.Variant = msg.variant.Name
+	}
+	failed := err != nil || degraded
+	if degraded {
+		result.Sources = sourceChunks(relevantDocs)
+	}
+	if retrieves(mode) {
+		result.CorrectedQuery = corrected
+		result.Entities = entities
+	}
+	if retrieves(mode) || mode == ModeCorpus {
+		result.Ranges = queryRanges(msg)
+	}
+	result.Clarification = clarification
+	result.Repeat = msg.repeat
+	result.Consistency = consistency
+	result.Corpus = scan
+	result.Comparison = comparison
+	scoring := time.Now()
+	if cfg := getConfig().Confidence; !failed && retrieves(mode) && flagOn(msg, FlagConfidence, cfg.Enabled) {
+		confidence := estimateConfidence(ctx, ollamaLLM, response, relevantDocs, flagOn(msg, FlagFaithfulness, cfg.FaithfulnessCheck))
+		result.Confidence = &confidence
+	}
+	if !failed && retrieves(mode) && len(relevantDocs) > 0 {
+		if wantHighlights(msg) {
+			result.Sources = sourceChunks(relevantDocs)
+			if result.Highlights, err = highlightAnswer(ctx, ollamaLLM, embedder, response, relevantDocs); err != nil {
+				log.Printf("Error highlighting answer: %v", err)
+			}
+		}
+		if wantFollowUps(msg) {
+			if result.FollowUps, err = suggestFollowUps(ctx, ollamaLLM, msg.Msg, response, relevantDocs); err != nil {
+				log.Printf("Error suggesting follow-up questions: %v", err)
+			}
+		}
+	}
+	if !failed && retrieves(mode) {
+		msg.timings.since(TimingScoring, scoring)
 	}
 
-	_, err = store.AddDocuments(ctx, docs)
+	if len(msg.Messages) == 0 {
+		result.QuestionID = msg.answering
+		sources := documentSources(relevantDocs)
+		if mode == ModeRepeat {
+			sources = msg.repeat.sources
+		}
+		result.MessageID = session.answer(ctx, response, msg.answering, sources)
+	}
+	if !failed && !result.Cancelled && getConfig().Memory.ExtractFacts {
+		go extractFacts(context.WithoutCancel(ctx), ollamaLLM, msg, response)
+	}
+	experimentRegistry.record(msg.variant, result, failed, time.Since(start))
+	recordStats(msg, mode, result, failed, time.Since(start))
+	recordGap(msg, mode, result, failed)
+	recordUsage(result)
+	exportInteraction(msg, mode, result, failed, time.Since(start))
+
+	return result
+}
+
+// answerWithRetrieval answers from the retrieved chunks or, if askable and
+// they are about different topics, asks the user which one they mean.
+func answerWithRetrieval(ctx context.Context, ollamaLLM Generator, store vectorstores.VectorStore, msg Message, askable bool, stream *answerStream) (string, []schema.Document, *Clarification, *Consistency, error) {
+	searching := time.Now()
+	retrieved, err := retrieveContext(ctx, ollamaLLM, store, msg, nil)
+	msg.timings.since(TimingRetrieval, searching)
 	if err != nil {
-		log.Fatal(err)
+		return "", nil, nil, nil, err
+	}
+	stream.sources(retrieved.docs)
+	stream.status(StageAnswering)
+	answering := time.Now()
+	defer msg.timings.since(TimingGeneration, answering)
+
+	if askable && len(retrieved.images) == 0 {
+		if topics := ambiguousTopics(retrieved.docs); topics != nil {
+			response, clarification, err := askWhichTopic(ctx, ollamaLLM, msg, topics, stream)
+			return response, topics, clarification, nil, err
+		}
 	}
 
-	chatContext.mu.Lock()
-	chatContext.Context = append(chatContext.Context, "User: "+msg)
-	chatContext.mu.Unlock()
+	var model llms.Model = ollamaLLM
+	prompt := retrieved.prompt
+	if len(retrieved.images) > 0 {
+		model, prompt = retrieved.visionModel, withImages(retrieved.prompt, retrieved.images)
+	}
+	// Sampled answers are sent once the best is picked, not streamed
+	if n := sampleCount(msg); n > 1 {
+		response, consistency, err := sampleAnswers(ctx, model, ollamaLLM, prompt, msg, retrieved.docs, n)
+		return response, retrieved.docs, nil, consistency, err
+	}
+	response, err := generate(ctx, model, prompt, stream.options(generationOptions(msg))...)
+	return response, retrieved.docs, nil, nil, err
+}
 
-	relevantDocs, err := store.SimilaritySearch(ctx, msg, 3)
+// searchChunks finds the k chunks best matching searchQuery and the
+// message's filter, rescored, resolved, stitched and translated as the
+// message asks.
+func searchChunks(ctx context.Context, ollamaLLM Generator, store vectorstores.VectorStore, msg Message, searchQuery string, k int, trace *RetrievalTrace) ([]schema.Document, error) {
+	var searchOptions []vectorstores.Option
+	filter := retrievalFilter(msg.Filter, msg.Version)
+	filter.Ranges = queryRanges(msg)
+	countFilterFields(ctx, filter)
+	if storeFilter := storeFilter(filter); storeFilter != nil {
+		searchOptions = append(searchOptions, vectorstores.WithFilters(storeFilter))
+	}
+
+	// Fetch extra candidates since several synthetic questions can point at
+	// the same chunk
+	start := time.Now()
+	relevantDocs, err := store.SimilaritySearch(ctx, searchQuery, k*2, searchOptions...)
 	if err != nil {
 		log.Printf("Error performing similarity search: %v", err)
 	}
+	relevantDocs = trace.searched(searchQuery, filter, k*2, time.Since(start), relevantDocs)
 
-	prompt := constructPrompt(chatContext.Context, relevantDocs, msg, defaultPromptTemplate)
+	if flagOn(msg, FlagRescore, msg.variant.rescore()) {
+		relevantDocs = trace.rescored(rescoreDocuments(relevantDocs))
+	}
+	relevantDocs = trace.resolved(resolveQuestionHits(relevantDocs, k))
+	if flagOn(msg, FlagStitch, getConfig().Chunking.StitchNeighbors) {
+		relevantDocs = trace.stitched(stitchNeighbors(relevantDocs))
+	}
+	if flagOn(msg, FlagGraph, getConfig().Graph.Enabled) {
+		var expansion *GraphExpansion
+		relevantDocs, expansion = expandGraph(ctx, msg, searchQuery, relevantDocs)
+		if trace != nil {
+			trace.Graph = expansion
+		}
+	}
+	relevantDocs, err = runRetrieveHooks(ctx, searchQuery, relevantDocs)
+	if err != nil {
+		return nil, err
+	}
+	relevantDocs = trace.selected(relevantDocs)
+
+	if flagOn(msg, FlagTranslate, getConfig().Multilingual.TranslateChunks) {
+		relevantDocs = translateDocuments(ctx, ollamaLLM, relevantDocs, queryLanguage(msg))
+	}
+	return relevantDocs, nil
+}
+
+// retrieved is the outcome of the retrieval stage of a rag answer.
+type retrieved struct {
+	docs        []schema.Document
+	prompt      []llms.MessageContent
+	images      []llms.BinaryContent
+	visionModel llms.Model
+}
+
+// retrieveContext searches the store for the message, rescores, resolves and
+// stitches the hits and builds the prompt. With a trace it records what each
+// stage did, for POST /debug/retrieve.
+func retrieveContext(ctx context.Context, ollamaLLM Generator, store vectorstores.VectorStore, msg Message, trace *RetrievalTrace) (retrieved, error) {
+	var result retrieved
+	searchQuery := msg.query
+	if searchQuery == "" {
+		searchQuery = msg.Msg
+	}
+	if flagOn(msg, FlagGlossary, true) {
+		searchQuery = glossaryRegistry.expand(msg, searchQuery)
+	}
+
+	if len(msg.Images) > 0 {
+		var err error
+		if result.images, err = decodeImages(msg.Images); err != nil {
+			return result, err
+		}
+		if result.visionModel, err = newVisionModel(); err != nil {
+			return result, err
+		}
+		description, err := describeImages(ctx, result.visionModel, result.images)
+		if err != nil {
+			return result, fmt.Errorf("failed to describe images: %v", err)
+		}
+		searchQuery = strings.TrimSpace(searchQuery + "\n" + description)
+	}
 
-	response, err := ollamaLLM.Call(ctx, prompt)
+	relevantDocs, err := searchChunks(ctx, ollamaLLM, store, msg, searchQuery, msg.variant.k(), trace)
 	if err != nil {
-		log.Printf("Error generating response: %v", err)
+		return result, err
 	}
 
-	chatContext.mu.Lock()
-	chatContext.Context = append(chatContext.Context, "Assistant: "+response)
-	if len(chatContext.Context) > maxContextLength*2 {
-		chatContext.Context = chatContext.Context[2:] // Remove oldest exchange
+	lang := queryLanguage(msg)
+	prompt := constructPrompt(conversation(msg), relevantDocs, msg.Msg, msg.variant.promptTemplate(lang).render(msg))
+	prompt, err = runPromptHooks(ctx, prompt)
+	if err != nil {
+		return result, err
+	}
+	if trace != nil {
+		trace.Context = sourceChunks(relevantDocs)
+		trace.Prompt = promptMessages(prompt)
 	}
-	chatContext.mu.Unlock()
+	result.docs = relevantDocs
+	result.prompt = prompt
+	return result, nil
+}
 
-	return response
+func newLLM() (Generator, error) {
+	if fakeLLMMode {
+		return FakeGenerator{}, nil
+	}
+	return withOllamaBreaker(newOllama(getConfig().LLM.Model))
 }
 
 func readDocumentsFromCSV(filename string) ([]schema.Document, error) {
@@ -161,7 +788,7 @@ func readDocumentsFromCSV(filename string) ([]schema.Document, error) {
 		}
 		doc := schema.Document{
 			PageContent: record[0],
-			Metadata:    map[string]any{"id": uuid.New().String()},
+			Metadata:    map[string]any{"id": uuid.New().String(), "source": filename},
 		}
 		// If there are additional columns, add them as metadata
 		for i := 1; i < len(record); i++ {
@@ -173,10 +800,9 @@ func readDocumentsFromCSV(filename string) ([]schema.Document, error) {
 	return docs, nil
 }
 
-func createCollectionIfNotExists(address string, collectionName string) error {
+func createCollectionIfNotExists(ctx context.Context, collectionName string, size int) error {
 	// Check if collection exists
-	checkURL := fmt.Sprintf("%s/collections/%s", address, collectionName)
-	resp, err := http.Get(checkURL)
+	resp, err := qdrantDo(ctx, "GET", "/collections/"+collectionName, nil)
 	if err != nil {
 		return fmt.Errorf("failed to check collection: %v", err)
 	}
@@ -188,27 +814,16 @@ func createCollectionIfNotExists(address string, collectionName string) error {
 	}
 
 	// Collection doesn't exist, create it
-	createURL := fmt.Sprintf("%s/collections/%s", address, collectionName)
-	createReq := map[string]interface{}{
-		"vectors": map[string]interface{}{
-			"size":     4096,
-			"distance": "Cosine",
-		},
-	}
-
-	jsonData, err := json.Marshal(createReq)
-	if err != nil {
-		return fmt.Errorf("failed to marshal create request: %v", err)
-	}
-
-	req, err := http.NewRequest("PUT", createURL, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %v", err)
+	createReq := qdrantCollectionConfig(size)
+	if lateInteraction(collectionName) {
+		tokenSize, err := tokenDimensions(ctx)
+		if err != nil {
+			return err
+		}
+		createReq["vectors"] = lateVectorsConfig(size, tokenSize)
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err = client.Do(req)
+	resp, err = qdrantDo(ctx, "PUT", "/collections/"+collectionName, createReq)
 	if err != nil {
 		return fmt.Errorf("failed to send create request: %v", err)
 	}
@@ -223,15 +838,20 @@ func createCollectionIfNotExists(address string, collectionName string) error {
 	return nil
 }
 
-func constructPrompt(context []string, relevantDocs []schema.Document, userQuery string, template PromptTemplate) string {
-	var sb strings.Builder
-
-	sb.WriteString(template.SystemMessage)
-	sb.WriteString("\n\n")
-
-	if len(context) > 0 {
-		sb.WriteString(fmt.Sprintf(template.ContextFormat, strings.Join(context, "\n")))
-		sb.WriteString("\n")
+// constructPrompt builds the messages of a prompt: the system message, the
+// template's few-shot examples that apply to the question, the previous
+// turns as user and assistant messages, the retrieved chunks in a system
+// message of their own and the question.
+func constructPrompt(history []string, relevantDocs []schema.Document, userQuery string, template PromptTemplate) []llms.MessageContent {
+	messages := []llms.MessageContent{llms.TextParts(llms.ChatMessageTypeSystem, template.SystemMessage)}
+	messages = append(messages, exampleMessages(promptRegistry.examples(template.Examples, userQuery))...)
+
+	for _, turn := range history {
+		if text, ok := strings.CutPrefix(turn, "Assistant: "); ok {
+			messages = append(messages, llms.TextParts(llms.ChatMessageTypeAI, text))
+		} else {
+			messages = append(messages, llms.TextParts(llms.ChatMessageTypeHuman, strings.TrimPrefix(turn, "User: ")))
+		}
 	}
 
 	if len(relevantDocs) > 0 {
@@ -240,11 +860,33 @@ func constructPrompt(context []string, relevantDocs []schema.Document, userQuery
 			relevantInfo.WriteString(doc.PageContent)
 			relevantInfo.WriteString("\n")
 		}
-		sb.WriteString(fmt.Sprintf(template.RelevantInfoFormat, relevantInfo.String()))
-		sb.WriteString("\n")
+		messages = append(messages, llms.TextParts(llms.ChatMessageTypeSystem, fmt.Sprintf(template.RelevantInfoFormat, relevantInfo.String())))
 	}
 
-	sb.WriteString(fmt.Sprintf(template.UserQueryFormat, userQuery))
+	if template.UserQueryFormat != "" {
+		userQuery = fmt.Sprintf(template.UserQueryFormat, userQuery)
+	}
+	messages = append(messages, llms.TextParts(llms.ChatMessageTypeHuman, userQuery))
+	return messages
+}
 
-	return sb.String()
+// promptMessages renders the messages of a prompt for traces.
+func promptMessages(messages []llms.MessageContent) []ChatMessage {
+	rendered := make([]ChatMessage, len(messages))
+	for i, message := range messages {
+		switch message.Role {
+		case llms.ChatMessageTypeSystem:
+			rendered[i].Role = RoleSystem
+		case llms.ChatMessageTypeAI:
+			rendered[i].Role = RoleAssistant
+		default:
+			rendered[i].Role = RoleUser
+		}
+		for _, part := range message.Parts {
+			if text, ok := part.(llms.TextContent); ok {
+				rendered[i].Content += text.Text
+			}
+		}
+	}
+	return rendered
 }
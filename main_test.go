@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const refundPolicy = "Refunds are issued within 30 days of purchase.\n"
+
+// newTestRouter serves the API with the fake LLM and embedder, a SQLite
+// vector store and metadata database in a temporary directory, and the files
+// written to its ingest root.
+func newTestRouter(t *testing.T, files map[string]string) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	fakeLLMMode = true
+	t.Cleanup(func() { fakeLLMMode = false })
+
+	dir := t.TempDir()
+	root := filepath.Join(dir, "data")
+	if err := os.Mkdir(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := defaultConfig()
+	cfg.Ingest.Root = root
+	cfg.VectorStore.Backend = StoreSQLite
+	cfg.VectorStore.SQLitePath = filepath.Join(dir, "vectors.db")
+	cfg.Metadata.Path = filepath.Join(dir, "metadata.db")
+	cfg.SQL.Path = filepath.Join(dir, "tabular.db")
+	cfg.Audit.Path = ""
+	setConfig(cfg)
+
+	var err error
+	if sharedState, err = newStateStore(cfg.State); err != nil {
+		t.Fatal(err)
+	}
+	if metadataStore, err = openMetadataStore(cfg.Metadata); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { metadataStore.db.Close() })
+	if err := newSQLiteVecStore(FakeEmbedder{}).ensureTables(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return newRouter(cfg)
+}
+
+func serveJSON(t *testing.T, r http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// ingest posts a file to POST /documents and waits for its job to end.
+func ingest(t *testing.T, r http.Handler, path string) Job {
+	t.Helper()
+	w := serveJSON(t, r, "POST", "/documents", `{"path": "`+path+`"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("POST /documents: status %d, body %s", w.Code, w.Body)
+	}
+	var job Job
+	if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for job.Status != JobCompleted && job.Status != JobFailed {
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s still %s", job.ID, job.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+		w = serveJSON(t, r, "GET", "/jobs/"+job.ID, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /jobs/%s: status %d, body %s", job.ID, w.Code, w.Body)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return job
+}
+
+func TestIngestAndChat(t *testing.T) {
+	r := newTestRouter(t, map[string]string{"refunds.txt": refundPolicy})
+
+	job := ingest(t, r, "refunds.txt")
+	if job.Status != JobCompleted || len(job.Errors) > 0 {
+		t.Fatalf("job %s: status %s, errors %v", job.ID, job.Status, job.Errors)
+	}
+	if job.Processed == 0 {
+		t.Errorf("job %s processed no chunks", job.ID)
+	}
+
+	w := serveJSON(t, r, "POST", "/chat", `{"msg": "How long do refunds take?", "mode": "rag", "highlights": true}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST /chat: status %d, body %s", w.Code, w.Body)
+	}
+	var response ChatResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.ID == "" || response.Error != "" {
+		t.Errorf("response ID %q, error %q", response.ID, response.Error)
+	}
+	if !strings.Contains(response.Message, "Refunds are issued") {
+		t.Errorf("message %q does not answer from the document", response.Message)
+	}
+	if len(response.Sources) == 0 || !strings.Contains(response.Sources[0].Content, "Refunds are issued") {
+		t.Errorf("sources %+v do not include the document", response.Sources)
+	}
+}
+
+func TestIngestAndChatStream(t *testing.T) {
+	r := newTestRouter(t, map[string]string{"refunds.txt": refundPolicy})
+	if job := ingest(t, r, "refunds.txt"); job.Status != JobCompleted {
+		t.Fatalf("job %s: status %s, errors %v", job.ID, job.Status, job.Errors)
+	}
+
+	w := serveJSON(t, r, "POST", "/chat/stream", `{"msg": "How long do refunds take?", "mode": "rag"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /chat/stream: status %d, body %s", w.Code, w.Body)
+	}
+
+	events := map[string][]string{}
+	var name string
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if value, ok := strings.CutPrefix(line, "event:"); ok {
+			name = value
+		} else if value, ok := strings.CutPrefix(line, "data:"); ok {
+			events[name] = append(events[name], value)
+		}
+	}
+	if len(events["error"]) > 0 {
+		t.Fatalf("stream failed: %v", events["error"])
+	}
+
+	if len(events["sources"]) != 1 {
+		t.Fatalf("got %d sources events, want 1", len(events["sources"]))
+	}
+	var sources struct {
+		Sources []SourceChunk `json:"sources"`
+	}
+	if err := json.Unmarshal([]byte(events["sources"][0]), &sources); err != nil {
+		t.Fatal(err)
+	}
+	if len(sources.Sources) == 0 || !strings.Contains(sources.Sources[0].Content, "Refunds are issued") {
+		t.Errorf("sources %+v do not include the document", sources.Sources)
+	}
+
+	if len(events["done"]) != 1 {
+		t.Fatalf("got %d done events, want 1", len(events["done"]))
+	}
+	var response ChatResponse
+	if err := json.Unmarshal([]byte(events["done"][0]), &response); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(response.Message, "Refunds are issued") {
+		t.Errorf("message %q does not answer from the document", response.Message)
+	}
+}
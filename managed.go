@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/tmc/langchaingo/schema"
+)
+
+// ManagedStore is implemented by vector stores that support the maintenance
+// operations behind document deletion and garbage collection.
+type ManagedStore interface {
+	// Sources lists the documents in the index by their "source" metadata.
+	Sources(ctx context.Context) ([]SourceInfo, error)
+	// DeleteWhere removes the chunks matching filter and returns how many
+	// were removed.
+	DeleteWhere(ctx context.Context, filter map[string]any) (int, error)
+	// UpdateWhere sets metadata fields on the chunks matching filter and
+	// returns how many were updated.
+	UpdateWhere(ctx context.Context, filter map[string]any, fields map[string]any) (int, error)
+	// Values lists the distinct values of a metadata field among the chunks
+	// matching filter.
+	Values(ctx context.Context, filter map[string]any, field string) ([]any, error)
+	// Chunks returns up to limit chunks matching filter, in no particular
+	// order.
+	Chunks(ctx context.Context, filter Filter, limit int) ([]schema.Document, error)
+}
+
+type SourceInfo struct {
+	ID            string     `json:"id,omitempty"` // For GET /documents/:id/analytics
+	Source        string     `json:"source"`
+	Chunks        int        `json:"chunks"`
+	Deleted       bool       `json:"deleted"`
+	DeletedAt     string     `json:"deleted_at,omitempty"`
+	LastRetrieved *time.Time `json:"last_retrieved,omitempty"`
+}
+
+func supportsMaintenance(backend string) bool {
+	return backend == StoreQdrant || backend == StoreElastic || backend == StoreSQLite
+}
+
+func newManagedStore(embedder Embedder) (ManagedStore, error) {
+	cfg := getConfig()
+	switch cfg.VectorStore.Backend {
+	case StoreQdrant:
+		return qdrantManager{collection: cfg.Embedding.Collection}, nil
+	case StoreElastic:
+		return newElasticStore(embedder), nil
+	case StoreSQLite:
+		return newSQLiteVecStore(embedder), nil
+	}
+	return nil, fmt.Errorf("the %s backend does not support maintenance operations", cfg.VectorStore.Backend)
+}
+
+// sourceAccumulator merges per-chunk source and deletion metadata into one
+// SourceInfo per source.
+type sourceAccumulator map[string]*SourceInfo
+
+func (a sourceAccumulator) add(source string, chunks int, deleted bool, deletedAt string) {
+	info, ok := a[source]
+	if !ok {
+		info = &SourceInfo{Source: source}
+		a[source] = info
+	}
+	info.Chunks += chunks
+	if deleted {
+		info.Deleted = true
+		info.DeletedAt = max(info.DeletedAt, deletedAt)
+	}
+}
+
+func (a sourceAccumulator) list() []SourceInfo {
+	sources := make([]SourceInfo, 0, len(a))
+	for _, info := range a {
+		sources = append(sources, *info)
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].Source < sources[j].Source })
+	return sources
+}
+
+type qdrantManager struct {
+	collection string
+}
+
+func (m qdrantManager) Sources(ctx context.Context) ([]SourceInfo, error) {
+	sources := sourceAccumulator{}
+	var offset any
+	for {
+		points, next, err := scrollPoints(m.collection, offset, migrateScrollSize, []string{"source", "deleted", "deleted_at"}, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, point := range points {
+			source, ok := point.Payload["source"].(string)
+			if !ok {
+				continue
+			}
+			deleted, _ := point.Payload["deleted"].(bool)
+			deletedAt, _ := point.Payload["deleted_at"].(string)
+			sources.add(source, 1, deleted, deletedAt)
+		}
+		if next == nil || len(points) == 0 {
+			break
+		}
+		offset = next
+	}
+	return sources.list(), nil
+}
+
+func (m qdrantManager) DeleteWhere(ctx context.Context, filter map[string]any) (int, error) {
+	qf := qdrantFilter(Filter{Match: filter})
+	count, err := countPoints(m.collection, qf)
+	if err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	err = qdrantRequest("POST", fmt.Sprintf("/collections/%s/points/delete?wait=true", m.collection), map[string]any{"filter": qf}, nil)
+	return count, err
+}
+
+func (m qdrantManager) UpdateWhere(ctx context.Context, filter map[string]any, fields map[string]any) (int, error) {
+	qf := qdrantFilter(Filter{Match: filter})
+	count, err := countPoints(m.collection, qf)
+	if err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	err = qdrantRequest("POST", fmt.Sprintf("/collections/%s/points/payload?wait=true", m.collection), map[string]any{"payload": fields, "filter": qf}, nil)
+	return count, err
+}
+
+func (m qdrantManager) Values(ctx context.Context, filter map[string]any, field string) ([]any, error) {
+	seen := map[string]bool{}
+	var values []any
+	var offset any
+	for {
+		points, next, err := scrollPoints(m.collection, offset, migrateScrollSize, []string{field}, qdrantFilter(Filter{Match: filter}))
+		if err != nil {
+			return nil, err
+		}
+		for _, point := range points {
+			value, ok := point.Payload[field]
+			if ok && !seen[fmt.Sprint(value)] {
+				seen[fmt.Sprint(value)] = true
+				values = append(values, value)
+			}
+		}
+		if next == nil || len(points) == 0 {
+			return values, nil
+		}
+		offset = next
+	}
+}
+
+func (m qdrantManager) Chunks(ctx context.Context, filter Filter, limit int) ([]schema.Document, error) {
+	var docs []schema.Document
+	var offset any
+	for len(docs) < limit {
+		points, next, err := scrollPoints(m.collection, offset, min(migrateScrollSize, limit-len(docs)), true, qdrantFilter(filter))
+		if err != nil {
+			return nil, err
+		}
+		for _, point := range points {
+			content, _ := point.Payload[qdrantContentKey].(string)
+			delete(point.Payload, qdrantContentKey)
+			docs = append(docs, schema.Document{PageContent: content, Metadata: point.Payload})
+		}
+		if next == nil || len(points) == 0 {
+			break
+		}
+		offset = next
+	}
+	return docs, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+type MemoryConfig struct {
+	MaxTokens        int  `json:"max_tokens"`         // Token budget for previous turns in the prompt
+	MaxRequestTokens int  `json:"max_request_tokens"` // Cap on a chat request's memory_tokens
+	MaxTurns         int  `json:"max_turns"`          // Turns (user or assistant messages) of a branch kept at all
+	MaxMessages      int  `json:"max_messages"`       // Messages a session keeps across its branches; the oldest go first
+	MaxFacts         int  `json:"max_facts"`          // Facts that can be pinned to a user or session
+	MaxFactLength    int  `json:"max_fact_length"`    // Longest pinned fact, in characters
+	ExtractFacts     bool `json:"extract_facts"`      // Have the model remember durable facts about the user from each exchange
+}
+
+func validateMemory(cfg MemoryConfig) error {
+	if cfg.MaxTokens < 0 || cfg.MaxRequestTokens < 0 {
+		return fmt.Errorf("memory token budgets must not be negative")
+	}
+	if cfg.MaxTurns < 2 {
+		return fmt.Errorf("memory.max_turns must be at least 2")
+	}
+	if cfg.MaxMessages < cfg.MaxTurns {
+		return fmt.Errorf("memory.max_messages must be at least memory.max_turns")
+	}
+	if cfg.MaxFacts < 0 || cfg.MaxFactLength < 1 {
+		return fmt.Errorf("memory.max_facts must not be negative and memory.max_fact_length must be at least 1")
+	}
+	return nil
+}
+
+const (
+	RoleSystem    = "system" // Only in prompts; requests cannot send system messages
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+)
+
+// ChatMessage is a turn of an OpenAI-style messages array.
+type ChatMessage struct {
+	Role    string `json:"role"` // "user" or "assistant"
+	Content string `json:"content"`
+}
+
+// bindMessages takes the question of a chat request from the last of its
+// messages, which must be the user's.
+func bindMessages(msg *Message) error {
+	if len(msg.Messages) == 0 {
+		return nil
+	}
+	if msg.Msg != "" {
+		return fmt.Errorf("send either msg or messages, not both")
+	}
+	for _, m := range msg.Messages {
+		if m.Role != RoleUser && m.Role != RoleAssistant {
+			return fmt.Errorf("unknown message role %q", m.Role)
+		}
+	}
+	last := msg.Messages[len(msg.Messages)-1]
+	if last.Role != RoleUser {
+		return fmt.Errorf("the last message must be the user's")
+	}
+	msg.Msg = last.Content
+	return nil
+}
+
+// conversation returns the previous turns of a chat request that fit in its
+// memory budget: those of its messages, or else those of its session's
+// branch up to the message it follows.
+func conversation(msg Message) []string {
+	if len(msg.Messages) == 0 {
+		return sessionContext(msg.SessionID).window(context.Background(), msg.parent, memoryBudget(msg))
+	}
+	turns := make([]string, 0, len(msg.Messages)-1)
+	for _, m := range msg.Messages[:len(msg.Messages)-1] {
+		if m.Role == RoleUser {
+			turns = append(turns, "User: "+m.Content)
+		} else {
+			turns = append(turns, "Assistant: "+m.Content)
+		}
+	}
+	return windowTurns(turns, memoryBudget(msg))
+}
+
+// memoryBudget is the token budget for previous turns: the chat request's
+// memory_tokens when set, else the configured one.
+func memoryBudget(msg Message) int {
+	if msg.MemoryTokens != nil {
+		return *msg.MemoryTokens
+	}
+	return getConfig().Memory.MaxTokens
+}
+
+// estimateTokens approximates the token count of text at four characters per
+// token, which is close enough for budgeting across models.
+func estimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// window returns the most recent turns of the branch ending at parent that
+// fit in budget tokens, oldest first.
+func (c *ChatContext) window(ctx context.Context, parent string, budget int) []string {
+	return windowTurns(c.turns(ctx, parent), budget)
+}
+
+// windowTurns returns the most recent of turns that fit in budget tokens.
+func windowTurns(turns []string, budget int) []string {
+	start := len(turns)
+	for used := 0; start > 0; start-- {
+		used += estimateTokens(turns[start-1])
+		if used > budget {
+			break
+		}
+	}
+	return turns[start:]
+}
+
+// reset replaces the conversation with turns, as "User: " and "Assistant: "
+// strings.
+func (c *ChatContext) reset(turns []string) {
+	ctx := context.Background()
+	c.clear(ctx)
+	parent := ""
+	for _, turn := range turns {
+		if content, ok := strings.CutPrefix(turn, "User: "); ok {
+			parent = c.add(ctx, RoleUser, content, parent)
+		} else {
+			parent = c.add(ctx, RoleAssistant, strings.TrimPrefix(turn, "Assistant: "), parent)
+		}
+	}
+}
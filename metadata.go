@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tmc/langchaingo/schema"
+
+	"langchainRAG/migrations"
+)
+
+const (
+	MetadataSQLite   = "sqlite"
+	MetadataPostgres = "postgres"
+)
+
+type MetadataConfig struct {
+	Backend string `json:"backend"` // "sqlite", "postgres", or "" to keep no metadata
+	Path    string `json:"path"`    // SQLite database file
+	URL     string `json:"url"`     // Postgres connection string; ${VAR} references are expanded
+	Migrate bool   `json:"migrate"` // Apply pending schema migrations on startup; otherwise refuse to start until ragctl migrate has
+}
+
+// SourceRecord is an ingested source and the documents last ingested from it.
+type SourceRecord struct {
+	Name            string           `json:"name"` // The job source: a path, or a connector and its target
+	FirstIngestedAt time.Time        `json:"first_ingested_at"`
+	LastIngestedAt  time.Time        `json:"last_ingested_at"`
+	LastJobID       string           `json:"last_job_id"`
+	Documents       []DocumentRecord `json:"documents"`
+}
+
+// DocumentRecord is one ingested version of a document.
+type DocumentRecord struct {
+	Name       string    `json:"name"`
+	Version    int       `json:"version"`
+	Source     string    `json:"source"`
+	Tenant     string    `json:"tenant,omitempty"`
+	JobID      string    `json:"job_id"`
+	Chunks     int       `json:"chunks"`
+	IngestedAt time.Time `json:"ingested_at"`
+}
+
+// MetadataStore records what the service has done in a relational database:
+// ingested sources, documents and chunks, jobs, chat sessions and feedback.
+// The vector store and the shared state stay authoritative; the records are
+// there to be queried. Its methods do nothing on a nil store, which is how
+// the service runs with metadata.backend "".
+type MetadataStore struct {
+	db      *sql.DB
+	backend string
+}
+
+// metadataStore is opened from the metadata config on startup.
+var metadataStore *MetadataStore
+
+func validateMetadata(cfg MetadataConfig) error {
+	switch cfg.Backend {
+	case "":
+	case MetadataSQLite:
+		if cfg.Path == "" {
+			return fmt.Errorf("metadata.path is required for sqlite")
+		}
+	case MetadataPostgres:
+		if cfg.URL == "" {
+			return fmt.Errorf("metadata.url is required for postgres")
+		}
+	default:
+		return fmt.Errorf("unknown metadata backend %q", cfg.Backend)
+	}
+	return nil
+}
+
+func openMetadataStore(cfg MetadataConfig) (*MetadataStore, error) {
+	var db *sql.DB
+	var err error
+	switch cfg.Backend {
+	case MetadataSQLite:
+		db, err = sql.Open("sqlite3", cfg.Path)
+	case MetadataPostgres:
+		db, err = sql.Open("postgres", os.ExpandEnv(cfg.URL))
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata config: %v", err)
+	}
+	if cfg.Backend == MetadataSQLite {
+		// SQLite takes one writer at a time
+		db.SetMaxOpenConns(1)
+	}
+
+	if err := migrateMetadata(db, cfg); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &MetadataStore{db: db, backend: cfg.Backend}, nil
+}
+
+// migrateMetadata applies the pending schema migrations, or with
+// metadata.migrate off, checks that there are none.
+func migrateMetadata(db *sql.DB, cfg MetadataConfig) error {
+	ctx := context.Background()
+	if !cfg.Migrate {
+		pending, err := migrations.Pending(ctx, db)
+		if err != nil {
+			return fmt.Errorf("failed to check metadata migrations: %v", err)
+		}
+		if len(pending) > 0 {
+			return fmt.Errorf("the metadata store has %d pending migrations, run ragctl migrate", len(pending))
+		}
+		return nil
+	}
+
+	applied, err := migrations.Up(ctx, db, cfg.Backend == MetadataPostgres)
+	for _, migration := range applied {
+		log.Printf("Applied metadata migration %04d_%s", migration.Version, migration.Name)
+	}
+	return err
+}
+
+// rebind turns the ? placeholders of query into Postgres' $1, $2...
+func (s *MetadataStore) rebind(query string) string {
+	if s.backend != MetadataPostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *MetadataStore) exec(ctx context.Context, query string, args ...any) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(query), args...)
+	return err
+}
+
+// saveJob records the latest snapshot of a job.
+func (s *MetadataStore) saveJob(ctx context.Context, job Job) error {
+	if s == nil {
+		return nil
+	}
+	errs, err := json.Marshal(job.Errors)
+	if err != nil {
+		return err
+	}
+	return s.exec(ctx, `INSERT INTO jobs (id, source, status, total, processed, batches, failed_batches, errors, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET status = excluded.status, total = excluded.total, processed = excluded.processed,
+			batches = excluded.batches, failed_batches = excluded.failed_batches, errors = excluded.errors, updated_at = excluded.updated_at`,
+		job.ID, job.Source, string(job.Status), job.Total, job.Processed, job.Batches, job.FailedBatches, string(errs),
+		job.CreatedAt.UTC(), job.UpdatedAt.UTC())
+}
+
+// saveIngestion records the documents a job ingested from source.
+func (s *MetadataStore) saveIngestion(ctx context.Context, source, jobID string, docs []DocumentRecord) error {
+	if s == nil {
+		return nil
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO sources (name, first_ingested_at, last_ingested_at, last_job_id) VALUES (?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET last_ingested_at = excluded.last_ingested_at, last_job_id = excluded.last_job_id`),
+		source, now, now, jobID); err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO documents (name, version, source, tenant, job_id, chunks, ingested_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (name, version) DO UPDATE SET source = excluded.source, tenant = excluded.tenant, job_id = excluded.job_id,
+				chunks = excluded.chunks, ingested_at = excluded.ingested_at`),
+			doc.Name, doc.Version, source, doc.Tenant, jobID, doc.Chunks, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// addChunks records the ids the vector store gave a stored batch. Stores
+// that return no ids leave nothing to record.
+func (s *MetadataStore) addChunks(ctx context.Context, jobID string, batch []schema.Document, ids []string) error {
+	if s == nil || len(ids) == 0 {
+		return nil
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, id := range ids {
+		if i >= len(batch) {
+			break
+		}
+		document, _ := batch[i].Metadata["document"].(string)
+		version, _ := intValue(batch[i].Metadata["version"])
+		if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO chunks (id, document, version, job_id) VALUES (?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET document = excluded.document, version = excluded.version, job_id = excluded.job_id`),
+			id, document, version, jobID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// touchSession counts a turn of a chat session.
+func (s *MetadataStore) touchSession(ctx context.Context, id string) error {
+	if s == nil {
+		return nil
+	}
+	now := time.Now().UTC()
+	return s.exec(ctx, `INSERT INTO sessions (id, turns, created_at, last_active_at) VALUES (?, 1, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET turns = sessions.turns + 1, last_active_at = excluded.last_active_at`,
+		id, now, now)
+}
+
+// deleteDocuments removes the records of documents, every version, and of
+// their chunks, entities and knowledge graph triples.
+func (s *MetadataStore) deleteDocuments(ctx context.Context, names []string) error {
+	if s == nil || len(names) == 0 {
+		return nil
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, name := range names {
+		for _, query := range []string{`DELETE FROM chunks WHERE document = ?`, `DELETE FROM entities WHERE document = ?`, `DELETE FROM triples WHERE document = ?`,
+			`DELETE FROM documents WHERE name = ?`} {
+			if _, err := tx.ExecContext(ctx, s.rebind(query), name); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// deleteSession removes the record of a chat session.
+func (s *MetadataStore) deleteSession(ctx context.Context, id string) error {
+	if s == nil {
+		return nil
+	}
+	return s.exec(ctx, `DELETE FROM sessions WHERE id = ?`, id)
+}
+
+// saveFeedback records the latest rating of an answer.
+func (s *MetadataStore) saveFeedback(ctx context.Context, feedback Feedback) error {
+	if s == nil {
+		return nil
+	}
+	return s.exec(ctx, `INSERT INTO feedback (answer_id, rating, comment, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (answer_id) DO UPDATE SET rating = excluded.rating, comment = excluded.comment, created_at = excluded.created_at`,
+		feedback.ID, feedback.Rating, feedback.Comment, time.Now().UTC())
+}
+
+// sources returns the ingested sources, most recently ingested first, with
+// their documents, newest version first.
+func (s *MetadataStore) sources(ctx context.Context) ([]SourceRecord, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT name, first_ingested_at, last_ingested_at, last_job_id FROM sources ORDER BY last_ingested_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sources := []SourceRecord{}
+	index := map[string]int{}
+	for rows.Next() {
+		var source SourceRecord
+		if err := rows.Scan(&source.Name, &source.FirstIngestedAt, &source.LastIngestedAt, &source.LastJobID); err != nil {
+			return nil, err
+		}
+		source.Documents = []DocumentRecord{}
+		index[source.Name] = len(sources)
+		sources = append(sources, source)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	docs, err := s.db.QueryContext(ctx, `SELECT name, version, source, tenant, job_id, chunks, ingested_at FROM documents ORDER BY name, version DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer docs.Close()
+	for docs.Next() {
+		var doc DocumentRecord
+		if err := docs.Scan(&doc.Name, &doc.Version, &doc.Source, &doc.Tenant, &doc.JobID, &doc.Chunks, &doc.IngestedAt); err != nil {
+			return nil, err
+		}
+		if i, ok := index[doc.Source]; ok {
+			sources[i].Documents = append(sources[i].Documents, doc)
+		}
+	}
+	return sources, docs.Err()
+}
+
+// listSources returns the sources recorded in the metadata store.
+func listSources(c *gin.Context) {
+	if metadataStore == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the metadata store is disabled"})
+		return
+	}
+	sources, err := metadataStore.sources(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, sources)
+}
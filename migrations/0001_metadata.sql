@@ -0,0 +1,10 @@
+-- The metadata store's tables. IF NOT EXISTS adopts the tables of servers
+-- that created them before migrations were versioned.
+CREATE TABLE IF NOT EXISTS sources (name TEXT PRIMARY KEY, first_ingested_at TIMESTAMP NOT NULL, last_ingested_at TIMESTAMP NOT NULL, last_job_id TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS documents (name TEXT NOT NULL, version INTEGER NOT NULL, source TEXT NOT NULL, tenant TEXT NOT NULL, job_id TEXT NOT NULL, chunks INTEGER NOT NULL, ingested_at TIMESTAMP NOT NULL, PRIMARY KEY (name, version));
+CREATE INDEX IF NOT EXISTS documents_source ON documents (source);
+CREATE TABLE IF NOT EXISTS chunks (id TEXT PRIMARY KEY, document TEXT NOT NULL, version INTEGER NOT NULL, job_id TEXT NOT NULL);
+CREATE INDEX IF NOT EXISTS chunks_document ON chunks (document, version);
+CREATE TABLE IF NOT EXISTS jobs (id TEXT PRIMARY KEY, source TEXT NOT NULL, status TEXT NOT NULL, total INTEGER NOT NULL, processed INTEGER NOT NULL, batches INTEGER NOT NULL, failed_batches INTEGER NOT NULL, errors TEXT NOT NULL, created_at TIMESTAMP NOT NULL, updated_at TIMESTAMP NOT NULL);
+CREATE TABLE IF NOT EXISTS sessions (id TEXT PRIMARY KEY, turns INTEGER NOT NULL, created_at TIMESTAMP NOT NULL, last_active_at TIMESTAMP NOT NULL);
+CREATE TABLE IF NOT EXISTS feedback (answer_id TEXT PRIMARY KEY, rating TEXT NOT NULL, comment TEXT NOT NULL, created_at TIMESTAMP NOT NULL);
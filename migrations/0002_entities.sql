@@ -0,0 +1,4 @@
+-- The entities the entities enrichment found in each chunk, for looking up
+-- what the documents mention and routing questions naming them.
+CREATE TABLE entities (name TEXT NOT NULL, type TEXT NOT NULL, document TEXT NOT NULL, version INTEGER NOT NULL, chunk_id TEXT NOT NULL, PRIMARY KEY (name, type, chunk_id));
+CREATE INDEX entities_document ON entities (document, version);
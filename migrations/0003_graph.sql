@@ -0,0 +1,6 @@
+-- The subject-relation-object triples the knowledge graph extraction found
+-- in each chunk, for expanding retrieval to the neighborhood of the
+-- entities a question names.
+CREATE TABLE triples (subject TEXT NOT NULL, relation TEXT NOT NULL, object TEXT NOT NULL, document TEXT NOT NULL, version INTEGER NOT NULL, chunk_id TEXT NOT NULL, PRIMARY KEY (subject, relation, object, chunk_id));
+CREATE INDEX triples_object ON triples (object);
+CREATE INDEX triples_document ON triples (document, version);
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/milvus-io/milvus-sdk-go/v2/client"
+	"github.com/milvus-io/milvus-sdk-go/v2/entity"
+	"github.com/tmc/langchaingo/vectorstores/milvus"
+)
+
+const (
+	MilvusIndexHNSW    = "hnsw"
+	MilvusIndexIVFFlat = "ivf_flat"
+	MilvusIndexFlat    = "flat"
+
+	TenantPartition  = "partition"  // One collection, a partition per tenant
+	TenantCollection = "collection" // A collection per tenant
+
+	milvusMaxTextLength = 65535
+)
+
+type MilvusConfig struct {
+	Address  string `json:"address"` // e.g. "localhost:19530", or a Zilliz Cloud endpoint
+	Username string `json:"username"`
+	Password string `json:"password"` // With environment variables expanded
+	APIKey   string `json:"api_key"`  // Zilliz Cloud API key, with environment variables expanded
+	TLS      bool   `json:"tls"`
+
+	Index          string `json:"index"`           // "hnsw", "ivf_flat" or "flat"
+	M              int    `json:"m"`               // HNSW graph degree
+	EFConstruction int    `json:"ef_construction"` // HNSW build-time candidate list
+	EF             int    `json:"ef"`              // HNSW search-time candidate list
+	NList          int    `json:"nlist"`           // IVF cluster count
+	NProbe         int    `json:"nprobe"`          // IVF clusters searched
+
+	TenantMode string `json:"tenant_mode"` // How requests with a tenant are isolated: "partition" or "collection"
+}
+
+var defaultMilvusConfig = MilvusConfig{
+	Address:        "localhost:19530",
+	Index:          MilvusIndexHNSW,
+	M:              16,
+	EFConstruction: 200,
+	EF:             64,
+	NList:          1024,
+	NProbe:         16,
+	TenantMode:     TenantPartition,
+}
+
+func validateMilvus(cfg MilvusConfig) error {
+	if cfg.Address == "" {
+		return fmt.Errorf("vector_store.milvus.address is required for the milvus backend")
+	}
+	if cfg.Index != MilvusIndexHNSW && cfg.Index != MilvusIndexIVFFlat && cfg.Index != MilvusIndexFlat {
+		return fmt.Errorf("unknown milvus index %q", cfg.Index)
+	}
+	if cfg.TenantMode != TenantPartition && cfg.TenantMode != TenantCollection {
+		return fmt.Errorf("unknown milvus tenant_mode %q", cfg.TenantMode)
+	}
+	return nil
+}
+
+// milvusTarget maps a tenant to the collection and partition holding its
+// chunks. Requests without a tenant use the configured collection's default
+// partition.
+func milvusTarget(tenant string) (string, string) {
+	collection := getConfig().Embedding.Collection
+	if tenant == "" {
+		return collection, ""
+	}
+	name := "tenant_" + sqlIdentifier(tenant)
+	if getConfig().VectorStore.Milvus.TenantMode == TenantCollection {
+		return collection + "_" + name, ""
+	}
+	return collection, name
+}
+
+func milvusClientConfig(cfg MilvusConfig) client.Config {
+	return client.Config{
+		Address:       cfg.Address,
+		Username:      cfg.Username,
+		Password:      os.ExpandEnv(cfg.Password),
+		APIKey:        os.ExpandEnv(cfg.APIKey),
+		EnableTLSAuth: cfg.TLS,
+	}
+}
+
+func milvusIndex(cfg MilvusConfig) (entity.Index, entity.SearchParam, error) {
+	switch cfg.Index {
+	case MilvusIndexIVFFlat:
+		index, err := entity.NewIndexIvfFlat(entity.COSINE, cfg.NList)
+		if err != nil {
+			return nil, nil, err
+		}
+		param, err := entity.NewIndexIvfFlatSearchParam(cfg.NProbe)
+		return index, param, err
+	case MilvusIndexFlat:
+		index, err := entity.NewIndexFlat(entity.COSINE)
+		if err != nil {
+			return nil, nil, err
+		}
+		param, err := entity.NewIndexFlatSearchParam()
+		return index, param, err
+	}
+	index, err := entity.NewIndexHNSW(entity.COSINE, cfg.M, cfg.EFConstruction)
+	if err != nil {
+		return nil, nil, err
+	}
+	param, err := entity.NewIndexHNSWSearchParam(cfg.EF)
+	return index, param, err
+}
+
+// newMilvusStore connects to the collection and partition of tenant. The
+// client langchaingo creates can't be reached to close it, so it stays open
+// until the process exits.
+func newMilvusStore(ctx context.Context, tenant string) (openStore, error) {
+	cfg := getConfig().VectorStore.Milvus
+	index, searchParam, err := milvusIndex(cfg)
+	if err != nil {
+		return openStore{}, fmt.Errorf("invalid milvus index config: %v", err)
+	}
+
+	collection, partition := milvusTarget(tenant)
+	options := []milvus.Option{
+		milvus.WithCollectionName(collection),
+		milvus.WithEmbedder(contextEmbedder{}),
+		milvus.WithIndex(index),
+		milvus.WithSearchParameters(searchParam),
+		milvus.WithMetricType(entity.COSINE),
+	}
+	if partition != "" {
+		options = append(options, milvus.WithPartitionName(partition))
+	}
+	store, err := milvus.New(ctx, milvusClientConfig(cfg), options...)
+	if err != nil {
+		return openStore{}, err
+	}
+	return openStore{store: store}, nil
+}
+
+// prepareMilvus creates the tenant's collection and partition. The schema
+// matches the one langchaingo creates lazily, which can't happen before a
+// partition is needed.
+func prepareMilvus(ctx context.Context, embedder Embedder, tenant string) error {
+	dims, err := embeddingDimensions(ctx, embedder)
+	if err != nil {
+		return err
+	}
+
+	milvusClient, err := client.NewClient(ctx, milvusClientConfig(getConfig().VectorStore.Milvus))
+	if err != nil {
+		return fmt.Errorf("failed to connect to milvus: %v", err)
+	}
+	defer milvusClient.Close()
+
+	collection, partition := milvusTarget(tenant)
+	exists, err := milvusClient.HasCollection(ctx, collection)
+	if err != nil {
+		return fmt.Errorf("failed to check collection: %v", err)
+	}
+	if !exists {
+		schema := &entity.Schema{
+			CollectionName: collection,
+			AutoID:         true,
+			Fields: []*entity.Field{
+				{Name: "pk", DataType: entity.FieldTypeInt64, AutoID: true, PrimaryKey: true},
+				{Name: "text", DataType: entity.FieldTypeVarChar, TypeParams: map[string]string{entity.TypeParamMaxLength: strconv.Itoa(milvusMaxTextLength)}},
+				{Name: "meta", DataType: entity.FieldTypeJSON},
+				{Name: "vector", DataType: entity.FieldTypeFloatVector, TypeParams: map[string]string{entity.TypeParamDim: strconv.Itoa(dims)}},
+			},
+		}
+		err := milvusClient.CreateCollection(ctx, schema, entity.DefaultShardNumber, client.WithMetricsType(entity.COSINE))
+		if err != nil {
+			return fmt.Errorf("failed to create collection %s: %v", collection, err)
+		}
+	}
+
+	if partition == "" {
+		return nil
+	}
+	exists, err = milvusClient.HasPartition(ctx, collection, partition)
+	if err != nil {
+		return fmt.Errorf("failed to check partition: %v", err)
+	}
+	if !exists {
+		if err := milvusClient.CreatePartition(ctx, collection, partition); err != nil {
+			return fmt.Errorf("failed to create partition %s: %v", partition, err)
+		}
+	}
+	return nil
+}
+
+// milvusFilter turns a Filter into a boolean expression over the JSON
+// metadata field.
+func milvusFilter(filter Filter) any {
+	if filter.empty() {
+		return nil
+	}
+
+	var clauses []string
+	for key, value := range filter.Match {
+		clauses = append(clauses, milvusClause(key, value))
+	}
+	for key, value := range filter.Exclude {
+		clauses = append(clauses, "not "+milvusClause(key, value))
+	}
+	return strings.Join(clauses, " and ")
+}
+
+func milvusClause(key string, value any) string {
+	field := fmt.Sprintf("meta[%s]", strconv.Quote(key))
+	encoded, _ := json.Marshal(value)
+	if _, ok := value.([]any); ok {
+		return fmt.Sprintf("(%s in %s or json_contains_any(%s, %s))", field, encoded, field, encoded)
+	}
+	return fmt.Sprintf("(%s == %s or json_contains(%s, %s))", field, encoded, field, encoded)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/schema"
+)
+
+var languageNames = map[string]string{
+	"en": "English",
+	"es": "Spanish",
+	"fr": "French",
+	"de": "German",
+	"it": "Italian",
+	"pt": "Portuguese",
+	"nl": "Dutch",
+}
+
+// queryLanguage returns the language to answer in: the one requested by the
+// client, else the one detected in the query, else the configured default.
+func queryLanguage(msg Message) string {
+	if msg.Language != "" {
+		return msg.Language
+	}
+	if lang := detectLanguage(msg.Msg); lang != "und" {
+		return lang
+	}
+	return getConfig().Multilingual.DefaultLanguage
+}
+
+// promptTemplateFor returns the configured template variant for lang, or the
+// default template with an instruction to answer in that language.
+func promptTemplateFor(lang string) PromptTemplate {
+	cfg := getConfig()
+	if template, ok := cfg.Multilingual.Templates[lang]; ok {
+		return template
+	}
+
+	template := defaultPromptTemplate
+	template.Examples = cfg.Prompts.DefaultExamples
+	if name, ok := languageNames[lang]; ok && cfg.Multilingual.Enabled {
+		template.SystemMessage += fmt.Sprintf(" Always answer in %s, the language of the user's question.", name)
+	}
+	return template
+}
+
+// translateDocuments translates retrieved chunks whose language differs from
+// lang. The chunk language comes from the "language" enrichment field when
+// present and is detected otherwise. Chunks that fail to translate are kept
+// as they are.
+func translateDocuments(ctx context.Context, llm llms.Model, docs []schema.Document, lang string) []schema.Document {
+	target, ok := languageNames[lang]
+	if !ok {
+		return docs
+	}
+
+	translated := make([]schema.Document, len(docs))
+	for i, doc := range docs {
+		translated[i] = doc
+
+		docLang, _ := doc.Metadata["language"].(string)
+		if docLang == "" {
+			docLang = detectLanguage(doc.PageContent)
+		}
+		if docLang == "und" || docLang == lang {
+			continue
+		}
+
+		prompt := fmt.Sprintf("Translate the following text to %s. Keep names, numbers and formatting unchanged. "+
+			"Reply with the translation only.\n\n%s", target, doc.PageContent)
+		text, err := llms.GenerateFromSinglePrompt(ctx, llm, prompt)
+		if err != nil {
+			continue
+		}
+		translated[i].PageContent = strings.TrimSpace(text)
+	}
+	return translated
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/tmc/langchaingo/schema"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	// vocabularyRefresh is how long the corpus vocabulary is cached.
+	vocabularyRefresh = time.Minute
+	// minCorrectedLength is the length of the shortest word spell correction
+	// touches; shorter ones are too often codes and abbreviations.
+	minCorrectedLength = 4
+)
+
+var wordPattern = regexp.MustCompile(`\p{L}+`)
+
+type NormalizeConfig struct {
+	Enabled    bool `json:"enabled"`     // Normalize the searched query: Unicode NFKC and collapsed whitespace
+	Lowercase  bool `json:"lowercase"`   // Also lowercase it
+	SpellCheck bool `json:"spell_check"` // Correct words missing from the corpus vocabulary, which ingestion counts
+	MinCount   int  `json:"min_count"`   // Times a word must occur in the corpus to be offered as a correction
+}
+
+func validateNormalize(cfg NormalizeConfig) error {
+	if cfg.MinCount < 1 {
+		return fmt.Errorf("normalize.min_count must be at least 1")
+	}
+	return nil
+}
+
+// Vocabulary caches the word counts of the collection being searched.
+type Vocabulary struct {
+	Collection string
+	Words      map[string]float64
+	LoadedAt   time.Time
+	mu         sync.Mutex
+}
+
+var vocabulary = Vocabulary{}
+
+// normalizeQuery returns the text to search for msg and, if spell correction
+// changed any word, the corrected question to report to the client.
+func normalizeQuery(ctx context.Context, msg Message) (string, string) {
+	cfg := getConfig().Normalize
+	if !flagOn(msg, FlagNormalize, cfg.Enabled) {
+		return msg.Msg, ""
+	}
+	query := strings.Join(strings.Fields(norm.NFKC.String(msg.Msg)), " ")
+	if cfg.Lowercase {
+		query = strings.ToLower(query)
+	}
+	if !flagOn(msg, FlagSpellCheck, cfg.SpellCheck) {
+		return query, ""
+	}
+
+	words := vocabulary.load(ctx)
+	if len(words) == 0 {
+		return query, ""
+	}
+	corrected := wordPattern.ReplaceAllStringFunc(query, func(word string) string {
+		return correctWord(word, words, cfg.MinCount)
+	})
+	if corrected == query {
+		return query, ""
+	}
+	log.Printf("Corrected query %q to %q", query, corrected)
+	return corrected, corrected
+}
+
+// correctWord returns the most frequent corpus word within one edit of word
+// (two for words over six letters), or word itself if it is in the corpus,
+// a stopword or nothing is close.
+func correctWord(word string, words map[string]float64, minCount int) string {
+	lower := strings.ToLower(word)
+	length := utf8.RuneCountInString(lower)
+	if length < minCorrectedLength || words[lower] > 0 || isStopword(lower) {
+		return word
+	}
+	maxDistance := 1
+	if length > 6 {
+		maxDistance = 2
+	}
+
+	best, bestDistance, bestCount := "", maxDistance, 0.0
+	for candidate, count := range words {
+		if count < float64(minCount) {
+			continue
+		}
+		if diff := utf8.RuneCountInString(candidate) - length; diff > maxDistance || -diff > maxDistance {
+			continue
+		}
+		distance := editDistance(lower, candidate, maxDistance)
+		if distance > maxDistance {
+			continue
+		}
+		if best == "" || distance < bestDistance || distance == bestDistance && (count > bestCount || count == bestCount && candidate < best) {
+			best, bestDistance, bestCount = candidate, distance, count
+		}
+	}
+	if best == "" {
+		return word
+	}
+	if first, _ := utf8.DecodeRuneInString(word); unicode.IsUpper(first) {
+		r, size := utf8.DecodeRuneInString(best)
+		return string(unicode.ToUpper(r)) + best[size:]
+	}
+	return best
+}
+
+// editDistance is the number of insertions, deletions, substitutions and
+// transpositions of adjacent letters turning a into b, or limit+1 once it is
+// known to exceed limit.
+func editDistance(a, b string, limit int) int {
+	ra, rb := []rune(a), []rune(b)
+	beforePrevious := make([]int, len(rb)+1)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		rowMin := current[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				current[j] = min(current[j], beforePrevious[j-2]+1)
+			}
+			rowMin = min(rowMin, current[j])
+		}
+		if rowMin > limit {
+			return limit + 1
+		}
+		beforePrevious, previous, current = previous, current, beforePrevious
+	}
+	return previous[len(rb)]
+}
+
+// load returns the word counts of the configured collection, reading them
+// from the shared state at most once every vocabularyRefresh. Failures are
+// logged and the cached counts kept.
+func (v *Vocabulary) load(ctx context.Context) map[string]float64 {
+	collection := getConfig().Embedding.Collection
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.Collection == collection && time.Since(v.LoadedAt) < vocabularyRefresh {
+		return v.Words
+	}
+	words, err := sharedState.Counters(ctx, "vocabulary:"+collection)
+	if err != nil {
+		log.Printf("Error loading the vocabulary of %s: %v", collection, err)
+		return v.Words
+	}
+	v.Collection, v.Words, v.LoadedAt = collection, words, time.Now()
+	return words
+}
+
+// countVocabulary adds the words of stored chunks to the vocabulary of the
+// collection, when spell correction is on.
+func countVocabulary(ctx context.Context, docs []schema.Document) {
+	cfg := getConfig()
+	if !flagOn(Message{}, FlagNormalize, cfg.Normalize.Enabled) || !flagOn(Message{}, FlagSpellCheck, cfg.Normalize.SpellCheck) {
+		return
+	}
+	counts := map[string]float64{}
+	for _, doc := range docs {
+		for _, word := range wordPattern.FindAllString(strings.ToLower(norm.NFKC.String(doc.PageContent)), -1) {
+			counts[word]++
+		}
+	}
+	if len(counts) == 0 {
+		return
+	}
+	if err := sharedState.Increment(ctx, "vocabulary:"+cfg.Embedding.Collection, counts); err != nil {
+		log.Printf("Error counting the vocabulary of %s: %v", cfg.Embedding.Collection, err)
+	}
+}
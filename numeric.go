@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// numericWindow is how many characters away from a comparison a field's
+// terms may be for the comparison to be on the field.
+const numericWindow = 40
+
+type NumericConfig struct {
+	Enabled bool           `json:"enabled"` // Filter questions comparing a field to a number on it; the numeric flag turns this on or off per request
+	Fields  []NumericField `json:"fields"`
+}
+
+// NumericField is a numeric payload field and the words questions name it
+// by, e.g. {"field": "row.age", "terms": ["age", "older", "younger"]}.
+type NumericField struct {
+	Field string   `json:"field"`
+	Terms []string `json:"terms"` // Words or symbols, e.g. "$", near a comparison on the field; matched case-insensitively
+}
+
+func validateNumeric(cfg NumericConfig) error {
+	if cfg.Enabled && len(cfg.Fields) == 0 {
+		return fmt.Errorf("numeric.fields must not be empty")
+	}
+	for _, field := range cfg.Fields {
+		if strings.TrimSpace(field.Field) == "" || len(field.Terms) == 0 {
+			return fmt.Errorf("numeric.fields need a field and terms")
+		}
+	}
+	return nil
+}
+
+const number = `\$?\s*(\d[\d,]*(?:\.\d+)?)(?:\s*(k|m|thousand|million)\b)?`
+
+var (
+	comparisonPrefixes = map[string]string{
+		"more than": "gt", "over": "gt", "above": "gt", "greater than": "gt", "higher than": "gt", "older than": "gt", "exceeding": "gt", ">": "gt",
+		"at least": "gte", "no less than": "gte", ">=": "gte",
+		"less than": "lt", "fewer than": "lt", "under": "lt", "below": "lt", "lower than": "lt", "younger than": "lt", "<": "lt",
+		"at most": "lte", "no more than": "lte", "up to": "lte", "<=": "lte",
+	}
+	comparisonSuffixes = map[string]string{
+		"or more": "gte", "or older": "gte", "or over": "gte", "or above": "gte",
+		"or less": "lte", "or fewer": "lte", "or younger": "lte", "or under": "lte", "or below": "lte",
+	}
+	numericBetweenPattern = regexp.MustCompile(`(?i)\bbetween\s+` + number + `\s+and\s+` + number)
+	numericPrefixPattern  = regexp.MustCompile(`(?i)(?:\b(` + alternatives(comparisonPrefixes, true) + `)\b|(>=|<=|>|<))\s*` + number)
+	numericSuffixPattern  = regexp.MustCompile(`(?i)` + number + `\s+(` + alternatives(comparisonSuffixes, false) + `)\b`)
+)
+
+// alternatives joins the words of operators, longest first so that "more
+// than" is preferred to a shorter prefix, leaving out symbols when words
+// is set.
+func alternatives(operators map[string]string, words bool) string {
+	var phrases []string
+	for phrase := range operators {
+		if !words || phrase[0] != '<' && phrase[0] != '>' {
+			phrases = append(phrases, regexp.QuoteMeta(phrase))
+		}
+	}
+	sort.Slice(phrases, func(i, j int) bool { return len(phrases[i]) > len(phrases[j]) })
+	return strings.Join(phrases, "|")
+}
+
+// numericRanges returns ranges for the comparisons of a message's question
+// with a number, e.g. "older than 65" or "over $10,000", each on the field
+// of numeric.fields whose terms are nearest it. Comparisons near none of the
+// fields are left to semantic search.
+func numericRanges(msg Message) []Range {
+	cfg := getConfig()
+	if !flagOn(msg, FlagNumeric, cfg.Numeric.Enabled) || !supportsMaintenance(cfg.VectorStore.Backend) {
+		return nil
+	}
+	return parseNumericRanges(msg.Msg, cfg.Numeric.Fields)
+}
+
+func parseNumericRanges(text string, fields []NumericField) []Range {
+	var ranges []Range
+	taken := map[int]bool{}
+	add := func(start, end int, r Range) {
+		if taken[start] {
+			return
+		}
+		field := nearestField(text, start, end, fields)
+		if field == "" {
+			return
+		}
+		taken[start] = true
+		r.Fields = []string{field}
+		ranges = append(ranges, r)
+	}
+
+	for _, m := range numericBetweenPattern.FindAllStringSubmatchIndex(text, -1) {
+		low, ok1 := parseNumber(text[m[2]:m[3]], submatch(text, m, 2))
+		high, ok2 := parseNumber(text[m[6]:m[7]], submatch(text, m, 4))
+		if ok1 && ok2 && low <= high {
+			add(m[0], m[1], Range{GTE: low, LTE: high})
+		}
+	}
+	for _, m := range numericPrefixPattern.FindAllStringSubmatchIndex(text, -1) {
+		op := strings.ToLower(submatch(text, m, 1) + submatch(text, m, 2))
+		value, ok := parseNumber(text[m[6]:m[7]], submatch(text, m, 4))
+		if ok {
+			add(m[0], m[1], bound(comparisonPrefixes[strings.Join(strings.Fields(op), " ")], value))
+		}
+	}
+	for _, m := range numericSuffixPattern.FindAllStringSubmatchIndex(text, -1) {
+		op := strings.ToLower(strings.Join(strings.Fields(submatch(text, m, 3)), " "))
+		value, ok := parseNumber(text[m[2]:m[3]], submatch(text, m, 2))
+		if ok {
+			add(m[0], m[1], bound(comparisonSuffixes[op], value))
+		}
+	}
+	return ranges
+}
+
+func submatch(text string, m []int, group int) string {
+	if m[2*group] < 0 {
+		return ""
+	}
+	return text[m[2*group]:m[2*group+1]]
+}
+
+func bound(op string, value float64) Range {
+	switch op {
+	case "gt":
+		return Range{GT: value}
+	case "gte":
+		return Range{GTE: value}
+	case "lt":
+		return Range{LT: value}
+	}
+	return Range{LTE: value}
+}
+
+// parseNumber reads digits with thousands separators and a scale, e.g.
+// "10,000" or "2.5" "million".
+func parseNumber(digits, scale string) (float64, bool) {
+	value, err := strconv.ParseFloat(strings.ReplaceAll(digits, ",", ""), 64)
+	if err != nil {
+		return 0, false
+	}
+	switch strings.ToLower(scale) {
+	case "k", "thousand":
+		value *= 1e3
+	case "m", "million":
+		value *= 1e6
+	}
+	return value, true
+}
+
+// nearestField returns the field with a term nearest to text[start:end],
+// within numericWindow characters, or "" when none is.
+func nearestField(text string, start, end int, fields []NumericField) string {
+	lower := strings.ToLower(text)
+	best, bestDistance := "", numericWindow+1
+	for _, field := range fields {
+		for _, term := range field.Terms {
+			term = strings.ToLower(strings.TrimSpace(term))
+			if term == "" {
+				continue
+			}
+			for offset := 0; ; {
+				i := strings.Index(lower[offset:], term)
+				if i < 0 {
+					break
+				}
+				at, after := offset+i, offset+i+len(term)
+				offset = after
+				if isWordChar(term[0]) && at > 0 && isWordChar(lower[at-1]) ||
+					isWordChar(term[len(term)-1]) && after < len(lower) && isWordChar(lower[after]) {
+					continue
+				}
+				distance := 0
+				if after <= start {
+					distance = start - after
+				} else if at >= end {
+					distance = at - end
+				}
+				if distance < bestDistance {
+					best, bestDistance = field.Field, distance
+				}
+			}
+		}
+	}
+	return best
+}
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= '0' && c <= '9'
+}
+
+// queryRanges returns the ranges a message's question is filtered on: its
+// period and its comparisons with numbers.
+func queryRanges(msg Message) []Range {
+	return append(temporalRanges(msg), numericRanges(msg)...)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseNumericRanges(t *testing.T) {
+	fields := []NumericField{
+		{Field: "row.age", Terms: []string{"age", "aged", "older", "younger", "years old"}},
+		{Field: "row.salary", Terms: []string{"salary", "earn", "$"}},
+	}
+	tests := []struct {
+		text string
+		want []Range
+	}{
+		{"patients older than 65", []Range{{Fields: []string{"row.age"}, GT: 65.0}}},
+		{"employees aged at least 30", []Range{{Fields: []string{"row.age"}, GTE: 30.0}}},
+		{"who is younger than 18?", []Range{{Fields: []string{"row.age"}, LT: 18.0}}},
+		{"age <= 40", []Range{{Fields: []string{"row.age"}, LTE: 40.0}}},
+		{"age >= 40", []Range{{Fields: []string{"row.age"}, GTE: 40.0}}},
+		{"staff aged 50 or more", []Range{{Fields: []string{"row.age"}, GTE: 50.0}}},
+		{"a salary over $10,000", []Range{{Fields: []string{"row.salary"}, GT: 10000.0}}},
+		{"who earn more than 2.5 million", []Range{{Fields: []string{"row.salary"}, GT: 2.5e6}}},
+		{"a salary under 50k", []Range{{Fields: []string{"row.salary"}, LT: 50000.0}}},
+		{"age between 20 and 30", []Range{{Fields: []string{"row.age"}, GTE: 20.0, LTE: 30.0}}},
+		{"age between 30 and 20", nil},
+		{"salary at most 1,000 and age over 60", []Range{
+			{Fields: []string{"row.salary"}, LTE: 1000.0},
+			{Fields: []string{"row.age"}, GT: 60.0},
+		}},
+		// Comparisons far from every field's terms are left to semantic search
+		{"more than 3 reports were filed", nil},
+		// Terms only match whole words
+		{"the damage was over 5", nil},
+		{"what is the refund policy?", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			if got := parseNumericRanges(tt.text, fields); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseNumericRanges(%q) = %+v, want %+v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/tmc/langchaingo/documentloaders"
+	"github.com/tmc/langchaingo/schema"
+)
+
+const (
+	OCREngineTesseract = "tesseract" // Local tesseract CLI
+	OCREngineRemote    = "remote"    // HTTP OCR service
+)
+
+var imageExtensions = map[string]bool{
+	".png": true, ".jpg": true, ".jpeg": true, ".tif": true, ".tiff": true, ".bmp": true, ".gif": true, ".webp": true,
+}
+
+type OCRPage struct {
+	Text       string  `json:"text"`
+	Confidence float64 `json:"confidence"` // Mean word confidence, 0-100
+}
+
+type OCREngine interface {
+	Recognize(ctx context.Context, imagePath string) (OCRPage, error)
+}
+
+func newOCREngine(cfg OCRConfig) (OCREngine, error) {
+	switch cfg.Engine {
+	case OCREngineTesseract:
+		return tesseractEngine{language: cfg.Language}, nil
+	case OCREngineRemote:
+		if cfg.RemoteURL == "" {
+			return nil, fmt.Errorf("ocr.remote_url is required for the remote OCR engine")
+		}
+		return remoteOCREngine{url: cfg.RemoteURL, apiKey: os.ExpandEnv(cfg.APIKey)}, nil
+	}
+	return nil, fmt.Errorf("unknown OCR engine %q", cfg.Engine)
+}
+
+// tesseractEngine runs the tesseract CLI and derives the page confidence from
+// its per-word TSV output.
+type tesseractEngine struct {
+	language string
+}
+
+func (e tesseractEngine) Recognize(ctx context.Context, imagePath string) (OCRPage, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "tesseract", imagePath, "stdout", "-l", e.language, "tsv")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return OCRPage{}, fmt.Errorf("tesseract failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return parseTesseractTSV(&stdout)
+}
+
+// parseTesseractTSV reads tesseract's TSV output line by line; it is not
+// valid CSV since recognized words may contain stray quotes.
+func parseTesseractTSV(r io.Reader) (OCRPage, error) {
+	var text strings.Builder
+	var confSum float64
+	words := 0
+	lastLine := ""
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// level page block par line word left top width height conf text
+		record := strings.Split(scanner.Text(), "\t")
+		if len(record) < 12 || record[0] != "5" {
+			continue
+		}
+		word := strings.TrimSpace(record[11])
+		conf, err := strconv.ParseFloat(record[10], 64)
+		if word == "" || err != nil || conf < 0 {
+			continue
+		}
+
+		line := strings.Join(record[2:5], ".")
+		if lastLine != "" {
+			if line != lastLine {
+				text.WriteString("\n")
+			} else {
+				text.WriteString(" ")
+			}
+		}
+		lastLine = line
+		text.WriteString(word)
+		confSum += conf
+		words++
+	}
+	if err := scanner.Err(); err != nil {
+		return OCRPage{}, fmt.Errorf("invalid tesseract output: %v", err)
+	}
+
+	page := OCRPage{Text: text.String()}
+	if words > 0 {
+		page.Confidence = confSum / float64(words)
+	}
+	return page, nil
+}
+
+// remoteOCREngine posts the raw image to an OCR service, which must answer
+// with {"text": "...", "confidence": 0-100}.
+type remoteOCREngine struct {
+	url    string
+	apiKey string
+}
+
+func (e remoteOCREngine) Recognize(ctx context.Context, imagePath string) (OCRPage, error) {
+	data, err := os.ReadFile(imagePath)
+	if err != nil {
+		return OCRPage{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", e.url, bytes.NewReader(data))
+	if err != nil {
+		return OCRPage{}, err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(imagePath))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	req.Header.Set("Content-Type", contentType)
+	if e.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+e.apiKey)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return OCRPage{}, fmt.Errorf("failed to call OCR service: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return OCRPage{}, fmt.Errorf("OCR service returned status %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	var page OCRPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return OCRPage{}, fmt.Errorf("invalid OCR service response: %v", err)
+	}
+	return page, nil
+}
+
+func loadImage(ctx context.Context, filename string) ([]schema.Document, error) {
+	cfg := getConfig().OCR
+	engine, err := newOCREngine(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := engine.Recognize(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return []schema.Document{ocrDocument(filename, page, 1, 1, cfg.MinConfidence)}, nil
+}
+
+// loadPDF extracts the text layer of every page and runs OCR on pages that
+// have (almost) none, which is what scanned pages look like. Rendering pages
+// for OCR needs pdftoppm (poppler-utils).
+func loadPDF(ctx context.Context, filename string) ([]schema.Document, error) {
+	cfg := getConfig().OCR
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	pages, err := documentloaders.NewPDF(file, info.Size()).Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var engine OCREngine
+	var tmpDir string
+	docs := make([]schema.Document, 0, len(pages))
+	for i, page := range pages {
+		number := i + 1
+		if len(strings.TrimSpace(page.PageContent)) >= cfg.MinPageText {
+			page.Metadata["source"] = filename
+			docs = append(docs, page)
+			continue
+		}
+
+		if engine == nil {
+			if engine, err = newOCREngine(cfg); err != nil {
+				return nil, err
+			}
+			if tmpDir, err = os.MkdirTemp("", "ocr"); err != nil {
+				return nil, err
+			}
+			defer os.RemoveAll(tmpDir)
+		}
+
+		image, err := renderPDFPage(ctx, filename, number, tmpDir)
+		if err != nil {
+			return nil, err
+		}
+		result, err := engine.Recognize(ctx, image)
+		if err != nil {
+			return nil, fmt.Errorf("page %d: %v", number, err)
+		}
+		docs = append(docs, ocrDocument(filename, result, number, len(pages), cfg.MinConfidence))
+	}
+	return docs, nil
+}
+
+func renderPDFPage(ctx context.Context, filename string, page int, dir string) (string, error) {
+	prefix := filepath.Join(dir, fmt.Sprintf("page-%d", page))
+	n := strconv.Itoa(page)
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "pdftoppm", "-f", n, "-l", n, "-r", "300", "-png", "-singlefile", filename, prefix)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("failed to render page %d: %v: %s", page, err, strings.TrimSpace(stderr.String()))
+	}
+	return prefix + ".png", nil
+}
+
+func ocrDocument(filename string, page OCRPage, number, total int, minConfidence float64) schema.Document {
+	return schema.Document{
+		PageContent: page.Text,
+		Metadata: map[string]any{
+			"source":         filename,
+			"page":           number,
+			"total_pages":    total,
+			"ocr":            true,
+			"ocr_confidence": page.Confidence,
+			"low_confidence": page.Confidence < minConfidence,
+		},
+	}
+}
+
+// lowConfidenceWarnings lists the OCR pages whose confidence fell below the
+// configured minimum, for the job report.
+func lowConfidenceWarnings(docs []schema.Document) []string {
+	var warnings []string
+	seen := map[int]bool{}
+	for _, doc := range docs {
+		low, _ := doc.Metadata["low_confidence"].(bool)
+		page, _ := doc.Metadata["page"].(int)
+		if !low || seen[page] {
+			continue
+		}
+		seen[page] = true
+		warnings = append(warnings, fmt.Sprintf("page %d: low OCR confidence (%.0f)", page, doc.Metadata["ocr_confidence"]))
+	}
+	return warnings
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tmc/langchaingo/schema"
+)
+
+// Payload field types, named as Qdrant names its payload indexes.
+const (
+	FieldKeyword  = "keyword"
+	FieldInteger  = "integer"
+	FieldFloat    = "float"
+	FieldBool     = "bool"
+	FieldDatetime = "datetime"
+	FieldText     = "text"
+)
+
+// maxSchemaViolations is how many violations a rejected ingestion lists.
+const maxSchemaViolations = 5
+
+// PayloadSchema declares the payload fields of a collection's chunks.
+type PayloadSchema struct {
+	Fields []PayloadField `json:"fields"`
+}
+
+type PayloadField struct {
+	Name     string `json:"name"`     // Dotted for nested fields, e.g. "row.age"
+	Type     string `json:"type"`     // keyword, integer, float, bool, datetime or text; a list of values of the type is valid too
+	Indexed  bool   `json:"indexed"`  // Create a Qdrant payload index on the field, for fast filtering
+	Required bool   `json:"required"` // Reject documents without the field
+}
+
+func validatePayloadSchemas(cfg Config) error {
+	for collection, payload := range cfg.PayloadSchemas {
+		seen := map[string]bool{}
+		for _, field := range payload.Fields {
+			if strings.TrimSpace(field.Name) == "" {
+				return fmt.Errorf("payload_schemas.%s: fields need a name", collection)
+			}
+			if seen[field.Name] {
+				return fmt.Errorf("payload_schemas.%s: field %q is declared twice", collection, field.Name)
+			}
+			seen[field.Name] = true
+			switch field.Type {
+			case FieldKeyword, FieldInteger, FieldFloat, FieldBool, FieldDatetime, FieldText:
+			default:
+				return fmt.Errorf("payload_schemas.%s: unknown type %q of field %q", collection, field.Type, field.Name)
+			}
+		}
+	}
+	// Filters parsed from questions must be on fields of the right type
+	fields := activeSchemaFields(cfg)
+	for _, name := range cfg.Temporal.Fields {
+		if field, ok := fields[name]; ok && field.Type != FieldDatetime {
+			return fmt.Errorf("temporal.fields: %q is a %s field", name, field.Type)
+		}
+	}
+	for _, numeric := range cfg.Numeric.Fields {
+		if field, ok := fields[numeric.Field]; ok && field.Type != FieldInteger && field.Type != FieldFloat {
+			return fmt.Errorf("numeric.fields: %q is a %s field", numeric.Field, field.Type)
+		}
+	}
+	return nil
+}
+
+// activeSchemaFields returns the declared fields of the collection chunks
+// are stored in, by name.
+func activeSchemaFields(cfg Config) map[string]PayloadField {
+	fields := map[string]PayloadField{}
+	for _, field := range cfg.PayloadSchemas[cfg.Embedding.Collection].Fields {
+		fields[field.Name] = field
+	}
+	return fields
+}
+
+// enforcePayloadSchema checks docs against the schema of the collection they
+// are stored in, converting values written as strings, such as numbers read
+// from text, to the declared types. It fails listing the first violations
+// when any doc breaks the schema, so that a rejected ingestion stores
+// nothing.
+func enforcePayloadSchema(docs []schema.Document) error {
+	cfg := getConfig()
+	fields := cfg.PayloadSchemas[cfg.Embedding.Collection].Fields
+	if len(fields) == 0 {
+		return nil
+	}
+	var violations []string
+	count := 0
+	for i, doc := range docs {
+		for _, field := range fields {
+			value, ok := payloadValue(doc.Metadata, field.Name)
+			if !ok || value == nil {
+				if field.Required {
+					count++
+					violations = append(violations, fmt.Sprintf("document %d lacks %s", i, field.Name))
+				}
+				continue
+			}
+			typed, err := typedPayload(value, field.Type)
+			if err != nil {
+				count++
+				violations = append(violations, fmt.Sprintf("document %d: %s %v", i, field.Name, err))
+				continue
+			}
+			setPayloadValue(doc.Metadata, field.Name, typed)
+		}
+	}
+	if count == 0 {
+		return nil
+	}
+	if len(violations) > maxSchemaViolations {
+		violations = violations[:maxSchemaViolations]
+	}
+	return fmt.Errorf("%d values break the payload schema of %s: %s", count, cfg.Embedding.Collection, strings.Join(violations, "; "))
+}
+
+// validateFilterSchema checks the values of a chat filter on declared
+// fields against their types.
+func validateFilterSchema(filter map[string]any) error {
+	fields := activeSchemaFields(getConfig())
+	for key, value := range filter {
+		field, ok := fields[key]
+		if !ok {
+			continue
+		}
+		if _, err := typedPayload(value, field.Type); err != nil {
+			return fmt.Errorf("filter %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// typedPayload converts value, or each value of a list, to kind.
+func typedPayload(value any, kind string) (any, error) {
+	switch v := value.(type) {
+	case []any:
+		typed := make([]any, len(v))
+		for i, item := range v {
+			var err error
+			if typed[i], err = typedPayload(item, kind); err != nil {
+				return nil, err
+			}
+		}
+		return typed, nil
+	case []string:
+		typed := make([]any, len(v))
+		for i, item := range v {
+			var err error
+			if typed[i], err = typedPayload(item, kind); err != nil {
+				return nil, err
+			}
+		}
+		return typed, nil
+	}
+
+	text, isText := value.(string)
+	text = strings.TrimSpace(text)
+	switch kind {
+	case FieldKeyword, FieldText:
+		if isText {
+			return value, nil
+		}
+	case FieldInteger:
+		if f, ok := floatValue(value); ok && f == math.Trunc(f) {
+			return int64(f), nil
+		}
+		if i, err := strconv.ParseInt(text, 10, 64); isText && err == nil {
+			return i, nil
+		}
+	case FieldFloat:
+		if f, ok := floatValue(value); ok {
+			return f, nil
+		}
+		if f, err := strconv.ParseFloat(text, 64); isText && err == nil {
+			return f, nil
+		}
+	case FieldBool:
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+		if b, err := strconv.ParseBool(strings.ToLower(text)); isText && err == nil {
+			return b, nil
+		}
+	case FieldDatetime:
+		if t, ok := value.(time.Time); ok {
+			return t.UTC().Format(time.RFC3339), nil
+		}
+		if t, ok := parseDate(text); isText && ok {
+			return t.Format(time.RFC3339), nil
+		}
+	}
+	return nil, fmt.Errorf("%v is not a valid %s", value, kind)
+}
+
+// floatValue returns a number of any Go numeric type as a float64.
+func floatValue(value any) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// payloadValue returns the value at a dotted path of metadata.
+func payloadValue(metadata map[string]any, path string) (any, bool) {
+	var value any = metadata
+	for _, key := range strings.Split(path, ".") {
+		fields, ok := value.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if value, ok = fields[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// setPayloadValue replaces the value at a dotted path of metadata that
+// payloadValue found.
+func setPayloadValue(metadata map[string]any, path string, value any) {
+	keys := strings.Split(path, ".")
+	fields := metadata
+	for _, key := range keys[:len(keys)-1] {
+		fields = fields[key].(map[string]any)
+	}
+	fields[keys[len(keys)-1]] = value
+}
+
+// PayloadIndex is a payload index of a Qdrant collection.
+type PayloadIndex struct {
+	Type   string `json:"type"`
+	Points int    `json:"points"` // Holding the field
+}
+
+// payloadIndexes returns the payload indexes of a Qdrant collection by field.
+func payloadIndexes(ctx context.Context, collection string) (map[string]PayloadIndex, error) {
+	resp, err := qdrantDo(ctx, "GET", "/collections/"+collection, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read collection: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to read collection: unexpected status code %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	var info struct {
+		Result struct {
+			PayloadSchema map[string]struct {
+				DataType string `json:"data_type"`
+				Points   int    `json:"points"`
+			} `json:"payload_schema"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("failed to decode collection info: %v", err)
+	}
+	indexes := make(map[string]PayloadIndex, len(info.Result.PayloadSchema))
+	for field, index := range info.Result.PayloadSchema {
+		indexes[field] = PayloadIndex{Type: index.DataType, Points: index.Points}
+	}
+	return indexes, nil
+}
+
+// createPayloadIndex indexes a payload field of a Qdrant collection.
+func createPayloadIndex(ctx context.Context, collection, field, kind string) error {
+	resp, err := qdrantDo(ctx, "PUT", "/collections/"+collection+"/index?wait=true", map[string]any{"field_name": field, "field_schema": kind})
+	if err != nil {
+		return fmt.Errorf("failed to index %s: %v", field, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to index %s: unexpected status code %d, body: %s", field, resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// ensurePayloadIndexes creates the payload indexes the schema of a Qdrant
+// collection declares and it lacks.
+func ensurePayloadIndexes(ctx context.Context, collection string) error {
+	var wanted []PayloadField
+	for _, field := range getConfig().PayloadSchemas[collection].Fields {
+		if field.Indexed {
+			wanted = append(wanted, field)
+		}
+	}
+	if len(wanted) == 0 {
+		return nil
+	}
+	indexes, err := payloadIndexes(ctx, collection)
+	if err != nil {
+		return err
+	}
+	for _, field := range wanted {
+		if _, ok := indexes[field.Name]; ok {
+			continue
+		}
+		if err := createPayloadIndex(ctx, collection, field.Name, field.Type); err != nil {
+			return err
+		}
+		log.Printf("Created %s payload index on %s of collection %s", field.Type, field.Name, collection)
+	}
+	return nil
+}
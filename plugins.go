@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+	"github.com/tmc/langchaingo/schema"
+)
+
+const defaultProcessorTimeout = 60
+
+// ProcessorConfig declares an external document processor: a command or a
+// WASI module that reads a ProcessorInput as JSON on stdin and writes a
+// ProcessorOutput as JSON to stdout.
+type ProcessorConfig struct {
+	Name       string   `json:"name"`
+	Command    []string `json:"command"`    // Executable and arguments
+	WASM       string   `json:"wasm"`       // Path to a WASI module, instead of command
+	Extensions []string `json:"extensions"` // File extensions handled, e.g. [".hl7"]
+	Timeout    int      `json:"timeout"`    // Seconds, default 60
+}
+
+type ProcessorInput struct {
+	Filename string `json:"filename"`
+	Content  []byte `json:"content"` // Base64 in JSON
+}
+
+type ProcessorOutput struct {
+	Documents []struct {
+		Content  string         `json:"content"`
+		Metadata map[string]any `json:"metadata"`
+	} `json:"documents"`
+	Error string `json:"error"`
+}
+
+func validateProcessors(processors []ProcessorConfig) error {
+	names := map[string]bool{}
+	for _, p := range processors {
+		if p.Name == "" {
+			return fmt.Errorf("processor name must not be empty")
+		}
+		if names[p.Name] {
+			return fmt.Errorf("duplicate processor %q", p.Name)
+		}
+		names[p.Name] = true
+		if (len(p.Command) == 0) == (p.WASM == "") {
+			return fmt.Errorf("processor %s needs exactly one of command or wasm", p.Name)
+		}
+	}
+	return nil
+}
+
+// findProcessor returns the processor named by the request, or the first one
+// handling the file's extension.
+func findProcessor(name, path string) (ProcessorConfig, bool, error) {
+	processors := getConfig().Processors
+	if name != "" {
+		for _, p := range processors {
+			if p.Name == name {
+				return p, true, nil
+			}
+		}
+		return ProcessorConfig{}, false, fmt.Errorf("unknown processor %q", name)
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, p := range processors {
+		for _, e := range p.Extensions {
+			if strings.ToLower(e) == ext {
+				return p, true, nil
+			}
+		}
+	}
+	return ProcessorConfig{}, false, nil
+}
+
+func loadWithProcessor(ctx context.Context, processor ProcessorConfig, path string) ([]schema.Document, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	input, err := json.Marshal(ProcessorInput{Filename: filepath.Base(path), Content: content})
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := processor.Timeout
+	if timeout <= 0 {
+		timeout = defaultProcessorTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	if processor.WASM != "" {
+		err = runWASMProcessor(ctx, processor, input, &stdout, &stderr)
+	} else {
+		cmd := exec.CommandContext(ctx, processor.Command[0], processor.Command[1:]...)
+		cmd.Stdin = bytes.NewReader(input)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		err = cmd.Run()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("processor %s failed: %v: %s", processor.Name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var output ProcessorOutput
+	if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+		return nil, fmt.Errorf("processor %s returned invalid JSON: %v", processor.Name, err)
+	}
+	if output.Error != "" {
+		return nil, fmt.Errorf("processor %s: %s", processor.Name, output.Error)
+	}
+
+	docs := make([]schema.Document, 0, len(output.Documents))
+	for _, d := range output.Documents {
+		metadata := map[string]any{}
+		for k, v := range d.Metadata {
+			metadata[k] = v
+		}
+		metadata["source"] = path
+		metadata["processor"] = processor.Name
+		docs = append(docs, schema.Document{PageContent: d.Content, Metadata: metadata})
+	}
+	return docs, nil
+}
+
+// runWASMProcessor runs a WASI module's _start with input on stdin. The
+// module gets no filesystem or network access.
+func runWASMProcessor(ctx context.Context, processor ProcessorConfig, input []byte, stdout, stderr *bytes.Buffer) error {
+	module, err := os.ReadFile(processor.WASM)
+	if err != nil {
+		return err
+	}
+
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	defer runtime.Close(ctx)
+	wasi_snapshot_preview1.MustInstantiate(ctx, runtime)
+
+	moduleConfig := wazero.NewModuleConfig().
+		WithName(processor.Name).
+		WithArgs(processor.Name).
+		WithStdin(bytes.NewReader(input)).
+		WithStdout(stdout).
+		WithStderr(stderr)
+
+	_, err = runtime.InstantiateWithConfig(ctx, module, moduleConfig)
+	var exitErr *sys.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 0 {
+		return nil
+	}
+	return err
+}
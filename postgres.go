@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+const postgresBatchSize = 100
+
+type PostgresConfig struct {
+	Enabled         bool            `json:"enabled"`          // Follow the tables' changes on startup
+	DSN             string          `json:"dsn"`              // $VAR and ${VAR} are expanded from the environment
+	Channel         string          `json:"channel"`          // NOTIFY channel the triggers publish row changes on
+	InstallTriggers bool            `json:"install_triggers"` // Create the notify triggers on startup; needs the privilege to
+	Tables          []PostgresTable `json:"tables"`
+}
+
+type PostgresTable struct {
+	Name     string   `json:"name"`              // Table name, optionally schema-qualified; defaults to the public schema
+	Key      string   `json:"key"`               // Primary key column; default "id"
+	Template string   `json:"template"`          // Go template over the row's columns rendering its text
+	Title    string   `json:"title,omitempty"`   // Go template rendering its title
+	Columns  []string `json:"columns,omitempty"` // Columns copied to the chunk metadata
+	Dataset  string   `json:"dataset,omitempty"`
+	Tenant   string   `json:"tenant,omitempty"`
+}
+
+// postgresChange is the NOTIFY payload of the triggers. Only the key is sent
+// since payloads are limited to 8000 bytes; the row is read back.
+type postgresChange struct {
+	Table string `json:"table"`
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+}
+
+type postgresSource struct {
+	table    PostgresTable
+	text     *template.Template
+	title    *template.Template
+	document string // Prefix of the documents of the rows
+}
+
+// postgresTriggerFunction publishes the table, operation and key of changed
+// rows; its arguments are the channel and the key column.
+const postgresTriggerFunction = `CREATE OR REPLACE FUNCTION rag_notify_change() RETURNS trigger AS $$
+DECLARE
+	changed record;
+BEGIN
+	IF TG_OP = 'DELETE' THEN changed := OLD; ELSE changed := NEW; END IF;
+	PERFORM pg_notify(TG_ARGV[0], json_build_object(
+		'table', TG_TABLE_SCHEMA || '.' || TG_TABLE_NAME,
+		'op', TG_OP,
+		'key', to_jsonb(changed) ->> TG_ARGV[1])::text);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql`
+
+func validatePostgres(cfg PostgresConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.DSN == "" || cfg.Channel == "" {
+		return fmt.Errorf("postgres.dsn and postgres.channel are required")
+	}
+	if len(cfg.Tables) == 0 {
+		return fmt.Errorf("postgres.tables is empty")
+	}
+	_, err := postgresSources(cfg.Tables)
+	return err
+}
+
+// postgresSources parses the tables' templates, keyed by schema-qualified
+// table name.
+func postgresSources(tables []PostgresTable) (map[string]postgresSource, error) {
+	sources := map[string]postgresSource{}
+	for _, table := range tables {
+		if table.Name == "" || table.Template == "" {
+			return nil, fmt.Errorf("postgres tables need a name and a template")
+		}
+		if !strings.Contains(table.Name, ".") {
+			table.Name = "public." + table.Name
+		}
+		if table.Key == "" {
+			table.Key = "id"
+		}
+		text, err := template.New(table.Name).Parse(table.Template)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for %s: %v", table.Name, err)
+		}
+		title, err := template.New(table.Name).Parse(table.Title)
+		if err != nil {
+			return nil, fmt.Errorf("invalid title for %s: %v", table.Name, err)
+		}
+		sources[table.Name] = postgresSource{table: table, text: text, title: title, document: "postgres:" + table.Name + ":"}
+	}
+	return sources, nil
+}
+
+func openPostgres(cfg PostgresConfig) (*sql.DB, error) {
+	db, err := sql.Open("postgres", os.ExpandEnv(cfg.DSN))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open postgres: %v", err)
+	}
+	return db, nil
+}
+
+// followPostgres installs the triggers if asked to, syncs every table and
+// then applies the changes the triggers announce. Changes missed while the
+// connection was down are caught up by syncing again after it reconnects.
+func followPostgres(ctx context.Context, cfg PostgresConfig) {
+	sources, _ := postgresSources(cfg.Tables)
+	job := jobRegistry.create("postgres:" + cfg.Channel)
+	jobRegistry.update(job.ID, func(job *Job) {
+		job.Status = JobRunning
+	})
+	fail := func(err error) {
+		log.Printf("Postgres change listener failed: %v", err)
+		jobRegistry.update(job.ID, func(job *Job) {
+			job.Status = JobFailed
+			job.Errors = append(job.Errors, err.Error())
+		})
+	}
+
+	db, err := openPostgres(cfg)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer db.Close()
+	if cfg.InstallTriggers {
+		if err := installPostgresTriggers(ctx, db, cfg.Channel, sources); err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	listener := pq.NewListener(os.ExpandEnv(cfg.DSN), time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Postgres listener: %v", err)
+		}
+	})
+	defer listener.Close()
+	if err := listener.Listen(cfg.Channel); err != nil {
+		fail(fmt.Errorf("failed to listen on %s: %v", cfg.Channel, err))
+		return
+	}
+	log.Printf("Following changes of %d postgres tables on %s (job %s)", len(sources), cfg.Channel, job.ID)
+	startPostgresSync(cfg, sources, nil)
+
+	for {
+		var notification *pq.Notification
+		select {
+		case notification = <-listener.Notify:
+		case <-ctx.Done():
+			log.Printf("Stopped following postgres changes on %s", cfg.Channel)
+			jobRegistry.update(job.ID, func(job *Job) {
+				job.Status = JobCompleted
+			})
+			return
+		}
+		// A nil notification means the connection was re-established
+		if notification == nil {
+			startPostgresSync(cfg, sources, nil)
+			continue
+		}
+		changes := []*pq.Notification{notification}
+	drain:
+		for len(changes) < postgresBatchSize {
+			select {
+			case next := <-listener.Notify:
+				if next == nil {
+					startPostgresSync(cfg, sources, nil)
+					break drain
+				}
+				changes = append(changes, next)
+			default:
+				break drain
+			}
+		}
+
+		var events []StreamEvent
+		for _, change := range changes {
+			event, err := postgresEvent(ctx, db, sources, change.Extra)
+			if err != nil {
+				jobRegistry.update(job.ID, func(job *Job) {
+					job.recordError(err.Error())
+				})
+				continue
+			}
+			events = append(events, event)
+		}
+		if err := applyStreamEvents(ctx, job.ID, events); err != nil {
+			log.Printf("Applying %d postgres changes failed: %v", len(events), err)
+			jobRegistry.update(job.ID, func(job *Job) {
+				job.recordError(err.Error())
+			})
+		}
+	}
+}
+
+func installPostgresTriggers(ctx context.Context, db *sql.DB, channel string, sources map[string]postgresSource) error {
+	if _, err := db.ExecContext(ctx, postgresTriggerFunction); err != nil {
+		return fmt.Errorf("failed to create the trigger function: %v", err)
+	}
+	for name, source := range sources {
+		table := quoteTable(name)
+		statements := []string{
+			fmt.Sprintf(`DROP TRIGGER IF EXISTS rag_notify_change ON %s`, table),
+			fmt.Sprintf(`CREATE TRIGGER rag_notify_change AFTER INSERT OR UPDATE OR DELETE ON %s FOR EACH ROW EXECUTE PROCEDURE rag_notify_change(%s, %s)`,
+				table, pq.QuoteLiteral(channel), pq.QuoteLiteral(source.table.Key)),
+		}
+		for _, statement := range statements {
+			if _, err := db.ExecContext(ctx, statement); err != nil {
+				return fmt.Errorf("failed to create the trigger on %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// postgresEvent turns a NOTIFY payload into the event that applies it.
+func postgresEvent(ctx context.Context, db *sql.DB, sources map[string]postgresSource, payload string) (StreamEvent, error) {
+	var change postgresChange
+	if err := json.Unmarshal([]byte(payload), &change); err != nil {
+		return StreamEvent{}, fmt.Errorf("malformed change %q: %v", payload, err)
+	}
+	source, ok := sources[change.Table]
+	if !ok {
+		return StreamEvent{}, fmt.Errorf("change to unconfigured table %s", change.Table)
+	}
+	document := source.document + change.Key
+	if change.Op == "DELETE" {
+		return StreamEvent{Op: StreamDelete, Document: document}, nil
+	}
+
+	var data []byte
+	err := db.QueryRowContext(ctx, fmt.Sprintf(`SELECT row_to_json(t)::text FROM %s t WHERE %s::text = $1`,
+		quoteTable(change.Table), pq.QuoteIdentifier(source.table.Key)), change.Key).Scan(&data)
+	if err == sql.ErrNoRows {
+		// Deleted again before it was read
+		return StreamEvent{Op: StreamDelete, Document: document}, nil
+	}
+	if err != nil {
+		return StreamEvent{}, fmt.Errorf("failed to read %s %s: %v", change.Table, change.Key, err)
+	}
+	row, err := decodePostgresRow(data)
+	if err != nil {
+		return StreamEvent{}, err
+	}
+	return source.event(row)
+}
+
+// event renders a row as an upsert of its document. The "row_hash" of the
+// rendered text lets a sync skip rows that did not change.
+func (s postgresSource) event(row map[string]any) (StreamEvent, error) {
+	key := fmt.Sprint(row[s.table.Key])
+	var text, title bytes.Buffer
+	if err := s.text.Execute(&text, row); err != nil {
+		return StreamEvent{}, fmt.Errorf("failed to render %s %s: %v", s.table.Name, key, err)
+	}
+	if err := s.title.Execute(&title, row); err != nil {
+		return StreamEvent{}, fmt.Errorf("failed to render the title of %s %s: %v", s.table.Name, key, err)
+	}
+
+	sum := sha256.Sum256([]byte(title.String() + "\x00" + text.String()))
+	metadata := map[string]any{
+		"pg_table": s.table.Name,
+		"pg_key":   key,
+		"row_hash": hex.EncodeToString(sum[:]),
+	}
+	for _, column := range s.table.Columns {
+		if value, ok := row[column]; ok && value != nil {
+			metadata[column] = jsonScalar(value)
+		}
+	}
+	return StreamEvent{
+		Op:       StreamUpsert,
+		Document: s.document + key,
+		Title:    strings.TrimSpace(title.String()),
+		Content:  text.String(),
+		Metadata: metadata,
+		Dataset:  s.table.Dataset,
+		Tenant:   s.table.Tenant,
+	}, nil
+}
+
+func decodePostgresRow(data []byte) (map[string]any, error) {
+	var row map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&row); err != nil {
+		return nil, fmt.Errorf("failed to decode row: %v", err)
+	}
+	return row, nil
+}
+
+// syncPostgres syncs the configured tables, or the one in the request body,
+// as a background job.
+func syncPostgres(c *gin.Context) {
+	var req struct {
+		Table string `json:"table"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && c.Request.ContentLength > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	cfg := getConfig().Postgres
+	if !cfg.Enabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Postgres ingestion is not enabled"})
+		return
+	}
+	sources, _ := postgresSources(cfg.Tables)
+	var only []string
+	if req.Table != "" {
+		name := req.Table
+		if !strings.Contains(name, ".") {
+			name = "public." + name
+		}
+		if _, ok := sources[name]; !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Table %s is not configured", req.Table)})
+			return
+		}
+		only = []string{name}
+	}
+	c.JSON(http.StatusAccepted, startPostgresSync(cfg, sources, only))
+}
+
+func startPostgresSync(cfg PostgresConfig, sources map[string]postgresSource, only []string) Job {
+	if only == nil {
+		for name := range sources {
+			only = append(only, name)
+		}
+	}
+	job := jobRegistry.create("postgres-sync")
+	go runJob(job.ID, func(ctx context.Context) error {
+		db, err := openPostgres(cfg)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		for _, name := range only {
+			if err := syncPostgresTable(ctx, job.ID, db, sources[name]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return job
+}
+
+// syncPostgresTable ingests the table's rows whose rendered text is not in
+// the store yet and deletes the documents of rows that no longer exist.
+// Backends without document maintenance ingest every row again.
+func syncPostgresTable(ctx context.Context, jobID string, db *sql.DB, source postgresSource) error {
+	name := source.table.Name
+	known, deleted := map[string]bool{}, map[string]bool{}
+	var keys []any
+	if supportsMaintenance(getConfig().VectorStore.Backend) {
+		embedder, err := newEmbedder()
+		if err != nil {
+			return err
+		}
+		if err := prepareStore(ctx, embedder, source.table.Tenant); err != nil {
+			return err
+		}
+		store, err := managedStore()
+		if err != nil {
+			return err
+		}
+		hashes, err := store.Values(ctx, map[string]any{"pg_table": name, "latest": true}, "row_hash")
+		if err != nil {
+			return err
+		}
+		deletedHashes, err := store.Values(ctx, map[string]any{"pg_table": name, "deleted": true}, "row_hash")
+		if err != nil {
+			return err
+		}
+		for _, hash := range hashes {
+			known[fmt.Sprint(hash)] = true
+		}
+		for _, hash := range deletedHashes {
+			delete(known, fmt.Sprint(hash))
+		}
+		if keys, err = store.Values(ctx, map[string]any{"pg_table": name}, "pg_key"); err != nil {
+			return err
+		}
+		deletedKeys, err := store.Values(ctx, map[string]any{"pg_table": name, "deleted": true}, "pg_key")
+		if err != nil {
+			return err
+		}
+		for _, key := range deletedKeys {
+			deleted[fmt.Sprint(key)] = true
+		}
+	}
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`SELECT row_to_json(t)::text FROM %s t`, quoteTable(name)))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	defer rows.Close()
+
+	present := map[string]bool{}
+	var events []StreamEvent
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return err
+		}
+		row, err := decodePostgresRow(data)
+		if err != nil {
+			return err
+		}
+		event, err := source.event(row)
+		if err != nil {
+			jobRegistry.update(jobID, func(job *Job) {
+				job.recordError(err.Error())
+			})
+			continue
+		}
+		present[fmt.Sprint(event.Metadata["pg_key"])] = true
+		if known[fmt.Sprint(event.Metadata["row_hash"])] {
+			continue
+		}
+		if events = append(events, event); len(events) == postgresBatchSize {
+			if err := applyStreamEvents(ctx, jobID, events); err != nil {
+				return err
+			}
+			events = nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if k := fmt.Sprint(key); !present[k] && !deleted[k] {
+			events = append(events, StreamEvent{Op: StreamDelete, Document: source.document + k})
+		}
+	}
+	return applyStreamEvents(ctx, jobID, events)
+}
+
+// quoteTable quotes a schema-qualified table name.
+func quoteTable(name string) string {
+	parts := strings.SplitN(name, ".", 2)
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+	return strings.Join(parts, ".")
+}
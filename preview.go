@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tmc/langchaingo/schema"
+)
+
+const (
+	defaultPreviewChunks = 20
+	maxPreviewChunks     = 200
+)
+
+type PreviewResponse struct {
+	Document     string         `json:"document"`
+	Chunking     string         `json:"chunking"`
+	ChunkSize    int            `json:"chunk_size"`
+	ChunkOverlap int            `json:"chunk_overlap"`
+	Total        int            `json:"total"`               // Chunks the file would be stored as, without synthetic questions
+	Sizes        PreviewSizes   `json:"sizes"`               // Of all chunks, in bytes
+	Chunks       []PreviewChunk `json:"chunks"`              // The first ?limit= chunks, enriched
+	Questions    []PreviewChunk `json:"questions,omitempty"` // Synthetic questions generated for those chunks
+	Warnings     []string       `json:"warnings,omitempty"`
+	Errors       []string       `json:"errors,omitempty"` // Enrichment and question generation failures
+}
+
+type PreviewSizes struct {
+	Min     int `json:"min"`
+	Max     int `json:"max"`
+	Average int `json:"average"`
+}
+
+type PreviewChunk struct {
+	Content  string         `json:"content"`
+	Metadata map[string]any `json:"metadata"`
+}
+
+// previewDocuments parses, chunks and enriches a file like POST /documents
+// but embeds and stores nothing, returning the chunks that would be created
+// so chunking settings can be tuned first. Only the first ?limit= chunks
+// (default 20) are enriched and returned; uploads are removed afterwards.
+func previewDocuments(c *gin.Context) {
+	limit := defaultPreviewChunks
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxPreviewChunks {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxPreviewChunks)})
+			return
+		}
+		limit = n
+	}
+
+	req, uploaded, ok := bindIngestRequest(c)
+	if uploaded {
+		defer os.Remove(req.Path)
+	}
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	docs, err := loadDocuments(ctx, req)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": fmt.Sprintf("failed to read %s: %v", req.Path, err)})
+		return
+	}
+
+	response := PreviewResponse{
+		Document:     req.Document,
+		Chunking:     req.Chunking,
+		ChunkSize:    req.ChunkSize,
+		ChunkOverlap: req.ChunkOverlap,
+		Total:        len(docs),
+		Sizes:        chunkSizes(docs),
+		Warnings:     lowConfidenceWarnings(docs),
+	}
+
+	shown := docs[:min(limit, len(docs))]
+	for i := range shown {
+		if shown[i].Metadata == nil {
+			shown[i].Metadata = map[string]any{}
+		}
+		if _, ok := shown[i].Metadata["document"]; !ok {
+			shown[i].Metadata["document"] = req.Document
+		}
+		if req.Dataset != "" {
+			shown[i].Metadata["dataset"] = req.Dataset
+		}
+	}
+
+	llm, err := newLLM()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	extractors, err := newExtractors(req.Enrich, llm)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	errs := enrichDocuments(ctx, shown, extractors)
+	if *req.Questions > 0 {
+		questions, questionErrs := generateQuestionDocuments(ctx, llm, shown, *req.Questions)
+		errs = append(errs, questionErrs...)
+		response.Questions = previewChunks(questions)
+	}
+	for _, err := range errs {
+		response.Errors = append(response.Errors, err.Error())
+	}
+
+	response.Chunks = previewChunks(shown)
+	c.JSON(http.StatusOK, response)
+}
+
+func previewChunks(docs []schema.Document) []PreviewChunk {
+	chunks := make([]PreviewChunk, len(docs))
+	for i, doc := range docs {
+		chunks[i] = PreviewChunk{Content: doc.PageContent, Metadata: doc.Metadata}
+	}
+	return chunks
+}
+
+func chunkSizes(docs []schema.Document) PreviewSizes {
+	if len(docs) == 0 {
+		return PreviewSizes{}
+	}
+	sizes := PreviewSizes{Min: len(docs[0].PageContent)}
+	total := 0
+	for _, doc := range docs {
+		size := len(doc.PageContent)
+		sizes.Min = min(sizes.Min, size)
+		sizes.Max = max(sizes.Max, size)
+		total += size
+	}
+	sizes.Average = total / len(docs)
+	return sizes
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// runtimeStatsKept is how many samples GET /metrics/runtime returns.
+const runtimeStatsKept = 120
+
+type AdminConfig struct {
+	Token                string `json:"token"`                  // Bearer token for the admin endpoints, with environment variables expanded
+	Pprof                bool   `json:"pprof"`                  // Serve net/http/pprof under /debug/pprof/, behind the token
+	StatsIntervalSeconds int    `json:"stats_interval_seconds"` // Sample memory and goroutine stats this often; 0 disables
+	Reload               bool   `json:"reload"`                 // Serve POST /admin/reload, behind the token
+	WatchConfigSeconds   int    `json:"watch_config_seconds"`   // Reload the config file when it changes, checked this often; 0 disables
+	Dashboard            bool   `json:"dashboard"`              // Serve GET /admin/stats, behind the token
+}
+
+func validateAdmin(cfg AdminConfig) error {
+	if cfg.Pprof && cfg.Token == "" {
+		return fmt.Errorf("admin.token is required to serve pprof")
+	}
+	if cfg.Reload && cfg.Token == "" {
+		return fmt.Errorf("admin.token is required to serve reloads")
+	}
+	if cfg.Dashboard && cfg.Token == "" {
+		return fmt.Errorf("admin.token is required to serve the dashboard")
+	}
+	if cfg.StatsIntervalSeconds < 0 || cfg.WatchConfigSeconds < 0 {
+		return fmt.Errorf("admin intervals must not be negative")
+	}
+	return nil
+}
+
+// requireAdmin rejects requests without the admin bearer token.
+func requireAdmin(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isAdmin(c, token) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Admin token required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// isAdmin reports whether a request carries the admin bearer token; none
+// does when no token is configured.
+func isAdmin(c *gin.Context, token string) bool {
+	expected := []byte("Bearer " + os.ExpandEnv(token))
+	return token != "" && subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), expected) == 1
+}
+
+// servePprof serves the net/http/pprof handlers: the index, the CPU
+// profile, the execution trace and the named profiles (heap, goroutine,
+// mutex, ...).
+func servePprof(c *gin.Context) {
+	name := strings.TrimPrefix(c.Param("name"), "/")
+	switch name {
+	case "":
+		pprof.Index(c.Writer, c.Request)
+	case "cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		pprof.Handler(name).ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// RuntimeStats is a sample of the process's memory and goroutines.
+type RuntimeStats struct {
+	Time         time.Time `json:"time"`
+	Goroutines   int       `json:"goroutines"`
+	HeapAlloc    uint64    `json:"heap_alloc_bytes"`  // Live heap objects
+	HeapInuse    uint64    `json:"heap_inuse_bytes"`  // Heap spans in use
+	Sys          uint64    `json:"sys_bytes"`         // Memory obtained from the OS
+	NumGC        uint32    `json:"gc_cycles"`         // Since startup
+	GCPauseTotal float64   `json:"gc_pause_total_ms"` // Since startup
+}
+
+// RuntimeStatsRecorder keeps the most recent samples.
+type RuntimeStatsRecorder struct {
+	Samples []RuntimeStats
+	mu      sync.Mutex
+}
+
+var runtimeStats RuntimeStatsRecorder
+
+func (r *RuntimeStatsRecorder) sample() {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := RuntimeStats{
+		Time:         time.Now(),
+		Goroutines:   runtime.NumGoroutine(),
+		HeapAlloc:    mem.HeapAlloc,
+		HeapInuse:    mem.HeapInuse,
+		Sys:          mem.Sys,
+		NumGC:        mem.NumGC,
+		GCPauseTotal: float64(mem.PauseTotalNs) / 1e6,
+	}
+
+	r.mu.Lock()
+	r.Samples = append(r.Samples, stats)
+	if len(r.Samples) > runtimeStatsKept {
+		r.Samples = r.Samples[len(r.Samples)-runtimeStatsKept:]
+	}
+	r.mu.Unlock()
+}
+
+// recordRuntimeStats samples the runtime stats every interval.
+func recordRuntimeStats(interval time.Duration) {
+	runtimeStats.sample()
+	for range time.Tick(interval) {
+		runtimeStats.sample()
+	}
+}
+
+// getRuntimeStats returns the recent samples of this replica, oldest first.
+func getRuntimeStats(c *gin.Context) {
+	runtimeStats.mu.Lock()
+	samples := append([]RuntimeStats(nil), runtimeStats.Samples...)
+	runtimeStats.mu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"samples": samples})
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// Question types, classified from the wording of a question to pick the
+// few-shot examples shown with it.
+const (
+	QuestionComparison = "comparison" // "X vs Y", "difference between"
+	QuestionProcedure  = "procedure"  // "How do I...", "steps to"
+	QuestionList       = "list"       // "List...", "Which...", "What are..."
+	QuestionDefinition = "definition" // "What is...", "Define..."
+	QuestionFactual    = "factual"    // Anything else
+)
+
+var (
+	comparisonPattern = regexp.MustCompile(`\b(vs\.?|versus|compared? (to|with)|comparison|difference between|differ)\b`)
+	procedurePattern  = regexp.MustCompile(`^(how (do|can|should|would) (i|we|you)|how to|what are the steps|steps (to|for))\b`)
+	listPattern       = regexp.MustCompile(`^(list|which|what are|name (all|the))\b`)
+	definitionPattern = regexp.MustCompile(`^(what is|what's|what does .+ mean|define|meaning of)\b`)
+)
+
+// dateVariable is filled in by the server with the current date.
+const dateVariable = "date"
+
+var variablePattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+var questionTypes = []string{QuestionComparison, QuestionProcedure, QuestionList, QuestionDefinition, QuestionFactual}
+
+type PromptsConfig struct {
+	ExampleSets     []ExampleSet `json:"example_sets"`     // Named few-shot examples prompt templates can include
+	DefaultExamples []string     `json:"default_examples"` // Example sets of the built-in templates
+	MaxExamples     int          `json:"max_examples"`     // Examples added to a prompt at most; 0 leaves them out
+
+	Variables         []string `json:"variables"`           // Template variables chat requests may set, e.g. "user_name"
+	MaxVariableLength int      `json:"max_variable_length"` // Longest value a request may give a variable
+
+	CurrentTime bool   `json:"current_time"` // Tell the model the current date, time and timezone in the system message
+	Timezone    string `json:"timezone"`     // IANA name used for the current time and {date}; the server's local time when empty
+}
+
+// ExampleSet is a named group of few-shot examples, added to the prompts of
+// templates that include it when the question matches.
+type ExampleSet struct {
+	Name          string    `json:"name"`
+	QuestionTypes []string  `json:"question_types,omitempty"` // Question types the set applies to
+	Patterns      []string  `json:"patterns,omitempty"`       // Regular expressions; the set also applies to questions matching one
+	Examples      []Example `json:"examples"`
+}
+
+type Example struct {
+	Question string `json:"question"`
+	Answer   string `json:"answer"`
+}
+
+// PromptRegistry holds the configured example sets.
+type PromptRegistry struct {
+	Sets     map[string]ExampleSet
+	Patterns map[string][]*regexp.Regexp // Compiled patterns by set name
+	mu       sync.RWMutex
+}
+
+var promptRegistry = PromptRegistry{}
+
+func validatePrompts(cfg Config) error {
+	sets := map[string]bool{}
+	for _, set := range cfg.Prompts.ExampleSets {
+		if set.Name == "" {
+			return fmt.Errorf("example sets need a name")
+		}
+		if sets[set.Name] {
+			return fmt.Errorf("example set %q is listed twice", set.Name)
+		}
+		sets[set.Name] = true
+		if len(set.QuestionTypes) == 0 && len(set.Patterns) == 0 {
+			return fmt.Errorf("example set %s needs question_types or patterns", set.Name)
+		}
+		for _, questionType := range set.QuestionTypes {
+			if !slices.Contains(questionTypes, questionType) {
+				return fmt.Errorf("example set %s: unknown question type %q", set.Name, questionType)
+			}
+		}
+		for _, pattern := range set.Patterns {
+			if _, err := regexp.Compile(pattern); err != nil {
+				return fmt.Errorf("example set %s: invalid pattern %q: %v", set.Name, pattern, err)
+			}
+		}
+		if len(set.Examples) == 0 {
+			return fmt.Errorf("example set %s has no examples", set.Name)
+		}
+		for _, example := range set.Examples {
+			if example.Question == "" || example.Answer == "" {
+				return fmt.Errorf("example set %s: examples need a question and an answer", set.Name)
+			}
+		}
+	}
+	if cfg.Prompts.MaxExamples < 0 {
+		return fmt.Errorf("prompts.max_examples must not be negative")
+	}
+	for _, name := range cfg.Prompts.Variables {
+		if !variablePattern.MatchString(name) {
+			return fmt.Errorf("invalid template variable name %q", name)
+		}
+		if name == dateVariable {
+			return fmt.Errorf("template variable %q is set by the server", name)
+		}
+	}
+	if cfg.Prompts.MaxVariableLength < 1 {
+		return fmt.Errorf("prompts.max_variable_length must be at least 1")
+	}
+	if _, err := time.LoadLocation(cfg.Prompts.Timezone); err != nil {
+		return fmt.Errorf("invalid prompts.timezone: %v", err)
+	}
+
+	// Every template may only include configured sets
+	included := map[string][]string{"prompts.default_examples": cfg.Prompts.DefaultExamples}
+	for lang, template := range cfg.Multilingual.Templates {
+		included["multilingual.templates."+lang] = template.Examples
+	}
+	for _, variant := range cfg.Experiments.Variants {
+		if variant.Prompt != nil {
+			included["variant "+variant.Name] = variant.Prompt.Examples
+		}
+	}
+	for where, names := range included {
+		for _, name := range names {
+			if !sets[name] {
+				return fmt.Errorf("%s: unknown example set %q", where, name)
+			}
+		}
+	}
+	return nil
+}
+
+// setConfiguredPrompts replaces the example sets with those of the config.
+func setConfiguredPrompts(cfg PromptsConfig) {
+	sets := make(map[string]ExampleSet, len(cfg.ExampleSets))
+	patterns := make(map[string][]*regexp.Regexp, len(cfg.ExampleSets))
+	for _, set := range cfg.ExampleSets {
+		sets[set.Name] = set
+		for _, pattern := range set.Patterns {
+			patterns[set.Name] = append(patterns[set.Name], regexp.MustCompile(pattern))
+		}
+	}
+	promptRegistry.mu.Lock()
+	promptRegistry.Sets = sets
+	promptRegistry.Patterns = patterns
+	promptRegistry.mu.Unlock()
+}
+
+// classifyQuestion returns the type of a question.
+func classifyQuestion(text string) string {
+	normalized := strings.ToLower(strings.TrimSpace(text))
+	switch {
+	case comparisonPattern.MatchString(normalized):
+		return QuestionComparison
+	case procedurePattern.MatchString(normalized):
+		return QuestionProcedure
+	case listPattern.MatchString(normalized):
+		return QuestionList
+	case definitionPattern.MatchString(normalized):
+		return QuestionDefinition
+	}
+	return QuestionFactual
+}
+
+// examples returns the examples of the named sets that apply to question,
+// in the order the sets are named, up to prompts.max_examples.
+func (r *PromptRegistry) examples(names []string, question string) []Example {
+	if len(names) == 0 {
+		return nil
+	}
+	limit := getConfig().Prompts.MaxExamples
+	questionType := classifyQuestion(question)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var examples []Example
+	for _, name := range names {
+		set, ok := r.Sets[name]
+		if !ok || !r.applies(set, questionType, question) {
+			continue
+		}
+		for _, example := range set.Examples {
+			if len(examples) == limit {
+				return examples
+			}
+			examples = append(examples, example)
+		}
+	}
+	return examples
+}
+
+func (r *PromptRegistry) applies(set ExampleSet, questionType, question string) bool {
+	if slices.Contains(set.QuestionTypes, questionType) {
+		return true
+	}
+	for _, pattern := range r.Patterns[set.Name] {
+		if pattern.MatchString(question) {
+			return true
+		}
+	}
+	return false
+}
+
+// exampleMessages renders examples as the user and assistant turns of a
+// prompt.
+func exampleMessages(examples []Example) []llms.MessageContent {
+	messages := make([]llms.MessageContent, 0, 2*len(examples))
+	for _, example := range examples {
+		messages = append(messages,
+			llms.TextParts(llms.ChatMessageTypeHuman, example.Question),
+			llms.TextParts(llms.ChatMessageTypeAI, example.Answer))
+	}
+	return messages
+}
+
+// validateVariables checks that a chat request only sets allowed template
+// variables, to single-line values of bounded length.
+func validateVariables(values map[string]string) error {
+	cfg := getConfig().Prompts
+	for name, value := range values {
+		if !slices.Contains(cfg.Variables, name) {
+			return fmt.Errorf("unknown template variable %q", name)
+		}
+		if utf8.RuneCountInString(value) > cfg.MaxVariableLength {
+			return fmt.Errorf("template variable %s is longer than %d characters", name, cfg.MaxVariableLength)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("template variable %s must be a single line", name)
+		}
+	}
+	return nil
+}
+
+// render fills the {name} placeholders of the system message and the query
+// format with a request's variables and the server's {date}, and tells the
+// model the current time, the pinned facts and its earlier answer to a
+// repeated question. Allowed variables the request leaves out render
+// empty; other braces are left as they are.
+func (t PromptTemplate) render(msg Message) PromptTemplate {
+	cfg := getConfig().Prompts
+	now := currentTime(cfg.Timezone)
+
+	pairs := make([]string, 0, 2*len(cfg.Variables)+2)
+	pairs = append(pairs, "{"+dateVariable+"}", now.Format(time.DateOnly))
+	for _, name := range cfg.Variables {
+		pairs = append(pairs, "{"+name+"}", msg.Variables[name])
+	}
+	replacer := strings.NewReplacer(pairs...)
+	t.SystemMessage = replacer.Replace(t.SystemMessage)
+	t.UserQueryFormat = replacer.Replace(t.UserQueryFormat)
+
+	if cfg.CurrentTime {
+		stamp := now.Format("Monday, 2 January 2006, 15:04 MST")
+		if cfg.Timezone != "" {
+			stamp += " (" + cfg.Timezone + ")"
+		}
+		t.SystemMessage += " The current date and time is " + stamp + "; use it for questions about today or recent events."
+	}
+	if len(msg.facts) > 0 {
+		t.SystemMessage += "\n\nKeep in mind these facts about the user and their instructions:\n- " + strings.Join(msg.facts, "\n- ")
+	}
+	if msg.repeat != nil {
+		t.SystemMessage += repeatReminder(msg.repeat)
+	}
+	return t
+}
+
+// currentTime is now in the named timezone, validated with the config.
+func currentTime(timezone string) time.Time {
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.Now()
+	}
+	return time.Now().In(location)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PurgeRequest names what to forget: a document by its id or source, or a
+// user.
+type PurgeRequest struct {
+	DocumentID string `json:"document_id,omitempty"` // As listed by GET /documents
+	Source     string `json:"source,omitempty"`
+	UserID     string `json:"user_id,omitempty"`
+}
+
+// DocumentPurgeReport is what purging a document removed.
+type DocumentPurgeReport struct {
+	ID           string   `json:"id"`
+	Source       string   `json:"source"`
+	Chunks       int      `json:"chunks"`        // Removed from the vector store, every version and soft-deleted ones included
+	Documents    []string `json:"documents"`     // Documents whose metadata records were deleted
+	Gaps         int      `json:"gaps"`          // Review queue entries stripped of answers drawn from it
+	Answers      int      `json:"answers"`       // Answers of chat sessions drawn from it, whose text was removed
+	AuditEntries int      `json:"audit_entries"` // Entries of this replica's audit log stripped of answers drawn from it
+}
+
+// purgeDocument removes every trace of a document the service keeps: its
+// chunks, their metadata records, usage counters and summary, and the
+// answers drawn from it in chat sessions, the review queue and the audit
+// log, which keep their questions.
+func purgeDocument(ctx context.Context, store ManagedStore, source string) (DocumentPurgeReport, error) {
+	report := DocumentPurgeReport{ID: documentID(source), Source: source, Documents: []string{}}
+
+	names, err := store.Values(ctx, map[string]any{"source": source}, "document")
+	if err != nil {
+		return report, fmt.Errorf("failed to list documents: %v", err)
+	}
+	if report.Chunks, err = store.DeleteWhere(ctx, map[string]any{"source": source}); err != nil {
+		return report, fmt.Errorf("failed to remove chunks: %v", err)
+	}
+	for _, name := range names {
+		if name, ok := name.(string); ok && name != "" {
+			report.Documents = append(report.Documents, name)
+		}
+	}
+	if err := metadataStore.deleteDocuments(ctx, report.Documents); err != nil {
+		return report, fmt.Errorf("failed to delete metadata records: %v", err)
+	}
+	for _, key := range []string{usageKey(report.ID), usageKey(report.ID) + ":seen", summaryKey(report.ID)} {
+		if _, err := sharedState.Delete(ctx, key); err != nil {
+			return report, fmt.Errorf("failed to delete usage: %v", err)
+		}
+	}
+	if report.Answers, err = purgeSessionSources(ctx, source); err != nil {
+		return report, fmt.Errorf("failed to purge chat sessions: %v", err)
+	}
+	if report.Gaps, err = purgeGapSources(ctx, source); err != nil {
+		return report, fmt.Errorf("failed to purge the review queue: %v", err)
+	}
+
+	if path := getConfig().Audit.Path; path != "" {
+		err := rewriteAudit(path, func(entries []AuditEntry) ([]AuditEntry, bool) {
+			for i := range entries {
+				if slices.Contains(entries[i].Sources, source) {
+					entries[i].Sources = slices.DeleteFunc(entries[i].Sources, func(s string) bool { return s == source })
+					entries[i].Answer, entries[i].History, entries[i].Purged = "", nil, true
+					report.AuditEntries++
+				}
+			}
+			return entries, report.AuditEntries > 0
+		})
+		if err != nil {
+			return report, fmt.Errorf("failed to purge the audit log: %v", err)
+		}
+	}
+	return report, nil
+}
+
+// purgeSessionSources removes the text of the session answers drawn from
+// source, so that they are neither shown nor returned again as repeats, and
+// returns how many it removed.
+func purgeSessionSources(ctx context.Context, source string) (int, error) {
+	values, err := sharedState.Scan(ctx, sessionRecordKey(""))
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, value := range values {
+		var record SessionRecord
+		if err := json.Unmarshal(value, &record); err != nil {
+			return purged, err
+		}
+		changed := 0
+		_, err := updateState(ctx, sessionContext(record.ID).treeKey(), func(tree *MessageTree, _ bool) bool {
+			changed = 0
+			for i, m := range tree.Messages {
+				if slices.Contains(m.Sources, source) {
+					tree.Messages[i].Sources = slices.DeleteFunc(m.Sources, func(s string) bool { return s == source })
+					tree.Messages[i].Content, tree.Messages[i].Purged = "", true
+					changed++
+				}
+			}
+			return changed > 0
+		})
+		if err != nil {
+			return purged, err
+		}
+		purged += changed
+	}
+	return purged, nil
+}
+
+// purgeGapSources strips the gaps whose latest answer drew on source of the
+// answer and the source, and returns how many it changed.
+func purgeGapSources(ctx context.Context, source string) (int, error) {
+	values, err := sharedState.Scan(ctx, gapKey(""))
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, value := range values {
+		var gap Gap
+		if err := json.Unmarshal(value, &gap); err != nil {
+			return purged, err
+		}
+		if !slices.Contains(gap.Sources, source) {
+			continue
+		}
+		changed := false
+		_, err := updateState(ctx, gapKey(gap.ID), func(gap *Gap, ok bool) bool {
+			changed = ok && slices.Contains(gap.Sources, source)
+			if changed {
+				gap.Sources = slices.DeleteFunc(gap.Sources, func(s string) bool { return s == source })
+				gap.Answer = ""
+			}
+			return changed
+		})
+		if err != nil {
+			return purged, err
+		}
+		if changed {
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// findSource returns the source of the document with id: from its usage if
+// it was ever retrieved, else from the index.
+func findSource(ctx context.Context, store ManagedStore, id string) (string, bool, error) {
+	var seen documentUsage
+	ok, err := loadState(ctx, usageKey(id)+":seen", &seen)
+	if err != nil || ok {
+		return seen.Source, ok, err
+	}
+	sources, err := store.Sources(ctx)
+	if err != nil {
+		return "", false, err
+	}
+	for _, info := range sources {
+		if documentID(info.Source) == id {
+			return info.Source, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// purge handles POST /purge, which forgets a document or a user for good
+// and reports what it removed.
+func purge(c *gin.Context) {
+	var req PurgeRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	named := 0
+	for _, value := range []string{req.DocumentID, req.Source, req.UserID} {
+		if value != "" {
+			named++
+		}
+	}
+	if named != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Send one of document_id, source and user_id"})
+		return
+	}
+	if req.UserID != "" {
+		forgetUser(c, req.UserID)
+		return
+	}
+
+	store, err := managedStore()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx := c.Request.Context()
+	source := req.Source
+	if req.DocumentID != "" {
+		found, ok, err := findSource(ctx, store, req.DocumentID)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Document not found"})
+			return
+		}
+		source = found
+	}
+	report, err := purgeDocument(ctx, store, source)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "report": report})
+		return
+	}
+	log.Printf("Purged document %s: %d chunks, %d gaps, %d audit entries", source, report.Chunks, report.Gaps, report.AuditEntries)
+	c.JSON(http.StatusOK, report)
+}
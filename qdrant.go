@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/tmc/langchaingo/schema"
+	"github.com/tmc/langchaingo/vectorstores"
+)
+
+// qdrantContentKey is the payload field holding a chunk's text.
+const qdrantContentKey = "content"
+
+type QdrantConfig struct {
+	URL    string `json:"url"`     // e.g. "http://localhost:6333"
+	APIKey string `json:"api_key"` // Sent as the api-key header, for Qdrant Cloud; with environment variables expanded
+
+	Transport string `json:"transport"` // "rest" or "grpc" for upserts and searches
+	GRPCPort  int    `json:"grpc_port"` // gRPC port on the host of url
+
+	MaxConnections int `json:"max_connections"` // Connections kept open to Qdrant for concurrent requests
+	TimeoutSeconds int `json:"timeout_seconds"` // Per request, including reading the response
+
+	CAFile             string `json:"ca_file"`              // PEM certificates trusted for an https URL, besides the system ones
+	CertFile           string `json:"cert_file"`            // PEM client certificate, for Qdrant behind mTLS
+	KeyFile            string `json:"key_file"`             // PEM private key of cert_file
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"` // Accept any certificate, for testing only
+
+	OnDisk        bool               `json:"on_disk"`         // Keep vectors and the HNSW index on disk, memory-mapped
+	OnDiskPayload bool               `json:"on_disk_payload"` // Keep payloads on disk
+	Quantization  QdrantQuantization `json:"quantization"`
+}
+
+type QdrantQuantization struct {
+	Type         string  `json:"type"`         // "scalar" (int8), "product" or empty for none
+	Quantile     float64 `json:"quantile"`     // Scalar: share of values that set the int8 range
+	Compression  string  `json:"compression"`  // Product: "x4", "x8", "x16", "x32" or "x64"
+	AlwaysRAM    bool    `json:"always_ram"`   // Keep the quantized vectors in memory when the originals are on disk
+	Oversampling float64 `json:"oversampling"` // Searches fetch this many times the results by quantized vectors and rescore them
+}
+
+const (
+	QuantizationScalar  = "scalar"
+	QuantizationProduct = "product"
+)
+
+var productCompressions = map[string]bool{"x4": true, "x8": true, "x16": true, "x32": true, "x64": true}
+
+var defaultQdrantConfig = QdrantConfig{
+	URL:            qdrantAddress,
+	Transport:      QdrantREST,
+	GRPCPort:       6334,
+	MaxConnections: 32,
+	TimeoutSeconds: 30,
+	Quantization: QdrantQuantization{
+		Quantile:     0.99,
+		Compression:  "x16",
+		AlwaysRAM:    true,
+		Oversampling: 2,
+	},
+}
+
+// qdrantClient is shared by every Qdrant request so that connections are
+// reused; configureQdrant tunes it on startup.
+var qdrantClient = &http.Client{Timeout: 30 * time.Second}
+
+func validateQdrant(cfg QdrantConfig) error {
+	if cfg.URL == "" {
+		return fmt.Errorf("vector_store.qdrant.url is required for the qdrant backend")
+	}
+	if cfg.Transport != QdrantREST && cfg.Transport != QdrantGRPC {
+		return fmt.Errorf("unknown vector_store.qdrant.transport %q", cfg.Transport)
+	}
+	if cfg.Transport == QdrantGRPC && cfg.GRPCPort <= 0 {
+		return fmt.Errorf("vector_store.qdrant.grpc_port must be positive")
+	}
+	if cfg.MaxConnections <= 0 || cfg.TimeoutSeconds <= 0 {
+		return fmt.Errorf("vector_store.qdrant.max_connections and timeout_seconds must be positive")
+	}
+	q := cfg.Quantization
+	switch q.Type {
+	case "":
+	case QuantizationScalar:
+		if q.Quantile < 0.5 || q.Quantile > 1 {
+			return fmt.Errorf("vector_store.qdrant.quantization.quantile must be between 0.5 and 1")
+		}
+	case QuantizationProduct:
+		if !productCompressions[q.Compression] {
+			return fmt.Errorf("unknown vector_store.qdrant.quantization.compression %q", q.Compression)
+		}
+	default:
+		return fmt.Errorf("unknown vector_store.qdrant.quantization.type %q", q.Type)
+	}
+	if q.Type != "" && q.Oversampling < 1 {
+		return fmt.Errorf("vector_store.qdrant.quantization.oversampling must be at least 1")
+	}
+	return nil
+}
+
+// qdrantCollectionConfig is the body creating a collection of size-dimensional
+// vectors with the configured storage options.
+func qdrantCollectionConfig(size int) map[string]any {
+	cfg := getConfig().VectorStore.Qdrant
+	body := map[string]any{
+		"vectors": map[string]any{
+			"size":     size,
+			"distance": "Cosine",
+			"on_disk":  cfg.OnDisk,
+		},
+		"hnsw_config":     map[string]any{"on_disk": cfg.OnDisk},
+		"on_disk_payload": cfg.OnDiskPayload,
+	}
+	if quantization := qdrantQuantizationConfig(cfg.Quantization); quantization != nil {
+		body["quantization_config"] = quantization
+	}
+	return body
+}
+
+func qdrantQuantizationConfig(q QdrantQuantization) map[string]any {
+	switch q.Type {
+	case QuantizationScalar:
+		return map[string]any{"scalar": map[string]any{"type": "int8", "quantile": q.Quantile, "always_ram": q.AlwaysRAM}}
+	case QuantizationProduct:
+		return map[string]any{"product": map[string]any{"compression": q.Compression, "always_ram": q.AlwaysRAM}}
+	}
+	return nil
+}
+
+type ConvertRequest struct {
+	Collection string `json:"collection"` // Defaults to the configured collection
+}
+
+// convertCollection applies the configured on-disk and quantization options
+// to an existing collection. Qdrant rebuilds its segments in the background;
+// the response has the collection status, "yellow" until it is done.
+func convertCollection(c *gin.Context) {
+	var req ConvertRequest
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	if req.Collection == "" {
+		req.Collection = getConfig().Embedding.Collection
+	}
+	if getConfig().VectorStore.Backend != StoreQdrant {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "collection conversion is only supported on qdrant"})
+		return
+	}
+
+	cfg := getConfig().VectorStore.Qdrant
+	vectors := map[string]any{"": map[string]any{"on_disk": cfg.OnDisk}}
+	if lateInteraction(req.Collection) {
+		vectors = map[string]any{denseVector: map[string]any{"on_disk": cfg.OnDisk}, tokenVector: map[string]any{"on_disk": cfg.OnDisk}}
+	}
+	update := map[string]any{
+		"vectors":     vectors,
+		"hnsw_config": map[string]any{"on_disk": cfg.OnDisk},
+		"params":      map[string]any{"on_disk_payload": cfg.OnDiskPayload},
+	}
+	if quantization := qdrantQuantizationConfig(cfg.Quantization); quantization != nil {
+		update["quantization_config"] = quantization
+	} else {
+		update["quantization_config"] = "Disabled"
+	}
+	ctx := c.Request.Context()
+	if err := qdrantRequestContext(ctx, "PATCH", "/collections/"+req.Collection, update, nil); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	var info struct {
+		Result struct {
+			Status string `json:"status"`
+		} `json:"result"`
+	}
+	if err := qdrantRequestContext(ctx, "GET", "/collections/"+req.Collection, nil, &info); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"collection": req.Collection, "status": info.Result.Status})
+}
+
+// qdrantSearchParams rescores quantized searches with the original vectors.
+func qdrantSearchParams() map[string]any {
+	q := getConfig().VectorStore.Qdrant.Quantization
+	if q.Type == "" {
+		return nil
+	}
+	return map[string]any{"quantization": map[string]any{"rescore": true, "oversampling": q.Oversampling}}
+}
+
+// configureQdrant sets up the shared client with a connection pool sized for
+// max_connections and the configured timeout and TLS settings, and the gRPC
+// client if that transport is selected.
+func configureQdrant(cfg QdrantConfig) error {
+	tlsConfig, err := clientTLS("vector_store.qdrant", cfg.CAFile, cfg.CertFile, cfg.KeyFile, cfg.InsecureSkipVerify)
+	if err != nil {
+		return err
+	}
+
+	qdrantClient = &http.Client{
+		Timeout: time.Duration(cfg.TimeoutSeconds) * time.Second,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+			TLSClientConfig:     tlsConfig,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConns:        cfg.MaxConnections,
+			MaxIdleConnsPerHost: cfg.MaxConnections,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+
+	qdrantGRPC = nil
+	if cfg.Transport == QdrantGRPC {
+		client, err := newQdrantGRPC(cfg, tlsConfig)
+		if err != nil {
+			return fmt.Errorf("failed to create the qdrant gRPC client: %v", err)
+		}
+		qdrantGRPC = client
+	}
+	return nil
+}
+
+// qdrantDo sends a request to the Qdrant REST API with the shared client.
+func qdrantDo(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		jsonData, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request: %v", err)
+		}
+		reader = bytes.NewReader(jsonData)
+	}
+
+	cfg := getConfig().VectorStore.Qdrant
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(cfg.URL, "/")+path, reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.APIKey != "" {
+		req.Header.Set("api-key", os.ExpandEnv(cfg.APIKey))
+	}
+
+	if err := qdrantBreaker.allow(); err != nil {
+		return nil, err
+	}
+	resp, err := qdrantClient.Do(req)
+	if err != nil {
+		qdrantBreaker.record(err)
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		qdrantBreaker.record(fmt.Errorf("status %d", resp.StatusCode))
+	} else {
+		qdrantBreaker.record(nil)
+	}
+	return resp, nil
+}
+
+func qdrantRequest(method, path string, body any, out any) error {
+	return qdrantRequestContext(context.Background(), method, path, body, out)
+}
+
+func qdrantRequestContext(ctx context.Context, method, path string, body any, out any) error {
+	resp, err := qdrantDo(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("qdrant %s %s: unexpected status code %d, body: %s", method, path, resp.StatusCode, string(respBody))
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("failed to decode qdrant response: %v", err)
+	}
+	return nil
+}
+
+// qdrantStore keeps chunks in a Qdrant collection, with the text under
+// "content" and the metadata alongside it in the payload.
+type qdrantStore struct {
+	collection string
+	embedder   Embedder
+}
+
+func newQdrantStore(embedder Embedder) qdrantStore {
+	return qdrantStore{
+		collection: getConfig().Embedding.Collection,
+		embedder:   embedder,
+	}
+}
+
+func (s qdrantStore) AddDocuments(ctx context.Context, docs []schema.Document, _ ...vectorstores.Option) ([]string, error) {
+	texts := make([]string, len(docs))
+	for i, doc := range docs {
+		texts[i] = doc.PageContent
+	}
+	dense, err := s.embedder.EmbedDocuments(ctx, texts)
+	if err != nil {
+		return nil, err
+	}
+	if len(dense) != len(docs) {
+		return nil, errors.New("number of vectors from embedder does not match number of documents")
+	}
+	vectors, err := pointVectors(ctx, s.collection, texts, dense)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(docs))
+	points := make([]qdrantPoint, len(docs))
+	for i, doc := range docs {
+		ids[i] = uuid.New().String()
+		payload := make(map[string]any, len(doc.Metadata)+1)
+		for key, value := range doc.Metadata {
+			payload[key] = value
+		}
+		payload[qdrantContentKey] = doc.PageContent
+		points[i] = qdrantPoint{ID: ids[i], Vector: vectors[i], Payload: payload}
+	}
+
+	// Token vectors are upserted over REST
+	if qdrantGRPC != nil && !lateInteraction(s.collection) {
+		err = s.upsertGRPC(ctx, points)
+	} else {
+		path := fmt.Sprintf("/collections/%s/points?wait=true", s.collection)
+		err = qdrantRequestContext(ctx, "PUT", path, map[string]any{"points": points}, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("upserting vectors: %v", err)
+	}
+	return ids, nil
+}
+
+func (s qdrantStore) SimilaritySearch(ctx context.Context, query string, numDocuments int, options ...vectorstores.Option) ([]schema.Document, error) {
+	opts := vectorstores.Options{}
+	for _, opt := range options {
+		opt(&opts)
+	}
+	if opts.ScoreThreshold < 0 || opts.ScoreThreshold > 1 {
+		return nil, errors.New("score threshold must be between 0 and 1")
+	}
+
+	vector, err := s.embedder.EmbedQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	filter, _ := opts.Filters.(Filter)
+	if lateInteraction(s.collection) {
+		docs, err := s.lateInteractionSearch(ctx, query, vector, numDocuments, qdrantFilter(filter), opts.ScoreThreshold)
+		if err != nil {
+			return nil, fmt.Errorf("querying collection: %v", err)
+		}
+		return docs, nil
+	}
+	if qdrantGRPC != nil {
+		docs, err := s.searchGRPC(ctx, vector, numDocuments, qdrantGRPCFilter(filter), opts.ScoreThreshold)
+		if err != nil {
+			return nil, fmt.Errorf("querying collection: %v", err)
+		}
+		return docs, nil
+	}
+
+	body := map[string]any{"vector": vector, "limit": numDocuments, "with_payload": true}
+	if qf := qdrantFilter(filter); qf != nil {
+		body["filter"] = qf
+	}
+	if opts.ScoreThreshold != 0 {
+		body["score_threshold"] = opts.ScoreThreshold
+	}
+	if params := qdrantSearchParams(); params != nil {
+		body["params"] = params
+	}
+	var resp struct {
+		Result []struct {
+			Score   float32        `json:"score"`
+			Payload map[string]any `json:"payload"`
+		} `json:"result"`
+	}
+	path := fmt.Sprintf("/collections/%s/points/search", s.collection)
+	if err := qdrantRequestContext(ctx, "POST", path, body, &resp); err != nil {
+		return nil, fmt.Errorf("querying collection: %v", err)
+	}
+
+	docs := make([]schema.Document, len(resp.Result))
+	for i, match := range resp.Result {
+		content, ok := match.Payload[qdrantContentKey].(string)
+		if !ok {
+			return nil, fmt.Errorf("payload does not contain content key '%s'", qdrantContentKey)
+		}
+		delete(match.Payload, qdrantContentKey)
+		docs[i] = schema.Document{PageContent: content, Metadata: match.Payload, Score: match.Score}
+	}
+	return docs, nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/qdrant/go-client/qdrant"
+	"github.com/tmc/langchaingo/schema"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	QdrantREST = "rest"
+	QdrantGRPC = "grpc"
+)
+
+// qdrantGRPC is the client for the gRPC API, set on startup when
+// vector_store.qdrant.transport is "grpc". Upserts and searches go through
+// it; collection management and maintenance stay on REST.
+var qdrantGRPC *qdrant.Client
+
+func newQdrantGRPC(cfg QdrantConfig, tlsConfig *tls.Config) (*qdrant.Client, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vector_store.qdrant.url: %v", err)
+	}
+	return qdrant.NewClient(&qdrant.Config{
+		Host:      u.Hostname(),
+		Port:      cfg.GRPCPort,
+		APIKey:    os.ExpandEnv(cfg.APIKey),
+		UseTLS:    u.Scheme == "https",
+		TLSConfig: tlsConfig,
+	})
+}
+
+func (s qdrantStore) upsertGRPC(ctx context.Context, points []qdrantPoint) error {
+	ctx, cancel := qdrantGRPCContext(ctx)
+	defer cancel()
+
+	structs := make([]*qdrant.PointStruct, len(points))
+	for i, point := range points {
+		payload, err := qdrantPayload(point.Payload)
+		if err != nil {
+			return err
+		}
+		structs[i] = &qdrant.PointStruct{
+			Id:      qdrant.NewID(point.ID.(string)),
+			Vectors: qdrant.NewVectorsDense(point.Vector.([]float32)),
+			Payload: payload,
+		}
+	}
+	wait := true
+	return qdrantGRPCCall(func() error {
+		_, err := qdrantGRPC.Upsert(ctx, &qdrant.UpsertPoints{
+			CollectionName: s.collection,
+			Wait:           &wait,
+			Points:         structs,
+		})
+		return err
+	})
+}
+
+func (s qdrantStore) searchGRPC(ctx context.Context, vector []float32, limit int, filter *qdrant.Filter, scoreThreshold float32) ([]schema.Document, error) {
+	ctx, cancel := qdrantGRPCContext(ctx)
+	defer cancel()
+
+	count := uint64(limit)
+	request := &qdrant.QueryPoints{
+		CollectionName: s.collection,
+		Query:          qdrant.NewQueryDense(vector),
+		Filter:         filter,
+		Limit:          &count,
+		WithPayload:    qdrant.NewWithPayload(true),
+	}
+	if scoreThreshold != 0 {
+		request.ScoreThreshold = &scoreThreshold
+	}
+	if q := getConfig().VectorStore.Qdrant.Quantization; q.Type != "" {
+		rescore := true
+		request.Params = &qdrant.SearchParams{
+			Quantization: &qdrant.QuantizationSearchParams{Rescore: &rescore, Oversampling: &q.Oversampling},
+		}
+	}
+	var results []*qdrant.ScoredPoint
+	err := qdrantGRPCCall(func() error {
+		var err error
+		results, err = qdrantGRPC.Query(ctx, request)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	docs := make([]schema.Document, len(results))
+	for i, result := range results {
+		metadata := make(map[string]any, len(result.Payload))
+		for key, value := range result.Payload {
+			metadata[key] = qdrantValue(value)
+		}
+		content, ok := metadata[qdrantContentKey].(string)
+		if !ok {
+			return nil, fmt.Errorf("payload does not contain content key '%s'", qdrantContentKey)
+		}
+		delete(metadata, qdrantContentKey)
+		docs[i] = schema.Document{PageContent: content, Metadata: metadata, Score: result.Score}
+	}
+	return docs, nil
+}
+
+func qdrantGRPCContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, time.Duration(getConfig().VectorStore.Qdrant.TimeoutSeconds)*time.Second)
+}
+
+// qdrantPayload converts chunk metadata the way the REST API would see it:
+// through JSON, so that lists, times and nested values keep their REST
+// form, with whole numbers as integers.
+func qdrantPayload(metadata map[string]any) (map[string]*qdrant.Value, error) {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode payload: %v", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var decoded map[string]any
+	if err := decoder.Decode(&decoded); err != nil {
+		return nil, fmt.Errorf("failed to encode payload: %v", err)
+	}
+	return qdrant.TryValueMap(jsonNumbers(decoded).(map[string]any))
+}
+
+func jsonNumbers(value any) any {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for key, item := range v {
+			v[key] = jsonNumbers(item)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = jsonNumbers(item)
+		}
+	}
+	return value
+}
+
+// qdrantValue converts a payload value back to what decoding the REST
+// response gives, with numbers as float64.
+func qdrantValue(value *qdrant.Value) any {
+	switch kind := value.GetKind().(type) {
+	case *qdrant.Value_BoolValue:
+		return kind.BoolValue
+	case *qdrant.Value_IntegerValue:
+		return float64(kind.IntegerValue)
+	case *qdrant.Value_DoubleValue:
+		return kind.DoubleValue
+	case *qdrant.Value_StringValue:
+		return kind.StringValue
+	case *qdrant.Value_ListValue:
+		list := make([]any, len(kind.ListValue.GetValues()))
+		for i, item := range kind.ListValue.GetValues() {
+			list[i] = qdrantValue(item)
+		}
+		return list
+	case *qdrant.Value_StructValue:
+		fields := make(map[string]any, len(kind.StructValue.GetFields()))
+		for key, item := range kind.StructValue.GetFields() {
+			fields[key] = qdrantValue(item)
+		}
+		return fields
+	}
+	return nil
+}
+
+// qdrantGRPCFilter is qdrantFilter for the gRPC API.
+func qdrantGRPCFilter(filter Filter) *qdrant.Filter {
+	if filter.empty() {
+		return nil
+	}
+	result := &qdrant.Filter{}
+	for key, value := range filter.Match {
+		result.Must = append(result.Must, qdrantGRPCCondition(key, value))
+	}
+	for key, value := range filter.Exclude {
+		result.MustNot = append(result.MustNot, qdrantGRPCCondition(key, value))
+	}
+	for _, r := range filter.Ranges {
+		anyOf := &qdrant.Filter{}
+		for _, field := range r.Fields {
+			anyOf.Should = append(anyOf.Should, qdrantGRPCRange(field, r))
+		}
+		if len(anyOf.Should) == 1 {
+			result.Must = append(result.Must, anyOf.Should[0])
+		} else {
+			result.Must = append(result.Must, qdrant.NewFilterAsCondition(anyOf))
+		}
+	}
+	return result
+}
+
+// qdrantGRPCRange bounds a field by r, as a datetime range when r bounds
+// dates.
+func qdrantGRPCRange(key string, r Range) *qdrant.Condition {
+	if r.dates() {
+		timestamp := func(value any) *timestamppb.Timestamp {
+			if t, ok := value.(time.Time); ok {
+				return timestamppb.New(t)
+			}
+			return nil
+		}
+		return qdrant.NewDatetimeRange(key, &qdrant.DatetimeRange{Gt: timestamp(r.GT), Gte: timestamp(r.GTE), Lt: timestamp(r.LT), Lte: timestamp(r.LTE)})
+	}
+	number := func(value any) *float64 {
+		if f, ok := value.(float64); ok {
+			return &f
+		}
+		return nil
+	}
+	return qdrant.NewRange(key, &qdrant.Range{Gt: number(r.GT), Gte: number(r.GTE), Lt: number(r.LT), Lte: number(r.LTE)})
+}
+
+// qdrantGRPCCondition matches a field against a value, or any of a list of
+// values.
+func qdrantGRPCCondition(key string, value any) *qdrant.Condition {
+	switch v := value.(type) {
+	case []any:
+		anyOf := &qdrant.Filter{}
+		for _, item := range v {
+			anyOf.Should = append(anyOf.Should, qdrantGRPCCondition(key, item))
+		}
+		return qdrant.NewFilterAsCondition(anyOf)
+	case string:
+		return qdrant.NewMatchKeyword(key, v)
+	case bool:
+		return qdrant.NewMatchBool(key, v)
+	case int:
+		return qdrant.NewMatchInt(key, int64(v))
+	case int64:
+		return qdrant.NewMatchInt(key, v)
+	case float64:
+		if v == math.Trunc(v) {
+			return qdrant.NewMatchInt(key, int64(v))
+		}
+	}
+	return qdrant.NewMatchKeyword(key, fmt.Sprint(value))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// queueHeartbeatInterval is how often a queued streaming client is told its
+// position.
+const queueHeartbeatInterval = 2 * time.Second
+
+// GenerationQueue limits the answers generated at once on this replica to
+// llm.max_concurrent, admitting the waiting ones in order.
+type GenerationQueue struct {
+	Running int
+	Waiting []chan struct{}
+	// Average time an admitted answer held its slot, for wait estimates
+	AverageDuration time.Duration
+
+	mu sync.Mutex
+}
+
+var generationQueue GenerationQueue
+
+// acquire waits for a free slot, sending "queued" events with the position
+// and estimated wait to a streaming client meanwhile. The returned function
+// frees the slot. It fails if ctx is done first.
+func (q *GenerationQueue) acquire(ctx context.Context, stream *answerStream) (func(), error) {
+	limit := getConfig().LLM.MaxConcurrent
+	if limit <= 0 {
+		return func() {}, nil
+	}
+
+	q.mu.Lock()
+	if q.Running < limit && len(q.Waiting) == 0 {
+		q.Running++
+		q.mu.Unlock()
+		return q.releaser(), nil
+	}
+	ready := make(chan struct{})
+	q.Waiting = append(q.Waiting, ready)
+	q.mu.Unlock()
+
+	q.heartbeat(ready, limit, stream)
+	ticker := time.NewTicker(queueHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ready:
+			return q.releaser(), nil
+		case <-ticker.C:
+			q.heartbeat(ready, limit, stream)
+		case <-ctx.Done():
+			q.mu.Lock()
+			for i, waiting := range q.Waiting {
+				if waiting == ready {
+					q.Waiting = append(q.Waiting[:i], q.Waiting[i+1:]...)
+					q.mu.Unlock()
+					return nil, ctx.Err()
+				}
+			}
+			q.mu.Unlock()
+			// Admitted while giving up; pass the slot on
+			q.releaser()()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// releaser returns the function freeing a slot taken now, which hands it
+// straight to the first waiting answer.
+func (q *GenerationQueue) releaser() func() {
+	start := time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			duration := time.Since(start)
+			if q.AverageDuration == 0 {
+				q.AverageDuration = duration
+			} else {
+				q.AverageDuration = (4*q.AverageDuration + duration) / 5
+			}
+			if len(q.Waiting) == 0 {
+				q.Running--
+				return
+			}
+			close(q.Waiting[0])
+			q.Waiting = q.Waiting[1:]
+		})
+	}
+}
+
+// heartbeat sends a queued answer's position, counted from 1, and the wait
+// estimated from the average duration of the answers before it.
+func (q *GenerationQueue) heartbeat(ready chan struct{}, limit int, stream *answerStream) {
+	if stream == nil {
+		return
+	}
+	q.mu.Lock()
+	position := 0
+	for i, waiting := range q.Waiting {
+		if waiting == ready {
+			position = i + 1
+			break
+		}
+	}
+	average := q.AverageDuration
+	q.mu.Unlock()
+	if position == 0 {
+		return
+	}
+
+	event := gin.H{"position": position}
+	if average > 0 {
+		rounds := math.Ceil(float64(position) / float64(limit))
+		event["estimated_wait_seconds"] = math.Round(rounds * average.Seconds())
+	}
+	stream.event("queued", event)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/tmc/langchaingo/schema"
+	"github.com/tmc/langchaingo/vectorstores"
+)
+
+const (
+	redisContentField = "content"
+	redisVectorField  = "content_vector"
+)
+
+// redisVecStore keeps chunks in Redis hashes under doc:<index>: and finds
+// them with a RediSearch KNN query. The keys, fields and index are the ones
+// langchaingo's redisvector wrote, so indexes filled before keep working.
+//
+// Scalar metadata fields are stored as filterable hash fields and the full
+// metadata as JSON, which is decoded again on retrieval so typed fields
+// (rows, flags, lists) survive.
+type redisVecStore struct {
+	client   *redis.Client
+	index    string
+	embedder Embedder
+
+	mu    sync.Mutex
+	ready bool // the index is known to exist
+}
+
+// newRedisVecStore connects to vector_store.redis_url. The index is created
+// on the first write, with a schema inferred from the first chunk.
+func newRedisVecStore(ctx context.Context) (openStore, error) {
+	cfg := getConfig()
+	opts, err := redis.ParseURL(cfg.VectorStore.RedisURL)
+	if err != nil {
+		return openStore{}, fmt.Errorf("invalid vector_store.redis_url: %v", err)
+	}
+	// Search replies are parsed in their RESP2 shape
+	opts.Protocol = 2
+	client := redis.NewClient(opts)
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return openStore{}, fmt.Errorf("failed to connect to redis: %v", err)
+	}
+	store := &redisVecStore{client: client, index: cfg.Embedding.Collection, embedder: contextEmbedder{}}
+	return openStore{store: store, close: client.Close}, nil
+}
+
+func (s *redisVecStore) prefix() string {
+	return "doc:" + s.index
+}
+
+func (s *redisVecStore) AddDocuments(ctx context.Context, docs []schema.Document, _ ...vectorstores.Option) ([]string, error) {
+	if len(docs) == 0 {
+		return nil, nil
+	}
+	texts := make([]string, len(docs))
+	for i, doc := range docs {
+		texts[i] = doc.PageContent
+	}
+	vectors, err := s.embedder.EmbedDocuments(ctx, texts)
+	if err != nil {
+		return nil, err
+	}
+	if len(vectors) != len(docs) {
+		return nil, fmt.Errorf("got %d embeddings for %d chunks", len(vectors), len(docs))
+	}
+
+	hashes := make([]map[string]any, len(docs))
+	for i, doc := range docs {
+		if hashes[i], err = redisHash(doc); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.ensureIndex(ctx, hashes[0], len(vectors[0])); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(docs))
+	pipe := s.client.Pipeline()
+	for i, hash := range hashes {
+		id, ok := hash["ids"]
+		if !ok {
+			id = uuid.NewString()
+		}
+		ids[i] = fmt.Sprintf("%s:%v", s.prefix(), id)
+
+		values := make([]any, 0, 2*len(hash)+4)
+		for key, value := range hash {
+			values = append(values, key, fmt.Sprint(value))
+		}
+		values = append(values, redisContentField, docs[i].PageContent, redisVectorField, redisVector(vectors[i]))
+		pipe.HSet(ctx, ids[i], values...)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to store chunks in redis: %v", err)
+	}
+	return ids, nil
+}
+
+// redisHash flattens the metadata of doc into hash fields: scalars as they
+// are, flags and lists as strings, and all of it as JSON.
+func redisHash(doc schema.Document) (map[string]any, error) {
+	encoded, err := json.Marshal(doc.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode metadata: %v", err)
+	}
+
+	hash := map[string]any{redisMetadataField: string(encoded)}
+	for key, value := range doc.Metadata {
+		switch v := value.(type) {
+		case string, int, int64, float64:
+			hash[key] = v
+		case bool:
+			hash[key] = fmt.Sprint(v)
+		case []string:
+			hash[key] = strings.Join(v, ",")
+		case []any:
+			parts := make([]string, len(v))
+			for j, part := range v {
+				parts[j] = fmt.Sprint(part)
+			}
+			hash[key] = strings.Join(parts, ",")
+		}
+	}
+	if id, ok := doc.Metadata["id"]; ok {
+		hash["ids"] = id
+	}
+	return hash, nil
+}
+
+// ensureIndex creates the index unless it exists: strings are indexed as
+// text, numbers as numeric fields, and the embedding for cosine KNN.
+func (s *redisVecStore) ensureIndex(ctx context.Context, hash map[string]any, dims int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ready {
+		return nil
+	}
+	if s.client.Do(ctx, "FT.INFO", s.index).Err() == nil {
+		s.ready = true
+		return nil
+	}
+
+	args := []any{"FT.CREATE", s.index, "ON", "HASH", "PREFIX", 1, s.prefix(), "SCORE", "1.0", "SCHEMA",
+		redisContentField, "TEXT"}
+	for key, value := range hash {
+		switch value.(type) {
+		case string:
+			args = append(args, key, "TEXT")
+		case int, int64, float64:
+			args = append(args, key, "NUMERIC")
+		}
+	}
+	args = append(args, redisVectorField, "VECTOR", "FLAT", 6, "TYPE", "FLOAT32", "DIM", dims, "DISTANCE_METRIC", "COSINE")
+	// Another replica may have created it in the meantime
+	if err := s.client.Do(ctx, args...).Err(); err != nil && !strings.Contains(err.Error(), "Index already exists") {
+		return fmt.Errorf("failed to create redis index %s: %v", s.index, err)
+	}
+	s.ready = true
+	return nil
+}
+
+func (s *redisVecStore) SimilaritySearch(ctx context.Context, query string, numDocuments int, options ...vectorstores.Option) ([]schema.Document, error) {
+	opts := vectorstores.Options{}
+	for _, option := range options {
+		option(&opts)
+	}
+	filter, _ := opts.Filters.(string)
+	if filter == "" {
+		filter = "*"
+	}
+	if numDocuments <= 0 {
+		numDocuments = 1
+	}
+
+	vector, err := s.embedder.EmbedQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := s.client.Do(ctx, "FT.SEARCH", s.index,
+		fmt.Sprintf("(%s)=>[KNN %d @%s $vector AS distance]", filter, numDocuments, redisVectorField),
+		"RETURN", 3, redisContentField, redisMetadataField, "distance",
+		"SORTBY", "distance", "ASC",
+		"DIALECT", 2,
+		"LIMIT", 0, numDocuments,
+		"PARAMS", 2, "vector", redisVector(vector),
+	).Slice()
+	if err != nil {
+		return nil, fmt.Errorf("redis search failed: %v", err)
+	}
+
+	// The reply is the total, then each key followed by its fields
+	var docs []schema.Document
+	for i := 1; i+1 < len(reply); i += 2 {
+		key, _ := reply[i].(string)
+		fields, _ := reply[i+1].([]any)
+		doc := schema.Document{Metadata: map[string]any{"id": key}}
+		for j := 0; j+1 < len(fields); j += 2 {
+			name, _ := fields[j].(string)
+			value, _ := fields[j+1].(string)
+			switch name {
+			case redisContentField:
+				doc.PageContent = value
+			case redisMetadataField:
+				var metadata map[string]any
+				if err := json.Unmarshal([]byte(value), &metadata); err == nil {
+					doc.Metadata = metadata
+				}
+			case "distance":
+				distance, _ := strconv.ParseFloat(value, 32)
+				doc.Score = float32(1 - distance)
+			}
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// redisVector encodes v as the little-endian FLOAT32 blob RediSearch reads.
+func redisVector(v []float32) []byte {
+	b := make([]byte, 4*len(v))
+	for i, f := range v {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(f))
+	}
+	return b
+}
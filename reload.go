@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// restartSettings are the settings read only on startup, by the name they
+// have in config.json. A reload changing any of them is refused.
+var restartSettings = map[string]func(Config) any{
+	"embedding":                  func(c Config) any { return c.Embedding },
+	"vector_store":               func(c Config) any { return c.VectorStore },
+	"state":                      func(c Config) any { return c.State },
+	"metadata":                   func(c Config) any { return c.Metadata },
+	"admin":                      func(c Config) any { return c.Admin },
+	"stream":                     func(c Config) any { return c.Stream },
+	"postgres":                   func(c Config) any { return c.Postgres },
+	"analytics":                  func(c Config) any { return c.Analytics },
+	"tls":                        func(c Config) any { return c.TLS },
+	"secrets":                    func(c Config) any { return c.Secrets },
+	"llm.ollama":                 func(c Config) any { return c.LLM.Ollama },
+	"llm.openai":                 func(c Config) any { return c.LLM.OpenAI },
+	"gc.interval_minutes":        func(c Config) any { return c.GC.IntervalMinutes },
+	"feeds.interval_minutes":     func(c Config) any { return c.Feeds.IntervalMinutes },
+	"retention.interval_minutes": func(c Config) any { return c.Retention.IntervalMinutes },
+}
+
+// reloadMu keeps reloads from interleaving.
+var reloadMu sync.Mutex
+
+// reloadConfig reads the config file again and applies it. Requests read the
+// config as each stage starts, so those in flight finish with a mix of the
+// old and the new settings rather than being dropped.
+func reloadConfig() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	next, err := loadConfig(configPath())
+	if err != nil {
+		return err
+	}
+	if fakeLLMMode {
+		next.Embedding.Collection += "_fake"
+	}
+	current := getConfig()
+	// The audit log of a replay stays off
+	next.Audit.Path = current.Audit.Path
+
+	var changed []string
+	for name, setting := range restartSettings {
+		if !reflect.DeepEqual(setting(current), setting(next)) {
+			changed = append(changed, name)
+		}
+	}
+	if len(changed) > 0 {
+		sort.Strings(changed)
+		return fmt.Errorf("%s only change on restart", strings.Join(changed, ", "))
+	}
+
+	if err := setConfiguredHooks(next.Hooks); err != nil {
+		return err
+	}
+	if err := setConfiguredDatasets(next.Datasets); err != nil {
+		return err
+	}
+	setConfig(next)
+	setConfiguredExperiments(next.Experiments)
+	setConfiguredPrompts(next.Prompts)
+	setConfiguredGlossaries(next.Glossary)
+	log.Printf("Reloaded config from %s", configPath())
+	return nil
+}
+
+// reloadConfigHandler applies the config file of this replica.
+func reloadConfigHandler(c *gin.Context) {
+	if err := reloadConfig(); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "reloaded"})
+}
+
+// watchConfig reloads the config file whenever its modification time or
+// size changes, checking every interval. Invalid files are logged and the
+// running config kept.
+func watchConfig(ctx context.Context, interval time.Duration) {
+	path := configPath()
+	stamp := func() string {
+		info, err := os.Stat(path)
+		if err != nil {
+			return ""
+		}
+		return fmt.Sprintf("%d:%d", info.ModTime().UnixNano(), info.Size())
+	}
+	last := stamp()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		current := stamp()
+		if current == last {
+			continue
+		}
+		last = current
+		if err := reloadConfig(); err != nil {
+			log.Printf("Error reloading config: %v", err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// What is done with a question asked again in a session
+const (
+	RepeatsCached = "cached" // Return the earlier answer with a note, without generating one
+	RepeatsRemind = "remind" // Answer again, telling the model what it answered before
+)
+
+type RepeatsConfig struct {
+	Mode          string  `json:"mode"`            // "cached" or "remind"; empty answers repeats like any question
+	Similarity    float64 `json:"similarity"`      // Embedding similarity from which a question is the same as an earlier one; 1 counts the same wording only
+	MaxAgeMinutes int     `json:"max_age_minutes"` // Only earlier answers this recent count; 0 means any in the conversation
+}
+
+func validateRepeats(cfg RepeatsConfig) error {
+	if cfg.Mode != "" && cfg.Mode != RepeatsCached && cfg.Mode != RepeatsRemind {
+		return fmt.Errorf(`repeats.mode must be "cached" or "remind"`)
+	}
+	if cfg.Similarity <= 0 || cfg.Similarity > 1 {
+		return fmt.Errorf("repeats.similarity must be in (0, 1]")
+	}
+	if cfg.MaxAgeMinutes < 0 {
+		return fmt.Errorf("repeats.max_age_minutes must not be negative")
+	}
+	return nil
+}
+
+// Repeat is the earlier exchange of a session a question asks again.
+type Repeat struct {
+	QuestionID string    `json:"question_id"`
+	AnswerID   string    `json:"answer_id"`
+	AskedAt    time.Time `json:"asked_at"`
+	Similarity float64   `json:"similarity"` // 1 for the same wording
+	Cached     bool      `json:"cached"`     // The message is the earlier answer rather than a new one
+	Note       string    `json:"note,omitempty"`
+
+	answer  string
+	sources []string
+}
+
+// findRepeat looks for the same question earlier in the conversation msg
+// continues: with the same wording once normalized, or as similar as
+// repeats.similarity. The latest of the closest ones wins. Questions sent
+// with their conversation, images or to regenerate an answer are never
+// repeats.
+func findRepeat(ctx context.Context, embedder Embedder, msg Message, regenerating bool) *Repeat {
+	cfg := getConfig().Repeats
+	if cfg.Mode == "" || regenerating || msg.parent == "" || len(msg.Messages) > 0 || len(msg.Images) > 0 {
+		return nil
+	}
+	path := sessionContext(msg.SessionID).tree(ctx).branch(msg.parent)
+	if keep := getConfig().Memory.MaxTurns; len(path) > keep {
+		path = path[len(path)-keep:]
+	}
+
+	var cutoff time.Time
+	if cfg.MaxAgeMinutes > 0 {
+		cutoff = time.Now().Add(-time.Duration(cfg.MaxAgeMinutes) * time.Minute)
+	}
+	var candidates []Repeat
+	var questions []string
+	for i := 0; i+1 < len(path); i++ {
+		question, answer := path[i], path[i+1]
+		if question.Role != RoleUser || answer.Role != RoleAssistant || answer.Purged || question.CreatedAt.Before(cutoff) {
+			continue
+		}
+		// An earlier "I don't know" is no answer to repeat
+		if cfg.Mode == RepeatsCached && isAbstention(answer.Content) {
+			continue
+		}
+		candidates = append(candidates, Repeat{
+			QuestionID: question.ID, AnswerID: answer.ID, AskedAt: question.CreatedAt,
+			answer: answer.Content, sources: answer.Sources,
+		})
+		questions = append(questions, question.Content)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	best := -1
+	for i := range candidates {
+		if statsQuery(questions[i]) == statsQuery(msg.Msg) {
+			best, candidates[i].Similarity = i, 1
+		}
+	}
+	if best < 0 && cfg.Similarity < 1 {
+		vectors, err := embedder.EmbedDocuments(ctx, append(questions, msg.Msg))
+		if err != nil {
+			log.Printf("Error embedding questions to find repeats: %v", err)
+			return nil
+		}
+		query := vectors[len(vectors)-1]
+		for i := range candidates {
+			candidates[i].Similarity = cosineSimilarity(query, vectors[i])
+			if candidates[i].Similarity >= cfg.Similarity && (best < 0 || candidates[i].Similarity >= candidates[best].Similarity) {
+				best = i
+			}
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+
+	repeat := candidates[best]
+	if cfg.Mode == RepeatsCached {
+		repeat.Cached = true
+		repeat.Note = "You asked this before in this conversation; this is the answer given then. Regenerate it for a new one."
+	}
+	log.Printf("Question %q repeats %s of session %s (similarity %.2f)", msg.Msg, repeat.QuestionID, msg.SessionID, repeat.Similarity)
+	return &repeat
+}
+
+// repeatReminder tells the model what it answered when the question was
+// asked before, so that it does not contradict itself without saying so.
+func repeatReminder(repeat *Repeat) string {
+	return "\n\nThe user asked this question before in this conversation, and you answered:\n" + repeat.answer +
+		"\nStay consistent with that answer unless the information given now says otherwise, and then say what changed."
+}
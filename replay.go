@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"time"
+)
+
+// ReplayResult compares the answer to a logged query under the current
+// config with the logged one.
+type ReplayResult struct {
+	Time           time.Time `json:"time"` // Of the logged answer
+	Message        string    `json:"message"`
+	Mode           string    `json:"mode"` // As logged
+	LoggedAnswer   string    `json:"logged_answer,omitempty"`
+	Answer         string    `json:"answer,omitempty"`
+	Similarity     float64   `json:"similarity"`     // Cosine similarity of the answers' embeddings
+	Exact          bool      `json:"exact"`          // Identical answers
+	SourceOverlap  float64   `json:"source_overlap"` // Jaccard overlap of the cited sources
+	AddedSources   []string  `json:"added_sources,omitempty"`
+	RemovedSources []string  `json:"removed_sources,omitempty"`
+	Regressed      bool      `json:"regressed"` // Similarity below the minimum
+	Skipped        string    `json:"skipped,omitempty"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// replayAudit answers the queries of an audit log, or its last limit entries,
+// with the current config, each with its logged conversation, and writes a
+// ReplayResult per entry to out as JSON Lines. It fails when any answer is
+// less similar than minSimilarity to the logged one.
+func replayAudit(path string, limit int, minSimilarity float64, out io.Writer) error {
+	entries, err := readAudit(path)
+	if err != nil {
+		return fmt.Errorf("failed to read audit log: %v", err)
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	embedder, err := newEmbedder()
+	if err != nil {
+		return err
+	}
+
+	// Replays keep their own conversation, leaving the shared one alone
+	ctx := context.Background()
+	chatContext = ChatContext{id: "replay", key: "chat:replay"}
+	defer chatContext.clear(ctx)
+
+	encoder := json.NewEncoder(out)
+	replayed, regressed, exact := 0, 0, 0
+	for _, entry := range entries {
+		result := ReplayResult{
+			Time:         entry.Time,
+			Message:      entry.Message.Msg,
+			Mode:         entry.Mode,
+			LoggedAnswer: entry.Answer,
+		}
+		switch {
+		case entry.Purged:
+			result.Skipped = "purged"
+		case entry.Images > 0:
+			result.Skipped = "images are not logged"
+		case entry.Error != "":
+			result.Skipped = "logged answer failed"
+		default:
+			chatContext.reset(entry.History)
+			message := entry.Message
+			message.SessionID, message.ParentID = "", ""
+			response := RAG(ctx, message, nil)
+			result.Answer = response.Message
+			if err := compareReplay(ctx, embedder, entry, response, &result); err != nil {
+				result.Error = err.Error()
+			}
+			result.Regressed = result.Error == "" && result.Similarity < minSimilarity
+		}
+
+		if result.Skipped == "" {
+			replayed++
+		}
+		if result.Regressed {
+			regressed++
+		}
+		if result.Exact {
+			exact++
+		}
+		if err := encoder.Encode(result); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Replayed %d of %d logged queries: %d identical, %d below similarity %.2f",
+		replayed, len(entries), exact, regressed, minSimilarity)
+	if regressed > 0 {
+		return fmt.Errorf("%d replayed answers regressed", regressed)
+	}
+	return nil
+}
+
+func compareReplay(ctx context.Context, embedder Embedder, entry AuditEntry, response ChatResponse, result *ReplayResult) error {
+	sources := documentSources(response.docs)
+	result.SourceOverlap, result.AddedSources, result.RemovedSources = compareSources(entry.Sources, sources)
+
+	result.Exact = response.Message == entry.Answer
+	if result.Exact {
+		result.Similarity = 1
+		return nil
+	}
+	vectors, err := embedder.EmbedDocuments(ctx, []string{entry.Answer, response.Message})
+	if err != nil {
+		return fmt.Errorf("failed to embed answers: %v", err)
+	}
+	result.Similarity = cosineSimilarity(vectors[0], vectors[1])
+	return nil
+}
+
+// compareSources returns the Jaccard overlap of two source lists and the
+// sources only in after and only in before.
+func compareSources(before, after []string) (float64, []string, []string) {
+	inBefore := map[string]bool{}
+	for _, source := range before {
+		inBefore[source] = true
+	}
+	inAfter := map[string]bool{}
+	for _, source := range after {
+		inAfter[source] = true
+	}
+	if len(inBefore) == 0 && len(inAfter) == 0 {
+		return 1, nil, nil
+	}
+
+	var added, removed []string
+	for _, source := range after {
+		if !inBefore[source] && !slices.Contains(added, source) {
+			added = append(added, source)
+		}
+	}
+	for _, source := range before {
+		if !inAfter[source] && !slices.Contains(removed, source) {
+			removed = append(removed, source)
+		}
+	}
+	shared := len(inAfter) - len(added)
+	return float64(shared) / float64(len(inBefore)+len(inAfter)-shared), added, removed
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tmc/langchaingo/schema"
+)
+
+const apiMaxResponseBytes = 20 << 20
+
+type APIConfig struct {
+	MaxPages int         `json:"max_pages"` // Cap and default for the pages requested per run
+	Sources  []APISource `json:"sources"`   // Sources POST /connectors/api can run by name
+}
+
+// APISource describes a paginated JSON API and where its items' text is.
+// Paths are JSONPath expressions ($, .key, ['key'], [n], [*] and .*); item
+// paths are relative to the item.
+type APISource struct {
+	Name     string            `json:"name"`
+	URL      string            `json:"url"`                 // Go template over .Page (from 1), .PageSize, .Offset (items so far) and .Cursor
+	Headers  map[string]string `json:"headers,omitempty"`   // For configured sources, $VAR and ${VAR} are expanded from the environment
+	Items    string            `json:"items"`               // Path of the items in a response, e.g. $.data[*]
+	Content  string            `json:"content"`             // Path of an item's text; several matches are joined
+	HTML     bool              `json:"html,omitempty"`      // The content is HTML and is reduced to text
+	Title    string            `json:"title,omitempty"`     // Path of an item's title
+	ID       string            `json:"id,omitempty"`        // Path of an item's unique ID, which names its document
+	Next     string            `json:"next,omitempty"`      // Path of the next page's URL or cursor; without it pages are requested until one is empty
+	Metadata map[string]string `json:"metadata,omitempty"`  // Chunk metadata field -> path in the item
+	PageSize int               `json:"page_size,omitempty"` // Value of .PageSize
+	MaxPages int               `json:"max_pages,omitempty"`
+	Dataset  string            `json:"dataset,omitempty"`
+	Tenant   string            `json:"tenant,omitempty"`
+}
+
+type apiPage struct {
+	Page, PageSize, Offset int
+	Cursor                 string
+}
+
+// jsonPathStep is one step of a JSONPath: a key, an index, or a wildcard
+// when both are unset.
+type jsonPathStep struct {
+	key   string
+	index *int
+}
+
+// apiPaths are the parsed paths of an API source, nil for those not set.
+type apiPaths struct {
+	items, content, title, id, next []jsonPathStep
+	metadata                        map[string][]jsonPathStep
+}
+
+func parseAPIPaths(source APISource) (apiPaths, error) {
+	var err error
+	parse := func(path string) []jsonPathStep {
+		if path == "" || err != nil {
+			return nil
+		}
+		var steps []jsonPathStep
+		steps, err = parseJSONPath(path)
+		return steps
+	}
+	paths := apiPaths{
+		items:    parse(source.Items),
+		content:  parse(source.Content),
+		title:    parse(source.Title),
+		id:       parse(source.ID),
+		next:     parse(source.Next),
+		metadata: make(map[string][]jsonPathStep, len(source.Metadata)),
+	}
+	for field, path := range source.Metadata {
+		paths.metadata[field] = parse(path)
+	}
+	return paths, err
+}
+
+func validateAPISources(sources []APISource) error {
+	names := map[string]bool{}
+	for _, source := range sources {
+		if source.Name == "" {
+			return fmt.Errorf("api sources need a name")
+		}
+		if names[source.Name] {
+			return fmt.Errorf("duplicate api source %q", source.Name)
+		}
+		names[source.Name] = true
+		if err := validateAPISource(source); err != nil {
+			return fmt.Errorf("api source %q: %v", source.Name, err)
+		}
+	}
+	return nil
+}
+
+func validateAPISource(source APISource) error {
+	if !strings.HasPrefix(source.URL, "http://") && !strings.HasPrefix(source.URL, "https://") {
+		return fmt.Errorf("url must be an http(s) URL")
+	}
+	if _, err := template.New("url").Parse(source.URL); err != nil {
+		return fmt.Errorf("invalid url template: %v", err)
+	}
+	if source.Items == "" || source.Content == "" {
+		return fmt.Errorf("items and content paths are required")
+	}
+	_, err := parseAPIPaths(source)
+	return err
+}
+
+// ingestAPI runs a configured API source, given by name, or the source
+// described in the request, as a background job.
+func ingestAPI(c *gin.Context) {
+	var source APISource
+	if err := c.BindJSON(&source); err != nil {
+		return
+	}
+
+	if source.URL == "" {
+		configured, ok := configuredAPISource(source.Name)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Unknown api source %q", source.Name)})
+			return
+		}
+		source = configured
+	} else if err := validateAPISource(source); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if source.Name == "" {
+		if u, err := url.Parse(source.URL); err == nil {
+			source.Name = u.Host
+		}
+	}
+
+	maxPages := getConfig().API.MaxPages
+	if source.MaxPages <= 0 || source.MaxPages > maxPages {
+		source.MaxPages = maxPages
+	}
+
+	ingest := IngestRequest{Dataset: source.Dataset, Tenant: source.Tenant, Path: source.URL}
+	if err := completeIngestRequest(&ingest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	job := jobRegistry.create("api:" + source.Name)
+	go runJob(job.ID, func(ctx context.Context) error {
+		return ingestAPISource(ctx, job.ID, source, ingest)
+	})
+
+	c.JSON(http.StatusAccepted, job)
+}
+
+// configuredAPISource returns the named source from the config with its
+// header values expanded from the environment. Sources sent in a request are
+// never expanded, so callers cannot read the server's environment.
+func configuredAPISource(name string) (APISource, bool) {
+	for _, source := range getConfig().API.Sources {
+		if source.Name != name {
+			continue
+		}
+		headers := make(map[string]string, len(source.Headers))
+		for key, value := range source.Headers {
+			headers[key] = os.ExpandEnv(value)
+		}
+		source.Headers = headers
+		return source, true
+	}
+	return APISource{}, false
+}
+
+// ingestAPISource requests the pages of an API and indexes one document per
+// item. A page without items, or without a next page when source.Next is
+// set, ends the run; so does a URL without template actions after its first
+// page.
+func ingestAPISource(ctx context.Context, jobID string, source APISource, ingest IngestRequest) error {
+	tmpl, err := template.New("url").Option("missingkey=error").Parse(source.URL)
+	if err != nil {
+		return err
+	}
+	paths, err := parseAPIPaths(source)
+	if err != nil {
+		return err
+	}
+	paged := strings.Contains(source.URL, "{{")
+
+	state := apiPage{Page: 1, PageSize: source.PageSize}
+	var docs []schema.Document
+	next := ""
+	for page := 0; page < source.MaxPages; page++ {
+		target := next
+		if target == "" {
+			var rendered bytes.Buffer
+			if err := tmpl.Execute(&rendered, state); err != nil {
+				return fmt.Errorf("failed to render url: %v", err)
+			}
+			target = rendered.String()
+		}
+
+		body, err := fetchJSON(ctx, target, source.Headers)
+		if err != nil {
+			return err
+		}
+		items := evalJSONPath(paths.items, body)
+		if len(items) == 0 {
+			break
+		}
+		for i, item := range items {
+			doc, ok := apiDocument(source, paths, target, i, item)
+			if ok {
+				docs = append(docs, doc)
+			}
+		}
+
+		state.Page++
+		state.Offset += len(items)
+		if source.Next == "" {
+			if !paged {
+				break
+			}
+			continue
+		}
+
+		value := firstNonEmpty(jsonStrings(evalJSONPath(paths.next, body))...)
+		if value == "" {
+			break
+		}
+		if strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://") || strings.HasPrefix(value, "/") || strings.HasPrefix(value, "?") {
+			base, _ := url.Parse(target)
+			link, err := base.Parse(value)
+			if err != nil {
+				return fmt.Errorf("invalid next page %q: %v", value, err)
+			}
+			if link.Host != base.Host {
+				return fmt.Errorf("next page %s is on another host", link)
+			}
+			next = link.String()
+		} else {
+			state.Cursor = value
+			next = ""
+		}
+	}
+
+	if len(docs) == 0 {
+		return nil
+	}
+	chunks, err := splitDocuments(ctx, docs, ingest)
+	if err != nil {
+		return err
+	}
+	return indexDocuments(ctx, jobID, ingest, chunks)
+}
+
+// apiDocument builds the document of an item. Items with an ID become the
+// document "api:<name>:<id>", so running the source again adds new versions;
+// items without one are named after their page and position.
+func apiDocument(source APISource, paths apiPaths, pageURL string, position int, item any) (schema.Document, bool) {
+	content := strings.Join(jsonStrings(evalJSONPath(paths.content, item)), "\n")
+	if source.HTML {
+		content = feedText(content)
+	}
+	title := firstNonEmpty(jsonStrings(evalJSONPath(paths.title, item))...)
+	if strings.TrimSpace(content) == "" {
+		return schema.Document{}, false
+	}
+
+	name := fmt.Sprintf("%s#%d", pageURL, position)
+	if paths.id != nil {
+		if id := firstNonEmpty(jsonStrings(evalJSONPath(paths.id, item))...); id != "" {
+			name = fmt.Sprintf("api:%s:%s", source.Name, id)
+		}
+	}
+	metadata := map[string]any{
+		"source":     name,
+		"document":   name,
+		"api_source": source.Name,
+	}
+	if title != "" {
+		metadata["title"] = title
+		content = title + "\n" + content
+	}
+	for field, steps := range paths.metadata {
+		values := evalJSONPath(steps, item)
+		switch len(values) {
+		case 0:
+		case 1:
+			metadata[field] = jsonScalar(values[0])
+		default:
+			metadata[field] = jsonStrings(values)
+		}
+	}
+	return schema.Document{PageContent: content, Metadata: metadata}, true
+}
+
+func fetchJSON(ctx context.Context, target string, headers map[string]string) (any, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected status code %d", target, resp.StatusCode)
+	}
+
+	var body any
+	decoder := json.NewDecoder(io.LimitReader(resp.Body, apiMaxResponseBytes))
+	decoder.UseNumber()
+	if err := decoder.Decode(&body); err != nil {
+		return nil, fmt.Errorf("%s: failed to decode response: %v", target, err)
+	}
+	return body, nil
+}
+
+// parseJSONPath parses the JSONPath subset the API connector supports. A
+// path without the leading $ is taken relative to the root; "$" is the root
+// itself, with no steps.
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+	rest := strings.TrimPrefix(strings.TrimSpace(path), "$")
+	steps := []jsonPathStep{}
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("invalid path %q: missing ]", path)
+			}
+			selector := strings.TrimSpace(rest[1:end])
+			rest = rest[end+1:]
+			switch {
+			case selector == "*":
+				steps = append(steps, jsonPathStep{})
+			case len(selector) >= 2 && (selector[0] == '\'' || selector[0] == '"') && selector[len(selector)-1] == selector[0]:
+				steps = append(steps, jsonPathStep{key: selector[1 : len(selector)-1]})
+			default:
+				index, err := strconv.Atoi(selector)
+				if err != nil {
+					return nil, fmt.Errorf("invalid path %q: bad selector [%s]", path, selector)
+				}
+				steps = append(steps, jsonPathStep{index: &index})
+			}
+		default:
+			rest = strings.TrimPrefix(rest, ".")
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			key := rest[:end]
+			rest = rest[end:]
+			if key == "" {
+				return nil, fmt.Errorf("invalid path %q: empty key", path)
+			}
+			if key == "*" {
+				steps = append(steps, jsonPathStep{})
+			} else {
+				steps = append(steps, jsonPathStep{key: key})
+			}
+		}
+	}
+	return steps, nil
+}
+
+// evalJSONPath returns every value the steps select: the value itself for
+// the no steps of "$", and nothing for the nil steps of a path not set.
+func evalJSONPath(steps []jsonPathStep, value any) []any {
+	if steps == nil {
+		return nil
+	}
+	values := []any{value}
+	for _, step := range steps {
+		var selected []any
+		for _, value := range values {
+			switch v := value.(type) {
+			case map[string]any:
+				if step.index != nil {
+					continue
+				}
+				if step.key == "" {
+					for _, child := range v {
+						selected = append(selected, child)
+					}
+				} else if child, ok := v[step.key]; ok {
+					selected = append(selected, child)
+				}
+			case []any:
+				switch {
+				case step.index != nil:
+					index := *step.index
+					if index < 0 {
+						index += len(v)
+					}
+					if index >= 0 && index < len(v) {
+						selected = append(selected, v[index])
+					}
+				case step.key == "":
+					selected = append(selected, v...)
+				}
+			}
+		}
+		values = selected
+	}
+	return values
+}
+
+// jsonStrings renders selected values as text: strings as they are, other
+// scalars formatted and objects and arrays as JSON. Nulls are dropped.
+func jsonStrings(values []any) []string {
+	var texts []string
+	for _, value := range values {
+		switch v := value.(type) {
+		case nil:
+		case string:
+			texts = append(texts, v)
+		case json.Number, bool:
+			texts = append(texts, fmt.Sprint(v))
+		default:
+			data, _ := json.Marshal(v)
+			texts = append(texts, string(data))
+		}
+	}
+	return texts
+}
+
+// jsonScalar turns a selected value into a metadata value, keeping numbers
+// numeric.
+func jsonScalar(value any) any {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case string, bool, nil:
+		return v
+	}
+	return jsonStrings([]any{value})[0]
+}
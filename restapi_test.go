@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseJSONPath(t *testing.T) {
+	index := func(i int) *int { return &i }
+	tests := []struct {
+		path    string
+		want    []jsonPathStep
+		wantErr bool
+	}{
+		{path: "$", want: []jsonPathStep{}},
+		{path: "$[*]", want: []jsonPathStep{{}}},
+		{path: "$.items", want: []jsonPathStep{{key: "items"}}},
+		{path: "items", want: []jsonPathStep{{key: "items"}}},
+		{path: " $.data.items ", want: []jsonPathStep{{key: "data"}, {key: "items"}}},
+		{path: "$.items[*]", want: []jsonPathStep{{key: "items"}, {}}},
+		{path: "$.items.*", want: []jsonPathStep{{key: "items"}, {}}},
+		{path: "$.items[0]", want: []jsonPathStep{{key: "items"}, {index: index(0)}}},
+		{path: "$.items[-1]", want: []jsonPathStep{{key: "items"}, {index: index(-1)}}},
+		{path: "$['a.b']", want: []jsonPathStep{{key: "a.b"}}},
+		{path: `$["a b"].c`, want: []jsonPathStep{{key: "a b"}, {key: "c"}}},
+		{path: "$.items[0", wantErr: true},
+		{path: "$.items[x]", wantErr: true},
+		{path: "$..items", wantErr: true},
+		{path: "$.items.", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := parseJSONPath(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseJSONPath(%q) error = %v, want error %v", tt.path, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseJSONPath(%q) = %+v, want %+v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvalJSONPath(t *testing.T) {
+	var doc any
+	if err := json.Unmarshal([]byte(`{"data": {"items": [{"title": "a"}, {"title": "b"}, {"name": "c"}]}}`), &doc); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want []any
+	}{
+		{"$.data.items[*].title", []any{"a", "b"}},
+		{"$.data.items[1].title", []any{"b"}},
+		{"$.data.items[-1].name", []any{"c"}},
+		{"$.data.items[5].title", nil},
+		{"$.data.missing", nil},
+		{"$.data.items.title", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			steps, err := parseJSONPath(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := evalJSONPath(steps, doc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("evalJSONPath(%q) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvalJSONPathRoot(t *testing.T) {
+	var doc any
+	if err := json.Unmarshal([]byte(`["a", "b"]`), &doc); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want []any
+	}{
+		{"$", []any{[]any{"a", "b"}}},
+		{"$[*]", []any{"a", "b"}},
+		{"$[1]", []any{"b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			steps, err := parseJSONPath(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := evalJSONPath(steps, doc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("evalJSONPath(%q) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+	if got := evalJSONPath(nil, doc); got != nil {
+		t.Errorf("evalJSONPath(nil) = %v, want nothing", got)
+	}
+}
+
+func TestAPIDocumentStringItems(t *testing.T) {
+	source := APISource{Name: "quotes", URL: "https://api.example.com/quotes", Items: "$.quotes[*]", Content: "$"}
+	if err := validateAPISource(source); err != nil {
+		t.Fatal(err)
+	}
+	paths, err := parseAPIPaths(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, ok := apiDocument(source, paths, source.URL, 0, "Stay hungry, stay foolish.")
+	if !ok || doc.PageContent != "Stay hungry, stay foolish." {
+		t.Errorf("apiDocument = %q, %v, want the string item", doc.PageContent, ok)
+	}
+}
+
+func TestParseAPIPathsRejectsInvalidPaths(t *testing.T) {
+	source := APISource{Items: "$.items[*]", Content: "$.text", Metadata: map[string]string{"author": "$.author["}}
+	if _, err := parseAPIPaths(source); err == nil {
+		t.Error("parseAPIPaths accepted an invalid metadata path")
+	}
+}
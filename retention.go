@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type RetentionConfig struct {
+	IntervalMinutes int `json:"interval_minutes"` // Enforce the retention periods this often; 0 disables
+	SessionDays     int `json:"session_days"`     // Delete chat sessions with no message in this many days; 0 keeps them
+	AuditDays       int `json:"audit_days"`       // Drop audit log entries older than this many days; 0 keeps them
+}
+
+func validateRetention(cfg RetentionConfig) error {
+	if cfg.IntervalMinutes < 0 || cfg.SessionDays < 0 || cfg.AuditDays < 0 {
+		return fmt.Errorf("retention settings must not be negative")
+	}
+	return nil
+}
+
+// scheduleRetention runs enforce every interval, starting right away.
+func scheduleRetention(ctx context.Context, interval time.Duration, enforce func(context.Context)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		enforce(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// expireSessions deletes the chat sessions idle for longer than
+// retention.session_days. It runs on the leading replica.
+func expireSessions(ctx context.Context) {
+	days := getConfig().Retention.SessionDays
+	if days == 0 {
+		return
+	}
+	cutoff := time.Now().AddDate(0, 0, -days)
+	values, err := sharedState.Scan(ctx, sessionRecordKey(""))
+	if err != nil {
+		log.Printf("Error listing chat sessions: %v", err)
+		return
+	}
+	expired := 0
+	for _, value := range values {
+		var record SessionRecord
+		if err := json.Unmarshal(value, &record); err != nil {
+			log.Printf("Invalid chat session record: %v", err)
+			continue
+		}
+		if record.LastActiveAt.After(cutoff) {
+			continue
+		}
+		if err := sessionContext(record.ID).purge(ctx); err != nil {
+			log.Printf("Error deleting chat session %s: %v", record.ID, err)
+			continue
+		}
+		expired++
+	}
+	if expired > 0 {
+		log.Printf("Deleted %d chat sessions idle for more than %d days", expired, days)
+	}
+}
+
+// trimAudit drops the entries older than retention.audit_days from the
+// audit log. Every replica trims its own log.
+func trimAudit(context.Context) {
+	cfg := getConfig()
+	if cfg.Retention.AuditDays == 0 || cfg.Audit.Path == "" {
+		return
+	}
+	cutoff := time.Now().AddDate(0, 0, -cfg.Retention.AuditDays)
+	dropped := 0
+	err := rewriteAudit(cfg.Audit.Path, func(entries []AuditEntry) ([]AuditEntry, bool) {
+		// Entries are appended in time order
+		for dropped < len(entries) && entries[dropped].Time.Before(cutoff) {
+			dropped++
+		}
+		return entries[dropped:], dropped > 0
+	})
+	if err != nil {
+		log.Printf("Error trimming audit log: %v", err)
+		return
+	}
+	if dropped > 0 {
+		log.Printf("Dropped %d audit log entries older than %d days", dropped, cfg.Retention.AuditDays)
+	}
+}
+
+// PurgeReport is what deleting a user's data removed.
+type PurgeReport struct {
+	User         string `json:"user"`
+	Facts        int    `json:"facts"`         // Facts pinned to or extracted about the user
+	Sessions     int    `json:"sessions"`      // Chat sessions the user asked in, with their facts
+	AuditEntries int    `json:"audit_entries"` // Entries of this replica's audit log stripped of their content
+}
+
+// purgeUser deletes what the service keeps about a user: their facts, the
+// sessions they asked in and the content of their audit log entries.
+func purgeUser(ctx context.Context, user string) (PurgeReport, error) {
+	report := PurgeReport{User: user}
+	var err error
+	if report.Facts, err = deleteFacts(ctx, ScopeUser, user, ""); err != nil {
+		return report, fmt.Errorf("failed to delete facts: %v", err)
+	}
+
+	values, err := sharedState.Scan(ctx, userSessionKey(user, ""))
+	if err != nil {
+		return report, fmt.Errorf("failed to list sessions: %v", err)
+	}
+	sessions := make([]string, len(values))
+	for i, value := range values {
+		sessions[i] = string(value)
+		if err := sessionContext(sessions[i]).purge(ctx); err != nil {
+			return report, fmt.Errorf("failed to delete session %s: %v", sessions[i], err)
+		}
+		report.Sessions++
+	}
+
+	if path := getConfig().Audit.Path; path != "" {
+		err := rewriteAudit(path, func(entries []AuditEntry) ([]AuditEntry, bool) {
+			for i := range entries {
+				message := entries[i].Message
+				if message.UserID == user || (message.SessionID != "" && slices.Contains(sessions, message.SessionID)) {
+					entries[i].tombstone()
+					report.AuditEntries++
+				}
+			}
+			return entries, report.AuditEntries > 0
+		})
+		if err != nil {
+			return report, fmt.Errorf("failed to purge the audit log: %v", err)
+		}
+	}
+	return report, nil
+}
+
+// deleteUserData handles DELETE /users/:id/data, for requests to be
+// forgotten.
+func deleteUserData(c *gin.Context) {
+	forgetUser(c, c.Param("id"))
+}
+
+// forgetUser purges the data of user and responds with what was deleted,
+// partly so when it fails midway.
+func forgetUser(c *gin.Context, user string) {
+	if !idPattern.MatchString(user) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	report, err := purgeUser(c.Request.Context(), user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "report": report})
+		return
+	}
+	log.Printf("Purged the data of user %s: %d facts, %d sessions, %d audit entries", user, report.Facts, report.Sessions, report.AuditEntries)
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestPurgeDefaultSessionUser(t *testing.T) {
+	r := newTestRouter(t, nil)
+
+	w := serveJSON(t, r, "POST", "/chat", `{"msg": "Hello there", "user_id": "u-1"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST /chat: status %d, body %s", w.Code, w.Body)
+	}
+	if tree := chatContext.tree(context.Background()); len(tree.Messages) == 0 {
+		t.Fatal("the default session recorded no messages")
+	}
+
+	w = serveJSON(t, r, "DELETE", "/users/u-1/data", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("DELETE /users/u-1/data: status %d, body %s", w.Code, w.Body)
+	}
+	var report PurgeReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Sessions != 1 {
+		t.Errorf("purged %d sessions, want 1", report.Sessions)
+	}
+	if tree := chatContext.tree(context.Background()); len(tree.Messages) > 0 {
+		t.Errorf("the default session still has %d messages", len(tree.Messages))
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+const (
+	IntentChitchat  = "chitchat"  // Small talk, answered without retrieval
+	IntentKnowledge = "knowledge" // Questions about the documents, answered with RAG
+	IntentCommand   = "command"   // Admin-style requests, handled by the agent's tools
+
+	ClassifierRules = "rules"
+	ClassifierLLM   = "llm"
+)
+
+const chitchatSystemMessage = "You are a friendly assistant for a document question answering service. " +
+	"Reply briefly to the user's small talk and offer to answer questions about the documents."
+
+const clarifySystemMessage = "You are an assistant for a document question answering service. " +
+	"The user's message is too short to search the documents with. Ask one brief question about what they would like to know."
+
+var (
+	chitchatPattern = regexp.MustCompile(`^(hi|hello|hey|hiya|yo|greetings|good (morning|afternoon|evening|night)|` +
+		`thanks|thank you|thx|cheers|bye|goodbye|see you|how are you|how's it going|who are you|what can you do|` +
+		`ok|okay|cool|great|nice|awesome)( there| a lot| so much| again| doing| today)*$`)
+	// fillerWords say nothing about what to search for, like stopwords
+	fillerWords = map[string]bool{"a": true, "an": true, "about": true, "um": true, "uh": true, "hmm": true, "er": true,
+		"so": true, "please": true, "pls": true, "tell": true, "me": true, "more": true, "something": true,
+		"anything": true, "stuff": true, "thing": true, "things": true, "info": true, "help": true, "question": true}
+	commandPattern = regexp.MustCompile(`^(/\w+|(list|show)( me)?( all)?( the)? (documents|docs|sources|files|tables|jobs)\b)`)
+)
+
+type RouterConfig struct {
+	Enabled    bool   `json:"enabled"`    // Classify messages sent without a mode
+	Classifier string `json:"classifier"` // "rules" or "llm"
+
+	DatasetRouting string `json:"dataset_routing"` // "embedding" or "llm": how datasets are picked for a query
+	MaxDatasets    int    `json:"max_datasets"`    // Datasets searched per query when routed
+
+	ClarifyShortQueries bool `json:"clarify_short_queries"` // Ask what the user means instead of searching for queries with too few terms
+	MinQueryTerms       int  `json:"min_query_terms"`       // Words other than stopwords a query needs to be searched
+}
+
+func validateRouter(cfg RouterConfig) error {
+	if cfg.Classifier != ClassifierRules && cfg.Classifier != ClassifierLLM {
+		return fmt.Errorf("unknown router classifier %q", cfg.Classifier)
+	}
+	if cfg.DatasetRouting != DatasetRoutingEmbedding && cfg.DatasetRouting != DatasetRoutingLLM {
+		return fmt.Errorf("unknown dataset routing %q", cfg.DatasetRouting)
+	}
+	if cfg.MaxDatasets < 1 {
+		return fmt.Errorf("router.max_datasets must be at least 1")
+	}
+	if cfg.MinQueryTerms < 1 {
+		return fmt.Errorf("router.min_query_terms must be at least 1")
+	}
+	return nil
+}
+
+// classifyQuery returns the intent of a message. The LLM classifier falls
+// back to the rules when the model gives no usable answer.
+func classifyQuery(ctx context.Context, llm Generator, msg Message) string {
+	if len(msg.Images) > 0 {
+		return IntentKnowledge
+	}
+	if getConfig().Router.Classifier == ClassifierLLM {
+		prompt := fmt.Sprintf("Classify the user message below as one of: %q for greetings and small talk, "+
+			"%q for questions that need the document knowledge base, %q for requests to list or inspect "+
+			"the ingested documents, tables or jobs. Respond with JSON of the form {\"intent\": \"...\"}.\n\nMessage:\n%s",
+			IntentChitchat, IntentKnowledge, IntentCommand, msg.Msg)
+
+		var result struct {
+			Intent string `json:"intent"`
+		}
+		if err := generateJSON(ctx, llm, prompt, &result); err == nil {
+			switch result.Intent {
+			case IntentChitchat, IntentKnowledge, IntentCommand:
+				return result.Intent
+			}
+		} else {
+			log.Printf("Query classification failed, using rules: %v", err)
+		}
+	}
+	return classifyByRules(msg.Msg)
+}
+
+func classifyByRules(text string) string {
+	normalized := strings.ToLower(strings.TrimSpace(text))
+	if commandPattern.MatchString(normalized) {
+		return IntentCommand
+	}
+	normalized = strings.Join(strings.Fields(strings.Trim(normalized, "!.?,:) ")), " ")
+	if chitchatPattern.MatchString(normalized) {
+		return IntentChitchat
+	}
+	return IntentKnowledge
+}
+
+// routeQuery picks the mode for a message sent without one.
+func routeQuery(ctx context.Context, llm Generator, msg Message) string {
+	if msg.Mode != "" || !getConfig().Router.Enabled {
+		return msg.Mode
+	}
+	intent := classifyQuery(ctx, llm, msg)
+	log.Printf("Routed query as %s", intent)
+	switch intent {
+	case IntentChitchat:
+		return ModeChitchat
+	case IntentCommand:
+		return ModeAgent
+	default:
+		return ModeRAG
+	}
+}
+
+// needsClarification reports whether a message sent without a mode that
+// starts a conversation has fewer than router.min_query_terms words that are
+// not stopwords or fillers, e.g. "what about it?", and
+// router.clarify_short_queries is on. Follow-ups can lean on the history and
+// images on themselves, so they are always searched.
+func needsClarification(msg Message, history []string) bool {
+	cfg := getConfig().Router
+	if !cfg.ClarifyShortQueries || msg.Mode != "" || len(msg.Images) > 0 || len(history) > 0 {
+		return false
+	}
+	terms := 0
+	for _, word := range tokenize(msg.Msg) {
+		if !isStopword(word) && !fillerWords[word] {
+			terms++
+		}
+	}
+	return terms < cfg.MinQueryTerms
+}
+
+// retrieves reports whether mode answers from retrieved documents.
+func retrieves(mode string) bool {
+	return mode != ModeAgent && mode != ModeChitchat && mode != ModeClarify && mode != ModeRepeat && mode != ModeCorpus
+}
+
+// answerChitchat replies to small talk from the conversation alone, skipping
+// retrieval.
+func answerChitchat(ctx context.Context, llm Generator, msg Message, stream *answerStream) (string, error) {
+	return answerDirectly(ctx, llm, msg, stream, chitchatSystemMessage)
+}
+
+// answerClarify asks the user what a query too short to search is about.
+func answerClarify(ctx context.Context, llm Generator, msg Message, stream *answerStream) (string, error) {
+	return answerDirectly(ctx, llm, msg, stream, clarifySystemMessage)
+}
+
+// answerDirectly answers from the conversation alone with systemMessage in
+// place of the built-in one.
+func answerDirectly(ctx context.Context, llm Generator, msg Message, stream *answerStream, systemMessage string) (string, error) {
+	template := promptTemplateFor(queryLanguage(msg)).render(msg)
+	template.SystemMessage = strings.Replace(template.SystemMessage, defaultPromptTemplate.SystemMessage, systemMessage, 1)
+	template.Examples = nil
+
+	prompt := constructPrompt(conversation(msg), nil, msg.Msg, template)
+	return generate(ctx, llm, prompt, stream.options(generationOptions(msg))...)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Malware scanners uploads can be checked with
+const (
+	ScanClamAV  = "clamav"  // A clamd daemon, over its INSTREAM command
+	ScanCommand = "command" // A program run with the file's path
+)
+
+// clamChunk is the size of the chunks a file is streamed to clamd in.
+const clamChunk = 64 << 10
+
+type ScanConfig struct {
+	Engine         string   `json:"engine"`          // "clamav" or "command"; empty scans nothing
+	Address        string   `json:"address"`         // clamd, e.g. "tcp://clamav:3310" or "unix:///run/clamav/clamd.ctl"
+	Command        []string `json:"command"`         // Run with the file's path appended; exit status 0 means clean, 1 infected, anything else a failure
+	TimeoutSeconds int      `json:"timeout_seconds"` // Per file
+	FailOpen       bool     `json:"fail_open"`       // Accept files when the scanner fails, rather than refusing them
+}
+
+func validateScan(cfg ScanConfig) error {
+	if cfg.TimeoutSeconds <= 0 {
+		return fmt.Errorf("scan.timeout_seconds must be positive")
+	}
+	switch cfg.Engine {
+	case "":
+	case ScanClamAV:
+		parsed, err := url.Parse(cfg.Address)
+		if err != nil || (parsed.Scheme != "tcp" && parsed.Scheme != "unix") || (parsed.Host == "" && parsed.Path == "") {
+			return fmt.Errorf(`scan.address must be a "tcp://host:port" or "unix:///path" URL for the clamav engine`)
+		}
+	case ScanCommand:
+		if len(cfg.Command) == 0 {
+			return fmt.Errorf("scan.command is required for the command engine")
+		}
+	default:
+		return fmt.Errorf(`scan.engine must be "clamav" or "command"`)
+	}
+	return nil
+}
+
+// errInfected is returned by scanners for a file found to be malware.
+var errInfected = errors.New("infected")
+
+// scanUpload checks an uploaded file for malware before it is parsed. It
+// returns the status to refuse the upload with and why, or 0 when the file
+// may be ingested.
+func scanUpload(ctx context.Context, up upload) (int, error) {
+	cfg := getConfig().Scan
+	if cfg.Engine == "" {
+		return 0, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.TimeoutSeconds)*time.Second)
+	defer cancel()
+
+	var verdict string
+	var err error
+	if cfg.Engine == ScanClamAV {
+		verdict, err = scanClamAV(ctx, cfg.Address, up.Path)
+	} else {
+		verdict, err = scanCommand(ctx, cfg.Command, up.Path)
+	}
+	switch {
+	case errors.Is(err, errInfected):
+		log.Printf("Rejected upload %s: %s", up.Filename, verdict)
+		return http.StatusUnprocessableEntity, fmt.Errorf("File rejected by the malware scan: %s", verdict)
+	case err != nil && cfg.FailOpen:
+		log.Printf("Accepted upload %s unscanned: %v", up.Filename, err)
+	case err != nil:
+		log.Printf("Refused upload %s, the malware scan failed: %v", up.Filename, err)
+		return http.StatusServiceUnavailable, fmt.Errorf("The malware scan failed, try again later")
+	}
+	return 0, nil
+}
+
+// scanClamAV streams the file at path to clamd and returns the signature it
+// found, if any.
+func scanClamAV(ctx context.Context, address, path string) (string, error) {
+	target, err := url.Parse(address)
+	if err != nil {
+		return "", err
+	}
+	network, host := "tcp", target.Host
+	if target.Scheme == "unix" {
+		network, host = "unix", target.Path
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, host)
+	if err != nil {
+		return "", fmt.Errorf("failed to reach clamd: %v", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	// Each chunk goes with its length; an empty one ends the stream
+	chunk := make([]byte, 4+clamChunk)
+	for {
+		n, err := file.Read(chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk[:4], uint32(n))
+			if _, err := conn.Write(chunk[:4+n]); err != nil {
+				return "", fmt.Errorf("failed to send the file to clamd: %v", err)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the clamd reply: %v", err)
+	}
+	result := strings.TrimPrefix(string(bytes.TrimRight(reply, "\x00\n")), "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), errInfected
+	}
+	return "", fmt.Errorf("clamd: %s", result)
+}
+
+// scanCommand runs the scanner command on the file at path, following the
+// exit status convention of clamscan.
+func scanCommand(ctx context.Context, command []string, path string) (string, error) {
+	cmd := exec.CommandContext(ctx, command[0], append(command[1:], path)...)
+	var output bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &output, &output
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() == 1 {
+		verdict := strings.TrimSpace(output.String())
+		if verdict == "" {
+			verdict = "infected"
+		}
+		// Scanners report the path, which is ours rather than the client's
+		return strings.ReplaceAll(verdict, path, "file"), errInfected
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s: %v: %s", command[0], err, bytes.TrimSpace(output.Bytes()))
+	}
+	return "", nil
+}
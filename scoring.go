@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/tmc/langchaingo/schema"
+)
+
+type ScoringConfig struct {
+	Recency RecencyConfig `json:"recency"`
+	Boosts  []BoostRule   `json:"boosts"`
+}
+
+// BoostRule adds Boost to the score of chunks whose Field equals Value, or
+// contains it for list fields.
+type BoostRule struct {
+	Field string  `json:"field"`
+	Value any     `json:"value"`
+	Boost float32 `json:"boost"`
+}
+
+type RecencyConfig struct {
+	Field        string  `json:"field"`          // Metadata field with the document's update time
+	HalfLifeDays float64 `json:"half_life_days"` // Age at which the recency boost halves; 0 disables it
+	Weight       float64 `json:"weight"`         // Share of the score subject to decay, 0-1
+}
+
+// rescoreDocuments adjusts similarity scores with the configured scoring
+// rules and re-sorts the documents by the adjusted score.
+func rescoreDocuments(docs []schema.Document) []schema.Document {
+	cfg := getConfig().Scoring
+	if cfg.Recency.HalfLifeDays <= 0 && len(cfg.Boosts) == 0 {
+		return docs
+	}
+
+	now := time.Now()
+	for i := range docs {
+		if cfg.Recency.HalfLifeDays > 0 {
+			docs[i].Score *= float32(recencyFactor(docs[i], cfg.Recency, now))
+		}
+		for _, rule := range cfg.Boosts {
+			if rule.matches(docs[i]) {
+				docs[i].Score += rule.Boost
+			}
+		}
+	}
+	sort.SliceStable(docs, func(i, j int) bool { return docs[i].Score > docs[j].Score })
+	return docs
+}
+
+// recencyFactor scales the decaying share of the score by 0.5 per half-life
+// of age. Documents without a parseable update time are left as they are.
+func recencyFactor(doc schema.Document, cfg RecencyConfig, now time.Time) float64 {
+	value, _ := doc.Metadata[cfg.Field].(string)
+	updated, ok := parseDate(value)
+	if !ok {
+		return 1
+	}
+
+	ageDays := max(now.Sub(updated).Hours()/24, 0)
+	decay := math.Pow(0.5, ageDays/cfg.HalfLifeDays)
+	return 1 - cfg.Weight + cfg.Weight*decay
+}
+
+func (r BoostRule) matches(doc schema.Document) bool {
+	want := fmt.Sprint(r.Value)
+	switch value := doc.Metadata[r.Field].(type) {
+	case nil:
+		return false
+	case []any:
+		for _, element := range value {
+			if fmt.Sprint(element) == want {
+				return true
+			}
+		}
+		return false
+	case []string:
+		return slices.Contains(value, want)
+	default:
+		return fmt.Sprint(value) == want
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Where secrets are read from
+const (
+	SecretsVault = "vault" // HashiCorp Vault's KV engine, version 1 or 2
+	SecretsAWS   = "aws"   // AWS Secrets Manager
+)
+
+// k8sTokenPath holds the token of the pod's service account, which the
+// Kubernetes auth method of Vault logs in with.
+const k8sTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// SecretsConfig resolves secrets into environment variables on startup, for
+// the settings that expand ${VAR} references and OPENAI_API_KEY to read.
+type SecretsConfig struct {
+	Provider       string            `json:"provider"`        // "vault" or "aws"; empty reads secrets from the environment only
+	Env            map[string]string `json:"env"`             // Environment variable to set, by name, to a secret: "path#key" for Vault, "secret-id" or "secret-id#key" for AWS
+	RefreshMinutes int               `json:"refresh_minutes"` // Read the secrets again this often, for rotation; 0 reads them on startup only
+
+	Vault VaultConfig      `json:"vault"`
+	AWS   AWSSecretsConfig `json:"aws"`
+}
+
+type VaultConfig struct {
+	Address   string `json:"address"`    // e.g. "https://vault.internal:8200"; VAULT_ADDR when empty
+	Token     string `json:"token"`      // With environment variables expanded; VAULT_TOKEN when empty
+	Namespace string `json:"namespace"`  // Vault Enterprise namespace
+	Role      string `json:"role"`       // Log in with the Kubernetes auth method as this role instead of a token
+	AuthMount string `json:"auth_mount"` // Where the Kubernetes auth method is mounted
+	CAFile    string `json:"ca_file"`    // PEM certificates trusted for Vault, besides the system ones
+}
+
+func validateSecrets(cfg SecretsConfig) error {
+	if cfg.RefreshMinutes < 0 {
+		return fmt.Errorf("secrets.refresh_minutes must not be negative")
+	}
+	switch cfg.Provider {
+	case "":
+		if len(cfg.Env) > 0 {
+			return fmt.Errorf("secrets.env needs secrets.provider")
+		}
+		return nil
+	case SecretsVault, SecretsAWS:
+	default:
+		return fmt.Errorf(`secrets.provider must be "vault" or "aws"`)
+	}
+	for name, ref := range cfg.Env {
+		if name == "" || strings.ContainsAny(name, "= ") {
+			return fmt.Errorf("secrets.env has an invalid variable name %q", name)
+		}
+		path, key, _ := strings.Cut(ref, "#")
+		if path == "" || (cfg.Provider == SecretsVault && key == "") {
+			return fmt.Errorf("secrets.env.%s must be %s", name, map[string]string{SecretsVault: `"path#key"`, SecretsAWS: `"secret-id" or "secret-id#key"`}[cfg.Provider])
+		}
+	}
+	return nil
+}
+
+// secretReader reads the secret at path, as a string for AWS secrets stored
+// as plain text or as its fields otherwise.
+type secretReader interface {
+	read(ctx context.Context, path string) (string, map[string]any, error)
+}
+
+var secretsClient = &http.Client{Timeout: 30 * time.Second}
+
+// loadSecrets sets the environment variables of secrets.env to the secrets
+// they name, and keeps them current in the background when
+// secrets.refresh_minutes is set. It fails when any secret cannot be read.
+func loadSecrets(cfg SecretsConfig) error {
+	if cfg.Provider == "" || len(cfg.Env) == 0 {
+		return nil
+	}
+	reader, err := newSecretReader(cfg)
+	if err != nil {
+		return err
+	}
+	values, err := readSecrets(context.Background(), reader, cfg.Env)
+	if err != nil {
+		return err
+	}
+	for name, value := range values {
+		os.Setenv(name, value)
+	}
+	log.Printf("Loaded %d secrets from %s", len(values), cfg.Provider)
+	if cfg.RefreshMinutes > 0 {
+		go refreshSecrets(reader, cfg.Env, time.Duration(cfg.RefreshMinutes)*time.Minute)
+	}
+	return nil
+}
+
+func newSecretReader(cfg SecretsConfig) (secretReader, error) {
+	if cfg.Provider == SecretsAWS {
+		return newAWSSecrets(cfg.AWS)
+	}
+	return newVault(cfg.Vault)
+}
+
+// readSecrets reads every secret of env, each path once.
+func readSecrets(ctx context.Context, reader secretReader, env map[string]string) (map[string]string, error) {
+	type secret struct {
+		text   string
+		fields map[string]any
+	}
+	read := map[string]secret{}
+	values := map[string]string{}
+	for name, ref := range env {
+		path, key, _ := strings.Cut(ref, "#")
+		s, ok := read[path]
+		if !ok {
+			text, fields, err := reader.read(ctx, path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read secret %s for %s: %v", path, name, err)
+			}
+			s = secret{text, fields}
+			read[path] = s
+		}
+		if key == "" {
+			values[name] = s.text
+			continue
+		}
+		value, ok := s.fields[key]
+		if !ok {
+			return nil, fmt.Errorf("secret %s has no key %q for %s", path, key, name)
+		}
+		if text, ok := value.(string); ok {
+			values[name] = text
+		} else {
+			values[name] = fmt.Sprint(value)
+		}
+	}
+	return values, nil
+}
+
+// refreshSecrets reads the secrets every interval and updates the variables
+// of those that changed. A failed refresh keeps the previous values.
+func refreshSecrets(reader secretReader, env map[string]string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*secretsClient.Timeout)
+		values, err := readSecrets(ctx, reader, env)
+		cancel()
+		if err != nil {
+			log.Printf("Error refreshing secrets: %v", err)
+			continue
+		}
+		var rotated []string
+		for name, value := range values {
+			if os.Getenv(name) != value {
+				os.Setenv(name, value)
+				rotated = append(rotated, name)
+			}
+		}
+		if len(rotated) > 0 {
+			sort.Strings(rotated)
+			log.Printf("Rotated secrets %s", strings.Join(rotated, ", "))
+		}
+	}
+}
+
+type vault struct {
+	cfg    VaultConfig
+	client *http.Client
+}
+
+func newVault(cfg VaultConfig) (*vault, error) {
+	if cfg.Address == "" {
+		cfg.Address = os.Getenv("VAULT_ADDR")
+	}
+	if cfg.Address == "" {
+		return nil, fmt.Errorf("secrets.vault.address or VAULT_ADDR is required for the vault provider")
+	}
+	if cfg.AuthMount == "" {
+		cfg.AuthMount = "kubernetes"
+	}
+	client := secretsClient
+	if cfg.CAFile != "" {
+		tlsConfig, err := clientTLS("secrets.vault", cfg.CAFile, "", "", false)
+		if err != nil {
+			return nil, err
+		}
+		client = &http.Client{Timeout: secretsClient.Timeout, Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}}
+	}
+	return &vault{cfg: cfg, client: client}, nil
+}
+
+// token returns the configured token, or logs in as the Kubernetes role for
+// one. Logging in on every read keeps the token from expiring between
+// refreshes.
+func (v *vault) token(ctx context.Context) (string, error) {
+	if v.cfg.Role == "" {
+		if token := os.ExpandEnv(v.cfg.Token); token != "" {
+			return token, nil
+		}
+		if token := os.Getenv("VAULT_TOKEN"); token != "" {
+			return token, nil
+		}
+		return "", fmt.Errorf("secrets.vault.token, VAULT_TOKEN or secrets.vault.role is required")
+	}
+	jwt, err := os.ReadFile(k8sTokenPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the service account token: %v", err)
+	}
+	body, _ := json.Marshal(map[string]string{"role": v.cfg.Role, "jwt": strings.TrimSpace(string(jwt))})
+	var login struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err := v.do(ctx, http.MethodPost, "auth/"+v.cfg.AuthMount+"/login", "", body, &login); err != nil {
+		return "", fmt.Errorf("failed to log in to Vault: %v", err)
+	}
+	return login.Auth.ClientToken, nil
+}
+
+func (v *vault) read(ctx context.Context, path string) (string, map[string]any, error) {
+	token, err := v.token(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	var secret struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := v.do(ctx, http.MethodGet, strings.TrimPrefix(path, "/"), token, nil, &secret); err != nil {
+		return "", nil, err
+	}
+	// KV version 2 nests the fields under data, next to their metadata
+	if data, ok := secret.Data["data"].(map[string]any); ok {
+		if _, ok := secret.Data["metadata"]; ok {
+			return "", data, nil
+		}
+	}
+	return "", secret.Data, nil
+}
+
+func (v *vault) do(ctx context.Context, method, path, token string, body []byte, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(v.cfg.Address, "/")+"/v1/"+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if v.cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.cfg.Namespace)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("vault returned %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
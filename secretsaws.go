@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The instance metadata service hands out the credentials of an EC2
+// instance's role; the ECS agent those of a task's role.
+const (
+	imdsURL   = "http://169.254.169.254/latest"
+	ecsCredIP = "http://169.254.170.2"
+)
+
+type AWSSecretsConfig struct {
+	Region   string `json:"region"`   // AWS_REGION or AWS_DEFAULT_REGION when empty
+	Endpoint string `json:"endpoint"` // e.g. a VPC endpoint; https://secretsmanager.<region>.amazonaws.com when empty
+}
+
+// awsCredentials are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN, else from the ECS task role or the EC2 instance role.
+type awsCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+type awsSecrets struct {
+	region   string
+	endpoint string
+
+	mu    sync.Mutex
+	creds awsCredentials // Of a role, cached until shortly before they expire
+}
+
+func newAWSSecrets(cfg AWSSecretsConfig) (*awsSecrets, error) {
+	region := cfg.Region
+	for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region == "" {
+			region = os.Getenv(name)
+		}
+	}
+	if region == "" {
+		return nil, fmt.Errorf("secrets.aws.region or AWS_REGION is required for the aws provider")
+	}
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + region + ".amazonaws.com"
+	}
+	return &awsSecrets{region: region, endpoint: strings.TrimRight(endpoint, "/")}, nil
+}
+
+func (a *awsSecrets) read(ctx context.Context, id string) (string, map[string]any, error) {
+	creds, err := a.credentials(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	body, _ := json.Marshal(map[string]string{"SecretId": id})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signAWS(req, body, creds, a.region, "secretsmanager", time.Now())
+
+	resp, err := secretsClient.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", nil, fmt.Errorf("secrets manager returned %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	var secret struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", nil, fmt.Errorf("invalid secrets manager response: %v", err)
+	}
+	// Key/value secrets are stored as a JSON object
+	var fields map[string]any
+	if json.Unmarshal([]byte(secret.SecretString), &fields) != nil {
+		fields = nil
+	}
+	return secret.SecretString, fields, nil
+}
+
+func (a *awsSecrets) credentials(ctx context.Context) (awsCredentials, error) {
+	if key := os.Getenv("AWS_ACCESS_KEY_ID"); key != "" {
+		return awsCredentials{AccessKeyID: key, SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"), Token: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.creds.AccessKeyID != "" && time.Now().Before(a.creds.Expiration.Add(-5*time.Minute)) {
+		return a.creds, nil
+	}
+
+	var creds awsCredentials
+	var err error
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		err = awsGet(ctx, ecsCredIP+uri, nil, &creds)
+	} else {
+		creds, err = instanceCredentials(ctx)
+	}
+	if err != nil {
+		return creds, fmt.Errorf("no AWS credentials in the environment or from the instance role: %v", err)
+	}
+	a.creds = creds
+	return creds, nil
+}
+
+// instanceCredentials reads the credentials of the EC2 instance role with
+// IMDSv2.
+func instanceCredentials(ctx context.Context) (awsCredentials, error) {
+	var creds awsCredentials
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, imdsURL+"/api/token", nil)
+	if err != nil {
+		return creds, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	resp, err := secretsClient.Do(req)
+	if err != nil {
+		return creds, err
+	}
+	token, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return creds, fmt.Errorf("instance metadata token: %s", resp.Status)
+	}
+	headers := map[string]string{"X-aws-ec2-metadata-token": string(token)}
+
+	var role string
+	if err := awsGet(ctx, imdsURL+"/meta-data/iam/security-credentials/", headers, &role); err != nil {
+		return creds, err
+	}
+	role, _, _ = strings.Cut(strings.TrimSpace(role), "\n")
+	err = awsGet(ctx, imdsURL+"/meta-data/iam/security-credentials/"+url.PathEscape(role), headers, &creds)
+	return creds, err
+}
+
+// awsGet reads a metadata endpoint into out, a *string for plain text.
+func awsGet(ctx context.Context, target string, headers map[string]string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := secretsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", target, resp.Status)
+	}
+	if text, ok := out.(*string); ok {
+		data, err := io.ReadAll(resp.Body)
+		*text = string(data)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// signAWS signs a request to an AWS API with Signature Version 4.
+func signAWS(req *http.Request, body []byte, creds awsCredentials, region, service string, now time.Time) {
+	stamp := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", stamp)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	request := strings.Join([]string{req.Method, path, req.URL.RawQuery, canonical.String(), signed, sha256Hex(body)}, "\n")
+
+	scope := stamp[:8] + "/" + region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + sha256Hex([]byte(request))
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{stamp[:8], region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKeyID+"/"+scope+", SignedHeaders="+signed+", Signature="+signature)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// defaultSession is the id of the conversation of chat requests sent without
+// a session_id.
+const defaultSession = "default"
+
+// idPattern is the form of session and user ids.
+var idPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// SessionMessage is a message of a chat session. Regenerating an answer or
+// branching from an earlier one adds a sibling rather than replacing
+// anything, so a session is a tree of messages and a conversation is the
+// path from the root to the message answered.
+type SessionMessage struct {
+	ID        string    `json:"id"`
+	ParentID  string    `json:"parent_id,omitempty"`
+	Role      string    `json:"role"` // "user" or "assistant"
+	Content   string    `json:"content"`
+	EditOf    string    `json:"edit_of,omitempty"` // The question this one is an edited version of
+	Sources   []string  `json:"sources,omitempty"` // Documents an answer drew on
+	Purged    bool      `json:"purged,omitempty"`  // The answer drew on a purged document and its text was removed
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SessionRecord indexes a session, for the retention janitor and purges of
+// a user's data to find it.
+type SessionRecord struct {
+	ID           string    `json:"id"`
+	Users        []string  `json:"users,omitempty"` // The user_ids sent with its questions
+	LastActiveAt time.Time `json:"last_active_at"`
+}
+
+// MessageTree is the stored form of a session.
+type MessageTree struct {
+	Head     string           `json:"head"`     // The latest message, which requests without a parent_id continue from
+	Messages []SessionMessage `json:"messages"` // Oldest first
+}
+
+// sessionContext returns the session with id, the default one for "".
+func sessionContext(id string) *ChatContext {
+	if id == "" || id == defaultSession {
+		return &chatContext
+	}
+	return &ChatContext{id: id, key: "chat:session:" + id}
+}
+
+func (c *ChatContext) treeKey() string {
+	return c.key + ":messages"
+}
+
+func sessionRecordKey(id string) string {
+	return "sessions:" + id
+}
+
+func userSessionKey(user, session string) string {
+	return "user:" + user + ":session:" + session
+}
+
+// record loads the index entry of the session.
+func (c *ChatContext) record(ctx context.Context) (SessionRecord, error) {
+	record := SessionRecord{ID: c.id}
+	_, err := loadState(ctx, sessionRecordKey(c.id), &record)
+	return record, err
+}
+
+// claim records that user asked in the session, so purging the user's data
+// deletes it. The default session is shared, so that deletes it for everyone.
+func (c *ChatContext) claim(ctx context.Context, user string) {
+	if user == "" {
+		return
+	}
+	_, err := updateState(ctx, sessionRecordKey(c.id), func(record *SessionRecord, _ bool) bool {
+		record.ID = c.id
+		if slices.Contains(record.Users, user) {
+			return false
+		}
+		record.Users = append(record.Users, user)
+		return true
+	})
+	if err == nil {
+		err = sharedState.Put(ctx, userSessionKey(user, c.id), []byte(c.id), 0)
+	}
+	if err != nil {
+		log.Printf("Error recording the user of chat session %s: %v", c.id, err)
+	}
+}
+
+// tree loads the messages of the session. Failures are logged and the
+// answer goes on without them.
+func (c *ChatContext) tree(ctx context.Context) MessageTree {
+	var tree MessageTree
+	value, ok, err := sharedState.Get(ctx, c.treeKey())
+	if err != nil {
+		log.Printf("Error reading chat session %s: %v", c.id, err)
+		return tree
+	}
+	if !ok {
+		return tree
+	}
+	if err := json.Unmarshal(value, &tree); err != nil {
+		log.Printf("Invalid chat session %s: %v", c.id, err)
+	}
+	return tree
+}
+
+// message returns a message of the session.
+func (c *ChatContext) message(ctx context.Context, id string) (SessionMessage, bool) {
+	for _, m := range c.tree(ctx).Messages {
+		if m.ID == id {
+			return m, true
+		}
+	}
+	return SessionMessage{}, false
+}
+
+// head returns the latest message of the session, "" if it has none.
+func (c *ChatContext) head(ctx context.Context) string {
+	return c.tree(ctx).Head
+}
+
+// branch returns the messages from the root of tree to id, oldest first. It
+// ends early where older messages were dropped.
+func (t MessageTree) branch(id string) []SessionMessage {
+	byID := make(map[string]SessionMessage, len(t.Messages))
+	for _, m := range t.Messages {
+		byID[m.ID] = m
+	}
+	var path []SessionMessage
+	for id != "" {
+		m, ok := byID[id]
+		if !ok {
+			break
+		}
+		path = append(path, m)
+		id = m.ParentID
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
+// turns returns the last memory.max_turns messages of the branch ending at
+// parent, as "User: " and "Assistant: " turns.
+func (c *ChatContext) turns(ctx context.Context, parent string) []string {
+	if parent == "" {
+		return nil
+	}
+	path := c.tree(ctx).branch(parent)
+	if keep := getConfig().Memory.MaxTurns; len(path) > keep {
+		path = path[len(path)-keep:]
+	}
+	turns := make([]string, len(path))
+	for i, m := range path {
+		if m.Role == RoleUser {
+			turns[i] = "User: " + m.Content
+		} else {
+			turns[i] = "Assistant: " + m.Content
+		}
+	}
+	return turns
+}
+
+// add records a message following parent, "" for the start of a new
+// conversation, makes it the head and returns its id.
+func (c *ChatContext) add(ctx context.Context, role, content, parent string) string {
+	return c.insert(ctx, SessionMessage{ParentID: parent, Role: role, Content: content})
+}
+
+// answer records an answer to the question parent, drawn from sources, so
+// that purging one of them removes it.
+func (c *ChatContext) answer(ctx context.Context, content, parent string, sources []string) string {
+	return c.insert(ctx, SessionMessage{ParentID: parent, Role: RoleAssistant, Content: content, Sources: sources})
+}
+
+// edit records content as an edit of the question original: a new question
+// in its place, whose branch leaves out the turns that followed original.
+func (c *ChatContext) edit(ctx context.Context, original SessionMessage, content string) string {
+	return c.insert(ctx, SessionMessage{ParentID: original.ParentID, Role: RoleUser, Content: content, EditOf: original.ID})
+}
+
+// insert stores m as the new head of the session and returns its id. The
+// oldest messages beyond memory.max_messages are dropped. Replicas adding
+// messages to the same session at once each keep theirs.
+func (c *ChatContext) insert(ctx context.Context, m SessionMessage) string {
+	m.ID, m.CreatedAt = uuid.New().String(), time.Now().UTC()
+	_, err := updateState(ctx, c.treeKey(), func(tree *MessageTree, _ bool) bool {
+		tree.Messages = append(tree.Messages, m)
+		tree.Head = m.ID
+		if keep := getConfig().Memory.MaxMessages; len(tree.Messages) > keep {
+			tree.Messages = tree.Messages[len(tree.Messages)-keep:]
+		}
+		return true
+	})
+	if err == nil {
+		_, err = updateState(ctx, sessionRecordKey(c.id), func(record *SessionRecord, _ bool) bool {
+			record.ID = c.id
+			if record.LastActiveAt.After(m.CreatedAt) {
+				return false
+			}
+			record.LastActiveAt = m.CreatedAt
+			return true
+		})
+	}
+	if err != nil {
+		log.Printf("Error saving chat session %s: %v", c.id, err)
+	}
+	if err := metadataStore.touchSession(ctx, c.id); err != nil {
+		log.Printf("Error recording chat session: %v", err)
+	}
+	return m.ID
+}
+
+// clear forgets the session.
+func (c *ChatContext) clear(ctx context.Context) {
+	for _, key := range []string{c.treeKey(), c.clarificationKey(), sessionRecordKey(c.id)} {
+		if _, err := sharedState.Delete(ctx, key); err != nil {
+			log.Printf("Error clearing chat session %s: %v", c.id, err)
+		}
+	}
+}
+
+// purge deletes the session: its messages, its facts, its index entries and
+// its metadata record.
+func (c *ChatContext) purge(ctx context.Context) error {
+	record, err := c.record(ctx)
+	if err != nil {
+		return err
+	}
+	keys := []string{c.treeKey(), c.clarificationKey(), sessionRecordKey(c.id)}
+	for _, user := range record.Users {
+		keys = append(keys, userSessionKey(user, c.id))
+	}
+	for _, key := range keys {
+		if _, err := sharedState.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	if _, err := deleteFacts(ctx, ScopeSession, c.id, ""); err != nil {
+		return err
+	}
+	return metadataStore.deleteSession(ctx, c.id)
+}
+
+// bindSession checks the session and user fields of a chat request.
+func bindSession(ctx context.Context, msg *Message) error {
+	if msg.UserID != "" && !idPattern.MatchString(msg.UserID) {
+		return fmt.Errorf("user_id must be 1 to 64 letters, digits, dashes or underscores")
+	}
+	if msg.SessionID == "" && msg.ParentID == "" {
+		return nil
+	}
+	if len(msg.Messages) > 0 {
+		return fmt.Errorf("messages cannot be sent with session_id or parent_id")
+	}
+	if msg.SessionID != "" && !idPattern.MatchString(msg.SessionID) {
+		return fmt.Errorf("session_id must be 1 to 64 letters, digits, dashes or underscores")
+	}
+	if msg.ParentID != "" {
+		parent, ok := sessionContext(msg.SessionID).message(ctx, msg.ParentID)
+		if !ok {
+			return fmt.Errorf("unknown parent_id %q", msg.ParentID)
+		}
+		if parent.Role != RoleAssistant {
+			return fmt.Errorf("parent_id must be an answer")
+		}
+	}
+	return nil
+}
+
+// followSession sets the message a question follows in its session: its
+// parent_id, else the latest message.
+func followSession(ctx context.Context, msg *Message) {
+	if len(msg.Messages) > 0 || msg.answering != "" {
+		return
+	}
+	msg.parent = msg.ParentID
+	if msg.parent == "" {
+		msg.parent = sessionContext(msg.SessionID).head(ctx)
+	}
+}
+
+// getSession returns the messages of a session and its head.
+func getSession(c *gin.Context) {
+	id := c.Param("id")
+	if !idPattern.MatchString(id) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return
+	}
+	tree := sessionContext(id).tree(c.Request.Context())
+	if tree.Messages == nil {
+		tree.Messages = []SessionMessage{}
+	}
+	c.JSON(http.StatusOK, tree)
+}
+
+// regenerateMessage answers a question of a session again, adding the new
+// answer next to the earlier ones. The message may be the question or one of
+// its answers; the request body may set generation controls.
+func regenerateMessage(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("id")
+	if !idPattern.MatchString(id) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return
+	}
+	session := sessionContext(id)
+	question, ok := session.message(ctx, c.Param("msg_id"))
+	if ok && question.Role == RoleAssistant {
+		question, ok = session.message(ctx, question.ParentID)
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	var msg Message
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&msg); err != nil {
+			if !bodyTooLarge(c, err) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			}
+			return
+		}
+	}
+	if msg.Msg != "" || len(msg.Messages) > 0 || msg.SessionID != "" || msg.ParentID != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The question is taken from the session"})
+		return
+	}
+	msg.Msg, msg.SessionID = question.Content, id
+	msg.parent, msg.answering = question.ParentID, question.ID
+	if !checkChatMessage(c, &msg) {
+		return
+	}
+	response := RAG(ctx, msg, nil)
+	c.JSON(chatStatus(response), response)
+}
+
+// editMessage replaces a question of a session with the msg of the request
+// body and answers it. Like regenerating, the edit is a new branch: the turns
+// after the original question drop out of the conversation but stay in the
+// session, and a clarifying question pending on them is dropped.
+func editMessage(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("id")
+	if !idPattern.MatchString(id) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return
+	}
+	session := sessionContext(id)
+	original, ok := session.message(ctx, c.Param("msg_id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+	if original.Role != RoleUser {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only questions can be edited"})
+		return
+	}
+
+	var msg Message
+	if err := c.ShouldBindJSON(&msg); err != nil {
+		if !bodyTooLarge(c, err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		}
+		return
+	}
+	if len(msg.Messages) > 0 || msg.SessionID != "" || msg.ParentID != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Send the edited question as msg"})
+		return
+	}
+	msg.SessionID, msg.parent = id, original.ParentID
+	if !checkChatMessage(c, &msg) {
+		return
+	}
+	if _, err := sharedState.Delete(ctx, session.clarificationKey()); err != nil {
+		log.Printf("Error clearing pending clarification: %v", err)
+	}
+	msg.answering = session.edit(ctx, original, msg.Msg)
+	response := RAG(ctx, msg, nil)
+	c.JSON(chatStatus(response), response)
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	vec "github.com/asg017/sqlite-vec-go-bindings/cgo"
+	"github.com/google/uuid"
+	"github.com/tmc/langchaingo/schema"
+	"github.com/tmc/langchaingo/vectorstores"
+)
+
+// sqliteVecOversample is how many more nearest neighbours are fetched when a
+// filter is applied after the KNN search.
+const sqliteVecOversample = 10
+
+var registerSQLiteVec sync.Once
+
+// sqliteVecStore keeps chunks in a local SQLite file: a table with the text
+// and JSON metadata, and a sqlite-vec table with the embeddings under the
+// same rowid.
+type sqliteVecStore struct {
+	path     string
+	chunks   string
+	vectors  string
+	embedder Embedder
+}
+
+func newSQLiteVecStore(embedder Embedder) sqliteVecStore {
+	registerSQLiteVec.Do(vec.Auto)
+
+	cfg := getConfig()
+	path := cfg.VectorStore.SQLitePath
+	if path == "" {
+		path = cfg.SQL.Path
+	}
+	name := sqlIdentifier(cfg.Embedding.Collection)
+	return sqliteVecStore{
+		path:     path,
+		chunks:   "chunks_" + name,
+		vectors:  "vec_" + name,
+		embedder: embedder,
+	}
+}
+
+func (s sqliteVecStore) open() (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", s.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", s.path, err)
+	}
+	return db, nil
+}
+
+// ensureTables creates the chunk and vector tables unless they exist.
+func (s sqliteVecStore) ensureTables(ctx context.Context) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var name string
+	err = db.QueryRowContext(ctx, "SELECT name FROM sqlite_master WHERE name = ?", s.vectors).Scan(&name)
+	if err == nil {
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	dims, err := embeddingDimensions(ctx, s.embedder)
+	if err != nil {
+		return err
+	}
+
+	statements := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "%s" (rowid INTEGER PRIMARY KEY, id TEXT UNIQUE, content TEXT, metadata TEXT)`, s.chunks),
+		fmt.Sprintf(`CREATE VIRTUAL TABLE "%s" USING vec0(embedding float[%d] distance_metric=cosine)`, s.vectors, dims),
+	}
+	for _, statement := range statements {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("failed to create sqlite-vec tables: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s sqliteVecStore) AddDocuments(ctx context.Context, docs []schema.Document, _ ...vectorstores.Option) ([]string, error) {
+	texts := make([]string, len(docs))
+	for i, doc := range docs {
+		texts[i] = doc.PageContent
+	}
+	vectors, err := s.embedder.EmbedDocuments(ctx, texts)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ids := make([]string, len(docs))
+	for i, doc := range docs {
+		ids[i] = uuid.New().String()
+		if id, ok := doc.Metadata["id"].(string); ok {
+			ids[i] = id
+		}
+		metadata, err := json.Marshal(doc.Metadata)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode metadata: %v", err)
+		}
+		embedding, err := vec.SerializeFloat32(vectors[i])
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := tx.ExecContext(ctx, fmt.Sprintf(`INSERT INTO "%s" (id, content, metadata) VALUES (?, ?, ?)`, s.chunks),
+			ids[i], doc.PageContent, string(metadata))
+		if err != nil {
+			return nil, fmt.Errorf("failed to insert chunk: %v", err)
+		}
+		rowid, err := result.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(`INSERT INTO "%s" (rowid, embedding) VALUES (?, ?)`, s.vectors), rowid, embedding)
+		if err != nil {
+			return nil, fmt.Errorf("failed to insert embedding: %v", err)
+		}
+	}
+	return ids, tx.Commit()
+}
+
+func (s sqliteVecStore) SimilaritySearch(ctx context.Context, query string, numDocuments int, options ...vectorstores.Option) ([]schema.Document, error) {
+	opts := vectorstores.Options{}
+	for _, option := range options {
+		option(&opts)
+	}
+	filter, _ := opts.Filters.(Filter)
+
+	vector, err := s.embedder.EmbedQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	embedding, err := vec.SerializeFloat32(vector)
+	if err != nil {
+		return nil, err
+	}
+
+	k := numDocuments
+	if !filter.empty() {
+		k *= sqliteVecOversample
+	}
+	conditions, args := sqliteFilterConditions(filter)
+	args = append([]any{embedding, k}, args...)
+	args = append(args, numDocuments)
+
+	statement := fmt.Sprintf(`WITH knn AS (SELECT rowid, distance FROM "%s" WHERE embedding MATCH ? AND k = ?)
+		SELECT c.content, c.metadata, knn.distance FROM knn JOIN "%s" c ON c.rowid = knn.rowid%s
+		ORDER BY knn.distance LIMIT ?`, s.vectors, s.chunks, conditions)
+
+	db, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, statement, args...)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite-vec search failed: %v", err)
+	}
+	defer rows.Close()
+
+	var docs []schema.Document
+	for rows.Next() {
+		var content, metadata string
+		var distance float64
+		if err := rows.Scan(&content, &metadata, &distance); err != nil {
+			return nil, err
+		}
+		doc := schema.Document{PageContent: content, Score: float32(1 - distance)}
+		if err := json.Unmarshal([]byte(metadata), &doc.Metadata); err != nil {
+			return nil, fmt.Errorf("failed to decode metadata: %v", err)
+		}
+		docs = append(docs, doc)
+	}
+	return docs, rows.Err()
+}
+
+// sqliteFilterConditions turns a Filter into a WHERE clause over the JSON
+// metadata of the chunks table aliased as c.
+func sqliteFilterConditions(filter Filter) (string, []any) {
+	if filter.empty() {
+		return "", nil
+	}
+
+	var conditions []string
+	var args []any
+	for key, value := range filter.Match {
+		condition, conditionArgs := sqliteCondition(key, value)
+		conditions = append(conditions, condition)
+		args = append(args, conditionArgs...)
+	}
+	for key, value := range filter.Exclude {
+		condition, conditionArgs := sqliteCondition(key, value)
+		conditions = append(conditions, "NOT COALESCE("+condition+", 0)")
+		args = append(args, conditionArgs...)
+	}
+	for _, r := range filter.Ranges {
+		condition, conditionArgs := sqliteRange(r)
+		conditions = append(conditions, condition)
+		args = append(args, conditionArgs...)
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+var sqliteOperators = map[string]string{"gt": ">", "gte": ">=", "lt": "<", "lte": "<="}
+
+// sqliteRange bounds any of r's fields. Dates compare as RFC 3339 strings;
+// midnight bounds are written as bare dates so that date-only values at the
+// bound are within it.
+func sqliteRange(r Range) (string, []any) {
+	bounds := r.bounds(func(t time.Time) any {
+		if t = t.UTC(); t.Equal(t.Truncate(24 * time.Hour)) {
+			return t.Format("2006-01-02")
+		}
+		return t.Format(time.RFC3339)
+	})
+	ops := make([]string, 0, len(bounds))
+	for op := range bounds {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	var anyOf []string
+	var args []any
+	for _, field := range r.Fields {
+		path := "$." + strings.ReplaceAll(field, `"`, "")
+		var all []string
+		for _, op := range ops {
+			all = append(all, fmt.Sprintf("json_extract(c.metadata, '%s') %s ?", path, sqliteOperators[op]))
+			args = append(args, bounds[op])
+		}
+		anyOf = append(anyOf, "("+strings.Join(all, " AND ")+")")
+	}
+	return "(" + strings.Join(anyOf, " OR ") + ")", args
+}
+
+func sqliteCondition(key string, value any) (string, []any) {
+	path := "$." + strings.ReplaceAll(key, `"`, "")
+	values, ok := value.([]any)
+	if !ok {
+		values = []any{value}
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")
+	condition := fmt.Sprintf(
+		`(json_extract(c.metadata, '%s') IN (%s) OR EXISTS (SELECT 1 FROM json_each(c.metadata, '%s') WHERE json_each.value IN (%s)))`,
+		path, placeholders, path, placeholders)
+
+	var args []any
+	for range 2 {
+		for _, v := range values {
+			if b, ok := v.(bool); ok {
+				v = 0
+				if b {
+					v = 1
+				}
+			}
+			args = append(args, v)
+		}
+	}
+	return condition, args
+}
+
+func (s sqliteVecStore) Sources(ctx context.Context) ([]SourceInfo, error) {
+	db, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`SELECT json_extract(metadata, '$.source'), COUNT(*),
+		COALESCE(MAX(json_extract(metadata, '$.deleted')), 0), COALESCE(MAX(json_extract(metadata, '$.deleted_at')), '')
+		FROM "%s" WHERE json_extract(metadata, '$.source') IS NOT NULL GROUP BY 1 ORDER BY 1`, s.chunks))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sources []SourceInfo
+	for rows.Next() {
+		var info SourceInfo
+		if err := rows.Scan(&info.Source, &info.Chunks, &info.Deleted, &info.DeletedAt); err != nil {
+			return nil, err
+		}
+		if !info.Deleted {
+			info.DeletedAt = ""
+		}
+		sources = append(sources, info)
+	}
+	return sources, rows.Err()
+}
+
+func (s sqliteVecStore) DeleteWhere(ctx context.Context, filter map[string]any) (int, error) {
+	db, err := s.open()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	conditions, args := sqliteFilterConditions(Filter{Match: filter})
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM "%s" WHERE rowid IN (SELECT c.rowid FROM "%s" c%s)`, s.vectors, s.chunks, conditions), args...)
+	if err != nil {
+		return 0, err
+	}
+	result, err := tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM "%s" AS c%s`, s.chunks, conditions), args...)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(deleted), tx.Commit()
+}
+
+func (s sqliteVecStore) UpdateWhere(ctx context.Context, filter map[string]any, fields map[string]any) (int, error) {
+	patch, err := json.Marshal(fields)
+	if err != nil {
+		return 0, err
+	}
+
+	db, err := s.open()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	conditions, args := sqliteFilterConditions(Filter{Match: filter})
+	result, err := db.ExecContext(ctx, fmt.Sprintf(`UPDATE "%s" AS c SET metadata = json_patch(metadata, ?)%s`, s.chunks, conditions),
+		append([]any{string(patch)}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	updated, err := result.RowsAffected()
+	return int(updated), err
+}
+
+func (s sqliteVecStore) Values(ctx context.Context, filter map[string]any, field string) ([]any, error) {
+	db, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	path := "$." + strings.ReplaceAll(field, `"`, "")
+	conditions, args := sqliteFilterConditions(Filter{Match: filter})
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`SELECT DISTINCT json_extract(c.metadata, '%s') FROM "%s" c%s`, path, s.chunks, conditions), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []any
+	for rows.Next() {
+		var value any
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		if value != nil {
+			values = append(values, value)
+		}
+	}
+	return values, rows.Err()
+}
+
+func (s sqliteVecStore) Chunks(ctx context.Context, filter Filter, limit int) ([]schema.Document, error) {
+	db, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	conditions, args := sqliteFilterConditions(filter)
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`SELECT c.content, c.metadata FROM "%s" c%s LIMIT ?`, s.chunks, conditions), append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var docs []schema.Document
+	for rows.Next() {
+		var content, metadata string
+		if err := rows.Scan(&content, &metadata); err != nil {
+			return nil, err
+		}
+		doc := schema.Document{PageContent: content}
+		if err := json.Unmarshal([]byte(metadata), &doc.Metadata); err != nil {
+			return nil, fmt.Errorf("failed to decode metadata: %v", err)
+		}
+		docs = append(docs, doc)
+	}
+	return docs, rows.Err()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3" // sqlite3 driver
+)
+
+var nonIdentifierChars = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// sqlIdentifier turns a file or column name into a lower-case SQL identifier,
+// e.g. "Blood Type" becomes blood_type and "sales.xlsx/Q1 2024" becomes
+// sales_q1_2024, so generated queries need no quoting.
+func sqlIdentifier(name string) string {
+	name = strings.ToLower(name)
+	for _, ext := range []string{".csv", ".xlsx", ".xlsm"} {
+		name = strings.Replace(name, ext, "", 1)
+	}
+	name = strings.Trim(nonIdentifierChars.ReplaceAllString(name, "_"), "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "t_" + name
+	}
+	return name
+}
+
+func sqlColumnType(columnType string) string {
+	switch columnType {
+	case "integer", "boolean":
+		return "INTEGER"
+	case "number":
+		return "REAL"
+	default:
+		return "TEXT"
+	}
+}
+
+// loadTableIntoSQLite (re)creates a table named after the source file in the
+// tabular database and copies every row into it with typed columns, so the
+// agent can answer aggregate questions with exact SQL. It returns the table
+// name.
+func loadTableIntoSQLite(ctx context.Context, path string, table Table) (string, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	name := sqlIdentifier(table.Name)
+	summaries := describeColumns(table)
+
+	columns := make([]string, len(summaries))
+	definitions := make([]string, len(summaries))
+	for i, summary := range summaries {
+		columns[i] = sqlIdentifier(summary.Name)
+		definitions[i] = fmt.Sprintf("%s %s", columns[i], sqlColumnType(summary.Type))
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", name)); err != nil {
+		return "", err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("CREATE TABLE %s (%s)", name, strings.Join(definitions, ", "))); err != nil {
+		return "", fmt.Errorf("failed to create table %s: %v", name, err)
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", name, strings.Join(columns, ", "), placeholders))
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+
+	for _, record := range table.Rows {
+		values := make([]any, len(summaries))
+		for j, summary := range summaries {
+			if j < len(record) && strings.TrimSpace(record[j]) != "" {
+				values[j] = typedValue(record[j], summary.Type)
+			}
+		}
+		if _, err := stmt.ExecContext(ctx, values...); err != nil {
+			return "", fmt.Errorf("failed to insert into %s: %v", name, err)
+		}
+	}
+
+	return name, tx.Commit()
+}
@@ -0,0 +1,627 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	StateMemory   = "memory"
+	StateRedis    = "redis"
+	StatePostgres = "postgres"
+)
+
+type StateConfig struct {
+	Backend string `json:"backend"` // "memory", "redis" or "postgres"
+	URL     string `json:"url"`     // Redis URL or Postgres connection string; ${VAR} references are expanded
+	Prefix  string `json:"prefix"`  // Prepended to every key, so deployments can share a server
+
+	LeaseSeconds int `json:"lease_seconds"` // How soon another replica takes over background jobs from a failed leader
+}
+
+// StateStore holds the state replicas share: chat context, jobs, datasets,
+// webhooks and experiment metrics. Values are JSON; lists and counters live
+// under their own keys, and Delete removes whatever is under a key. Swap
+// lets replicas update a value without losing each other's changes, see
+// updateState. It also elects the replica that runs each background job.
+type StateStore interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Put(ctx context.Context, key string, value []byte, ttl time.Duration) error // ttl 0 keeps the value
+	PutNew(ctx context.Context, key string, value []byte) (bool, error)         // Reports false if the key exists
+	Swap(ctx context.Context, key string, old, value []byte) (bool, error)      // Reports false if the value is no longer old, nil for none
+	Delete(ctx context.Context, key string) (bool, error)
+	Scan(ctx context.Context, prefix string) ([][]byte, error) // Values of the keys with prefix, in key order
+	Append(ctx context.Context, key string, value []byte, keep int) error
+	Range(ctx context.Context, key string) ([][]byte, error)
+	Increment(ctx context.Context, key string, deltas map[string]float64) error
+	Counters(ctx context.Context, key string) (map[string]float64, error)
+
+	// TryLead takes the lead of a background job if no other replica has
+	// it. The context is cancelled when the lead is lost; release gives it up.
+	TryLead(ctx context.Context, name string) (lead context.Context, release func(), ok bool, err error)
+}
+
+// sharedState is set from state.backend on startup.
+var sharedState StateStore = newMemoryState()
+
+func validateState(cfg StateConfig) error {
+	switch cfg.Backend {
+	case StateMemory:
+	case StateRedis, StatePostgres:
+		if cfg.URL == "" {
+			return fmt.Errorf("state.url is required for %s", cfg.Backend)
+		}
+	default:
+		return fmt.Errorf("unknown state backend %q", cfg.Backend)
+	}
+	if cfg.LeaseSeconds < 3 {
+		return fmt.Errorf("state.lease_seconds must be at least 3")
+	}
+	return nil
+}
+
+// validateStateless checks that nothing replicas need to agree on is kept in
+// process or on local disk, for --stateless.
+func validateStateless(cfg Config) error {
+	if cfg.State.Backend == StateMemory {
+		return fmt.Errorf("--stateless needs a redis or postgres state backend")
+	}
+	if cfg.VectorStore.Backend == StoreSQLite {
+		return fmt.Errorf("--stateless needs a shared vector store, not sqlite")
+	}
+	if cfg.Metadata.Backend == MetadataSQLite {
+		return fmt.Errorf("--stateless needs a postgres metadata store, or none")
+	}
+	if cfg.SQL.Path != "" {
+		return fmt.Errorf("--stateless needs sql.path unset, as the agent's SQL tool reads a local sqlite file")
+	}
+	return nil
+}
+
+func newStateStore(cfg StateConfig) (StateStore, error) {
+	lease := time.Duration(cfg.LeaseSeconds) * time.Second
+	switch cfg.Backend {
+	case StateRedis:
+		opts, err := redis.ParseURL(os.ExpandEnv(cfg.URL))
+		if err != nil {
+			return nil, fmt.Errorf("invalid state.url: %v", err)
+		}
+		client := redis.NewClient(opts)
+		if err := client.Ping(context.Background()).Err(); err != nil {
+			return nil, fmt.Errorf("failed to connect to redis: %v", err)
+		}
+		return &redisState{client: client, prefix: cfg.Prefix, lease: lease}, nil
+	case StatePostgres:
+		db, err := sql.Open("postgres", os.ExpandEnv(cfg.URL))
+		if err != nil {
+			return nil, fmt.Errorf("invalid state.url: %v", err)
+		}
+		for _, statement := range postgresStateSchema {
+			if _, err := db.Exec(statement); err != nil {
+				db.Close()
+				return nil, fmt.Errorf("failed to create state tables: %v", err)
+			}
+		}
+		return &postgresState{db: db, prefix: cfg.Prefix, lease: lease}, nil
+	}
+	return newMemoryState(), nil
+}
+
+func loadState(ctx context.Context, key string, v any) (bool, error) {
+	data, ok, err := sharedState.Get(ctx, key)
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+func saveState(ctx context.Context, key string, v any, ttl time.Duration) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return sharedState.Put(ctx, key, data, ttl)
+}
+
+// maxStateSwaps bounds the attempts of updateState when other replicas keep
+// changing the value.
+const maxStateSwaps = 16
+
+// updateState applies update to the value of type T under key, the zero
+// value when there is none, and stores it if update reports a change. When
+// another replica changed the value meanwhile, it starts over from the new
+// value. It returns the value as stored.
+func updateState[T any](ctx context.Context, key string, update func(value *T, found bool) bool) (T, error) {
+	for range maxStateSwaps {
+		var value T
+		old, ok, err := sharedState.Get(ctx, key)
+		if err != nil {
+			return value, err
+		}
+		if ok {
+			if err := json.Unmarshal(old, &value); err != nil {
+				return value, err
+			}
+		} else {
+			old = nil
+		}
+		if !update(&value, ok) {
+			return value, nil
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return value, err
+		}
+		swapped, err := sharedState.Swap(ctx, key, old, data)
+		if err != nil || swapped {
+			return value, err
+		}
+	}
+	var value T
+	return value, fmt.Errorf("%s kept changing, gave up updating it", key)
+}
+
+// memoryState keeps the state in process, for a single replica.
+type memoryState struct {
+	values   map[string]memoryValue
+	lists    map[string][][]byte
+	counters map[string]map[string]float64
+	mu       sync.Mutex
+}
+
+type memoryValue struct {
+	data    []byte
+	expires time.Time // Zero for values without a ttl
+}
+
+func newMemoryState() *memoryState {
+	return &memoryState{
+		values:   make(map[string]memoryValue),
+		lists:    make(map[string][][]byte),
+		counters: make(map[string]map[string]float64),
+	}
+}
+
+func (s *memoryState) live(key string) (memoryValue, bool) {
+	value, ok := s.values[key]
+	if ok && !value.expires.IsZero() && time.Now().After(value.expires) {
+		delete(s.values, key)
+		return memoryValue{}, false
+	}
+	return value, ok
+}
+
+func (s *memoryState) Get(_ context.Context, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.live(key)
+	return value.data, ok, nil
+}
+
+func (s *memoryState) Put(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := memoryValue{data: value}
+	if ttl > 0 {
+		stored.expires = time.Now().Add(ttl)
+	}
+	s.values[key] = stored
+	return nil
+}
+
+func (s *memoryState) PutNew(_ context.Context, key string, value []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.live(key); ok {
+		return false, nil
+	}
+	s.values[key] = memoryValue{data: value}
+	return true, nil
+}
+
+func (s *memoryState) Swap(_ context.Context, key string, old, value []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.live(key)
+	if ok != (old != nil) || ok && !bytes.Equal(current.data, old) {
+		return false, nil
+	}
+	s.values[key] = memoryValue{data: value}
+	return true, nil
+}
+
+func (s *memoryState) Delete(_ context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, value := s.live(key)
+	_, list := s.lists[key]
+	_, counters := s.counters[key]
+	delete(s.values, key)
+	delete(s.lists, key)
+	delete(s.counters, key)
+	return value || list || counters, nil
+}
+
+func (s *memoryState) Scan(_ context.Context, prefix string) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.values {
+		if strings.HasPrefix(key, prefix) {
+			if _, ok := s.live(key); ok {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = s.values[key].data
+	}
+	return values, nil
+}
+
+func (s *memoryState) Append(_ context.Context, key string, value []byte, keep int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := append(s.lists[key], value)
+	if excess := len(list) - keep; excess > 0 {
+		list = list[excess:]
+	}
+	s.lists[key] = list
+	return nil
+}
+
+func (s *memoryState) Range(_ context.Context, key string) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]byte(nil), s.lists[key]...), nil
+}
+
+func (s *memoryState) Increment(_ context.Context, key string, deltas map[string]float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counters, ok := s.counters[key]
+	if !ok {
+		counters = make(map[string]float64)
+		s.counters[key] = counters
+	}
+	for field, delta := range deltas {
+		counters[field] += delta
+	}
+	return nil
+}
+
+func (s *memoryState) Counters(_ context.Context, key string) (map[string]float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counters := make(map[string]float64, len(s.counters[key]))
+	for field, value := range s.counters[key] {
+		counters[field] = value
+	}
+	return counters, nil
+}
+
+type redisState struct {
+	client *redis.Client
+	prefix string
+	lease  time.Duration
+}
+
+func (s *redisState) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := s.client.Get(ctx, s.prefix+key).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	return value, err == nil, err
+}
+
+func (s *redisState) Put(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return s.client.Set(ctx, s.prefix+key, value, ttl).Err()
+}
+
+func (s *redisState) PutNew(ctx context.Context, key string, value []byte) (bool, error) {
+	return s.client.SetNX(ctx, s.prefix+key, value, 0).Result()
+}
+
+func (s *redisState) Swap(ctx context.Context, key string, old, value []byte) (bool, error) {
+	key = s.prefix + key
+	swapped := false
+	err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			current = nil
+		} else if err != nil {
+			return err
+		}
+		if (current != nil) != (old != nil) || !bytes.Equal(current, old) {
+			return nil
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, value, 0)
+			return nil
+		})
+		swapped = err == nil
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		// The value changed between the read and the write
+		return false, nil
+	}
+	return swapped, err
+}
+
+func (s *redisState) Delete(ctx context.Context, key string) (bool, error) {
+	n, err := s.client.Del(ctx, s.prefix+key).Result()
+	return n > 0, err
+}
+
+func (s *redisState) Scan(ctx context.Context, prefix string) ([][]byte, error) {
+	var keys []string
+	iter := s.client.Scan(ctx, 0, redisPattern(s.prefix+prefix)+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+
+	var values [][]byte
+	for start := 0; start < len(keys); start += 1000 {
+		batch := keys[start:min(start+1000, len(keys))]
+		results, err := s.client.MGet(ctx, batch...).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, result := range results {
+			// Keys that expired or hold a list or counters come back as nil
+			if value, ok := result.(string); ok {
+				values = append(values, []byte(value))
+			}
+		}
+	}
+	return values, nil
+}
+
+func (s *redisState) Append(ctx context.Context, key string, value []byte, keep int) error {
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, s.prefix+key, value)
+		pipe.LTrim(ctx, s.prefix+key, int64(-keep), -1)
+		return nil
+	})
+	return err
+}
+
+func (s *redisState) Range(ctx context.Context, key string) ([][]byte, error) {
+	items, err := s.client.LRange(ctx, s.prefix+key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	values := make([][]byte, len(items))
+	for i, item := range items {
+		values[i] = []byte(item)
+	}
+	return values, nil
+}
+
+func (s *redisState) Increment(ctx context.Context, key string, deltas map[string]float64) error {
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for field, delta := range deltas {
+			pipe.HIncrByFloat(ctx, s.prefix+key, field, delta)
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *redisState) Counters(ctx context.Context, key string) (map[string]float64, error) {
+	fields, err := s.client.HGetAll(ctx, s.prefix+key).Result()
+	if err != nil {
+		return nil, err
+	}
+	counters := make(map[string]float64, len(fields))
+	for field, value := range fields {
+		if counters[field], err = strconv.ParseFloat(value, 64); err != nil {
+			return nil, fmt.Errorf("counter %s of %s: %v", field, key, err)
+		}
+	}
+	return counters, nil
+}
+
+// redisPattern escapes the glob characters of a SCAN prefix.
+func redisPattern(prefix string) string {
+	var b strings.Builder
+	for _, r := range prefix {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+var postgresStateSchema = []string{
+	`CREATE TABLE IF NOT EXISTS rag_state (key text PRIMARY KEY, value bytea NOT NULL, expires_at timestamptz)`,
+	`CREATE TABLE IF NOT EXISTS rag_state_lists (id bigserial PRIMARY KEY, key text NOT NULL, value bytea NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS rag_state_lists_key ON rag_state_lists (key, id)`,
+	`CREATE TABLE IF NOT EXISTS rag_state_counters (key text NOT NULL, field text NOT NULL, value double precision NOT NULL, PRIMARY KEY (key, field))`,
+}
+
+type postgresState struct {
+	db     *sql.DB
+	prefix string
+	lease  time.Duration
+}
+
+func (s *postgresState) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	var value []byte
+	err := s.db.QueryRowContext(ctx,
+		`SELECT value FROM rag_state WHERE key = $1 AND (expires_at IS NULL OR expires_at > now())`,
+		s.prefix+key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	return value, err == nil, err
+}
+
+func (s *postgresState) Put(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	var expires sql.NullTime
+	if ttl > 0 {
+		expires = sql.NullTime{Time: time.Now().Add(ttl), Valid: true}
+		// Expired values are only filtered out on reads, so clear them now
+		// and then
+		if rand.Intn(100) == 0 {
+			if _, err := s.db.ExecContext(ctx, `DELETE FROM rag_state WHERE expires_at < now()`); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO rag_state (key, value, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, expires_at = EXCLUDED.expires_at`,
+		s.prefix+key, value, expires)
+	return err
+}
+
+func (s *postgresState) PutNew(ctx context.Context, key string, value []byte) (bool, error) {
+	result, err := s.db.ExecContext(ctx,
+		`INSERT INTO rag_state (key, value) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, expires_at = NULL WHERE rag_state.expires_at < now()`,
+		s.prefix+key, value)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *postgresState) Swap(ctx context.Context, key string, old, value []byte) (bool, error) {
+	if old == nil {
+		return s.PutNew(ctx, key, value)
+	}
+	result, err := s.db.ExecContext(ctx,
+		`UPDATE rag_state SET value = $2, expires_at = NULL
+		WHERE key = $1 AND value = $3 AND (expires_at IS NULL OR expires_at > now())`,
+		s.prefix+key, value, old)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *postgresState) Delete(ctx context.Context, key string) (bool, error) {
+	deleted := false
+	for _, table := range []string{"rag_state", "rag_state_lists", "rag_state_counters"} {
+		result, err := s.db.ExecContext(ctx, `DELETE FROM `+table+` WHERE key = $1`, s.prefix+key)
+		if err != nil {
+			return false, err
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			deleted = true
+		}
+	}
+	return deleted, nil
+}
+
+func (s *postgresState) Scan(ctx context.Context, prefix string) ([][]byte, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT value FROM rag_state WHERE left(key, length($1)) = $1 AND (expires_at IS NULL OR expires_at > now()) ORDER BY key`,
+		s.prefix+prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values [][]byte
+	for rows.Next() {
+		var value []byte
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+func (s *postgresState) Append(ctx context.Context, key string, value []byte, keep int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `INSERT INTO rag_state_lists (key, value) VALUES ($1, $2)`, s.prefix+key, value); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`DELETE FROM rag_state_lists WHERE key = $1 AND id NOT IN
+		(SELECT id FROM rag_state_lists WHERE key = $1 ORDER BY id DESC LIMIT $2)`,
+		s.prefix+key, keep); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *postgresState) Range(ctx context.Context, key string) ([][]byte, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT value FROM rag_state_lists WHERE key = $1 ORDER BY id`, s.prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values [][]byte
+	for rows.Next() {
+		var value []byte
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+func (s *postgresState) Increment(ctx context.Context, key string, deltas map[string]float64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for field, delta := range deltas {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO rag_state_counters (key, field, value) VALUES ($1, $2, $3)
+			ON CONFLICT (key, field) DO UPDATE SET value = rag_state_counters.value + EXCLUDED.value`,
+			s.prefix+key, field, delta); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *postgresState) Counters(ctx context.Context, key string) (map[string]float64, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT field, value FROM rag_state_counters WHERE key = $1`, s.prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counters := map[string]float64{}
+	for rows.Next() {
+		var field string
+		var value float64
+		if err := rows.Scan(&field, &value); err != nil {
+			return nil, err
+		}
+		counters[field] = value
+	}
+	return counters, rows.Err()
+}
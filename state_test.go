@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestUpdateStateKeepsConcurrentUpdates(t *testing.T) {
+	sharedState = newMemoryState()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := updateState(ctx, "gap:test", func(gap *Gap, _ bool) bool {
+				gap.Count++
+				return true
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var gap Gap
+	if _, err := loadState(ctx, "gap:test", &gap); err != nil {
+		t.Fatal(err)
+	}
+	if gap.Count != 20 {
+		t.Errorf("count = %d, want 20", gap.Count)
+	}
+}
+
+func TestSwap(t *testing.T) {
+	state := newMemoryState()
+	ctx := context.Background()
+
+	for _, step := range []struct {
+		old, value string
+		none       bool
+		want       bool
+	}{
+		{none: true, value: "1", want: true},
+		{none: true, value: "2", want: false},
+		{old: "2", value: "3", want: false},
+		{old: "1", value: "2", want: true},
+		{old: "1", value: "3", want: false},
+	} {
+		var old []byte
+		if !step.none {
+			old = []byte(step.old)
+		}
+		swapped, err := state.Swap(ctx, "key", old, []byte(step.value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if swapped != step.want {
+			t.Errorf("Swap(%q, %q) = %v, want %v", old, step.value, swapped, step.want)
+		}
+	}
+	if value, _, _ := state.Get(ctx, "key"); string(value) != "2" {
+		t.Errorf("value = %q, want 2", value)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tmc/langchaingo/schema"
+)
+
+// Timed stages of an answer
+const (
+	TimingRouting    = "routing"    // Normalizing and routing the query and picking datasets
+	TimingRetrieval  = "retrieval"  // Searching, rescoring and stitching chunks and building the prompt
+	TimingGeneration = "generation" // Generating the answer
+	TimingScoring    = "scoring"    // Confidence, highlights and follow-up questions
+)
+
+var timedStages = []string{TimingRouting, TimingRetrieval, TimingGeneration, TimingScoring}
+
+// maxStatsDays is how far back GET /admin/stats looks at most.
+const maxStatsDays = 90
+
+// maxStatsQuery is the length unanswered queries are counted under at most.
+const maxStatsQuery = 200
+
+type StatsConfig struct {
+	Enabled   bool `json:"enabled"`   // Count answers per day for GET /admin/stats
+	Top       int  `json:"top"`       // Unanswered queries and documents listed by GET /admin/stats
+	Documents bool `json:"documents"` // Count retrievals and citations per document and chunk, for GET /documents/:id/analytics
+}
+
+func validateStats(cfg StatsConfig) error {
+	if cfg.Top < 1 {
+		return fmt.Errorf("stats.top must be at least 1")
+	}
+	return nil
+}
+
+// stageTimings collects how long the stages of an answer took. Its methods do
+// nothing on a nil receiver.
+type stageTimings struct {
+	mu sync.Mutex
+	ms map[string]float64
+}
+
+func newStageTimings() *stageTimings {
+	return &stageTimings{ms: map[string]float64{}}
+}
+
+// since adds the time from start to stage.
+func (t *stageTimings) since(stage string, start time.Time) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ms[stage] += milliseconds(time.Since(start))
+}
+
+func (t *stageTimings) snapshot() map[string]float64 {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ms := make(map[string]float64, len(t.ms))
+	for stage, value := range t.ms {
+		ms[stage] = value
+	}
+	return ms
+}
+
+func statsDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// statsQuery is the form unanswered queries are counted under, so the same
+// question asked with different casing or spacing counts once.
+func statsQuery(query string) string {
+	query = strings.ToLower(strings.Join(strings.Fields(query), " "))
+	if runes := []rune(query); len(runes) > maxStatsQuery {
+		query = string(runes[:maxStatsQuery])
+	}
+	return query
+}
+
+// recordStats counts an answer towards the day's stats: its mode, latency
+// per stage, confidence, whether the model could not answer and the
+// documents retrieved for it. Failures are logged rather than failing the
+// chat request.
+func recordStats(msg Message, mode string, result ChatResponse, failed bool, latency time.Duration) {
+	if !getConfig().Stats.Enabled {
+		return
+	}
+	if mode == "" {
+		mode = ModeRAG
+	}
+	ctx := context.Background()
+	day := statsDay(time.Now())
+
+	deltas := map[string]float64{"requests": 1, "latency_ms": milliseconds(latency), "mode:" + mode: 1}
+	if failed {
+		deltas["errors"] = 1
+	}
+	if result.Cancelled {
+		deltas["cancelled"] = 1
+	}
+	for stage, ms := range msg.timings.snapshot() {
+		deltas["latency_ms:"+stage] += ms
+		deltas["timed:"+stage] = 1
+	}
+	if result.Confidence != nil {
+		deltas["confidence"] = result.Confidence.Score
+		deltas["confident"] = 1
+		if result.Confidence.Faithfulness != nil {
+			deltas["faithfulness"] = *result.Confidence.Faithfulness
+			deltas["faithful"] = 1
+		}
+	}
+	unanswered := !failed && !result.Cancelled && retrieves(mode) && isAbstention(result.Message)
+	if unanswered {
+		deltas["unanswered"] = 1
+	}
+	if err := sharedState.Increment(ctx, "stats:"+day, deltas); err != nil {
+		log.Printf("Error recording stats: %v", err)
+		return
+	}
+
+	if unanswered {
+		if err := sharedState.Increment(ctx, "stats:unanswered:"+day, map[string]float64{statsQuery(msg.Msg): 1}); err != nil {
+			log.Printf("Error recording unanswered query: %v", err)
+		}
+	}
+	if sources := retrievedSources(result.docs); len(sources) > 0 {
+		if err := sharedState.Increment(ctx, "stats:documents:"+day, sources); err != nil {
+			log.Printf("Error recording retrieved documents: %v", err)
+		}
+	}
+}
+
+// retrievedSources counts each document with chunks in docs once.
+func retrievedSources(docs []schema.Document) map[string]float64 {
+	sources := map[string]float64{}
+	for _, source := range documentSources(docs) {
+		sources[source] = 1
+	}
+	return sources
+}
+
+// DayStats are the answers of a day, in UTC.
+type DayStats struct {
+	Date         string             `json:"date"`
+	Requests     int                `json:"requests"`
+	Errors       int                `json:"errors"`
+	Cancelled    int                `json:"cancelled"`
+	Unanswered   int                `json:"unanswered"`             // Rag answers where the model said it does not know
+	Modes        map[string]int     `json:"modes"`                  // Answers per routed mode
+	LatencyMS    float64            `json:"latency_ms"`             // Average
+	StageMS      map[string]float64 `json:"stage_ms"`               // Average per stage, over the answers that ran it
+	Groundedness *float64           `json:"groundedness,omitempty"` // Average faithfulness, else confidence, of rag answers
+}
+
+// Count is how often a query or document came up.
+type Count struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+func dayStats(day string, counters map[string]float64) DayStats {
+	stats := DayStats{
+		Date:       day,
+		Requests:   int(counters["requests"]),
+		Errors:     int(counters["errors"]),
+		Cancelled:  int(counters["cancelled"]),
+		Unanswered: int(counters["unanswered"]),
+		Modes:      map[string]int{},
+		StageMS:    map[string]float64{},
+	}
+	if stats.Requests > 0 {
+		stats.LatencyMS = counters["latency_ms"] / float64(stats.Requests)
+	}
+	for field, value := range counters {
+		if mode, ok := strings.CutPrefix(field, "mode:"); ok {
+			stats.Modes[mode] = int(value)
+		}
+	}
+	for _, stage := range timedStages {
+		if timed := counters["timed:"+stage]; timed > 0 {
+			stats.StageMS[stage] = counters["latency_ms:"+stage] / timed
+		}
+	}
+	if value, judged := groundedness(counters); judged > 0 {
+		stats.Groundedness = &value
+	}
+	return stats
+}
+
+// topCounts sums the counters of key over days and returns the n highest.
+func topCounts(ctx context.Context, key string, days []string, n int) ([]Count, error) {
+	totals := map[string]float64{}
+	for _, day := range days {
+		counters, err := sharedState.Counters(ctx, key+day)
+		if err != nil {
+			return nil, err
+		}
+		for field, value := range counters {
+			totals[field] += value
+		}
+	}
+	counts := make([]Count, 0, len(totals))
+	for field, value := range totals {
+		counts = append(counts, Count{Key: field, Count: int(value)})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Key < counts[j].Key
+	})
+	return counts[:min(n, len(counts))], nil
+}
+
+// adminStats returns the quality and usage stats of the last ?days= days
+// (default 7), today included: per day volume, latency per stage and
+// groundedness, and over the whole range the queries the model most often
+// could not answer and the most retrieved documents.
+func adminStats(c *gin.Context) {
+	days := 7
+	if value := c.Query("days"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxStatsDays {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("days must be between 1 and %d", maxStatsDays)})
+			return
+		}
+		days = n
+	}
+
+	ctx := c.Request.Context()
+	now := time.Now()
+	dates := make([]string, days)
+	stats := make([]DayStats, days)
+	for i := range dates {
+		dates[i] = statsDay(now.AddDate(0, 0, i-days+1))
+		counters, err := sharedState.Counters(ctx, "stats:"+dates[i])
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		stats[i] = dayStats(dates[i], counters)
+	}
+
+	top := getConfig().Stats.Top
+	unanswered, err := topCounts(ctx, "stats:unanswered:", dates, top)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	documents, err := topCounts(ctx, "stats:documents:", dates, top)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"days": stats, "unanswered": unanswered, "documents": documents})
+}
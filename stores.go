@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/tmc/langchaingo/schema"
+	"github.com/tmc/langchaingo/vectorstores"
+)
+
+// openStore is a vector store holding a client, opened once and shared by
+// every request, and how to close its client on shutdown, if it can be.
+type openStore struct {
+	store vectorstores.VectorStore
+	close func() error
+}
+
+// storeCache keeps the open stores by tenant until the server shuts down. A
+// reload cannot change the vector store config they were opened with.
+var storeCache = struct {
+	sync.Mutex
+	stores map[string]openStore
+}{}
+
+// sharedStore returns the open store of tenant, opening it with open the
+// first time. Stores embed with the embedder of the request's context, see
+// boundStore.
+func sharedStore(tenant string, open func() (openStore, error)) (vectorstores.VectorStore, error) {
+	storeCache.Lock()
+	defer storeCache.Unlock()
+	if opened, ok := storeCache.stores[tenant]; ok {
+		return opened.store, nil
+	}
+	opened, err := open()
+	if err != nil {
+		return nil, err
+	}
+	if storeCache.stores == nil {
+		storeCache.stores = map[string]openStore{}
+	}
+	storeCache.stores[tenant] = opened
+	return opened.store, nil
+}
+
+// closeStores closes the clients of the open stores, on shutdown.
+func closeStores() {
+	storeCache.Lock()
+	defer storeCache.Unlock()
+	for tenant, opened := range storeCache.stores {
+		if opened.close == nil {
+			continue
+		}
+		if err := opened.close(); err != nil {
+			log.Printf("Error closing the vector store of tenant %q: %v", tenant, err)
+		}
+	}
+	storeCache.stores = nil
+}
+
+type embedderKey struct{}
+
+// contextEmbedder embeds with the embedder of the context, so that a shared
+// store uses the one of each request, e.g. the timed embedder of
+// POST /debug/retrieve.
+type contextEmbedder struct{}
+
+func (contextEmbedder) EmbedDocuments(ctx context.Context, texts []string) ([][]float32, error) {
+	return ctx.Value(embedderKey{}).(Embedder).EmbedDocuments(ctx, texts)
+}
+
+func (contextEmbedder) EmbedQuery(ctx context.Context, text string) ([]float32, error) {
+	return ctx.Value(embedderKey{}).(Embedder).EmbedQuery(ctx, text)
+}
+
+// boundStore is a shared store used with the embedder of a request.
+type boundStore struct {
+	store    vectorstores.VectorStore
+	embedder Embedder
+}
+
+func (s boundStore) AddDocuments(ctx context.Context, docs []schema.Document, options ...vectorstores.Option) ([]string, error) {
+	return s.store.AddDocuments(context.WithValue(ctx, embedderKey{}, s.embedder), docs, options...)
+}
+
+func (s boundStore) SimilaritySearch(ctx context.Context, query string, numDocuments int, options ...vectorstores.Option) ([]schema.Document, error) {
+	return s.store.SimilaritySearch(context.WithValue(ctx, embedderKey{}, s.embedder), query, numDocuments, options...)
+}
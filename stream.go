@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+	"github.com/tmc/langchaingo/schema"
+)
+
+const (
+	StreamKafka = "kafka"
+	StreamNATS  = "nats"
+
+	StreamUpsert = "upsert"
+	StreamDelete = "delete"
+
+	streamRetryDelay = 5 * time.Second
+)
+
+type StreamConfig struct {
+	Enabled   bool     `json:"enabled"`    // Consume document events on startup
+	Broker    string   `json:"broker"`     // "kafka" or "nats"
+	Brokers   []string `json:"brokers"`    // Kafka bootstrap servers
+	URL       string   `json:"url"`        // NATS server URL
+	Topic     string   `json:"topic"`      // Kafka topic or NATS subject
+	Group     string   `json:"group"`      // Kafka consumer group or NATS queue group
+	BatchSize int      `json:"batch_size"` // Events applied together
+	FlushMS   int      `json:"flush_ms"`   // Longest wait for a batch to fill after its first event
+}
+
+// StreamEvent is a document change published to the stream. Upserts replace
+// the document with a new version; deletes soft-delete it like
+// DELETE /documents.
+type StreamEvent struct {
+	Op          string         `json:"op"`
+	Document    string         `json:"document"`
+	Content     string         `json:"content,omitempty"`
+	ContentType string         `json:"content_type,omitempty"` // "text/html" content is reduced to text
+	Title       string         `json:"title,omitempty"`
+	Metadata    map[string]any `json:"metadata,omitempty"`
+	Dataset     string         `json:"dataset,omitempty"`
+	Tenant      string         `json:"tenant,omitempty"`
+}
+
+// streamConsumer reads events from a broker. Commit acknowledges everything
+// fetched so far, once it has been applied.
+type streamConsumer interface {
+	Fetch(ctx context.Context) ([]byte, error)
+	Commit(ctx context.Context) error
+	Close() error
+}
+
+type kafkaConsumer struct {
+	reader  *kafka.Reader
+	fetched []kafka.Message
+}
+
+type natsConsumer struct {
+	conn     *nats.Conn
+	sub      *nats.Subscription
+	messages chan *nats.Msg
+}
+
+func validateStream(cfg StreamConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+	switch cfg.Broker {
+	case StreamKafka:
+		if len(cfg.Brokers) == 0 {
+			return fmt.Errorf("stream.brokers is required for kafka")
+		}
+	case StreamNATS:
+		if cfg.URL == "" {
+			return fmt.Errorf("stream.url is required for nats")
+		}
+	default:
+		return fmt.Errorf("unknown stream broker %q", cfg.Broker)
+	}
+	if cfg.Topic == "" {
+		return fmt.Errorf("stream.topic is required")
+	}
+	if cfg.BatchSize <= 0 || cfg.FlushMS <= 0 {
+		return fmt.Errorf("stream.batch_size and stream.flush_ms must be positive")
+	}
+	return nil
+}
+
+func newStreamConsumer(cfg StreamConfig) (streamConsumer, error) {
+	if cfg.Broker == StreamKafka {
+		return &kafkaConsumer{reader: kafka.NewReader(kafka.ReaderConfig{
+			Brokers: cfg.Brokers,
+			Topic:   cfg.Topic,
+			GroupID: cfg.Group,
+		})}, nil
+	}
+
+	conn, err := nats.Connect(cfg.URL, nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nats: %v", err)
+	}
+	consumer := &natsConsumer{conn: conn, messages: make(chan *nats.Msg, cfg.BatchSize*4)}
+	consumer.sub, err = conn.ChanQueueSubscribe(cfg.Topic, cfg.Group, consumer.messages)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to subscribe to %s: %v", cfg.Topic, err)
+	}
+	return consumer, nil
+}
+
+func (c *kafkaConsumer) Fetch(ctx context.Context) ([]byte, error) {
+	message, err := c.reader.FetchMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.fetched = append(c.fetched, message)
+	return message.Value, nil
+}
+
+func (c *kafkaConsumer) Commit(ctx context.Context) error {
+	if len(c.fetched) == 0 {
+		return nil
+	}
+	err := c.reader.CommitMessages(ctx, c.fetched...)
+	c.fetched = c.fetched[:0]
+	return err
+}
+
+func (c *kafkaConsumer) Close() error {
+	return c.reader.Close()
+}
+
+func (c *natsConsumer) Fetch(ctx context.Context) ([]byte, error) {
+	select {
+	case message := <-c.messages:
+		return message.Data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Commit is a no-op: core NATS does not redeliver, so events that arrive
+// while the service is down are lost.
+func (c *natsConsumer) Commit(context.Context) error {
+	return nil
+}
+
+func (c *natsConsumer) Close() error {
+	err := c.sub.Unsubscribe()
+	c.conn.Close()
+	return err
+}
+
+// consumeStream applies the events of the configured topic in batches until
+// the consumer fails. Its job stays running and collects the errors of
+// events that could not be applied.
+func consumeStream(cfg StreamConfig) {
+	job := jobRegistry.create(fmt.Sprintf("stream:%s:%s", cfg.Broker, cfg.Topic))
+	jobRegistry.update(job.ID, func(job *Job) {
+		job.Status = JobRunning
+	})
+	log.Printf("Consuming document events from %s %s (job %s)", cfg.Broker, cfg.Topic, job.ID)
+
+	consumer, err := newStreamConsumer(cfg)
+	if err != nil {
+		log.Printf("Stream consumer failed: %v", err)
+		jobRegistry.update(job.ID, func(job *Job) {
+			job.Status = JobFailed
+			job.Errors = append(job.Errors, err.Error())
+		})
+		return
+	}
+	defer consumer.Close()
+
+	ctx := context.Background()
+	for {
+		batch, err := fetchStreamBatch(ctx, consumer, cfg)
+		if err != nil {
+			log.Printf("Stream consumer failed: %v", err)
+			jobRegistry.update(job.ID, func(job *Job) {
+				job.Status = JobFailed
+				job.Errors = append(job.Errors, err.Error())
+			})
+			return
+		}
+
+		// Events are committed only once applied, so a failing store stalls
+		// the consumer instead of dropping events
+		for {
+			err := applyStreamEvents(ctx, job.ID, batch)
+			if err == nil {
+				break
+			}
+			log.Printf("Applying %d stream events failed, retrying: %v", len(batch), err)
+			time.Sleep(streamRetryDelay)
+		}
+		if err := consumer.Commit(ctx); err != nil {
+			log.Printf("Committing stream events failed: %v", err)
+		}
+	}
+}
+
+// fetchStreamBatch waits for an event, then collects more until the batch is
+// full or FlushMS has passed. Malformed events are logged and skipped.
+func fetchStreamBatch(ctx context.Context, consumer streamConsumer, cfg StreamConfig) ([]StreamEvent, error) {
+	var batch []StreamEvent
+	deadline := ctx
+	for len(batch) < cfg.BatchSize {
+		data, err := consumer.Fetch(deadline)
+		if err != nil {
+			if deadline != ctx && errors.Is(err, context.DeadlineExceeded) {
+				break
+			}
+			return nil, err
+		}
+		if deadline == ctx {
+			var cancel context.CancelFunc
+			deadline, cancel = context.WithTimeout(ctx, time.Duration(cfg.FlushMS)*time.Millisecond)
+			defer cancel()
+		}
+
+		var event StreamEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			log.Printf("Skipping malformed stream event: %v", err)
+			continue
+		}
+		if event.Document == "" || (event.Op != StreamUpsert && event.Op != StreamDelete) {
+			log.Printf("Skipping stream event without document or with op %q", event.Op)
+			continue
+		}
+		batch = append(batch, event)
+	}
+	return batch, nil
+}
+
+// applyStreamEvents applies a batch in order. Consecutive upserts to the same
+// dataset and tenant are indexed together, the last one winning when a
+// document repeats; a document's chunks have the document name as "source",
+// so deletes find every version.
+func applyStreamEvents(ctx context.Context, jobID string, events []StreamEvent) error {
+	var pending []schema.Document
+	var pendingReq IngestRequest
+	positions := map[string]int{}
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		chunks, err := splitDocuments(ctx, pending, pendingReq)
+		if err != nil {
+			return err
+		}
+		if err := indexDocuments(ctx, jobID, pendingReq, chunks); err != nil {
+			return err
+		}
+		pending = nil
+		positions = map[string]int{}
+		return nil
+	}
+
+	for _, event := range events {
+		if event.Op == StreamDelete {
+			if err := flush(); err != nil {
+				return err
+			}
+			if err := deleteSources(ctx, []string{event.Document}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		req := IngestRequest{Dataset: event.Dataset, Tenant: event.Tenant, Path: event.Document}
+		if err := completeIngestRequest(&req); err != nil {
+			jobRegistry.update(jobID, func(job *Job) {
+				job.recordError(fmt.Sprintf("%s: %v", event.Document, err))
+			})
+			continue
+		}
+		if len(pending) > 0 && (req.Dataset != pendingReq.Dataset || req.Tenant != pendingReq.Tenant) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		pendingReq = req
+		if i, ok := positions[event.Document]; ok {
+			pending[i] = streamDocument(event)
+			continue
+		}
+		positions[event.Document] = len(pending)
+		pending = append(pending, streamDocument(event))
+	}
+	return flush()
+}
+
+func streamDocument(event StreamEvent) schema.Document {
+	content := event.Content
+	if strings.HasPrefix(event.ContentType, "text/html") {
+		content = feedText(content)
+	}
+	metadata := make(map[string]any, len(event.Metadata)+3)
+	for key, value := range event.Metadata {
+		metadata[key] = value
+	}
+	metadata["source"] = event.Document
+	metadata["document"] = event.Document
+	if event.Title != "" {
+		metadata["title"] = event.Title
+		content = event.Title + "\n" + content
+	}
+	return schema.Document{PageContent: content, Metadata: metadata}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/schema"
+)
+
+type SummariesConfig struct {
+	Words         int `json:"words"`          // Length of a summary unless the request asks for another
+	MaxWords      int `json:"max_words"`      // Cap on the length a request asks for
+	BatchChunks   int `json:"batch_chunks"`   // Chunks, then partial summaries, condensed in one call
+	DensityRounds int `json:"density_rounds"` // Chain-of-density rewrites of the summary, each adding details it misses at the same length
+	MaxChunks     int `json:"max_chunks"`     // Documents with more chunks are not summarized
+}
+
+func validateSummaries(cfg SummariesConfig) error {
+	if cfg.Words <= 0 || cfg.MaxWords < cfg.Words {
+		return fmt.Errorf("summaries must satisfy 0 < words <= max_words")
+	}
+	if cfg.BatchChunks < 2 {
+		return fmt.Errorf("summaries.batch_chunks must be at least 2")
+	}
+	if cfg.DensityRounds < 0 {
+		return fmt.Errorf("summaries.density_rounds must not be negative")
+	}
+	if cfg.MaxChunks <= 0 {
+		return fmt.Errorf("summaries.max_chunks must be positive")
+	}
+	return nil
+}
+
+type SummarizeRequest struct {
+	Words         int  `json:"words,omitempty"`          // summaries.words when 0
+	DensityRounds *int `json:"density_rounds,omitempty"` // summaries.density_rounds when unset
+}
+
+// DocumentSummary is the stored summary of a document.
+type DocumentSummary struct {
+	ID            string    `json:"id"`
+	Source        string    `json:"source"`
+	Summary       string    `json:"summary"`
+	Words         int       `json:"words"` // Asked for; the model may write a few more or less
+	DensityRounds int       `json:"density_rounds"`
+	Chunks        int       `json:"chunks"` // Of the document when it was summarized
+	JobID         string    `json:"job_id"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func summaryKey(id string) string {
+	return "summary:" + id
+}
+
+// summarizeDocument starts a job summarizing the latest version of the
+// document with :id, replacing its stored summary once done.
+func summarizeDocument(c *gin.Context) {
+	var req SummarizeRequest
+	if err := c.ShouldBindJSON(&req); err != nil && c.Request.ContentLength > 0 {
+		if !bodyTooLarge(c, err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		}
+		return
+	}
+	cfg := getConfig().Summaries
+	if req.Words == 0 {
+		req.Words = cfg.Words
+	}
+	if req.DensityRounds == nil {
+		req.DensityRounds = &cfg.DensityRounds
+	}
+	if req.Words < 0 || req.Words > cfg.MaxWords || *req.DensityRounds < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("words must be between 1 and %d and density_rounds not negative", cfg.MaxWords)})
+		return
+	}
+
+	store, err := managedStore()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx := c.Request.Context()
+	id := c.Param("id")
+	source, ok, err := findSource(ctx, store, id)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Document not found"})
+		return
+	}
+	chunks, err := store.Chunks(ctx, chunkFilter(map[string]any{"source": source}, 0), cfg.MaxChunks+1)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	switch {
+	case len(chunks) == 0:
+		c.JSON(http.StatusNotFound, gin.H{"error": "The document has no chunks to summarize"})
+		return
+	case len(chunks) > cfg.MaxChunks:
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": fmt.Sprintf("The document has more than %d chunks, the summaries.max_chunks", cfg.MaxChunks)})
+		return
+	}
+
+	job := jobRegistry.create("summarize:" + source)
+	summary := DocumentSummary{ID: id, Source: source, Words: req.Words, DensityRounds: *req.DensityRounds, Chunks: len(chunks), JobID: job.ID}
+	go runSummaryJob(summary, chunks)
+	c.JSON(http.StatusAccepted, job)
+}
+
+// getDocumentSummary returns the stored summary of the document with :id.
+func getDocumentSummary(c *gin.Context) {
+	var summary DocumentSummary
+	ok, err := loadState(c.Request.Context(), summaryKey(c.Param("id")), &summary)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "The document has not been summarized"})
+		return
+	}
+	c.JSON(http.StatusOK, summary)
+}
+
+func runSummaryJob(summary DocumentSummary, chunks []schema.Document) {
+	jobID := summary.JobID
+	jobRegistry.update(jobID, func(job *Job) { job.Status = JobRunning })
+
+	fail := func(err error) {
+		log.Printf("Summary job %s failed: %v", jobID, err)
+		jobRegistry.update(jobID, func(job *Job) {
+			job.Status = JobFailed
+			job.recordError(err.Error())
+		})
+	}
+	llm, err := newLLM()
+	if err != nil {
+		fail(err)
+		return
+	}
+	ctx := context.Background()
+	if summary.Summary, err = summarizeChunks(ctx, llm, jobID, chunks, summary.Words, summary.DensityRounds); err != nil {
+		fail(err)
+		return
+	}
+	summary.CreatedAt = time.Now().UTC()
+	if err := saveState(ctx, summaryKey(summary.ID), summary, 0); err != nil {
+		fail(fmt.Errorf("failed to store the summary: %v", err))
+		return
+	}
+	jobRegistry.update(jobID, func(job *Job) {
+		job.Status = JobCompleted
+		job.Progress = 100
+	})
+}
+
+// summarizeChunks map-reduces the chunks of a document in reading order:
+// batches of summaries.batch_chunks chunks are condensed into notes, and
+// batches of notes into fewer notes, until one call can write the summary
+// from them. The summary is then made denser, chain-of-density style, one
+// round at a time.
+func summarizeChunks(ctx context.Context, llm Generator, jobID string, chunks []schema.Document, words, rounds int) (string, error) {
+	batch := getConfig().Summaries.BatchChunks
+	sort.SliceStable(chunks, func(i, j int) bool {
+		a, _ := intValue(chunks[i].Metadata["chunk_index"])
+		b, _ := intValue(chunks[j].Metadata["chunk_index"])
+		return a < b
+	})
+	notes := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		// Overlapping chunks would have the model read their shared text twice
+		notes[i] = chunk.PageContent
+		if overlap, ok := intValue(chunk.Metadata["chunk_overlap"]); ok && overlap > 0 && overlap <= len(notes[i]) {
+			notes[i] = notes[i][overlap:]
+		}
+	}
+
+	calls := 1 + rounds
+	for n := len(notes); n > batch; n = (n + batch - 1) / batch {
+		calls += (n + batch - 1) / batch
+	}
+	done := 0
+	progress := func() {
+		done++
+		jobRegistry.update(jobID, func(job *Job) {
+			job.Total, job.Processed = calls, done
+			job.Progress = float64(done) * 100 / float64(calls)
+		})
+	}
+
+	for len(notes) > batch {
+		var condensed []string
+		for first := 0; first < len(notes); first += batch {
+			prompt := fmt.Sprintf("Below are consecutive passages of a document. Write notes of at most %d words covering what they say, "+
+				"keeping names, numbers and dates. Respond with the notes only.\n\n%s", words, strings.Join(notes[first:min(first+batch, len(notes))], "\n\n---\n\n"))
+			note, err := llms.GenerateFromSinglePrompt(ctx, llm, prompt)
+			if err != nil {
+				return "", fmt.Errorf("failed to condense passages %d to %d: %v", first+1, min(first+batch, len(notes)), err)
+			}
+			condensed = append(condensed, strings.TrimSpace(note))
+			progress()
+		}
+		notes = condensed
+	}
+
+	source := strings.Join(notes, "\n\n---\n\n")
+	prompt := fmt.Sprintf("Below are consecutive parts of a document. Write a summary of the whole document in about %d words. "+
+		"Respond with the summary only.\n\n%s", words, source)
+	summary, err := llms.GenerateFromSinglePrompt(ctx, llm, prompt)
+	if err != nil {
+		return "", fmt.Errorf("failed to write the summary: %v", err)
+	}
+	summary = strings.TrimSpace(summary)
+	progress()
+
+	for round := range rounds {
+		prompt := fmt.Sprintf("Below are a document and a summary of it. Find one to three informative details of the document "+
+			"(people, places, figures, findings) the summary leaves out, and rewrite the summary to include them in about %d words, "+
+			"making room by fusing and compressing what it says rather than by dropping details. Respond with the rewritten summary only."+
+			"\n\nDocument:\n%s\n\nSummary:\n%s", words, source, summary)
+		denser, err := llms.GenerateFromSinglePrompt(ctx, llm, prompt)
+		if err != nil {
+			return "", fmt.Errorf("failed to densify the summary (round %d): %v", round+1, err)
+		}
+		if denser = strings.TrimSpace(denser); denser != "" {
+			summary = denser
+		}
+		progress()
+	}
+	return summary, nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tmc/langchaingo/schema"
+)
+
+const (
+	IngestModeRows  = "rows"  // One document per CSV record, first column as content
+	IngestModeTable = "table" // Column summaries plus a rendering of every row
+)
+
+const maxCategoricalValues = 20 // Columns with at most this many distinct values are listed in full
+
+var dateLayouts = []string{"2006-01-02", "2006/01/02", "01/02/2006", "02.01.2006", time.RFC3339}
+
+type Table struct {
+	Name   string
+	Sheet  string // Worksheet the table was read from, empty for CSV
+	Header []string
+	Rows   [][]string
+}
+
+type ColumnSummary struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"` // integer, number, date, boolean, categorical or text
+	Distinct int      `json:"distinct"`
+	Empty    int      `json:"empty"`
+	Min      string   `json:"min,omitempty"`
+	Max      string   `json:"max,omitempty"`
+	Mean     float64  `json:"mean,omitempty"`
+	Values   []string `json:"values,omitempty"` // All values of categorical columns, examples otherwise
+}
+
+func readTableCSV(filename string) (Table, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return Table{}, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return Table{}, err
+	}
+	if len(records) == 0 {
+		return Table{}, fmt.Errorf("%s is empty", filename)
+	}
+
+	return Table{
+		Name:   filepath.Base(filename),
+		Header: records[0],
+		Rows:   records[1:],
+	}, nil
+}
+
+// tableDocuments renders a table as one overview document, one document per
+// column describing its type and values, and one natural-language document
+// per row. Row documents keep the typed row under the "row" payload field.
+func tableDocuments(table Table, source string, rowTemplate string) []schema.Document {
+	summaries := describeColumns(table)
+	types := make(map[string]string, len(summaries))
+	for _, summary := range summaries {
+		types[summary.Name] = summary.Type
+	}
+
+	docs := make([]schema.Document, 0, len(table.Rows)+len(summaries)+1)
+
+	docs = append(docs, schema.Document{
+		PageContent: fmt.Sprintf("Table %s has %d rows and the columns %s.",
+			table.Name, len(table.Rows), strings.Join(table.Header, ", ")),
+		Metadata: map[string]any{
+			"id":       uuid.New().String(),
+			"source":   source,
+			"doc_type": "table_summary",
+			"table":    table.Name,
+		},
+	})
+
+	for _, summary := range summaries {
+		docs = append(docs, schema.Document{
+			PageContent: describeColumn(table.Name, summary),
+			Metadata: map[string]any{
+				"id":       uuid.New().String(),
+				"source":   source,
+				"doc_type": "column_summary",
+				"table":    table.Name,
+				"column":   summary.Name,
+			},
+		})
+	}
+
+	for i, record := range table.Rows {
+		row := make(map[string]any, len(table.Header))
+		for j, column := range table.Header {
+			if j < len(record) {
+				row[column] = typedValue(record[j], types[column])
+			}
+		}
+		docs = append(docs, schema.Document{
+			PageContent: renderRow(table, record, rowTemplate),
+			Metadata: map[string]any{
+				"id":        uuid.New().String(),
+				"source":    source,
+				"doc_type":  "row",
+				"table":     table.Name,
+				"row_index": i,
+				"row":       row,
+			},
+		})
+	}
+
+	if table.Sheet != "" {
+		for _, doc := range docs {
+			doc.Metadata["sheet"] = table.Sheet
+		}
+	}
+
+	return docs
+}
+
+// renderRow renders a record with rowTemplate, where {Column Name} is replaced
+// by that column's value. Without a template every column is listed as
+// "Column: value".
+func renderRow(table Table, record []string, rowTemplate string) string {
+	if rowTemplate != "" {
+		pairs := make([]string, 0, len(table.Header)*2)
+		for j, column := range table.Header {
+			value := ""
+			if j < len(record) {
+				value = record[j]
+			}
+			pairs = append(pairs, "{"+column+"}", value)
+		}
+		return strings.NewReplacer(pairs...).Replace(rowTemplate)
+	}
+
+	parts := make([]string, 0, len(table.Header))
+	for j, column := range table.Header {
+		if j < len(record) && strings.TrimSpace(record[j]) != "" {
+			parts = append(parts, column+": "+record[j])
+		}
+	}
+	return fmt.Sprintf("Record from %s. %s.", table.Name, strings.Join(parts, ", "))
+}
+
+func describeColumns(table Table) []ColumnSummary {
+	summaries := make([]ColumnSummary, 0, len(table.Header))
+	for j, column := range table.Header {
+		values := make([]string, 0, len(table.Rows))
+		empty := 0
+		for _, record := range table.Rows {
+			if j >= len(record) || strings.TrimSpace(record[j]) == "" {
+				empty++
+				continue
+			}
+			values = append(values, strings.TrimSpace(record[j]))
+		}
+		summary := summarizeColumn(column, values)
+		summary.Empty = empty
+		summaries = append(summaries, summary)
+	}
+	return summaries
+}
+
+func summarizeColumn(name string, values []string) ColumnSummary {
+	summary := ColumnSummary{Name: name}
+
+	counts := map[string]int{}
+	for _, v := range values {
+		counts[v]++
+	}
+	summary.Distinct = len(counts)
+
+	summary.Type = inferColumnType(values, len(counts))
+	switch summary.Type {
+	case "integer", "number":
+		minV, maxV, sum := math.Inf(1), math.Inf(-1), 0.0
+		for _, v := range values {
+			f, _ := strconv.ParseFloat(v, 64)
+			minV, maxV, sum = math.Min(minV, f), math.Max(maxV, f), sum+f
+		}
+		summary.Min = strconv.FormatFloat(minV, 'f', -1, 64)
+		summary.Max = strconv.FormatFloat(maxV, 'f', -1, 64)
+		summary.Mean = math.Round(sum/float64(len(values))*100) / 100
+	case "date":
+		var minT, maxT time.Time
+		for _, v := range values {
+			t, _ := parseDate(v)
+			if minT.IsZero() || t.Before(minT) {
+				minT = t
+			}
+			if t.After(maxT) {
+				maxT = t
+			}
+		}
+		summary.Min = minT.Format("2006-01-02")
+		summary.Max = maxT.Format("2006-01-02")
+	}
+
+	distinct := make([]string, 0, len(counts))
+	for v := range counts {
+		distinct = append(distinct, v)
+	}
+	sort.Slice(distinct, func(a, b int) bool {
+		if counts[distinct[a]] != counts[distinct[b]] {
+			return counts[distinct[a]] > counts[distinct[b]]
+		}
+		return distinct[a] < distinct[b]
+	})
+	if summary.Type == "categorical" || summary.Type == "boolean" {
+		summary.Values = distinct
+	} else if summary.Type == "text" {
+		summary.Values = distinct[:min(5, len(distinct))]
+	}
+
+	return summary
+}
+
+func inferColumnType(values []string, distinct int) string {
+	if len(values) == 0 {
+		return "text"
+	}
+
+	isInt, isNumber, isDate, isBool := true, true, true, true
+	for _, v := range values {
+		if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+			isInt = false
+		}
+		if _, err := strconv.ParseFloat(v, 64); err != nil {
+			isNumber = false
+		}
+		if _, ok := parseDate(v); !ok {
+			isDate = false
+		}
+		if _, err := strconv.ParseBool(strings.ToLower(v)); err != nil {
+			isBool = false
+		}
+	}
+
+	switch {
+	case isBool && !isNumber:
+		return "boolean"
+	case isInt:
+		return "integer"
+	case isNumber:
+		return "number"
+	case isDate:
+		return "date"
+	case distinct <= maxCategoricalValues:
+		return "categorical"
+	default:
+		return "text"
+	}
+}
+
+func describeColumn(table string, summary ColumnSummary) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Column %q of table %s holds %s values", summary.Name, table, summary.Type))
+	switch summary.Type {
+	case "integer", "number":
+		sb.WriteString(fmt.Sprintf(" ranging from %s to %s with a mean of %g", summary.Min, summary.Max, summary.Mean))
+	case "date":
+		sb.WriteString(fmt.Sprintf(" from %s to %s", summary.Min, summary.Max))
+	case "categorical", "boolean":
+		sb.WriteString(fmt.Sprintf(", one of: %s", strings.Join(summary.Values, ", ")))
+	case "text":
+		sb.WriteString(fmt.Sprintf(" (%d distinct), for example: %s", summary.Distinct, strings.Join(summary.Values, "; ")))
+	}
+	sb.WriteString(".")
+	if summary.Empty > 0 {
+		sb.WriteString(fmt.Sprintf(" %d rows have no value.", summary.Empty))
+	}
+	return sb.String()
+}
+
+// typedValue converts a cell to the inferred column type so payload range
+// filters work on numbers and dates; dates are stored as RFC 3339 strings.
+func typedValue(value string, columnType string) any {
+	value = strings.TrimSpace(value)
+	switch columnType {
+	case "integer":
+		if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return i
+		}
+	case "number":
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(strings.ToLower(value)); err == nil {
+			return b
+		}
+	case "date":
+		if t, ok := parseDate(value); ok {
+			return t.Format(time.RFC3339)
+		}
+	}
+	return value
+}
+
+func parseDate(value string) (time.Time, bool) {
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
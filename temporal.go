@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type TemporalConfig struct {
+	Enabled bool     `json:"enabled"` // Filter questions naming a period on it; the temporal flag turns this on or off per request
+	Fields  []string `json:"fields"`  // Payload fields holding the dates of chunks, e.g. "date" or "row.visit_date"; a chunk matches when any is within the period
+}
+
+func validateTemporal(cfg TemporalConfig) error {
+	if cfg.Enabled && len(cfg.Fields) == 0 {
+		return fmt.Errorf("temporal.fields must not be empty")
+	}
+	for _, field := range cfg.Fields {
+		if strings.TrimSpace(field) == "" {
+			return fmt.Errorf("temporal.fields must not hold empty names")
+		}
+	}
+	return nil
+}
+
+var monthNames = map[string]time.Month{
+	"january": time.January, "jan": time.January, "february": time.February, "feb": time.February,
+	"march": time.March, "mar": time.March, "april": time.April, "apr": time.April, "may": time.May,
+	"june": time.June, "jun": time.June, "july": time.July, "jul": time.July, "august": time.August, "aug": time.August,
+	"september": time.September, "sep": time.September, "sept": time.September, "october": time.October, "oct": time.October,
+	"november": time.November, "nov": time.November, "december": time.December, "dec": time.December,
+}
+
+// period matches a named period: a quarter of a year ("q3 2023"), a month
+// with or without its year ("march 2023") or a year.
+const period = `(q[1-4]\s+(?:of\s+)?\d{4}|(?:january|february|march|april|may|june|july|august|september|october|november|december|` +
+	`jan|feb|mar|apr|jun|jul|aug|sept|sep|oct|nov|dec)(?:\s+\d{4})?|(?:19|20)\d{2})`
+
+var (
+	spanPattern     = regexp.MustCompile(`(?i)\b(?:between|from)\s+` + period + `\s+(?:and|to|through|until)\s+` + period + `\b`)
+	boundPattern    = regexp.MustCompile(`(?i)\b(since|after|before|until)\s+` + period + `\b`)
+	inPattern       = regexp.MustCompile(`(?i)\b(?:(?:in|during|throughout|from)\s+(?:the\s+year\s+)?|for\s+the\s+year\s+)` + period + `\b`)
+	quarterPattern  = regexp.MustCompile(`(?i)\b(q[1-4]\s+(?:of\s+)?\d{4})\b`)
+	recentPattern   = regexp.MustCompile(`(?i)\b(?:last|past)\s+(\d+)\s+(day|week|month|year)s?\b`)
+	relativePattern = regexp.MustCompile(`(?i)\b(last|past|previous|this|current)\s+(week|month|quarter|year)\b`)
+	dayPattern      = regexp.MustCompile(`(?i)\b(yesterday|today)\b`)
+)
+
+// temporalRanges returns the date range a message's question names, e.g.
+// "last quarter" or "in 2023", as a range over temporal.fields, or nil when
+// it names none or temporal filtering is off.
+func temporalRanges(msg Message) []Range {
+	cfg := getConfig()
+	if !flagOn(msg, FlagTemporal, cfg.Temporal.Enabled) || !supportsMaintenance(cfg.VectorStore.Backend) {
+		return nil
+	}
+	from, to, ok := parseDateRange(msg.Msg, time.Now())
+	if !ok {
+		return nil
+	}
+	r := Range{Fields: cfg.Temporal.Fields}
+	if !from.IsZero() {
+		r.GTE = from
+	}
+	if !to.IsZero() {
+		r.LT = to
+	}
+	return []Range{r}
+}
+
+// parseDateRange finds the first date expression of text and returns the
+// period it names relative to now, from inclusive and to exclusive, zero for
+// an open end. Weeks start on Monday.
+func parseDateRange(text string, now time.Time) (from, to time.Time, ok bool) {
+	now = now.UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	if m := spanPattern.FindStringSubmatch(text); m != nil {
+		first, _, ok1 := parsePeriod(m[1], now)
+		_, last, ok2 := parsePeriod(m[2], now)
+		if ok1 && ok2 && first.Before(last) {
+			return first, last, true
+		}
+	}
+	if m := boundPattern.FindStringSubmatch(text); m != nil {
+		if start, end, ok := parsePeriod(m[2], now); ok {
+			switch strings.ToLower(m[1]) {
+			case "since":
+				return start, time.Time{}, true
+			case "after":
+				return end, time.Time{}, true
+			case "before":
+				return time.Time{}, start, true
+			case "until":
+				return time.Time{}, end, true
+			}
+		}
+	}
+	if m := quarterPattern.FindStringSubmatch(text); m != nil {
+		if start, end, ok := parsePeriod(m[1], now); ok {
+			return start, end, true
+		}
+	}
+	if m := inPattern.FindStringSubmatch(text); m != nil {
+		if start, end, ok := parsePeriod(m[1], now); ok {
+			return start, end, true
+		}
+	}
+	if m := recentPattern.FindStringSubmatch(text); m != nil {
+		n, err := strconv.Atoi(m[1])
+		if err == nil && n > 0 {
+			switch strings.ToLower(m[2]) {
+			case "day":
+				return today.AddDate(0, 0, -n), time.Time{}, true
+			case "week":
+				return today.AddDate(0, 0, -7*n), time.Time{}, true
+			case "month":
+				return today.AddDate(0, -n, 0), time.Time{}, true
+			case "year":
+				return today.AddDate(-n, 0, 0), time.Time{}, true
+			}
+		}
+	}
+	if m := relativePattern.FindStringSubmatch(text); m != nil {
+		back := 0
+		if which := strings.ToLower(m[1]); which == "last" || which == "past" || which == "previous" {
+			back = 1
+		}
+		switch strings.ToLower(m[2]) {
+		case "week":
+			start := today.AddDate(0, 0, -(int(today.Weekday())+6)%7-7*back)
+			return start, start.AddDate(0, 0, 7), true
+		case "month":
+			start := time.Date(now.Year(), now.Month()-time.Month(back), 1, 0, 0, 0, 0, time.UTC)
+			return start, start.AddDate(0, 1, 0), true
+		case "quarter":
+			start := time.Date(now.Year(), (now.Month()-1)/3*3+1-time.Month(3*back), 1, 0, 0, 0, 0, time.UTC)
+			return start, start.AddDate(0, 3, 0), true
+		case "year":
+			start := time.Date(now.Year()-back, time.January, 1, 0, 0, 0, 0, time.UTC)
+			return start, start.AddDate(1, 0, 0), true
+		}
+	}
+	if m := dayPattern.FindStringSubmatch(text); m != nil {
+		if strings.EqualFold(m[1], "yesterday") {
+			return today.AddDate(0, 0, -1), today, true
+		}
+		return today, today.AddDate(0, 0, 1), true
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// parsePeriod returns the start and end of a period matched by period. A
+// month without a year is its latest occurrence up to now.
+func parsePeriod(text string, now time.Time) (time.Time, time.Time, bool) {
+	fields := strings.Fields(strings.ToLower(text))
+	if len(fields) == 0 {
+		return time.Time{}, time.Time{}, false
+	}
+	year := func(s string) (int, bool) {
+		y, err := strconv.Atoi(s)
+		return y, err == nil && y >= 1900 && y < 2100
+	}
+	last := fields[len(fields)-1]
+	switch {
+	case fields[0][0] == 'q':
+		y, ok := year(last)
+		if !ok {
+			return time.Time{}, time.Time{}, false
+		}
+		start := time.Date(y, time.Month(3*int(fields[0][1]-'1')+1), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 3, 0), true
+	case monthNames[fields[0]] != 0:
+		month := monthNames[fields[0]]
+		y, ok := year(last)
+		if !ok {
+			if y = now.Year(); month > now.Month() {
+				y--
+			}
+		}
+		start := time.Date(y, month, 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0), true
+	}
+	y, ok := year(last)
+	if !ok {
+		return time.Time{}, time.Time{}, false
+	}
+	start := time.Date(y, time.January, 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(1, 0, 0), true
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout is how long requests in flight get to finish on shutdown.
+const shutdownTimeout = 30 * time.Second
+
+// How the server treats client certificates
+const (
+	ClientAuthNone     = "none"     // Not asked for
+	ClientAuthOptional = "optional" // Verified against client_ca_file when sent
+	ClientAuthRequire  = "require"  // Required and verified against client_ca_file
+)
+
+// TLSConfig has the server terminate TLS itself, for deployments without a
+// proxy in front.
+type TLSConfig struct {
+	CertFile     string `json:"cert_file"`      // PEM certificate chain; the server speaks HTTPS when set
+	KeyFile      string `json:"key_file"`       // PEM private key of cert_file
+	ClientCAFile string `json:"client_ca_file"` // PEM certificates client certificates are verified against
+	ClientAuth   string `json:"client_auth"`    // "none", "optional" or "require"; "require" when client_ca_file is set
+	MinVersion   string `json:"min_version"`    // "1.2" or "1.3"
+}
+
+func validateTLS(cfg TLSConfig) error {
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return fmt.Errorf("tls.cert_file and tls.key_file must be set together")
+	}
+	if cfg.CertFile == "" && (cfg.ClientCAFile != "" || cfg.ClientAuth != "") {
+		return fmt.Errorf("client certificates need tls.cert_file and tls.key_file")
+	}
+	switch cfg.ClientAuth {
+	case "", ClientAuthNone:
+	case ClientAuthOptional, ClientAuthRequire:
+		if cfg.ClientCAFile == "" {
+			return fmt.Errorf("tls.client_auth %q needs tls.client_ca_file", cfg.ClientAuth)
+		}
+	default:
+		return fmt.Errorf(`tls.client_auth must be "none", "optional" or "require"`)
+	}
+	if _, ok := tlsVersions[cfg.MinVersion]; !ok {
+		return fmt.Errorf(`tls.min_version must be "1.2" or "1.3"`)
+	}
+	return nil
+}
+
+var tlsVersions = map[string]uint16{
+	"":    tls.VersionTLS12,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// loadCertPool returns the system certificates with those in the PEM file at
+// path added. setting names the file in errors.
+func loadCertPool(path, setting string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", setting, err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// clientTLS is the TLS configuration of an outbound client: the CA bundle it
+// trusts besides the system certificates and the certificate it presents,
+// each when set. prefix names the settings in errors.
+func clientTLS(prefix, caFile, certFile, keyFile string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile, prefix+".ca_file")
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("%s.cert_file and %s.key_file must be set together", prefix, prefix)
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the %s client certificate: %v", prefix, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// serverTLS is the TLS configuration the server terminates connections with.
+func serverTLS(cfg TLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the server certificate: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tlsVersions[cfg.MinVersion],
+	}
+	if cfg.ClientCAFile == "" || cfg.ClientAuth == ClientAuthNone {
+		return config, nil
+	}
+	// Client certificates are checked against the given CAs only
+	pem, err := os.ReadFile(cfg.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tls.client_ca_file: %v", err)
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", cfg.ClientCAFile)
+	}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	if cfg.ClientAuth == ClientAuthOptional {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// serve listens on addr, over HTTPS when a certificate is configured,
+// until SIGINT or SIGTERM, then lets the requests in flight finish.
+func serve(addr string, handler http.Handler, cfg TLSConfig) error {
+	server := &http.Server{Addr: addr, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdown := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		log.Printf("Shutting down")
+		timeout, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		shutdown <- server.Shutdown(timeout)
+	}()
+
+	var err error
+	if cfg.CertFile == "" {
+		log.Printf("Listening on %s", addr)
+		err = server.ListenAndServe()
+	} else {
+		config, tlsErr := serverTLS(cfg)
+		if tlsErr != nil {
+			return tlsErr
+		}
+		server.TLSConfig = config
+		log.Printf("Listening on %s over TLS, client certificates %s", addr, clientAuthName(config.ClientAuth))
+		// The certificate is already in the TLS configuration
+		err = server.ListenAndServeTLS("", "")
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return <-shutdown
+}
+
+func clientAuthName(auth tls.ClientAuthType) string {
+	switch auth {
+	case tls.RequireAndVerifyClientCert:
+		return "required"
+	case tls.VerifyClientCertIfGiven:
+		return "optional"
+	}
+	return "not asked for"
+}
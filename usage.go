@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tmc/langchaingo/schema"
+)
+
+// DocumentUsage is how often a document and its chunks were retrieved into
+// the prompt of an answer and cited by it. Citations are only counted for
+// answers returned with highlights, which map answer sentences to chunks.
+type DocumentUsage struct {
+	ID            string       `json:"id"`
+	Source        string       `json:"source"`
+	Retrieved     int          `json:"retrieved"`                // Answers with a chunk of the document in the prompt
+	Cited         int          `json:"cited"`                    // Answers highlighting a chunk of the document
+	LastRetrieved *time.Time   `json:"last_retrieved,omitempty"` // Of the latest answer retrieving it
+	Chunks        []ChunkUsage `json:"chunks"`                   // Chunks retrieved at least once, the most retrieved first
+}
+
+type ChunkUsage struct {
+	ID        string `json:"id"`
+	Retrieved int    `json:"retrieved"`
+	Cited     int    `json:"cited"`
+}
+
+// documentUsage is what the usage of a document is kept as besides its
+// counters.
+type documentUsage struct {
+	Source        string    `json:"source"`
+	LastRetrieved time.Time `json:"last_retrieved"`
+}
+
+// documentID is the id of a document in the usage routes, derived from its
+// source, which may not fit in a path.
+func documentID(source string) string {
+	sum := sha256.Sum256([]byte(source))
+	return hex.EncodeToString(sum[:8])
+}
+
+func usageKey(id string) string {
+	return "usage:" + id
+}
+
+// recordUsage counts the documents and chunks in the prompt of an answer,
+// and those its highlights cite. Failures are logged rather than failing the
+// chat request.
+func recordUsage(result ChatResponse) {
+	cfg := getConfig().Stats
+	if !cfg.Enabled || !cfg.Documents || len(result.docs) == 0 {
+		return
+	}
+	cited := map[int]bool{}
+	for _, highlight := range result.Highlights {
+		cited[highlight.Chunk] = true
+	}
+
+	ctx := context.Background()
+	now := time.Now().UTC()
+	deltas := map[string]map[string]float64{}
+	sources := map[string]string{}
+	for i, doc := range result.docs {
+		source, ok := doc.Metadata["source"].(string)
+		if !ok {
+			continue
+		}
+		id := documentID(source)
+		counters, ok := deltas[id]
+		if !ok {
+			counters = map[string]float64{"retrieved": 1}
+			deltas[id], sources[id] = counters, source
+		}
+		chunk := chunkID(doc)
+		if chunk != "" {
+			counters["chunk:"+chunk+":retrieved"] = 1
+		}
+		if cited[i] {
+			counters["cited"] = 1
+			if chunk != "" {
+				counters["chunk:"+chunk+":cited"] = 1
+			}
+		}
+	}
+	for id, counters := range deltas {
+		if err := sharedState.Increment(ctx, usageKey(id), counters); err != nil {
+			log.Printf("Error recording usage of %s: %v", sources[id], err)
+			continue
+		}
+		if err := saveState(ctx, usageKey(id)+":seen", documentUsage{Source: sources[id], LastRetrieved: now}, 0); err != nil {
+			log.Printf("Error recording usage of %s: %v", sources[id], err)
+		}
+	}
+}
+
+func chunkID(doc schema.Document) string {
+	if id, ok := doc.Metadata["id"]; ok && id != nil {
+		return fmt.Sprint(id)
+	}
+	return ""
+}
+
+// loadUsage returns the usage of a document, with ok false if it was never
+// retrieved.
+func loadUsage(ctx context.Context, id string) (DocumentUsage, bool, error) {
+	usage := DocumentUsage{ID: id, Chunks: []ChunkUsage{}}
+	var seen documentUsage
+	ok, err := loadState(ctx, usageKey(id)+":seen", &seen)
+	if err != nil || !ok {
+		return usage, false, err
+	}
+	counters, err := sharedState.Counters(ctx, usageKey(id))
+	if err != nil {
+		return usage, false, err
+	}
+	usage.Source, usage.LastRetrieved = seen.Source, &seen.LastRetrieved
+	usage.Retrieved, usage.Cited = int(counters["retrieved"]), int(counters["cited"])
+
+	chunks := map[string]*ChunkUsage{}
+	for field, value := range counters {
+		rest, ok := strings.CutPrefix(field, "chunk:")
+		if !ok {
+			continue
+		}
+		i := strings.LastIndex(rest, ":")
+		chunk, ok := chunks[rest[:i]]
+		if !ok {
+			chunk = &ChunkUsage{ID: rest[:i]}
+			chunks[rest[:i]] = chunk
+		}
+		if rest[i+1:] == "cited" {
+			chunk.Cited = int(value)
+		} else {
+			chunk.Retrieved = int(value)
+		}
+	}
+	for _, chunk := range chunks {
+		usage.Chunks = append(usage.Chunks, *chunk)
+	}
+	sort.Slice(usage.Chunks, func(i, j int) bool {
+		if usage.Chunks[i].Retrieved != usage.Chunks[j].Retrieved {
+			return usage.Chunks[i].Retrieved > usage.Chunks[j].Retrieved
+		}
+		return usage.Chunks[i].ID < usage.Chunks[j].ID
+	})
+	return usage, true, nil
+}
+
+// documentAnalytics returns the usage of a document by the id GET
+// /documents lists for it.
+func documentAnalytics(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("id")
+	usage, ok, err := loadUsage(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if ok {
+		c.JSON(http.StatusOK, usage)
+		return
+	}
+
+	// Documents never retrieved have no usage, only their place in the index
+	store, err := managedStore()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sources, err := store.Sources(ctx)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	for _, info := range sources {
+		if documentID(info.Source) == id {
+			usage.Source = info.Source
+			c.JSON(http.StatusOK, usage)
+			return
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "Document not found"})
+}
+
+// neverRetrieved lists the documents in the index no answer has retrieved,
+// or with ?days= none in that many days, candidates for being stale or
+// redundant. Deleted documents are left out.
+func neverRetrieved(c *gin.Context) {
+	var since time.Time
+	if value := c.Query("days"); value != "" {
+		days, err := strconv.Atoi(value)
+		if err != nil || days <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "days must be a positive number"})
+			return
+		}
+		since = time.Now().AddDate(0, 0, -days)
+	}
+	store, err := managedStore()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx := c.Request.Context()
+	sources, err := store.Sources(ctx)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	documents := []SourceInfo{}
+	for _, info := range sources {
+		if info.Deleted {
+			continue
+		}
+		info.ID = documentID(info.Source)
+		var seen documentUsage
+		ok, err := loadState(ctx, usageKey(info.ID)+":seen", &seen)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if ok && seen.LastRetrieved.After(since) {
+			continue
+		}
+		if ok {
+			info.LastRetrieved = &seen.LastRetrieved
+		}
+		documents = append(documents, info)
+	}
+	c.JSON(http.StatusOK, gin.H{"documents": documents})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/tmc/langchaingo/vectorstores"
+)
+
+const (
+	StoreQdrant  = "qdrant"
+	StoreRedis   = "redis"
+	StoreMilvus  = "milvus"
+	StoreElastic = "elastic"
+	StoreSQLite  = "sqlite"
+)
+
+// redisMetadataField holds the JSON encoded metadata of a chunk stored in
+// Redis, which otherwise keeps every field as a string.
+const redisMetadataField = "metadata_json"
+
+func validateVectorStore(cfg VectorStoreConfig) error {
+	switch cfg.Backend {
+	case StoreQdrant:
+		return validateQdrant(cfg.Qdrant)
+	case StoreRedis:
+		if cfg.RedisURL == "" {
+			return fmt.Errorf("vector_store.redis_url is required for the redis backend")
+		}
+		return nil
+	case StoreMilvus:
+		return validateMilvus(cfg.Milvus)
+	case StoreElastic:
+		return validateElastic(cfg.Elastic)
+	case StoreSQLite:
+		return nil
+	}
+	return fmt.Errorf("unknown vector store backend %q", cfg.Backend)
+}
+
+// newStore opens the configured vector store. The tenant selects a Milvus
+// partition or collection and is ignored by the other backends. Milvus and
+// Redis stores hold a client, so they are opened once per tenant and shared.
+func newStore(embedder Embedder, tenant string) (vectorstores.VectorStore, error) {
+	cfg := getConfig()
+	switch cfg.VectorStore.Backend {
+	case StoreMilvus:
+		store, err := sharedStore(tenant, func() (openStore, error) {
+			return newMilvusStore(context.Background(), tenant)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return boundStore{store: store, embedder: embedder}, nil
+	case StoreElastic:
+		return newElasticStore(embedder), nil
+	case StoreSQLite:
+		return newSQLiteVecStore(embedder), nil
+	case StoreRedis:
+		// Tenants share the index, and so the store
+		store, err := sharedStore("", func() (openStore, error) {
+			return newRedisVecStore(context.Background())
+		})
+		if err != nil {
+			return nil, err
+		}
+		return boundStore{store: store, embedder: embedder}, nil
+	}
+
+	return newQdrantStore(embedder), nil
+}
+
+// prepareStore makes sure the store can take vectors from the embedder.
+// Redis creates its index on the first write.
+func prepareStore(ctx context.Context, embedder Embedder, tenant string) error {
+	switch getConfig().VectorStore.Backend {
+	case StoreQdrant:
+		return ensureCollection(ctx, embedder, getConfig().Embedding.Collection)
+	case StoreMilvus:
+		return prepareMilvus(ctx, embedder, tenant)
+	case StoreElastic:
+		return newElasticStore(embedder).ensureIndex(ctx)
+	case StoreSQLite:
+		return newSQLiteVecStore(embedder).ensureTables(ctx)
+	}
+	return nil
+}
+
+// storeFilter turns a chat request filter into the configured backend's
+// filter format.
+func storeFilter(filter Filter) any {
+	switch getConfig().VectorStore.Backend {
+	case StoreRedis:
+		return redisFilter(filter)
+	case StoreMilvus:
+		return milvusFilter(filter)
+	case StoreElastic:
+		return elasticFilter(filter)
+	}
+	// sqlite and Qdrant, which builds the filter for its transport
+	if filter.empty() {
+		return nil
+	}
+	return filter
+}
+
+// redisFilter turns a Filter into a RediSearch pre-filter. Numbers match
+// exactly, other values as phrases.
+func redisFilter(filter Filter) any {
+	if filter.empty() {
+		return nil
+	}
+
+	var clauses []string
+	for key, value := range filter.Match {
+		clauses = append(clauses, redisClause(key, value))
+	}
+	for key, value := range filter.Exclude {
+		clauses = append(clauses, "-"+redisClause(key, value))
+	}
+	return strings.Join(clauses, " ")
+}
+
+func redisClause(key string, value any) string {
+	values, ok := value.([]any)
+	if !ok {
+		values = []any{value}
+	}
+
+	terms := make([]string, 0, len(values))
+	for _, v := range values {
+		if n, ok := v.(float64); ok {
+			terms = append(terms, fmt.Sprintf("@%s:[%v %v]", key, n, n))
+			continue
+		}
+		phrase := strings.ReplaceAll(fmt.Sprint(v), `"`, `\"`)
+		terms = append(terms, fmt.Sprintf(`@%s:"%s"`, key, phrase))
+	}
+	return "(" + strings.Join(terms, " | ") + ")"
+}
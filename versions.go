@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/tmc/langchaingo/schema"
+)
+
+// nextVersion returns the version number for a new ingestion of document and
+// the versions it supersedes. Backends without maintenance support always
+// get version 1.
+func nextVersion(ctx context.Context, document string) (int, []any, error) {
+	if !supportsMaintenance(getConfig().VectorStore.Backend) {
+		return 1, nil, nil
+	}
+	store, err := managedStore()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	values, err := store.Values(ctx, map[string]any{"document": document}, "version")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to look up versions of %s: %v", document, err)
+	}
+
+	latest := 0
+	var older []any
+	for _, value := range values {
+		version, ok := intValue(value)
+		if !ok {
+			continue
+		}
+		older = append(older, version)
+		latest = max(latest, version)
+	}
+	return latest + 1, older, nil
+}
+
+// stampVersion records the document and version on every chunk and marks the
+// chunks as the latest version. Chunks without an "updated_at" get the file's
+// modification time.
+func stampVersion(docs []schema.Document, path, document string, version int) {
+	ingestedAt := time.Now().UTC().Format(time.RFC3339)
+	updatedAt := ingestedAt
+	if info, err := os.Stat(path); err == nil {
+		updatedAt = info.ModTime().UTC().Format(time.RFC3339)
+	}
+	for i := range docs {
+		if docs[i].Metadata == nil {
+			docs[i].Metadata = map[string]any{}
+		}
+		docs[i].Metadata["document"] = document
+		docs[i].Metadata["version"] = version
+		docs[i].Metadata["latest"] = true
+		docs[i].Metadata["ingested_at"] = ingestedAt
+		if _, ok := docs[i].Metadata["updated_at"]; !ok {
+			docs[i].Metadata["updated_at"] = updatedAt
+		}
+	}
+}
+
+// supersede marks the chunks of older versions of document as not latest,
+// which hides them from retrieval unless a version is asked for.
+func supersede(ctx context.Context, document string, older []any) {
+	if len(older) == 0 {
+		return
+	}
+	store, err := managedStore()
+	if err != nil {
+		log.Printf("Failed to supersede old versions of %s: %v", document, err)
+		return
+	}
+	if _, err := store.UpdateWhere(ctx, map[string]any{"document": document, "version": older}, map[string]any{"latest": false}); err != nil {
+		log.Printf("Failed to supersede old versions of %s: %v", document, err)
+	}
+}
+
+// documentName is the default document identity of an ingestion request:
+// the path of a file on the server, or the original name of an upload.
+func documentName(path string, uploadName string) string {
+	if uploadName != "" {
+		return filepath.Base(uploadName)
+	}
+	return path
+}
+
+func intValue(value any) (int, bool) {
+	switch v := value.(type) {
+	case int:
+		return v, true
+	case int64:
+		return int(v), true
+	case float64:
+		return int(v), true
+	case string:
+		n, err := strconv.Atoi(v)
+		return n, err == nil
+	}
+	return 0, false
+}
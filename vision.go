@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+const (
+	VisionProviderOllama = "ollama"
+	VisionProviderOpenAI = "openai"
+)
+
+const (
+	maxChatImages       = 4
+	maxImageBytes       = 10 << 20
+	imageDescribePrompt = "Describe this image in two or three sentences, naming any visible text, objects, products or people. Be factual."
+)
+
+func newVisionModel() (llms.Model, error) {
+	if fakeLLMMode {
+		return FakeGenerator{}, nil
+	}
+
+	cfg := getConfig().LLM
+	switch cfg.VisionProvider {
+	case VisionProviderOllama:
+		return withOllamaBreaker(newOllama(cfg.VisionModel))
+	case VisionProviderOpenAI:
+		return newOpenAI(cfg.VisionModel)
+	}
+	return nil, fmt.Errorf("unknown vision provider %q", cfg.VisionProvider)
+}
+
+// decodeImages decodes chat image attachments given as base64 or as
+// data:image/...;base64 URLs.
+func decodeImages(images []string) ([]llms.BinaryContent, error) {
+	if len(images) > maxChatImages {
+		return nil, fmt.Errorf("at most %d images are allowed", maxChatImages)
+	}
+
+	contents := make([]llms.BinaryContent, 0, len(images))
+	for i, image := range images {
+		encoded := image
+		if strings.HasPrefix(encoded, "data:") {
+			_, data, ok := strings.Cut(encoded, ",")
+			if !ok {
+				return nil, fmt.Errorf("image %d: malformed data URL", i+1)
+			}
+			encoded = data
+		}
+
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("image %d: invalid base64", i+1)
+		}
+		if len(data) > maxImageBytes {
+			return nil, fmt.Errorf("image %d is larger than %d MB", i+1, maxImageBytes>>20)
+		}
+
+		mimeType := http.DetectContentType(data)
+		if !strings.HasPrefix(mimeType, "image/") {
+			return nil, fmt.Errorf("image %d is not an image (%s)", i+1, mimeType)
+		}
+		contents = append(contents, llms.BinaryContent{MIMEType: mimeType, Data: data})
+	}
+	return contents, nil
+}
+
+// describeImages asks the vision model for a short description of each
+// image. The descriptions are added to the retrieval query so documents
+// about what the image shows are found even when the question only says
+// "what is this?".
+func describeImages(ctx context.Context, model llms.Model, images []llms.BinaryContent) (string, error) {
+	descriptions := make([]string, 0, len(images))
+	for _, image := range images {
+		description, err := generateWithImages(ctx, model, imageDescribePrompt, []llms.BinaryContent{image})
+		if err != nil {
+			return "", err
+		}
+		descriptions = append(descriptions, strings.TrimSpace(description))
+	}
+	return strings.Join(descriptions, "\n"), nil
+}
+
+func generateWithImages(ctx context.Context, model llms.Model, prompt string, images []llms.BinaryContent, options ...llms.CallOption) (string, error) {
+	return generate(ctx, model, withImages([]llms.MessageContent{llms.TextParts(llms.ChatMessageTypeHuman, prompt)}, images), options...)
+}
+
+// withImages attaches images to the last message of a prompt, the question.
+func withImages(prompt []llms.MessageContent, images []llms.BinaryContent) []llms.MessageContent {
+	prompt = append([]llms.MessageContent{}, prompt...)
+	last := &prompt[len(prompt)-1]
+	last.Parts = append([]llms.ContentPart{}, last.Parts...)
+	for _, image := range images {
+		last.Parts = append(last.Parts, image)
+	}
+	return prompt
+}
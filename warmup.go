@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// warmUpProbe is the query embedded and searched during the warm-up.
+const warmUpProbe = "warm-up probe"
+
+type WarmUpConfig struct {
+	Enabled        bool `json:"enabled"`         // Load the models and open the vector store before serving
+	TimeoutSeconds int  `json:"timeout_seconds"` // Time the warm-up may take before serving anyway
+}
+
+func validateWarmUp(cfg WarmUpConfig) error {
+	if cfg.Enabled && cfg.TimeoutSeconds <= 0 {
+		return fmt.Errorf("warm_up.timeout_seconds must be positive")
+	}
+	return nil
+}
+
+// warmUp makes Ollama load the chat and embedding models and opens the
+// connections to the vector store, creating the collection if needed, so that
+// the first chat request doesn't wait for them. Each step is logged with its
+// duration; failures are logged and the server starts regardless.
+func warmUp(ctx context.Context, cfg WarmUpConfig) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.TimeoutSeconds)*time.Second)
+	defer cancel()
+	start := time.Now()
+
+	warmUpStep("chat model", func() error {
+		llm, err := newLLM()
+		if err != nil {
+			return err
+		}
+		_, err = llms.GenerateFromSinglePrompt(ctx, llm, "Hi", llms.WithMaxTokens(1))
+		return err
+	})
+
+	embedder, err := newEmbedder()
+	if err != nil {
+		log.Printf("Warm-up of the embedding model failed: %v", err)
+		return
+	}
+	warmUpStep("embedding model", func() error {
+		_, err := embedder.EmbedQuery(ctx, warmUpProbe)
+		return err
+	})
+	warmUpStep("vector store", func() error {
+		if err := prepareStore(ctx, embedder, ""); err != nil {
+			return err
+		}
+		store, err := newStore(embedder, "")
+		if err != nil {
+			return err
+		}
+		_, err = store.SimilaritySearch(ctx, warmUpProbe, 1)
+		return err
+	})
+
+	log.Printf("Warm-up finished in %s", time.Since(start).Round(time.Millisecond))
+}
+
+func warmUpStep(name string, step func() error) {
+	start := time.Now()
+	if err := step(); err != nil {
+		log.Printf("Warm-up of the %s failed: %v", name, err)
+		return
+	}
+	log.Printf("Warmed up the %s in %s", name, time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	EventIngestionStarted   = "ingestion.started"
+	EventIngestionProgress  = "ingestion.progress"
+	EventIngestionCompleted = "ingestion.completed"
+	EventIngestionFailed    = "ingestion.failed"
+)
+
+const webhookMaxAttempts = 3
+
+var webhookEvents = []string{
+	EventIngestionStarted,
+	EventIngestionProgress,
+	EventIngestionCompleted,
+	EventIngestionFailed,
+}
+
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events,omitempty"` // Empty means all events
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WebhookEvent struct {
+	Event     string    `json:"event"`
+	Sequence  uint64    `json:"sequence"`
+	Timestamp time.Time `json:"timestamp"`
+	Job       Job       `json:"job"`
+}
+
+var webhookSequence atomic.Uint64
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func (w Webhook) wants(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func registerWebhook(c *gin.Context) {
+	var hook Webhook
+	if err := c.BindJSON(&hook); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Webhook url must be an absolute http(s) URL"})
+		return
+	}
+	for _, e := range hook.Events {
+		if !isWebhookEvent(e) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown event %q", e)})
+			return
+		}
+	}
+
+	hook.ID = uuid.New().String()
+	hook.CreatedAt = time.Now()
+
+	if err := saveState(c.Request.Context(), "webhook:"+hook.ID, hook, 0); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, hook.redacted())
+}
+
+func listWebhooks(c *gin.Context) {
+	hooks, err := loadWebhooks(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for i := range hooks {
+		hooks[i] = hooks[i].redacted()
+	}
+
+	c.JSON(http.StatusOK, gin.H{"webhooks": hooks})
+}
+
+func deleteWebhook(c *gin.Context) {
+	ok, err := sharedState.Delete(c.Request.Context(), "webhook:"+c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (w Webhook) redacted() Webhook {
+	if w.Secret != "" {
+		w.Secret = "********"
+	}
+	return w
+}
+
+// loadWebhooks returns the webhooks registered with any replica.
+func loadWebhooks(ctx context.Context) ([]Webhook, error) {
+	values, err := sharedState.Scan(ctx, "webhook:")
+	if err != nil {
+		return nil, err
+	}
+	hooks := make([]Webhook, 0, len(values))
+	for _, value := range values {
+		var hook Webhook
+		if err := json.Unmarshal(value, &hook); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+func isWebhookEvent(event string) bool {
+	for _, e := range webhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// emitJobEvent notifies every webhook subscribed to event. Deliveries run in
+// the background; receivers can use the sequence number to restore ordering.
+func emitJobEvent(event string, job Job) {
+	payload := WebhookEvent{
+		Event:     event,
+		Sequence:  webhookSequence.Add(1),
+		Timestamp: time.Now(),
+		Job:       job,
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshalling webhook event: %v", err)
+		return
+	}
+
+	hooks, err := loadWebhooks(context.Background())
+	if err != nil {
+		log.Printf("Error loading webhooks for %s: %v", event, err)
+		return
+	}
+	for _, hook := range hooks {
+		if hook.wants(event) {
+			go deliverWebhook(hook, event, body)
+		}
+	}
+}
+
+func deliverWebhook(hook Webhook, event string, body []byte) {
+	var err error
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		if err = postWebhook(hook, event, body); err == nil {
+			return
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+	log.Printf("Error delivering %s to webhook %s: %v", event, hook.URL, err)
+}
+
+func postWebhook(hook Webhook, event string, body []byte) error {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", event)
+	if hook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(hook.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+const headerScanRows = 10 // Rows inspected when looking for the header row
+
+// readTablesXLSX reads the given sheets of a workbook (all sheets when none
+// are given) into tables. Empty sheets are skipped. Each sheet's header row
+// is detected, so title rows above the header are ignored.
+func readTablesXLSX(filename string, sheets []string) ([]Table, error) {
+	f, err := excelize.OpenFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if len(sheets) == 0 {
+		sheets = f.GetSheetList()
+	}
+
+	var tables []Table
+	for _, sheet := range sheets {
+		if idx, err := f.GetSheetIndex(sheet); err != nil || idx < 0 {
+			return nil, fmt.Errorf("sheet %q not found in %s", sheet, filepath.Base(filename))
+		}
+
+		rows, err := f.GetRows(sheet)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read sheet %q: %v", sheet, err)
+		}
+		rows = trimEmptyRows(rows)
+		if len(rows) == 0 {
+			continue
+		}
+
+		table := Table{
+			Name:  filepath.Base(filename) + "/" + sheet,
+			Sheet: sheet,
+		}
+		if headerIdx := detectHeaderRow(rows); headerIdx >= 0 {
+			table.Header = rows[headerIdx]
+			table.Rows = rows[headerIdx+1:]
+		} else {
+			table.Header = syntheticHeader(rows)
+			table.Rows = rows
+		}
+		tables = append(tables, table)
+	}
+
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("no data in %s", filepath.Base(filename))
+	}
+	return tables, nil
+}
+
+// detectHeaderRow returns the index of the first row that looks like a
+// header: at least half as wide as the widest row, every cell filled with
+// distinct non-numeric text. It returns -1 when no such row exists.
+func detectHeaderRow(rows [][]string) int {
+	width := 0
+	for _, row := range rows {
+		width = max(width, len(row))
+	}
+
+	for i := 0; i < len(rows) && i < headerScanRows; i++ {
+		row := rows[i]
+		if len(row) < 2 && width >= 2 || len(row)*2 < width {
+			continue
+		}
+
+		seen := map[string]bool{}
+		isHeader := true
+		for _, cell := range row {
+			cell = strings.TrimSpace(cell)
+			if cell == "" || seen[cell] {
+				isHeader = false
+				break
+			}
+			if _, err := strconv.ParseFloat(cell, 64); err == nil {
+				isHeader = false
+				break
+			}
+			seen[cell] = true
+		}
+		if isHeader && i+1 < len(rows) {
+			return i
+		}
+	}
+	return -1
+}
+
+func syntheticHeader(rows [][]string) []string {
+	width := 0
+	for _, row := range rows {
+		width = max(width, len(row))
+	}
+	header := make([]string, width)
+	for i := range header {
+		header[i] = fmt.Sprintf("Column %d", i+1)
+	}
+	return header
+}
+
+func trimEmptyRows(rows [][]string) [][]string {
+	kept := rows[:0]
+	for _, row := range rows {
+		for _, cell := range row {
+			if strings.TrimSpace(cell) != "" {
+				kept = append(kept, row)
+				break
+			}
+		}
+	}
+	return kept
+}